@@ -6,6 +6,7 @@ import(
 	"os"
 	"time"
 	"rand"
+	"sync"
 	"wgo/stats"
 	"wgo/peers"
 	)
@@ -25,22 +26,51 @@ type PeerChoke struct {
 	peer *peers.Peer
 }
 
-type ChokeMgr struct {
+type torrent struct {
 	stats stats.Stats
 	peerMgr peers.PeerMgr
+}
+
+// Global for multiple torrents, the upload slots are given to the best
+// peers of all the torrents
+
+type ChokeMgr struct {
+	mutex *sync.Mutex
+	torrents map[string]*torrent
 	optimistic_unchoke int
+	slots int
+	quit chan bool
 }
 
 type Speed []*PeerChoke
 
-func NewChokeMgr(st stats.Stats, pm peers.PeerMgr) (c *ChokeMgr, err os.Error) {
+// slots <= 0 uses UPLOADING_PEERS
+
+func NewChokeMgr(slots int) (c *ChokeMgr, err os.Error) {
 	c = new(ChokeMgr)
-	c.stats = st
-	c.peerMgr = pm
+	c.mutex = new(sync.Mutex)
+	c.torrents = make(map[string]*torrent)
+	c.slots = slots
+	if c.slots <= 0 {
+		c.slots = UPLOADING_PEERS
+	}
+	c.quit = make(chan bool)
 	go c.Run()
 	return
 }
 
+func (c *ChokeMgr) AddTorrent(st stats.Stats, pm peers.PeerMgr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.torrents[pm.Infohash()] = &torrent{st, pm}
+}
+
+func (c *ChokeMgr) RemoveTorrent(infohash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.torrents[infohash] = nil, false
+}
+
 func (l Speed) Len() int { return len(l) }
 func (l Speed) Less(i, j int) bool { return l[i].speed < l[j].speed }
 func (l Speed) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -100,16 +130,28 @@ func apply(peers []*PeerChoke) {
 }
 
 func (c *ChokeMgr) RequestPeers() []*PeerChoke {
+	c.mutex.Lock()
+	torrents := make([]*torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	c.mutex.Unlock()
+	peers := make([]*PeerChoke, 0, 10)
+	for _, t := range torrents {
+		peers = t.requestPeers(peers)
+	}
+	return peers
+}
+
+func (t *torrent) requestPeers(peers []*PeerChoke) []*PeerChoke {
 	// Prepare peer array
 	lastPiece := int64(0)
 	// Request info
 	//log.Println("ChokeMgr -> Receiving from channels")
 	//c.inStats <- inStats
-	stats := c.stats.GetStats()
-	list := c.peerMgr.GetPeers()
+	stats := t.stats.GetStats()
+	list := t.peerMgr.GetPeers()
 	//log.Println("ChokeMgr -> Finished receiving")
-	// Prepare peer array
-	peers := make([]*PeerChoke, 0, 10)
 	for addr, peer := range(list) {
 		//log.Println("ChokeMgr -> Checking if completed")
 		if peer.Connected() && !peer.Completed() {
@@ -145,7 +187,7 @@ func (c *ChokeMgr) Choking(peers []*PeerChoke) {
 		//log.Println("ChokeMgr -> Finished sorting")
 		// UnChoke peers starting by the one that has a higher upload speed an is interested
 		// Reserve 1 slot for optimisting unchoking
-		up_limit := UPLOADING_PEERS
+		up_limit := c.slots
 		if c.optimistic_unchoke == 0 {
 			up_limit--
 		}
@@ -191,11 +233,18 @@ func (c *ChokeMgr) Stats(peers []*PeerChoke) {
 	log.Println("ChokeMgr -> Choked peers:", num_choked, "Unchoked peers:", num_unchoked, "Total:", len(peers))
 }
 
+func (c *ChokeMgr) Close() {
+	close(c.quit)
+}
+
 func (c *ChokeMgr) Run() {
-	choking := time.Tick(CHOKE_ROUND*NS_PER_S)
+	choking := time.NewTicker(CHOKE_ROUND*NS_PER_S)
+	defer choking.Stop()
 	for {
 		select {
-			case <- choking:
+			case <- c.quit:
+				return
+			case <- choking.C:
 				//log.Println("ChokeMgr -> Choke round")
 				if peers := c.RequestPeers(); len(peers) > 0 {
 					//log.Println("ChokeMgr -> Starting choke")
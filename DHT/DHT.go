@@ -0,0 +1,697 @@
+// Mainline DHT node (BEP 5), used as a source of peers
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package dht
+
+import(
+	"os"
+	"log"
+	"net"
+	"rand"
+	"time"
+	"sync"
+	"bytes"
+	"io/ioutil"
+	"crypto/sha1"
+	"container/list"
+	"wgo/bencode"
+	)
+
+const(
+	NS_PER_S = 1000000000
+	ALPHA = 3 // parallel queries during lookups
+	QUERY_TIMEOUT = 5*NS_PER_S
+	MAX_LOOKUP_QUERIES = 64
+	TOKEN_ROTATION = 5*60
+	PEER_TTL = 30*60
+	MAX_VALUES = 100 // peers returned in a get_peers response
+	MAX_STORED_TORRENTS = 2000 // infohashes we keep announced peers for
+	MAX_STORED_PEERS = 500 // announced peers kept for each infohash
+	SAVE_INTERVAL = 10*60
+	REFRESH_INTERVAL = 60
+	SEARCH_INTERVAL = 15*60
+	SEARCH_RETRY = 30
+	DHT_PACKET_SIZE = 4096
+)
+
+// Anything that wants the peers found by the DHT
+
+type PeerAdder interface {
+	AddPeers(peers *list.List)
+}
+
+// Socket used to send the KRPC packets, it can be shared with other
+// protocols like uTP, see NewSharedDHT
+
+type PacketConn interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, os.Error)
+	LocalAddr() net.Addr
+}
+
+type DHT struct {
+	mutex *sync.Mutex
+	id string
+	conn PacketConn
+	// Our own socket, nil if it's shared
+	udp *net.UDPConn
+	// The socket can reach IPv6 nodes, nodes6 are asked for
+	ipv6 bool
+	routing *routingTable
+	// Outstanding queries by transaction id
+	pending map[string]*pendingQuery
+	nextTid uint16
+	// Peers announced to us: infohash -> compact peer -> time
+	peers map[string]map[string]int64
+	// Torrents we are searching peers for
+	torrents map[string]*search
+	secret, oldSecret string
+	nodesFile string
+	quit chan bool
+}
+
+// Query waiting for the response of the node at addr
+
+type pendingQuery struct {
+	addr *net.UDPAddr
+	ch chan *krpcMsg
+}
+
+// Periodic search of the peers of a torrent
+
+type search struct {
+	pa PeerAdder
+	quit chan bool
+}
+
+// A node found during a lookup
+
+type lookupNode struct {
+	node *Node
+	token string
+	queried, answered bool
+}
+
+// Create a DHT node listening on port. nodesFile stores the routing
+// table between runs, bootstrap contains host:port addresses used to
+// join the network when the table is empty.
+
+func NewDHT(port int, nodesFile string, bootstrap []string) (d *DHT, err os.Error) {
+	// Dual stack socket, IPv4 nodes use mapped addresses
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return
+	}
+	d = newDHT(udp, nodesFile, bootstrap)
+	d.udp = udp
+	go d.read()
+	return
+}
+
+// Create a DHT node that sends through conn. The owner of conn must give
+// the packets that Match to HandlePacket.
+
+func NewSharedDHT(conn PacketConn, nodesFile string, bootstrap []string) (d *DHT) {
+	return newDHT(conn, nodesFile, bootstrap)
+}
+
+func newDHT(conn PacketConn, nodesFile string, bootstrap []string) (d *DHT) {
+	d = new(DHT)
+	d.mutex = new(sync.Mutex)
+	d.pending = make(map[string]*pendingQuery)
+	d.nextTid = uint16(rand.Intn(1 << 16))
+	d.peers = make(map[string]map[string]int64)
+	d.torrents = make(map[string]*search)
+	d.nodesFile = nodesFile
+	d.quit = make(chan bool)
+	d.secret, d.oldSecret = randomId(), randomId()
+	nodes := d.load()
+	if len(d.id) != NODE_ID_LEN {
+		d.id = randomId()
+	}
+	d.routing = newRoutingTable(d.id)
+	d.conn = conn
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		d.ipv6 = laddr.IP.To4() == nil
+	}
+	log.Println("DHT -> Listening on:", d.conn.LocalAddr().String())
+	go d.run()
+	go d.bootstrap(nodes, bootstrap)
+	return
+}
+
+func randomId() string {
+	id := make([]byte, NODE_ID_LEN)
+	for i, _ := range id {
+		id[i] = byte(rand.Intn(256))
+	}
+	return string(id)
+}
+
+func (d *DHT) Port() int {
+	return d.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (d *DHT) Nodes() int {
+	return d.routing.Len()
+}
+
+// Ping a node, it will be added to the routing table if it answers.
+// Used for the PORT message of peers.
+
+func (d *DHT) AddNode(addr string) {
+	go func() {
+		raddr, err := net.ResolveUDPAddr(addr)
+		if err != nil {
+			return
+		}
+		d.query(raddr, "", "ping", map[string]interface{}{"id": d.id})
+	}()
+}
+
+// Search for peers of the torrent and announce that we are downloading
+// it, periodically, sending the peers found to pa. Adding a torrent
+// again only changes where the peers are sent.
+
+func (d *DHT) AddTorrent(infohash string, port int, pa PeerAdder) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if s, ok := d.torrents[infohash]; ok {
+		s.pa = pa
+		return
+	}
+	s := &search{pa, make(chan bool)}
+	d.torrents[infohash] = s
+	go func() {
+		for {
+			wait := int64(SEARCH_INTERVAL)
+			if d.routing.Len() == 0 {
+				wait = SEARCH_RETRY
+			} else if peers := d.Announce(infohash, port); peers.Len() > 0 {
+				log.Println("DHT -> Found", peers.Len(), "peers")
+				d.mutex.Lock()
+				pa := s.pa
+				d.mutex.Unlock()
+				select {
+					case <- s.quit:
+						return
+					default:
+				}
+				pa.AddPeers(peers)
+			}
+			select {
+				case <- d.quit:
+					return
+				case <- s.quit:
+					return
+				case <- time.After(wait*NS_PER_S):
+			}
+		}
+	}()
+}
+
+// Stop searching peers for the torrent
+
+func (d *DHT) RemoveTorrent(infohash string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if s, ok := d.torrents[infohash]; ok {
+		close(s.quit)
+		d.torrents[infohash] = nil, false
+	}
+}
+
+// Find peers for the torrent
+
+func (d *DHT) GetPeers(infohash string) (peers *list.List) {
+	_, peers = d.lookup(infohash, "get_peers")
+	return
+}
+
+// Find peers and announce ourselves to the closest nodes
+
+func (d *DHT) Announce(infohash string, port int) (peers *list.List) {
+	nodes, peers := d.lookup(infohash, "get_peers")
+	for _, n := range nodes {
+		if len(n.token) == 0 {
+			continue
+		}
+		go d.query(n.node.addr, n.node.id, "announce_peer", map[string]interface{}{
+			"id": d.id,
+			"info_hash": infohash,
+			"port": int64(port),
+			"token": n.token})
+	}
+	return
+}
+
+func (d *DHT) Close() {
+	close(d.quit)
+	d.save()
+	if d.udp != nil {
+		d.udp.Close()
+	}
+}
+
+// Send a query and wait for the answer. id is the node id if known, it's
+// used to mark failures in the routing table.
+
+func (d *DHT) query(addr *net.UDPAddr, id, q string, args map[string]interface{}) (resp *krpcMsg, err os.Error) {
+	d.mutex.Lock()
+	d.nextTid++
+	tid := string([]byte{byte(d.nextTid>>8), byte(d.nextTid)})
+	ch := make(chan *krpcMsg, 1)
+	d.pending[tid] = &pendingQuery{addr, ch}
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		d.pending[tid] = nil, false
+		d.mutex.Unlock()
+	}()
+	data, err := encodeQuery(tid, q, args)
+	if err != nil {
+		return
+	}
+	if _, err = d.conn.WriteToUDP(data, addr); err != nil {
+		return
+	}
+	select {
+		case resp = <- ch:
+		case <- time.After(QUERY_TIMEOUT):
+			if len(id) > 0 {
+				d.routing.Failed(id)
+			}
+			return nil, os.NewError("DHT query timed out")
+	}
+	if resp.y == "e" {
+		return nil, &KrpcError{resp.errCode, resp.errMsg}
+	}
+	d.update(getString(resp.args, "id"), addr)
+	return
+}
+
+// Mark a node as alive in the routing table. If its bucket is full, the
+// questionable node returned is pinged and replaced if it doesn't answer.
+
+func (d *DHT) update(id string, addr *net.UDPAddr) {
+	if n := d.routing.Update(id, addr); n != nil {
+		go d.query(n.addr, n.id, "ping", map[string]interface{}{"id": d.id})
+	}
+}
+
+// Read incoming packets
+
+func (d *DHT) read() {
+	buf := make([]byte, DHT_PACKET_SIZE)
+	for {
+		n, addr, err := d.udp.ReadFromUDP(buf)
+		if err != nil {
+			select {
+				case <- d.quit:
+					return
+				default:
+			}
+			log.Println("DHT -> Error reading:", err)
+			continue
+		}
+		d.HandlePacket(buf[0:n], addr)
+	}
+}
+
+// KRPC packets are bencoded dictionaries
+
+func (d *DHT) Match(data []byte) bool {
+	return len(data) > 0 && data[0] == 'd'
+}
+
+// Process a KRPC packet
+
+func (d *DHT) HandlePacket(data []byte, addr *net.UDPAddr) {
+	msg, err := decodeMsg(data)
+	if err != nil {
+		return
+	}
+	if msg.y == "q" {
+		d.handleQuery(msg, addr)
+		return
+	}
+	d.mutex.Lock()
+	p, ok := d.pending[msg.t]
+	d.mutex.Unlock()
+	// The transaction id is easy to guess, only the node we asked answers
+	if ok && p.addr.IP.Equal(addr.IP) && p.addr.Port == addr.Port {
+		select {
+			case p.ch <- msg:
+			default:
+		}
+	}
+}
+
+func (d *DHT) handleQuery(msg *krpcMsg, addr *net.UDPAddr) {
+	id := getString(msg.args, "id")
+	if len(id) != NODE_ID_LEN {
+		d.reply(msg.t, addr, nil, KRPC_PROTOCOL_ERROR, "Invalid id")
+		return
+	}
+	d.update(id, addr)
+	r := map[string]interface{}{"id": d.id}
+	switch msg.q {
+		case "ping":
+		case "find_node":
+			target := getString(msg.args, "target")
+			if len(target) != NODE_ID_LEN {
+				d.reply(msg.t, addr, nil, KRPC_PROTOCOL_ERROR, "Invalid target")
+				return
+			}
+			d.addNodes(r, msg, addr, d.routing.Closest(target, K))
+		case "get_peers":
+			infohash := getString(msg.args, "info_hash")
+			if len(infohash) != NODE_ID_LEN {
+				d.reply(msg.t, addr, nil, KRPC_PROTOCOL_ERROR, "Invalid info_hash")
+				return
+			}
+			r["token"] = d.token(addr.IP, false)
+			if values := d.storedPeers(infohash, addr.IP.To4() == nil); len(values) > 0 {
+				r["values"] = values
+			} else {
+				d.addNodes(r, msg, addr, d.routing.Closest(infohash, K))
+			}
+		case "announce_peer":
+			infohash := getString(msg.args, "info_hash")
+			token := getString(msg.args, "token")
+			if len(infohash) != NODE_ID_LEN || (token != d.token(addr.IP, false) && token != d.token(addr.IP, true)) {
+				d.reply(msg.t, addr, nil, KRPC_PROTOCOL_ERROR, "Invalid token")
+				return
+			}
+			port := int(getInt(msg.args, "port"))
+			if getInt(msg.args, "implied_port") != 0 {
+				port = addr.Port
+			}
+			if port <= 0 || port > 65535 {
+				d.reply(msg.t, addr, nil, KRPC_PROTOCOL_ERROR, "Invalid port")
+				return
+			}
+			d.storePeer(infohash, &net.UDPAddr{IP: addr.IP, Port: port})
+		default:
+			d.reply(msg.t, addr, nil, KRPC_METHOD_UNKNOWN, "Method Unknown")
+			return
+	}
+	d.reply(msg.t, addr, r, 0, "")
+}
+
+// Add nodes and/or nodes6 to a response, as requested in want (BEP 32).
+// Without want the family of the requester is used.
+
+func (d *DHT) addNodes(r map[string]interface{}, msg *krpcMsg, addr *net.UDPAddr, nodes []*Node) {
+	want := getList(msg.args, "want")
+	n4, n6 := addr.IP.To4() != nil, addr.IP.To4() == nil
+	if len(want) > 0 {
+		n4, n6 = false, false
+		for _, w := range want {
+			n4 = n4 || w == "n4"
+			n6 = n6 || w == "n6"
+		}
+	}
+	if n4 {
+		r["nodes"] = encodeNodes(nodes)
+	}
+	if n6 {
+		r["nodes6"] = encodeNodes6(nodes)
+	}
+}
+
+func (d *DHT) reply(tid string, addr *net.UDPAddr, r map[string]interface{}, code int64, msg string) {
+	var data []byte
+	var err os.Error
+	if r != nil {
+		data, err = encodeResponse(tid, r)
+	} else {
+		data, err = encodeError(tid, code, msg)
+	}
+	if err != nil {
+		log.Println("DHT -> Error encoding reply:", err)
+		return
+	}
+	d.conn.WriteToUDP(data, addr)
+}
+
+// Tokens are the hash of the IP address and a secret that changes
+// every 5 minutes, tokens from the previous secret are also accepted
+
+func (d *DHT) token(ip net.IP, old bool) string {
+	d.mutex.Lock()
+	secret := d.secret
+	if old {
+		secret = d.oldSecret
+	}
+	d.mutex.Unlock()
+	h := sha1.New()
+	h.Write([]byte(ip.To16()))
+	h.Write([]byte(secret))
+	return string(h.Sum()[0:8])
+}
+
+func (d *DHT) storePeer(infohash string, addr *net.UDPAddr) {
+	peer := encodePeer(addr)
+	if len(peer) == 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// Announces are unauthenticated, bound what they can make us keep
+	peers, ok := d.peers[infohash]
+	if !ok {
+		if len(d.peers) >= MAX_STORED_TORRENTS {
+			return
+		}
+		peers = make(map[string]int64)
+		d.peers[infohash] = peers
+	}
+	if _, ok := peers[peer]; !ok && len(peers) >= MAX_STORED_PEERS {
+		return
+	}
+	peers[peer] = time.Seconds()
+}
+
+// Peers of the infohash with the same address family as the requester
+
+func (d *DHT) storedPeers(infohash string, ipv6 bool) (values []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for peer, _ := range d.peers[infohash] {
+		if len(values) >= MAX_VALUES {
+			break
+		}
+		if (len(peer) == COMPACT_PEER6_LEN) != ipv6 {
+			continue
+		}
+		values = append(values, peer)
+	}
+	return
+}
+
+// Iterative lookup of target. Returns the closest nodes that answered,
+// with their tokens, and the peers found for get_peers lookups.
+
+func (d *DHT) lookup(target, q string) (closest []*lookupNode, peers *list.List) {
+	peers = list.New()
+	seenPeers := make(map[string]bool)
+	found := make(map[string]*lookupNode)
+	for _, n := range d.routing.Closest(target, K) {
+		found[n.id] = &lookupNode{node: n}
+	}
+	type result struct {
+		ln *lookupNode
+		resp *krpcMsg
+	}
+	queries := 0
+	for queries < MAX_LOOKUP_QUERIES {
+		// Query the closest nodes not queried yet
+		candidates := closestLookup(found, target, K)
+		results := make(chan *result, ALPHA)
+		n := 0
+		for _, ln := range candidates {
+			if ln.queried {
+				continue
+			}
+			ln.queried = true
+			n++
+			go func(ln *lookupNode) {
+				key := "target"
+				if q == "get_peers" {
+					key = "info_hash"
+				}
+				args := map[string]interface{}{"id": d.id, key: target}
+				if d.ipv6 {
+					args["want"] = []interface{}{"n4", "n6"}
+				}
+				resp, err := d.query(ln.node.addr, ln.node.id, q, args)
+				if err != nil {
+					resp = nil
+				}
+				results <- &result{ln, resp}
+			}(ln)
+			if n == ALPHA {
+				break
+			}
+		}
+		if n == 0 {
+			break
+		}
+		queries += n
+		for ; n > 0; n-- {
+			res := <- results
+			if res.resp == nil {
+				continue
+			}
+			res.ln.answered = true
+			res.ln.token = getString(res.resp.args, "token")
+			nodes := decodeNodes(getString(res.resp.args, "nodes"))
+			if d.ipv6 {
+				nodes = append(nodes, decodeNodes6(getString(res.resp.args, "nodes6"))...)
+			}
+			for _, node := range nodes {
+				if _, ok := found[node.id]; !ok && node.id != d.id {
+					found[node.id] = &lookupNode{node: node}
+				}
+			}
+			for _, value := range getList(res.resp.args, "values") {
+				if peer := decodePeer(value); len(peer) > 0 && !seenPeers[peer] {
+					seenPeers[peer] = true
+					peers.PushBack(peer)
+				}
+			}
+		}
+	}
+	for _, ln := range closestLookup(found, target, len(found)) {
+		if ln.answered {
+			closest = append(closest, ln)
+			if len(closest) == K {
+				break
+			}
+		}
+	}
+	return
+}
+
+func closestLookup(found map[string]*lookupNode, target string, n int) (closest []*lookupNode) {
+	nodes := make([]*Node, 0, len(found))
+	for _, ln := range found {
+		nodes = append(nodes, ln.node)
+	}
+	sortByDistance(nodes, target)
+	for i := 0; i < len(nodes) && i < n; i++ {
+		closest = append(closest, found[nodes[i].id])
+	}
+	return
+}
+
+// Join the network pinging the nodes of the previous run and the
+// bootstrap nodes, then look for our own id to fill the table
+
+func (d *DHT) bootstrap(nodes []*Node, bootstrap []string) {
+	done := make(chan bool)
+	for _, n := range nodes {
+		go func(n *Node) {
+			d.query(n.addr, n.id, "ping", map[string]interface{}{"id": d.id})
+			done <- true
+		}(n)
+	}
+	for _, addr := range bootstrap {
+		go func(addr string) {
+			if raddr, err := net.ResolveUDPAddr(addr); err == nil {
+				d.query(raddr, "", "ping", map[string]interface{}{"id": d.id})
+			} else {
+				log.Println("DHT -> Unable to resolve bootstrap node:", addr, err)
+			}
+			done <- true
+		}(addr)
+	}
+	for i := 0; i < len(nodes)+len(bootstrap); i++ {
+		<- done
+	}
+	d.lookup(d.id, "find_node")
+	log.Println("DHT -> Bootstrap finished, nodes:", d.routing.Len())
+}
+
+// Maintenance: rotate token secrets, expire peers, refresh buckets
+// and save the routing table
+
+func (d *DHT) run() {
+	rotate := time.Tick(TOKEN_ROTATION*NS_PER_S)
+	refresh := time.Tick(REFRESH_INTERVAL*NS_PER_S)
+	save := time.Tick(SAVE_INTERVAL*NS_PER_S)
+	for {
+		select {
+			case <- rotate:
+				d.mutex.Lock()
+				d.oldSecret, d.secret = d.secret, randomId()
+				now := time.Seconds()
+				for infohash, peers := range d.peers {
+					for peer, seen := range peers {
+						if now-seen > PEER_TTL {
+							peers[peer] = 0, false
+						}
+					}
+					if len(peers) == 0 {
+						d.peers[infohash] = nil, false
+					}
+				}
+				d.mutex.Unlock()
+			case <- refresh:
+				for _, b := range d.routing.Stale() {
+					go d.lookup(d.routing.RandomId(b), "find_node")
+				}
+			case <- save:
+				d.save()
+			case <- d.quit:
+				return
+		}
+	}
+}
+
+// The node table is stored as a bencoded dictionary with our id and
+// the compact node info of the table
+
+func (d *DHT) save() {
+	if len(d.nodesFile) == 0 {
+		return
+	}
+	data, err := encode(map[string]interface{}{"id": d.id, "nodes": encodeNodes(d.routing.Nodes()), "nodes6": encodeNodes6(d.routing.Nodes())})
+	if err != nil {
+		return
+	}
+	// Write to a temporary file and rename it so the table is never
+	// left half written
+	tmp := d.nodesFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("DHT -> Error saving nodes:", err)
+		return
+	}
+	if err = os.Rename(tmp, d.nodesFile); err != nil {
+		log.Println("DHT -> Error saving nodes:", err)
+	}
+}
+
+func (d *DHT) load() (nodes []*Node) {
+	if len(d.nodesFile) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(d.nodesFile)
+	if err != nil {
+		return
+	}
+	v, err := bencode.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		log.Println("DHT -> Error loading nodes:", err)
+		return
+	}
+	msg, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	d.id = getString(msg, "id")
+	nodes = append(decodeNodes(getString(msg, "nodes")), decodeNodes6(getString(msg, "nodes6"))...)
+	log.Println("DHT -> Loaded", len(nodes), "nodes from", d.nodesFile)
+	return
+}
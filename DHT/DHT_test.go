@@ -0,0 +1,259 @@
+package dht
+
+import(
+	"os"
+	"net"
+	"testing"
+	"strconv"
+	"time"
+	)
+
+func TestKrpc(t *testing.T) {
+	data, err := encodeQuery("aa", "ping", map[string]interface{}{"id": "abcdefghij0123456789"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"
+	if string(data) != expected {
+		t.Errorf("Got %q, expected %q", data, expected)
+	}
+	msg, err := decodeMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.t != "aa" || msg.y != "q" || msg.q != "ping" || getString(msg.args, "id") != "abcdefghij0123456789" {
+		t.Errorf("Wrong decoded message %v", msg)
+	}
+	data, err = encodeError("aa", KRPC_GENERIC_ERROR, "A Generic Error Ocurred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = decodeMsg(data); err != nil {
+		t.Fatal(err)
+	}
+	if msg.y != "e" || msg.errCode != KRPC_GENERIC_ERROR || msg.errMsg != "A Generic Error Ocurred" {
+		t.Errorf("Wrong decoded error %v", msg)
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	n := NewNode(randomId(), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	nodes := decodeNodes(encodeNodes([]*Node{n}))
+	if len(nodes) != 1 || nodes[0].id != n.id || nodes[0].addr.String() != "10.0.0.1:6881" {
+		t.Errorf("Got %v, expected %v", nodes, n)
+	}
+	peer := decodePeer(encodePeer(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 51413}))
+	if peer != "10.0.0.2:51413" {
+		t.Errorf("Got %s, expected 10.0.0.2:51413", peer)
+	}
+}
+
+func TestCompactNodes6(t *testing.T) {
+	n4 := NewNode(randomId(), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	n6 := NewNode(randomId(), &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881})
+	if nodes := decodeNodes(encodeNodes([]*Node{n4, n6})); len(nodes) != 1 || nodes[0].id != n4.id {
+		t.Errorf("Got %v in nodes, expected only %v", nodes, n4)
+	}
+	nodes := decodeNodes6(encodeNodes6([]*Node{n4, n6}))
+	if len(nodes) != 1 || nodes[0].id != n6.id || nodes[0].addr.String() != "[2001:db8::1]:6881" {
+		t.Errorf("Got %v in nodes6, expected only %v", nodes, n6)
+	}
+	compact := encodePeer(&net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 51413})
+	if len(compact) != COMPACT_PEER6_LEN {
+		t.Fatalf("Got %d bytes for an IPv6 peer, expected %d", len(compact), COMPACT_PEER6_LEN)
+	}
+	if peer := decodePeer(compact); peer != "[2001:db8::2]:51413" {
+		t.Errorf("Got %s, expected [2001:db8::2]:51413", peer)
+	}
+}
+
+func TestRandomId(t *testing.T) {
+	r := newRoutingTable(randomId())
+	for _, b := range []int{0, 1, 7, 8, 100, NUM_BUCKETS-2} {
+		if p := commonPrefix(r.id, r.RandomId(b)); p != b {
+			t.Errorf("RandomId(%d) shares %d bits with our id", b, p)
+		}
+	}
+}
+
+// A full bucket pings its questionable nodes, a node is only replaced if
+// the ping times out
+
+func TestFullBucket(t *testing.T) {
+	r := newRoutingTable(randomId())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	ids := make([]string, K)
+	for i, _ := range ids {
+		ids[i] = r.RandomId(0)
+		r.Update(ids[i], addr)
+	}
+	if n := r.Update(r.RandomId(0), addr); n != nil {
+		t.Errorf("Pinging good node %x", n.id)
+	}
+	// The first two become questionable
+	r.buckets[0][0].lastSeen = 0
+	r.buckets[0][1].lastSeen = 0
+	first, second := r.RandomId(0), r.RandomId(0)
+	if n := r.Update(first, addr); n == nil || n.id != ids[0] {
+		t.Fatalf("Got %v to ping, expected the first node", n)
+	}
+	// The first one is already being pinged
+	if n := r.Update(second, addr); n == nil || n.id != ids[1] {
+		t.Fatalf("Got %v to ping, expected the second node", n)
+	}
+	if n := r.Update(r.RandomId(0), addr); n != nil {
+		t.Errorf("Pinging %x twice", n.id)
+	}
+	// The first doesn't answer, the second does
+	r.Failed(ids[0])
+	r.Update(ids[1], addr)
+	if r.find(0, ids[0]) >= 0 || r.find(0, first) < 0 {
+		t.Errorf("The node that didn't answer wasn't replaced")
+	}
+	if r.find(0, ids[1]) < 0 || r.find(0, second) >= 0 {
+		t.Errorf("The node that answered was replaced")
+	}
+	// Later failures only count, on a copy of the node
+	n := r.buckets[0][r.find(0, ids[1])]
+	r.Failed(ids[1])
+	if n.failures != 0 {
+		t.Errorf("Failed changed the node instead of replacing it")
+	}
+	if i := r.find(0, ids[1]); i < 0 || r.buckets[0][i].failures != 1 {
+		t.Errorf("The failure wasn't counted")
+	}
+	if r.Len() != K {
+		t.Errorf("Got %d nodes, expected %d", r.Len(), K)
+	}
+}
+
+func newTestDHT(t *testing.T, bootstrap []string) *DHT {
+	d, err := NewDHT(0, "", bootstrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Several nodes on loopback: two of them join through the first one,
+// one announces a torrent and the other finds it
+
+func testLoopback(t *testing.T, host string) {
+	router := newTestDHT(t, nil)
+	defer router.Close()
+	addr := net.JoinHostPort(host, strconv.Itoa(router.Port()))
+	seeder := newTestDHT(t, []string{addr})
+	defer seeder.Close()
+	leecher := newTestDHT(t, []string{addr})
+	defer leecher.Close()
+	// Wait for the bootstrap pings, they run in the background
+	for i := 0; i < 50 && (router.Nodes() < 2 || seeder.Nodes() < 1 || leecher.Nodes() < 1); i++ {
+		time.Sleep(100*NS_PER_MS)
+	}
+	seeder.lookup(seeder.id, "find_node")
+	leecher.lookup(leecher.id, "find_node")
+	if router.Nodes() != 2 {
+		t.Errorf("Router knows %d nodes, expected 2", router.Nodes())
+	}
+	infohash := randomId()
+	seeder.Announce(infohash, 5000)
+	expected := net.JoinHostPort(host, "5000")
+	// announce_peer is sent in the background, ask until it arrives
+	for i := 0; i < 10; i++ {
+		peers := leecher.GetPeers(infohash)
+		if peers.Len() > 0 {
+			if peer := peers.Front().Value.(string); peer != expected {
+				t.Errorf("Got peer %s, expected %s", peer, expected)
+			}
+			return
+		}
+	}
+	t.Error("Announced peer not found")
+}
+
+func TestLoopback(t *testing.T) {
+	testLoopback(t, "127.0.0.1")
+}
+
+func TestLoopback6(t *testing.T) {
+	testLoopback(t, "::1")
+}
+
+const NS_PER_MS = 1000000
+
+type testPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// Socket that keeps the packets sent through it
+
+type testConn chan testPacket
+
+func (c testConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, os.Error) {
+	c <- testPacket{append([]byte(nil), b...), addr}
+	return len(b), nil
+}
+
+func (c testConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+}
+
+func TestResponseAddress(t *testing.T) {
+	conn := make(testConn, 16)
+	d := NewSharedDHT(conn, "", nil)
+	defer d.Close()
+	node := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	done := make(chan os.Error)
+	go func() {
+		_, err := d.query(node, "", "ping", map[string]interface{}{"id": d.id})
+		done <- err
+	}()
+	var tid string
+	for len(tid) == 0 {
+		p := <- conn
+		if msg, err := decodeMsg(p.data); err == nil && msg.q == "ping" && p.addr == node {
+			tid = msg.t
+		}
+	}
+	data, err := encodeResponse(tid, map[string]interface{}{"id": randomId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same transaction id from another node, and from another port
+	d.HandlePacket(data, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	d.HandlePacket(data, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6882})
+	select {
+		case err = <- done:
+			t.Fatalf("Query answered by another node: %v", err)
+		default:
+	}
+	// The node we asked, from a dual stack socket
+	d.HandlePacket(data, &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 6881})
+	if err = <- done; err != nil {
+		t.Errorf("Query failed: %v", err)
+	}
+}
+
+func TestStoredPeersLimits(t *testing.T) {
+	d := NewSharedDHT(make(testConn, 16), "", nil)
+	defer d.Close()
+	infohash := randomId()
+	for port := 1; port <= MAX_STORED_PEERS+10; port++ {
+		d.storePeer(infohash, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port})
+	}
+	if n := len(d.peers[infohash]); n != MAX_STORED_PEERS {
+		t.Errorf("Stored %d peers, expected %d", n, MAX_STORED_PEERS)
+	}
+	for i := 0; i < MAX_STORED_TORRENTS+10; i++ {
+		d.storePeer(randomId(), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+	}
+	if len(d.peers) != MAX_STORED_TORRENTS {
+		t.Errorf("Stored peers of %d torrents, expected %d", len(d.peers), MAX_STORED_TORRENTS)
+	}
+	// Peers already stored are refreshed
+	d.storePeer(infohash, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+	if len(d.peers[infohash]) != MAX_STORED_PEERS {
+		t.Errorf("Refreshing a peer changed the stored peers")
+	}
+}
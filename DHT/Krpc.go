@@ -0,0 +1,216 @@
+// KRPC messages used by the DHT (BEP 5)
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package dht
+
+import(
+	"os"
+	"net"
+	"bytes"
+	"strconv"
+	"encoding/binary"
+	"container/vector"
+	"wgo/bencode"
+	)
+
+// KRPC error codes
+
+const(
+	KRPC_GENERIC_ERROR = 201
+	KRPC_SERVER_ERROR = 202
+	KRPC_PROTOCOL_ERROR = 203
+	KRPC_METHOD_UNKNOWN = 204
+)
+
+const(
+	NODE_ID_LEN = 20
+	COMPACT_NODE_LEN = 26
+	COMPACT_NODE6_LEN = 38
+	COMPACT_PEER_LEN = 6
+	COMPACT_PEER6_LEN = 18
+)
+
+type krpcMsg struct {
+	t, y, q string // transaction id, type and query method
+	args map[string]interface{} // "a" for queries, "r" for responses
+	errCode int64
+	errMsg string
+}
+
+// Error received from a remote node
+
+type KrpcError struct {
+	Code int64
+	Msg string
+}
+
+func (e *KrpcError) String() string {
+	return "KRPC error " + strconv.Itoa64(e.Code) + ": " + e.Msg
+}
+
+func encodeQuery(t, q string, args map[string]interface{}) (data []byte, err os.Error) {
+	return encode(map[string]interface{}{"t": t, "y": "q", "q": q, "a": args})
+}
+
+func encodeResponse(t string, args map[string]interface{}) (data []byte, err os.Error) {
+	return encode(map[string]interface{}{"t": t, "y": "r", "r": args})
+}
+
+func encodeError(t string, code int64, msg string) (data []byte, err os.Error) {
+	return encode(map[string]interface{}{"t": t, "y": "e", "e": []interface{}{code, msg}})
+}
+
+func encode(m map[string]interface{}) (data []byte, err os.Error) {
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, m); err != nil {
+		return
+	}
+	return b.Bytes(), nil
+}
+
+func decodeMsg(data []byte) (msg *krpcMsg, err os.Error) {
+	v, err := bencode.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, os.NewError("KRPC message is not a dictionary")
+	}
+	msg = new(krpcMsg)
+	msg.t = getString(m, "t")
+	msg.y = getString(m, "y")
+	switch msg.y {
+		case "q":
+			msg.q = getString(m, "q")
+			msg.args = getMap(m, "a")
+		case "r":
+			msg.args = getMap(m, "r")
+		case "e":
+			if e, ok := m["e"].(vector.Vector); ok && len(e) >= 2 {
+				msg.errCode, _ = e[0].(int64)
+				msg.errMsg, _ = e[1].(string)
+			}
+		default:
+			return nil, os.NewError("Unknown KRPC message type " + msg.y)
+	}
+	if msg.y != "e" && msg.args == nil {
+		return nil, os.NewError("KRPC message without arguments")
+	}
+	return
+}
+
+func getString(m map[string]interface{}, k string) string {
+	if v, ok := m[k]; ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func getInt(m map[string]interface{}, k string) int64 {
+	if v, ok := m[k]; ok {
+		if i, ok := v.(int64); ok {
+			return i
+		}
+	}
+	return 0
+}
+
+func getMap(m map[string]interface{}, k string) map[string]interface{} {
+	if v, ok := m[k]; ok {
+		if d, ok := v.(map[string]interface{}); ok {
+			return d
+		}
+	}
+	return nil
+}
+
+func getList(m map[string]interface{}, k string) (list []string) {
+	if v, ok := m[k]; ok {
+		if l, ok := v.(vector.Vector); ok {
+			for _, e := range l {
+				if s, ok := e.(string); ok {
+					list = append(list, s)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Compact node info: 20 bytes id, 4 bytes ip and 2 bytes port. Only
+// IPv4 nodes are encoded, IPv6 ones go to nodes6 (BEP 32).
+
+func encodeNodes(nodes []*Node) string {
+	b := make([]byte, 0, len(nodes)*COMPACT_NODE_LEN)
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		b = append(b, []byte(n.id)...)
+		b = append(b, ip...)
+		b = append(b, byte(n.addr.Port>>8), byte(n.addr.Port))
+	}
+	return string(b)
+}
+
+// Compact IPv6 node info: 20 bytes id, 16 bytes ip and 2 bytes port
+
+func encodeNodes6(nodes []*Node) string {
+	b := make([]byte, 0, len(nodes)*COMPACT_NODE6_LEN)
+	for _, n := range nodes {
+		if n.addr.IP.To4() != nil {
+			continue
+		}
+		ip := n.addr.IP.To16()
+		if ip == nil {
+			continue
+		}
+		b = append(b, []byte(n.id)...)
+		b = append(b, ip...)
+		b = append(b, byte(n.addr.Port>>8), byte(n.addr.Port))
+	}
+	return string(b)
+}
+
+func decodeNodes(compact string) (nodes []*Node) {
+	for i := 0; i+COMPACT_NODE_LEN <= len(compact); i += COMPACT_NODE_LEN {
+		addr := &net.UDPAddr{IP: net.IPv4(compact[i+20], compact[i+21], compact[i+22], compact[i+23]),
+			Port: int(binary.BigEndian.Uint16([]byte(compact[i+24:i+26])))}
+		nodes = append(nodes, NewNode(compact[i:i+20], addr))
+	}
+	return
+}
+
+func decodeNodes6(compact string) (nodes []*Node) {
+	for i := 0; i+COMPACT_NODE6_LEN <= len(compact); i += COMPACT_NODE6_LEN {
+		addr := &net.UDPAddr{IP: net.IP([]byte(compact[i+20:i+36])),
+			Port: int(binary.BigEndian.Uint16([]byte(compact[i+36:i+38])))}
+		nodes = append(nodes, NewNode(compact[i:i+20], addr))
+	}
+	return
+}
+
+// Compact peer info: 4 or 16 bytes ip and 2 bytes port
+
+func encodePeer(addr *net.UDPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		if ip = addr.IP.To16(); ip == nil {
+			return ""
+		}
+	}
+	return string(append([]byte(ip), byte(addr.Port>>8), byte(addr.Port)))
+}
+
+func decodePeer(compact string) string {
+	if len(compact) != COMPACT_PEER_LEN && len(compact) != COMPACT_PEER6_LEN {
+		return ""
+	}
+	ip := net.IP([]byte(compact[0:len(compact)-2]))
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16([]byte(compact[len(compact)-2:])))))
+}
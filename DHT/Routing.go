@@ -0,0 +1,285 @@
+// Kademlia routing table with k-buckets
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package dht
+
+import(
+	"net"
+	"sort"
+	"sync"
+	"time"
+	)
+
+const(
+	K = 8 // nodes per bucket
+	NUM_BUCKETS = NODE_ID_LEN*8
+	QUESTIONABLE_TIME = 15*60 // nodes not seen for 15 minutes are questionable
+	MAX_NODE_FAILURES = 2 // nodes that failed this many queries are bad
+	REPLACEMENT_TIMEOUT = 30 // a questionable node is pinged again after this
+)
+
+type Node struct {
+	id string
+	addr *net.UDPAddr
+	lastSeen int64
+	failures int
+}
+
+type routingTable struct {
+	mutex *sync.Mutex
+	id string
+	buckets [NUM_BUCKETS][]*Node
+	// Last time each bucket was changed, used to refresh them
+	changed [NUM_BUCKETS]int64
+	// Nodes waiting to replace a questionable node of a full bucket,
+	// by the id of the questionable node
+	replacements map[string]*replacement
+}
+
+type replacement struct {
+	node *Node
+	pinged int64
+}
+
+func NewNode(id string, addr *net.UDPAddr) (n *Node) {
+	n = new(Node)
+	n.id = id
+	n.addr = addr
+	return
+}
+
+func (n *Node) Good() bool {
+	return n.failures < MAX_NODE_FAILURES && time.Seconds()-n.lastSeen < QUESTIONABLE_TIME
+}
+
+func (n *Node) Bad() bool {
+	return n.failures >= MAX_NODE_FAILURES
+}
+
+func newRoutingTable(id string) (r *routingTable) {
+	r = new(routingTable)
+	r.mutex = new(sync.Mutex)
+	r.id = id
+	r.replacements = make(map[string]*replacement)
+	now := time.Seconds()
+	for i, _ := range r.changed {
+		r.changed[i] = now
+	}
+	return
+}
+
+// Number of leading bits shared by a and b, nodes are stored in the
+// bucket with this index
+
+func commonPrefix(a, b string) int {
+	for i := 0; i < NODE_ID_LEN; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i*8
+			for ; x&0x80 == 0; x <<= 1 {
+				n++
+			}
+			return n
+		}
+	}
+	return NUM_BUCKETS-1
+}
+
+func (r *routingTable) bucket(id string) int {
+	b := commonPrefix(r.id, id)
+	if b >= NUM_BUCKETS {
+		b = NUM_BUCKETS-1
+	}
+	return b
+}
+
+// Mark a node as alive, adding it to the table if there's room. Full
+// buckets replace bad nodes; if there's none but a questionable node, it
+// is returned to be pinged and the new node only replaces it if the ping
+// times out. Otherwise the new node is dropped.
+
+func (r *routingTable) Update(id string, addr *net.UDPAddr) (ping *Node) {
+	if len(id) != NODE_ID_LEN || id == r.id {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Seconds()
+	b := r.bucket(id)
+	bucket := r.buckets[b]
+	node := NewNode(id, addr)
+	node.lastSeen = now
+	// Lookups read the nodes returned by Closest without the mutex, so
+	// they are replaced instead of changed
+	for i, n := range bucket {
+		if n.id == id {
+			bucket[i] = node
+			r.changed[b] = now
+			// It answered, it stays
+			r.replacements[id] = nil, false
+			return
+		}
+	}
+	if len(bucket) < K {
+		r.buckets[b] = append(bucket, node)
+		r.changed[b] = now
+		return
+	}
+	for i, n := range bucket {
+		if n.Bad() {
+			r.replacements[n.id] = nil, false
+			bucket[i] = node
+			r.changed[b] = now
+			return
+		}
+	}
+	for _, n := range bucket {
+		if n.Good() {
+			continue
+		}
+		if rep, ok := r.replacements[n.id]; ok {
+			if now-rep.pinged < REPLACEMENT_TIMEOUT {
+				// Already being pinged, try the next one
+				continue
+			}
+		}
+		r.replacements[n.id] = &replacement{node, now}
+		return n
+	}
+	return
+}
+
+// A query to the node timed out. A questionable node being pinged is
+// replaced by the node waiting for its place.
+
+func (r *routingTable) Failed(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	b := r.bucket(id)
+	for i, n := range r.buckets[b] {
+		if n.id == id {
+			if rep, ok := r.replacements[id]; ok && r.find(b, rep.node.id) < 0 {
+				r.replacements[id] = nil, false
+				r.buckets[b][i] = rep.node
+				r.changed[b] = time.Seconds()
+				return
+			}
+			failed := *n
+			failed.failures++
+			r.buckets[b][i] = &failed
+			return
+		}
+	}
+}
+
+// Index of the node in the bucket, -1 if it isn't there
+
+func (r *routingTable) find(b int, id string) int {
+	for i, n := range r.buckets[b] {
+		if n.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the n nodes closest to target
+
+func (r *routingTable) Closest(target string, n int) (nodes []*Node) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	nodes = make([]*Node, 0, NUM_BUCKETS)
+	for _, bucket := range r.buckets {
+		for _, node := range bucket {
+			if !node.Bad() {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	sortByDistance(nodes, target)
+	if len(nodes) > n {
+		nodes = nodes[0:n]
+	}
+	return
+}
+
+func (r *routingTable) Nodes() (nodes []*Node) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, bucket := range r.buckets {
+		for _, node := range bucket {
+			nodes = append(nodes, node)
+		}
+	}
+	return
+}
+
+func (r *routingTable) Len() (n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, bucket := range r.buckets {
+		n += len(bucket)
+	}
+	return
+}
+
+// Buckets that haven't changed in the last 15 minutes must be refreshed,
+// returns their indexes
+
+func (r *routingTable) Stale() (buckets []int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Seconds()
+	for i, bucket := range r.buckets {
+		if len(bucket) > 0 && now-r.changed[i] > QUESTIONABLE_TIME {
+			buckets = append(buckets, i)
+			r.changed[i] = now
+		}
+	}
+	return
+}
+
+// Random id that falls in the given bucket
+
+func (r *routingTable) RandomId(bucket int) string {
+	id := []byte(randomId())
+	for i := 0; i < bucket; i++ {
+		mask := byte(0x80 >> uint(i%8))
+		id[i/8] = id[i/8] &^ mask | r.id[i/8] & mask
+	}
+	if bucket < NUM_BUCKETS {
+		// The next bit must differ
+		mask := byte(0x80 >> uint(bucket%8))
+		id[bucket/8] = id[bucket/8] &^ mask | ^r.id[bucket/8] & mask
+	}
+	return string(id)
+}
+
+// Sort nodes by XOR distance to target
+
+type byDistance struct {
+	nodes []*Node
+	target string
+}
+
+func (d *byDistance) Len() int { return len(d.nodes) }
+func (d *byDistance) Swap(i, j int) { d.nodes[i], d.nodes[j] = d.nodes[j], d.nodes[i] }
+func (d *byDistance) Less(i, j int) bool {
+	return closer(d.nodes[i].id, d.nodes[j].id, d.target)
+}
+
+func sortByDistance(nodes []*Node, target string) {
+	sort.Sort(&byDistance{nodes, target})
+}
+
+// a is closer than b to target
+
+func closer(a, b, target string) bool {
+	for i := 0; i < NODE_ID_LEN; i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Storage keeping the data of a torrent in a single preallocated file,
+// the files of the torrent aren't created
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"os"
+	"sync"
+	"wgo/bencode"
+	)
+
+type blobStorage struct {
+	// Protects fd, reads and writes take it for reading
+	mutex *sync.RWMutex
+	fd *os.File
+	name string
+	numFiles int
+	totalLength int64
+}
+
+// Open or create dir/name.blob with the size of the torrent, priorities
+// aren't used as all the data is in the same file
+
+func NewBlobStorage(info *bencode.InfoDict, dir string, priorities []int) (s Storage, err os.Error) {
+	bs := new(blobStorage)
+	bs.mutex = new(sync.RWMutex)
+	lengths, _, totalLength := layout(info)
+	bs.numFiles = len(lengths)
+	bs.totalLength = totalLength
+	name, err := joinPath([]string{info.Name})
+	if err != nil {
+		return
+	}
+	bs.name = dir + "/" + name + ".blob"
+	if err = ensureDirectory(bs.name); err != nil {
+		return
+	}
+	if bs.fd, err = os.Open(bs.name, os.O_RDWR|os.O_CREAT, FILE_PERM); err != nil {
+		return
+	}
+	// Don't change the modification time if it has the right size, or
+	// the fast resume data won't be used
+	fi, err := bs.fd.Stat()
+	if err == nil && fi.Size != totalLength {
+		err = bs.fd.Truncate(totalLength)
+	}
+	if err != nil {
+		bs.fd.Close()
+		return
+	}
+	return bs, nil
+}
+
+func (bs *blobStorage) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+	if bs.fd == nil {
+		return 0, os.NewError("Blob closed")
+	}
+	n, err = bs.fd.ReadAt(p, off)
+	if err == os.EOF {
+		// Past the end of the torrent, read zeros like the file store
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		n, err = len(p), nil
+	}
+	return
+}
+
+func (bs *blobStorage) WriteAt(p []byte, off int64) (n int, err os.Error) {
+	if off + int64(len(p)) > bs.totalLength {
+		return 0, os.NewError("Write out of the torrent data")
+	}
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+	if bs.fd == nil {
+		return 0, os.NewError("Blob closed")
+	}
+	return bs.fd.WriteAt(p, off)
+}
+
+func (bs *blobStorage) SetPriority(file, priority int) (os.Error) {
+	return nil
+}
+
+// All the files have the state of the blob
+
+func (bs *blobStorage) States() (states []FileState, err os.Error) {
+	fi, err := os.Stat(bs.name)
+	if err != nil {
+		return
+	}
+	states = make([]FileState, bs.numFiles)
+	for i, _ := range states {
+		states[i] = FileState{fi.Size, fi.Mtime_ns}
+	}
+	return
+}
+
+func (bs *blobStorage) Close() (err os.Error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	if bs.fd == nil {
+		return
+	}
+	err = bs.fd.Sync()
+	bs.fd.Close()
+	bs.fd = nil
+	return
+}
+
+func (bs *blobStorage) Remove() (os.Error) {
+	bs.Close()
+	return os.Remove(bs.name)
+}
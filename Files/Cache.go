@@ -0,0 +1,779 @@
+// Write-back and read cache of the pieces of a torrent. The blocks of a
+// piece are gathered in memory and hashed as they arrive, and the piece
+// is written with a single write by a pool of workers, so the peers
+// never wait on the disk.
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"bytes"
+	"crypto/sha1"
+	"hash"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"wgo/bit_field"
+	)
+
+const(
+	DISK_WORKERS = 4
+	DISK_QUEUE = 64 // jobs waiting for a worker, the peers block when it's full
+	CACHE_BLOCK = 16*1024
+	DEFAULT_CACHE_SIZE = 16*1024*1024
+)
+
+// State of each block of a cached piece
+
+const(
+	block_missing = iota
+	block_memory
+	block_disk
+)
+
+// State of a cached piece
+
+const(
+	piece_gathering = iota // receiving blocks, some can be on disk
+	piece_hashing // complete, reading the blocks not hashed from disk
+	piece_dirty // passed the hash check, not written yet
+	piece_clean // the same as on disk
+	piece_failed // failed the hash check, kept to read the bad blocks
+)
+
+const(
+	job_read = iota
+	job_flush
+	job_hash
+	job_write
+)
+
+type cachedPiece struct {
+	index, off int64
+	data []byte // nil if there isn't any block in memory
+	blocks []int
+	missing int
+	state int
+	flushing bool
+	// The blocks before hashedBlocks are in hasher, only a goroutine
+	// advances it at a time
+	hasher hash.Hash
+	hashedBlocks int
+	advancing bool
+	// Closed when err has the result of the hash check
+	hashed chan bool
+	err os.Error
+	used int64
+}
+
+type diskJob struct {
+	op int
+	piece *cachedPiece
+	buf []byte
+	off int64
+	done chan os.Error
+}
+
+type cache struct {
+	mutex *sync.Mutex
+	storage Storage
+	hashes string
+	pieceLength, totalLength, numPieces int64
+	pieces map[int64]*cachedPiece
+	// Pieces that passed the hash check in the cache, blocks received
+	// later are duplicates from the end game
+	passed *bit_field.Bitfield
+	size, maxSize int64
+	clock int64
+	onError func(os.Error)
+	jobs chan *diskJob
+	quit chan bool
+	workers chan bool
+}
+
+func newCache(storage Storage, pieceLength, totalLength int64, hashes string) (c *cache) {
+	c = new(cache)
+	c.mutex = new(sync.Mutex)
+	c.storage = storage
+	c.hashes = hashes
+	c.pieceLength = pieceLength
+	c.totalLength = totalLength
+	c.numPieces = (totalLength + pieceLength - 1) / pieceLength
+	c.pieces = make(map[int64]*cachedPiece)
+	c.passed = bit_field.NewBitfield(c.numPieces)
+	c.maxSize = DEFAULT_CACHE_SIZE
+	c.jobs = make(chan *diskJob, DISK_QUEUE)
+	c.quit = make(chan bool)
+	c.workers = make(chan bool, DISK_WORKERS)
+	for i := 0; i < DISK_WORKERS; i++ {
+		go c.worker()
+	}
+	return
+}
+
+func (c *cache) worker() {
+	defer func() { c.workers <- true }()
+	for {
+		select {
+			case job := <- c.jobs:
+				c.do(job)
+			case <- c.quit:
+				// Nobody must be left waiting for a job
+				for {
+					select {
+						case job := <- c.jobs:
+							c.do(job)
+						default:
+							return
+					}
+				}
+		}
+	}
+}
+
+func (c *cache) do(job *diskJob) {
+	switch job.op {
+		case job_read:
+			_, err := c.storage.ReadAt(job.buf, job.off)
+			job.done <- err
+		case job_flush:
+			c.flush(job.piece)
+		case job_hash:
+			c.hash(job.piece)
+		case job_write:
+			c.write(job.piece)
+	}
+}
+
+// Queue a job for the workers, once the cache is closed it's done by the
+// caller. The workers must not call it, the queue can be full.
+
+func (c *cache) send(job *diskJob) {
+	select {
+		case c.jobs <- job:
+		case <- c.quit:
+			c.do(job)
+	}
+}
+
+// Read through the workers
+
+func (c *cache) read(p []byte, off int64) (os.Error) {
+	job := &diskJob{op: job_read, buf: p, off: off, done: make(chan os.Error, 1)}
+	c.send(job)
+	return <- job.done
+}
+
+// Disk errors are handled in their own goroutine, the handler can close
+// the cache
+
+func (c *cache) report(err os.Error) {
+	log.Println("Files -> Disk error:", err)
+	c.mutex.Lock()
+	onError := c.onError
+	c.mutex.Unlock()
+	if onError != nil {
+		go onError(err)
+	}
+}
+
+func (c *cache) SetErrorHandler(f func(os.Error)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onError = f
+}
+
+func (c *cache) SetSize(size int64) {
+	c.mutex.Lock()
+	c.maxSize = size
+	jobs := c.evict()
+	c.mutex.Unlock()
+	for _, job := range jobs {
+		c.send(job)
+	}
+}
+
+func (c *cache) pieceLen(index int64) int64 {
+	if index == c.numPieces-1 {
+		return c.totalLength - index*c.pieceLength
+	}
+	return c.pieceLength
+}
+
+// Copy a block to the cache and hash it if the blocks before it are
+// hashed, the piece is checked and written once all of its blocks are
+// there. Blocks must be aligned to CACHE_BLOCK. A block received twice
+// keeps the first data, as it can be hashed already.
+
+func (c *cache) WriteAt(index, begin int64, p []byte) (err os.Error) {
+	if index < 0 || index >= c.numPieces {
+		return os.NewError("Piece out of range")
+	}
+	length := c.pieceLen(index)
+	end := begin + int64(len(p))
+	if begin < 0 || end > length {
+		return os.NewError("Block out of range")
+	}
+	if begin%CACHE_BLOCK != 0 || (end%CACHE_BLOCK != 0 && end != length) {
+		return os.NewError("Block not aligned")
+	}
+	c.mutex.Lock()
+	if c.passed.IsSet(index) {
+		c.mutex.Unlock()
+		return
+	}
+	piece := c.pieces[index]
+	if piece == nil || piece.state == piece_clean || piece.state == piece_failed {
+		// Downloading it again
+		piece = c.newPiece(index)
+	}
+	if piece.state != piece_gathering {
+		// Complete, waiting for the hash check
+		c.mutex.Unlock()
+		return
+	}
+	c.alloc(piece)
+	for i := begin/CACHE_BLOCK; i*CACHE_BLOCK < end; i++ {
+		if piece.blocks[i] != block_missing {
+			continue
+		}
+		copy(piece.data[i*CACHE_BLOCK:], p[i*CACHE_BLOCK-begin:])
+		piece.blocks[i] = block_memory
+		piece.missing--
+	}
+	c.touch(piece)
+	jobs := c.advance(piece)
+	jobs = append(jobs, c.evict()...)
+	c.mutex.Unlock()
+	for _, job := range jobs {
+		c.send(job)
+	}
+	return
+}
+
+// Read from the cache, the blocks that aren't in memory are read from
+// the storage by the workers
+
+func (c *cache) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	return c.readAt(p, off, false)
+}
+
+// Reader of the pieces sent to the peers
+
+type readAhead struct {
+	c *cache
+}
+
+func (r readAhead) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	return r.c.readAt(p, off, true)
+}
+
+// With ahead the rest of a piece not cached is read too, and kept
+// for the next requests of the peers
+
+func (c *cache) readAt(p []byte, off int64, ahead bool) (n int, err os.Error) {
+	for len(p) > 0 {
+		index := off / c.pieceLength
+		if index >= c.numPieces {
+			// Past the end of the torrent, read zeros like the storage
+			for i, _ := range p {
+				p[i] = 0
+			}
+			return n + len(p), nil
+		}
+		begin := off - index*c.pieceLength
+		chunk := c.pieceLen(index) - begin
+		if chunk > int64(len(p)) {
+			chunk = int64(len(p))
+		}
+		if err = c.readPiece(index, begin, p[0:chunk], ahead); err != nil {
+			return
+		}
+		n += int(chunk)
+		p = p[chunk:]
+		off += chunk
+	}
+	return
+}
+
+func (c *cache) readPiece(index, begin int64, p []byte, ahead bool) (err os.Error) {
+	c.mutex.Lock()
+	piece := c.pieces[index]
+	if piece != nil && piece.data != nil && piece.has(begin, int64(len(p))) {
+		copy(p, piece.data[begin:])
+		c.touch(piece)
+		c.mutex.Unlock()
+		return
+	}
+	c.mutex.Unlock()
+	if piece == nil && ahead {
+		data := make([]byte, c.pieceLen(index))
+		if err = c.read(data, index*c.pieceLength); err != nil {
+			c.report(err)
+			return
+		}
+		copy(p, data[begin:])
+		c.mutex.Lock()
+		var jobs []*diskJob
+		if c.pieces[index] == nil {
+			piece = c.newPiece(index)
+			piece.data, piece.state, piece.missing = data, piece_clean, 0
+			for i, _ := range piece.blocks {
+				piece.blocks[i] = block_memory
+			}
+			c.size += int64(len(data))
+			c.touch(piece)
+			jobs = c.evict()
+		}
+		c.mutex.Unlock()
+		for _, job := range jobs {
+			c.send(job)
+		}
+		return
+	}
+	// Read from the storage and copy the blocks in memory on top
+	if err = c.read(p, index*c.pieceLength + begin); err != nil {
+		c.report(err)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if piece = c.pieces[index]; piece == nil || piece.data == nil {
+		return
+	}
+	end := begin + int64(len(p))
+	for i, state := range piece.blocks {
+		first, last := int64(i)*CACHE_BLOCK, int64(i+1)*CACHE_BLOCK
+		if state != block_memory || last <= begin || first >= end {
+			continue
+		}
+		if first < begin {
+			first = begin
+		}
+		if last > end {
+			last = end
+		}
+		copy(p[first-begin:last-begin], piece.data[first:last])
+	}
+	return
+}
+
+// All the bytes from begin to begin+length are in data
+
+func (piece *cachedPiece) has(begin, length int64) bool {
+	for i := begin/CACHE_BLOCK; i*CACHE_BLOCK < begin+length; i++ {
+		if piece.blocks[i] != block_memory {
+			return false
+		}
+	}
+	return true
+}
+
+// Result of the hash check of a piece completed in the cache. If ok is
+// false the piece wasn't complete in the cache and it has to be checked
+// reading it.
+
+func (c *cache) checked(index int64) (err os.Error, ok bool) {
+	c.mutex.Lock()
+	if c.passed.IsSet(index) {
+		c.mutex.Unlock()
+		return nil, true
+	}
+	piece := c.pieces[index]
+	if piece == nil || piece.hashed == nil {
+		c.mutex.Unlock()
+		return nil, false
+	}
+	hashed := piece.hashed
+	c.mutex.Unlock()
+	<- hashed
+	return piece.err, true
+}
+
+// Result of a piece checked reading it, e.g. one with blocks downloaded
+// before it was started again. A good one is written, a bad one is
+// downloaded again.
+
+func (c *cache) settle(index int64, err os.Error) {
+	c.mutex.Lock()
+	piece := c.pieces[index]
+	if err != nil {
+		if piece != nil && piece.state == piece_gathering {
+			c.drop(piece)
+		}
+		c.mutex.Unlock()
+		return
+	}
+	c.passed.Set(index)
+	var job *diskJob
+	if piece != nil && piece.state == piece_gathering && !piece.flushing && piece.inMemory() {
+		piece.flushing = true
+		job = &diskJob{op: job_flush, piece: piece}
+	}
+	c.mutex.Unlock()
+	if job != nil {
+		c.send(job)
+	}
+}
+
+func (c *cache) newPiece(index int64) (piece *cachedPiece) {
+	c.drop(c.pieces[index])
+	piece = &cachedPiece{index: index, off: index*c.pieceLength, hasher: sha1.New()}
+	piece.blocks = make([]int, (c.pieceLen(index) + CACHE_BLOCK - 1) / CACHE_BLOCK)
+	piece.missing = len(piece.blocks)
+	c.pieces[index] = piece
+	return
+}
+
+// Remove a piece from the cache, the readers of its data keep it
+
+func (c *cache) drop(piece *cachedPiece) {
+	if piece == nil || c.pieces[piece.index] != piece {
+		return
+	}
+	if piece.data != nil {
+		c.size -= int64(len(piece.data))
+	}
+	c.pieces[piece.index] = nil, false
+}
+
+func (c *cache) alloc(piece *cachedPiece) {
+	if piece.data == nil {
+		piece.data = make([]byte, c.pieceLen(piece.index))
+		if c.pieces[piece.index] == piece {
+			c.size += int64(len(piece.data))
+		}
+	}
+}
+
+func (c *cache) touch(piece *cachedPiece) {
+	c.clock++
+	piece.used = c.clock
+}
+
+func (piece *cachedPiece) inDisk() bool {
+	for _, state := range piece.blocks {
+		if state == block_disk {
+			return true
+		}
+	}
+	return false
+}
+
+func (piece *cachedPiece) inMemory() bool {
+	for _, state := range piece.blocks {
+		if state == block_memory {
+			return true
+		}
+	}
+	return false
+}
+
+// Pieces in the order they are evicted: the ones on disk, the bad ones
+// and the incomplete ones, least recently used first
+
+type byEviction []*cachedPiece
+
+func (b byEviction) Len() int {
+	return len(b)
+}
+
+func (b byEviction) Less(i, j int) bool {
+	if b[i].state != b[j].state {
+		return evictionRank(b[i].state) < evictionRank(b[j].state)
+	}
+	return b[i].used < b[j].used
+}
+
+func (b byEviction) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func evictionRank(state int) int {
+	switch state {
+		case piece_clean:
+			return 0
+		case piece_failed:
+			return 1
+	}
+	return 2
+}
+
+// Free memory until the cache fits in maxSize, the incomplete pieces
+// are written to disk by the jobs returned. The complete pieces that
+// aren't written yet can't be evicted.
+
+func (c *cache) evict() (jobs []*diskJob) {
+	size := c.size
+	if size <= c.maxSize {
+		return
+	}
+	pieces := make(byEviction, 0, len(c.pieces))
+	for _, piece := range c.pieces {
+		if piece.data != nil && !piece.flushing {
+			pieces = append(pieces, piece)
+		}
+	}
+	sort.Sort(pieces)
+	for _, piece := range pieces {
+		if size <= c.maxSize {
+			break
+		}
+		switch piece.state {
+			case piece_clean, piece_failed:
+				c.drop(piece)
+				size = c.size
+			case piece_gathering:
+				piece.flushing = true
+				jobs = append(jobs, &diskJob{op: job_flush, piece: piece})
+				size -= int64(len(piece.data))
+		}
+	}
+	return
+}
+
+// Write the blocks of an incomplete piece that are in memory and free
+// its memory. Like write, it runs the pieces evicted itself.
+
+func (c *cache) flush(piece *cachedPiece) (err os.Error) {
+	c.mutex.Lock()
+	data := piece.data
+	blocks := make([]int, len(piece.blocks))
+	copy(blocks, piece.blocks)
+	c.mutex.Unlock()
+	err = c.writeBlocks(piece.off, data, blocks)
+	c.mutex.Lock()
+	piece.flushing = false
+	if err == nil {
+		for i, state := range blocks {
+			if state == block_memory && piece.blocks[i] == block_memory {
+				piece.blocks[i] = block_disk
+			}
+		}
+	}
+	if piece.state == piece_gathering && c.pieces[piece.index] == piece && piece.data != nil && !piece.inMemory() {
+		c.size -= int64(len(piece.data))
+		piece.data = nil
+	}
+	// The piece could be completed and written meanwhile, evict skipped it
+	jobs := c.evict()
+	c.mutex.Unlock()
+	if err != nil {
+		c.report(err)
+	}
+	for _, job := range jobs {
+		c.do(job)
+	}
+	return
+}
+
+// Write the blocks in memory of a piece at off, a write for each run of
+// consecutive blocks
+
+func (c *cache) writeBlocks(off int64, data []byte, blocks []int) (err os.Error) {
+	for i := 0; i < len(blocks) && err == nil; i++ {
+		if blocks[i] != block_memory {
+			continue
+		}
+		j := i
+		for j < len(blocks) && blocks[j] == block_memory {
+			j++
+		}
+		first, last := int64(i)*CACHE_BLOCK, int64(j)*CACHE_BLOCK
+		if last > int64(len(data)) {
+			last = int64(len(data))
+		}
+		_, err = c.storage.WriteAt(data[first:last], off + first)
+		i = j
+	}
+	return
+}
+
+// Hash the blocks in memory that follow the ones already hashed, the
+// caller holds the mutex, it's released while hashing. Once the piece
+// is complete the result is ready, unless some blocks were written to
+// free memory before they could be hashed: a job reads them from disk.
+
+func (c *cache) advance(piece *cachedPiece) (jobs []*diskJob) {
+	if piece.advancing {
+		// The other goroutine hashes the new blocks too
+		return
+	}
+	piece.advancing = true
+	for {
+		first, last := piece.hashedBlocks, piece.hashedBlocks
+		for last < len(piece.blocks) && piece.blocks[last] == block_memory {
+			last++
+		}
+		if last == first {
+			break
+		}
+		data := piece.data[first*CACHE_BLOCK:]
+		if end := (last - first)*CACHE_BLOCK; end < len(data) {
+			data = data[0:end]
+		}
+		c.mutex.Unlock()
+		piece.hasher.Write(data)
+		c.mutex.Lock()
+		piece.hashedBlocks = last
+	}
+	piece.advancing = false
+	if piece.state != piece_gathering || piece.missing > 0 {
+		return
+	}
+	piece.state = piece_hashing
+	piece.hashed = make(chan bool)
+	if piece.hashedBlocks < len(piece.blocks) {
+		return []*diskJob{&diskJob{op: job_hash, piece: piece}}
+	}
+	if job := c.result(piece, c.compare(piece)); job != nil {
+		jobs = append(jobs, job)
+	}
+	return
+}
+
+// Hash the blocks of a complete piece that were written to disk before
+// they could be hashed
+
+func (c *cache) hash(piece *cachedPiece) {
+	c.mutex.Lock()
+	c.alloc(piece)
+	data, first := piece.data, piece.hashedBlocks
+	blocks := make([]int, len(piece.blocks))
+	copy(blocks, piece.blocks)
+	c.mutex.Unlock()
+	var err, readErr os.Error
+	for i := first; i < len(blocks); i++ {
+		if blocks[i] != block_disk {
+			continue
+		}
+		begin, end := int64(i)*CACHE_BLOCK, int64(i+1)*CACHE_BLOCK
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if _, readErr = c.storage.ReadAt(data[begin:end], piece.off + begin); readErr != nil {
+			break
+		}
+	}
+	if err = readErr; err == nil {
+		piece.hasher.Write(data[first*CACHE_BLOCK:])
+		err = c.compare(piece)
+	}
+	c.mutex.Lock()
+	job := c.result(piece, err)
+	c.mutex.Unlock()
+	if readErr != nil {
+		c.report(readErr)
+	}
+	if job != nil {
+		c.write(piece)
+	}
+}
+
+func (c *cache) compare(piece *cachedPiece) (os.Error) {
+	base := piece.index * sha1.Size
+	if !bytes.Equal([]byte(c.hashes[base:base+sha1.Size]), piece.hasher.Sum()) {
+		return os.NewError("Piece hash doesn't match")
+	}
+	return nil
+}
+
+// Set the result of the hash check of a piece, the caller holds the
+// mutex. A good piece has to be written by the job returned.
+
+func (c *cache) result(piece *cachedPiece, err os.Error) (job *diskJob) {
+	piece.err = err
+	if err == nil {
+		piece.state = piece_dirty
+		c.passed.Set(piece.index)
+		job = &diskJob{op: job_write, piece: piece}
+	} else {
+		piece.state = piece_failed
+	}
+	close(piece.hashed)
+	return
+}
+
+// Write the blocks of a dirty piece that are in memory, with a single
+// write if all of them are. If it fails it stays in memory until Flush
+// writes it. It runs in the workers, so the pieces evicted are written
+// here: waiting for a worker in a full queue could wait for ourselves.
+
+func (c *cache) write(piece *cachedPiece) (err os.Error) {
+	c.mutex.Lock()
+	data := piece.data
+	blocks := make([]int, len(piece.blocks))
+	copy(blocks, piece.blocks)
+	c.mutex.Unlock()
+	if err = c.writeBlocks(piece.off, data, blocks); err != nil {
+		c.report(err)
+		return
+	}
+	c.mutex.Lock()
+	if piece.state == piece_dirty {
+		piece.state = piece_clean
+		if piece.inDisk() {
+			// Only the blocks in memory are the same as on disk
+			c.drop(piece)
+		}
+	}
+	jobs := c.evict()
+	c.mutex.Unlock()
+	for _, job := range jobs {
+		c.do(job)
+	}
+	return
+}
+
+// Write everything in memory, waiting for the pieces being hashed
+
+func (c *cache) Flush() (err os.Error) {
+	c.mutex.Lock()
+	pieces := make([]*cachedPiece, 0, len(c.pieces))
+	hashed := make([]chan bool, 0, len(c.pieces))
+	for _, piece := range c.pieces {
+		pieces = append(pieces, piece)
+		hashed = append(hashed, piece.hashed)
+	}
+	c.mutex.Unlock()
+	for i, piece := range pieces {
+		if hashed[i] != nil {
+			<- hashed[i]
+		}
+		c.mutex.Lock()
+		state, inMemory := piece.state, piece.inMemory()
+		c.mutex.Unlock()
+		var e os.Error
+		switch {
+			case state == piece_dirty:
+				e = c.write(piece)
+			case state == piece_gathering && inMemory:
+				e = c.flush(piece)
+		}
+		if e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Flush and stop the workers
+
+func (c *cache) Close() (err os.Error) {
+	err = c.Flush()
+	c.mutex.Lock()
+	select {
+		case <- c.quit:
+			c.mutex.Unlock()
+			return
+		default:
+			close(c.quit)
+	}
+	c.mutex.Unlock()
+	for i := 0; i < DISK_WORKERS; i++ {
+		<- c.workers
+	}
+	return
+}
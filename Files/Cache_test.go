@@ -0,0 +1,439 @@
+package files
+
+import(
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"rand"
+	"sync"
+	"testing"
+	"wgo/bencode"
+	)
+
+const(
+	BENCH_PIECE_LENGTH = 256*1024
+	BENCH_PIECES = 64
+	BENCH_PEERS = 4
+)
+
+// Torrent of random data, the seeder keeps it in memory
+
+func benchTorrent() (info *bencode.InfoDict, seeder Files) {
+	data := make([]byte, BENCH_PIECE_LENGTH*BENCH_PIECES)
+	for i, _ := range data {
+		data[i] = byte(rand.Int())
+	}
+	hashes := make([]byte, 0, BENCH_PIECES*sha1.Size)
+	for i := 0; i < BENCH_PIECES; i++ {
+		hasher := sha1.New()
+		hasher.Write(data[i*BENCH_PIECE_LENGTH:(i+1)*BENCH_PIECE_LENGTH])
+		hashes = append(hashes, hasher.Sum()...)
+	}
+	info = &bencode.InfoDict{Name: "wgo_bench", Piece_length: BENCH_PIECE_LENGTH, Pieces: string(hashes), Length: int64(len(data))}
+	seeder, _, err := NewStorageFiles(info, "", nil, NewMemStorage)
+	must(err)
+	for i := int64(0); i < BENCH_PIECES; i++ {
+		for begin := int64(0); begin < BENCH_PIECE_LENGTH; begin += CACHE_BLOCK {
+			off := i*BENCH_PIECE_LENGTH + begin
+			must(seeder.WriteAt(i, begin, data[off:off+CACHE_BLOCK]))
+		}
+	}
+	return
+}
+
+func must(err os.Error) {
+	if err != nil {
+		panic(err.String())
+	}
+}
+
+func must2(n int, err os.Error) {
+	must(err)
+}
+
+// Cache over a MemStorage of random data, with pieces of
+// 4*CACHE_BLOCK and a last piece shorter than a block
+
+const(
+	TEST_PIECE_LENGTH = 4*CACHE_BLOCK
+	TEST_LENGTH = 5*TEST_PIECE_LENGTH + 1000
+)
+
+func testCache() (c *cache, data []byte, storage Storage) {
+	data = make([]byte, TEST_LENGTH)
+	for i, _ := range data {
+		data[i] = byte(rand.Int())
+	}
+	hashes := make([]byte, 0)
+	for off := 0; off < len(data); off += TEST_PIECE_LENGTH {
+		end := off + TEST_PIECE_LENGTH
+		if end > len(data) {
+			end = len(data)
+		}
+		hasher := sha1.New()
+		hasher.Write(data[off:end])
+		hashes = append(hashes, hasher.Sum()...)
+	}
+	storage, err := NewMemStorage(&bencode.InfoDict{Length: TEST_LENGTH}, "", nil)
+	must(err)
+	return newCache(storage, TEST_PIECE_LENGTH, TEST_LENGTH, string(hashes)), data, storage
+}
+
+// Write the blocks of a piece in the order of blocks, the ones past the
+// end of the torrent are skipped
+
+func writeBlocks(t *testing.T, c *cache, data []byte, index int64, blocks []int64) {
+	for _, block := range blocks {
+		begin := index*TEST_PIECE_LENGTH + block*CACHE_BLOCK
+		end := begin + CACHE_BLOCK
+		if begin >= int64(len(data)) {
+			// Past the end of the last piece
+			continue
+		}
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if err := c.WriteAt(index, block*CACHE_BLOCK, data[begin:end]); err != nil {
+			t.Fatalf("Writing block %d of piece %d: %v", block, index, err)
+		}
+	}
+}
+
+func checkStorage(t *testing.T, storage Storage, data []byte) {
+	stored := make([]byte, len(data))
+	if _, err := storage.ReadAt(stored, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Errorf("The storage doesn't have the data")
+	}
+}
+
+func TestCacheOutOfOrder(t *testing.T) {
+	c, data, storage := testCache()
+	writeBlocks(t, c, data, 0, []int64{3, 1, 0, 2})
+	writeBlocks(t, c, data, 1, []int64{0, 1, 2, 3})
+	writeBlocks(t, c, data, 5, []int64{0})
+	for _, index := range []int64{0, 1, 5} {
+		if err, ok := c.checked(index); !ok || err != nil {
+			t.Errorf("Piece %d: checked %v, %v", index, ok, err)
+		}
+	}
+	if _, ok := c.checked(2); ok {
+		t.Errorf("Piece 2 checked without any block")
+	}
+	if err := c.WriteAt(0, 100, data[100:200]); err == nil {
+		t.Errorf("Accepted a block not aligned")
+	}
+	must(c.Close())
+	expected := make([]byte, len(data))
+	copy(expected, data[0:2*TEST_PIECE_LENGTH])
+	copy(expected[5*TEST_PIECE_LENGTH:], data[5*TEST_PIECE_LENGTH:])
+	checkStorage(t, storage, expected)
+}
+
+func TestCacheDuplicate(t *testing.T) {
+	c, data, storage := testCache()
+	bad := make([]byte, CACHE_BLOCK)
+	// The first copy of a block is kept
+	writeBlocks(t, c, data, 0, []int64{0, 1})
+	must(c.WriteAt(0, 0, bad))
+	writeBlocks(t, c, data, 0, []int64{2, 3})
+	if err, ok := c.checked(0); !ok || err != nil {
+		t.Errorf("Piece 0 with a duplicate block: checked %v, %v", ok, err)
+	}
+	// Blocks of pieces that passed are from the end game
+	must(c.WriteAt(0, 0, bad))
+	must(c.WriteAt(1, 0, bad))
+	writeBlocks(t, c, data, 1, []int64{0, 1, 2, 3})
+	if err, ok := c.checked(1); !ok || err == nil {
+		t.Errorf("Piece 1 with a bad first copy: checked %v, %v", ok, err)
+	}
+	// The failed piece is downloaded again
+	writeBlocks(t, c, data, 1, []int64{0, 1, 2, 3})
+	if err, ok := c.checked(1); !ok || err != nil {
+		t.Errorf("Piece 1 downloaded again: checked %v, %v", ok, err)
+	}
+	must(c.Close())
+	stored := make([]byte, 2*TEST_PIECE_LENGTH)
+	must2(storage.ReadAt(stored, 0))
+	if !bytes.Equal(stored, data[0:2*TEST_PIECE_LENGTH]) {
+		t.Errorf("The storage doesn't have the good pieces")
+	}
+}
+
+// Without memory the blocks go to disk before they can be hashed, and
+// the complete piece is hashed reading them
+
+func TestCacheEvictGathering(t *testing.T) {
+	c, data, storage := testCache()
+	c.SetSize(0)
+	writeBlocks(t, c, data, 2, []int64{1, 2, 3})
+	writeBlocks(t, c, data, 3, []int64{0, 1})
+	writeBlocks(t, c, data, 2, []int64{0})
+	writeBlocks(t, c, data, 3, []int64{3, 2})
+	for _, index := range []int64{2, 3} {
+		if err, ok := c.checked(index); !ok || err != nil {
+			t.Errorf("Piece %d: checked %v, %v", index, ok, err)
+		}
+	}
+	// The workers are done once it's closed
+	must(c.Close())
+	if c.size != 0 {
+		t.Errorf("%d bytes in memory with a cache of 0", c.size)
+	}
+	stored := make([]byte, 2*TEST_PIECE_LENGTH)
+	must2(storage.ReadAt(stored, 2*TEST_PIECE_LENGTH))
+	if !bytes.Equal(stored, data[2*TEST_PIECE_LENGTH:4*TEST_PIECE_LENGTH]) {
+		t.Errorf("The storage doesn't have the pieces")
+	}
+}
+
+// Pieces with blocks from a previous run aren't complete in the cache,
+// Files checks them reading them and settles the result
+
+func TestCacheSettle(t *testing.T) {
+	c, data, storage := testCache()
+	must2(storage.WriteAt(data[0:2*CACHE_BLOCK], 0))
+	writeBlocks(t, c, data, 0, []int64{2, 3})
+	if _, ok := c.checked(0); ok {
+		t.Fatalf("Piece 0 checked with blocks only on disk")
+	}
+	read := make([]byte, TEST_PIECE_LENGTH)
+	must2(c.ReadAt(read, 0))
+	if !bytes.Equal(read, data[0:TEST_PIECE_LENGTH]) {
+		t.Errorf("Read doesn't have the blocks of the disk and the memory")
+	}
+	c.settle(0, nil)
+	if err, ok := c.checked(0); !ok || err != nil {
+		t.Errorf("Settled piece: checked %v, %v", ok, err)
+	}
+	// A bad one is dropped and downloaded again
+	writeBlocks(t, c, data, 1, []int64{2, 3})
+	c.settle(1, os.NewError("Piece hash doesn't match"))
+	if _, ok := c.checked(1); ok {
+		t.Errorf("Bad piece still in the cache")
+	}
+	must(c.Close())
+	stored := make([]byte, 2*TEST_PIECE_LENGTH)
+	must2(storage.ReadAt(stored, 0))
+	if !bytes.Equal(stored[0:TEST_PIECE_LENGTH], data[0:TEST_PIECE_LENGTH]) {
+		t.Errorf("The settled piece wasn't written")
+	}
+	if !bytes.Equal(stored[TEST_PIECE_LENGTH:], make([]byte, TEST_PIECE_LENGTH)) {
+		t.Errorf("The bad piece was written")
+	}
+}
+
+// Storage that fails the writes while full is set
+
+type fullStorage struct {
+	Storage
+	mutex *sync.Mutex
+	full bool
+}
+
+func (s *fullStorage) WriteAt(p []byte, off int64) (n int, err os.Error) {
+	s.mutex.Lock()
+	full := s.full
+	s.mutex.Unlock()
+	if full {
+		return 0, os.NewError("Disk full")
+	}
+	return s.Storage.WriteAt(p, off)
+}
+
+func TestCacheDiskError(t *testing.T) {
+	c, data, storage := testCache()
+	fs := &fullStorage{storage, new(sync.Mutex), true}
+	c.storage = fs
+	errs := make(chan os.Error, 16)
+	c.SetErrorHandler(func(err os.Error) {
+		errs <- err
+	})
+	writeBlocks(t, c, data, 0, []int64{0, 1, 2, 3})
+	if err, ok := c.checked(0); !ok || err != nil {
+		t.Errorf("Piece 0: checked %v, %v", ok, err)
+	}
+	if err := <- errs; err == nil {
+		t.Errorf("No disk error reported")
+	}
+	// The piece is kept in memory until it can be written
+	if err := c.Flush(); err == nil {
+		t.Errorf("Flush didn't fail")
+	}
+	read := make([]byte, TEST_PIECE_LENGTH)
+	must2(c.ReadAt(read, 0))
+	if !bytes.Equal(read, data[0:TEST_PIECE_LENGTH]) {
+		t.Errorf("The piece that couldn't be written was lost")
+	}
+	fs.mutex.Lock()
+	fs.full = false
+	fs.mutex.Unlock()
+	must(c.Close())
+	stored := make([]byte, TEST_PIECE_LENGTH)
+	must2(storage.ReadAt(stored, 0))
+	if !bytes.Equal(stored, data[0:TEST_PIECE_LENGTH]) {
+		t.Errorf("The piece wasn't written once the disk had room")
+	}
+}
+
+// Pieces written and evicted at the same time by several peers, with a
+// queue smaller than the pieces evicted by each write
+
+func TestCacheConcurrent(t *testing.T) {
+	for _, size := range []int64{0, TEST_PIECE_LENGTH, DEFAULT_CACHE_SIZE} {
+		c, data, storage := testCache()
+		c.SetSize(size)
+		done := make(chan bool)
+		for peer := int64(0); peer < 3; peer++ {
+			go func(peer int64) {
+				for index := peer; index*TEST_PIECE_LENGTH < TEST_LENGTH; index += 3 {
+					writeBlocks(t, c, data, index, []int64{3, 0, 2, 1})
+				}
+				done <- true
+			}(peer)
+		}
+		for peer := 0; peer < 3; peer++ {
+			<- done
+		}
+		for index := int64(0); index*TEST_PIECE_LENGTH < TEST_LENGTH; index++ {
+			if err, ok := c.checked(index); !ok || err != nil {
+				t.Errorf("Cache of %d bytes, piece %d: checked %v, %v", size, index, ok, err)
+			}
+		}
+		must(c.Close())
+		must(c.Close())
+		checkStorage(t, storage, data)
+	}
+}
+
+// Send the pieces of a peer to conn, a header with the index and begin
+// before each block. The blocks of the odd pieces go backwards so they
+// arrive out of order.
+
+func seed(seeder Files, conn net.Conn, peer int) {
+	defer conn.Close()
+	header := make([]byte, 8)
+	for i := int64(peer); i < BENCH_PIECES; i += BENCH_PEERS {
+		for n := int64(0); n < BENCH_PIECE_LENGTH/CACHE_BLOCK; n++ {
+			begin := n*CACHE_BLOCK
+			if i%2 == 1 {
+				begin = BENCH_PIECE_LENGTH - (n+1)*CACHE_BLOCK
+			}
+			binary.BigEndian.PutUint32(header[0:4], uint32(i))
+			binary.BigEndian.PutUint32(header[4:8], uint32(begin))
+			if _, err := conn.Write(header); err != nil {
+				return
+			}
+			if _, err := io.Copy(conn, seeder.GetReaderAt(i, begin, CACHE_BLOCK)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Receive the blocks of conn, calling check once all the blocks of a
+// piece are saved
+
+func leech(fs *fileStore, conn net.Conn, save func(fs *fileStore, index, begin int64, block []byte) os.Error, check func(fs *fileStore, index int64) os.Error) (err os.Error) {
+	defer conn.Close()
+	header := make([]byte, 8)
+	block := make([]byte, CACHE_BLOCK)
+	received := make(map[int64]int)
+	for {
+		if _, err = io.ReadFull(conn, header); err == os.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, block); err != nil {
+			return
+		}
+		index := int64(binary.BigEndian.Uint32(header[0:4]))
+		if err = save(fs, index, int64(binary.BigEndian.Uint32(header[4:8])), block); err != nil {
+			return
+		}
+		if received[index]++; received[index] == BENCH_PIECE_LENGTH/CACHE_BLOCK {
+			if err = check(fs, index); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Download the torrent from BENCH_PEERS seeders over loopback
+// connections to files in the temporary folder
+
+func benchmarkSwarm(b *testing.B, save func(fs *fileStore, index, begin int64, block []byte) os.Error, check func(fs *fileStore, index int64) os.Error) {
+	b.StopTimer()
+	info, seeder := benchTorrent()
+	defer seeder.Close()
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	must(err)
+	defer l.Close()
+	b.SetBytes(BENCH_PIECE_LENGTH*BENCH_PIECES)
+	for i := 0; i < b.N; i++ {
+		leecher, _, err := NewStorageFiles(info, os.TempDir(), nil, NewFileStorage)
+		must(err)
+		start := make(chan bool)
+		for peer := 0; peer < BENCH_PEERS; peer++ {
+			go func(peer int) {
+				conn, err := l.Accept()
+				must(err)
+				<- start
+				seed(seeder, conn, peer)
+			}(peer)
+		}
+		done := make(chan os.Error, BENCH_PEERS)
+		for peer := 0; peer < BENCH_PEERS; peer++ {
+			conn, err := net.Dial("tcp4", "", l.Addr().String())
+			must(err)
+			go func() {
+				done <- leech(leecher.(*fileStore), conn, save, check)
+			}()
+		}
+		b.StartTimer()
+		close(start)
+		for peer := 0; peer < BENCH_PEERS; peer++ {
+			must(<- done)
+		}
+		must(leecher.Close())
+		b.StopTimer()
+		must(leecher.Remove())
+	}
+}
+
+// Before the cache: each block is written to the files, and the piece
+// is read back from them to hash it
+
+func BenchmarkSwarmRehash(b *testing.B) {
+	benchmarkSwarm(b, func(fs *fileStore, index, begin int64, block []byte) os.Error {
+		_, err := fs.storage.WriteAt(block, index*BENCH_PIECE_LENGTH + begin)
+		return err
+	}, func(fs *fileStore, index int64) os.Error {
+		hasher := sha1.New()
+		if _, err := io.Copy(hasher, io.NewSectionReader(fs.storage, index*BENCH_PIECE_LENGTH, BENCH_PIECE_LENGTH)); err != nil {
+			return err
+		}
+		if !bytes.Equal(hasher.Sum(), []byte(fs.info.Pieces[index*sha1.Size:(index+1)*sha1.Size])) {
+			return os.NewError("Piece hash doesn't match")
+		}
+		return nil
+	})
+}
+
+// With the cache: the blocks are hashed as they arrive, and the piece
+// is written once
+
+func BenchmarkSwarmIncremental(b *testing.B) {
+	benchmarkSwarm(b, func(fs *fileStore, index, begin int64, block []byte) os.Error {
+		return fs.WriteAt(index, begin, block)
+	}, func(fs *fileStore, index int64) os.Error {
+		return fs.CheckPiece(index)
+	})
+}
@@ -0,0 +1,332 @@
+// Layout of the files of a torrent in the FS, each file of the torrent
+// in its own file
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"os"
+	"strings"
+	"log"
+	"sync"
+	"wgo/bencode"
+	)
+
+var errStorageClosed = os.NewError("Storage closed")
+
+type fileEntry struct {
+	length int64
+	fd     *os.File
+	name   string
+	priority int
+}
+
+// The files of the torrent in dir, as described in the info dictionary
+
+type fileStorage struct {
+	// Protects the fds, skipped files are opened when they are written
+	mutex *sync.RWMutex
+	offsets []int64
+	files   []fileEntry // Stored in increasing globalOffset order
+	// Folder of a multi file torrent, empty for single file torrents
+	dir string
+	// Set by Close, the files aren't read or created anymore
+	closed bool
+}
+
+// Open the files of the torrent in fileDir, the skipped ones are only
+// opened if they already exist
+
+func NewFileStorage(info *bencode.InfoDict, fileDir string, priorities []int) (s Storage, err os.Error) {
+	fs := new(fileStorage)
+	fs.mutex = new(sync.RWMutex)
+	numFiles := len(info.Files)
+	if numFiles == 0 {
+		// Create dummy Files structure.
+		info = &bencode.InfoDict{Files: []bencode.FileDict{bencode.FileDict{Length: info.Length, Path: []string{info.Name}, Md5sum: info.Md5sum}}}
+		numFiles = 1
+	} else {
+		fileDir = fileDir + "/" + info.Name
+		fs.dir = fileDir
+	}
+	log.Println("Files -> Number of files:", numFiles)
+	fs.files = make([]fileEntry, numFiles)
+	fs.offsets = make([]int64, numFiles)
+	totalSize := int64(0)
+	for i, _ := range (info.Files) {
+		src := &info.Files[i]
+		fs.files[i].priority = PRIORITY_NORMAL
+		if priorities != nil {
+			fs.files[i].priority = priorities[i]
+		}
+		//log.Println("Files ->", src.Path)
+		torrentPath, err := joinPath(src.Path)
+		if err != nil {
+			log.Println("Files ->",err)
+			fs.Close()
+			return nil, err
+		}
+		fullPath := fileDir + "/" + torrentPath
+		//log.Println("Files -> Fullpath:", fullPath)
+		err = fs.files[i].open(fullPath, src.Length)
+		if err != nil {
+			log.Println("Files ->",err)
+			fs.Close()
+			return nil, err
+		}
+		fs.offsets[i] = totalSize
+		totalSize += src.Length
+	}
+	return fs, nil
+}
+
+func (fe *fileEntry) open(name string, length int64) (err os.Error) {
+	fe.length = length
+	fe.name = name
+	if fe.priority == PRIORITY_SKIP {
+		// Only use what was already downloaded
+		if fe.fd, err = os.Open(name, os.O_RDWR, FILE_PERM); err != nil {
+			fe.fd = nil
+			return nil
+		}
+		return
+	}
+	if err = ensureDirectory(name); err != nil {
+		return
+	}
+	fe.fd, err = os.Open(name, os.O_RDWR|os.O_CREAT, FILE_PERM)
+	if err != nil {
+		return
+	}
+	// Truncating changes the modification time, don't do it if the size
+	// is already the right one or the fast resume data won't be used
+	fi, err := fe.fd.Stat()
+	if err != nil || fi.Size == length {
+		return
+	}
+	if err = fe.fd.Truncate(length); err != nil {
+		return
+	}
+	return
+}
+
+// Read from the logical concatenation of the files, the files not
+// created yet read as zeros
+
+func (fs *fileStorage) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	if fs.closed {
+		return 0, errStorageClosed
+	}
+	for index := findOffset(fs.offsets, off); len(p) > 0 && index < len(fs.offsets); index++ {
+		chunk := int64(len(p))
+		entry := &fs.files[index]
+		itemOffset := off - fs.offsets[index]
+		if itemOffset >= entry.length {
+			continue
+		}
+		space := entry.length - itemOffset
+		if space < chunk {
+			chunk = space
+		}
+		nThisTime := 0
+		if entry.fd != nil {
+			nThisTime, err = entry.fd.ReadAt(p[0:chunk], itemOffset)
+			if err != nil && err != os.EOF {
+				n += nThisTime
+				return
+			}
+			err = nil
+		}
+		// Skipped files are sparse or missing
+		for i := int64(nThisTime); i < chunk; i++ {
+			p[i] = 0
+		}
+		n += int(chunk)
+		p = p[chunk:]
+		off += chunk
+	}
+	// At this point if there's anything left to read it means we've run off the
+	// end of the file store. Read zeros. This is defined by the bittorrent protocol.
+	for i, _ := range (p) {
+		p[i] = 0
+		n++
+	}
+	return
+}
+
+func (fs *fileStorage) WriteAt(p []byte, off int64) (n int, err os.Error) {
+	for index := findOffset(fs.offsets, off); len(p) > 0 && index < len(fs.offsets); index++ {
+		chunk := int64(len(p))
+		entry := &fs.files[index]
+		itemOffset := off - fs.offsets[index]
+		if itemOffset >= entry.length {
+			continue
+		}
+		space := entry.length - itemOffset
+		if space < chunk {
+			chunk = space
+		}
+		fd, err := fs.fd(index)
+		if err != nil {
+			return n, err
+		}
+		nThisTime, err := fd.WriteAt(p[0:chunk], itemOffset)
+		n += nThisTime
+		if err != nil {
+			return n, err
+		}
+		p = p[nThisTime:]
+		off += int64(nThisTime)
+	}
+	// At this point if there's anything left to write it means we've run off the
+	// end of the file store. Check that the data is zeros.
+	// This is defined by the bittorrent protocol.
+	for i, _ := range (p) {
+		if p[i] != 0 {
+			err = os.NewError("Unexpected non-zero data at end of store.")
+			n = n + i
+			return
+		}
+	}
+	n = n + len(p)
+	return
+}
+
+// File descriptor of a file, a skipped file is created the first time
+// it's written, without allocating it. Once closed nothing is created.
+
+func (fs *fileStorage) fd(index int) (fd *os.File, err os.Error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.closed {
+		return nil, errStorageClosed
+	}
+	entry := &fs.files[index]
+	if entry.fd == nil {
+		if err = ensureDirectory(entry.name); err != nil {
+			return
+		}
+		if entry.fd, err = os.Open(entry.name, os.O_RDWR|os.O_CREAT, FILE_PERM); err != nil {
+			return
+		}
+	}
+	return entry.fd, nil
+}
+
+// A skipped file is created and allocated when it's wanted
+
+func (fs *fileStorage) SetPriority(file, priority int) (err os.Error) {
+	fs.mutex.Lock()
+	fs.files[file].priority = priority
+	fs.mutex.Unlock()
+	if priority == PRIORITY_SKIP {
+		return
+	}
+	fd, err := fs.fd(file)
+	if err != nil {
+		return
+	}
+	fi, err := fd.Stat()
+	if err != nil || fi.Size == fs.files[file].length {
+		return
+	}
+	return fd.Truncate(fs.files[file].length)
+}
+
+// Size and modification time of the files, they can be closed. Skipped
+// files that weren't created have an empty state.
+
+func (fs *fileStorage) States() (states []FileState, err os.Error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	states = make([]FileState, len(fs.files))
+	for i, file := range fs.files {
+		fi, err := os.Stat(file.name)
+		if err != nil && file.priority == PRIORITY_SKIP {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		states[i] = FileState{fi.Size, fi.Mtime_ns}
+	}
+	return
+}
+
+// Flush and close all the files in the torrent
+
+func (fs *fileStorage) Close() (err os.Error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.closed = true
+	for i, _ := range (fs.files) {
+		fd := fs.files[i].fd
+		if fd != nil {
+			if e := fd.Sync(); e != nil {
+				err = e
+			}
+			fd.Close()
+			fs.files[i].fd = nil
+		}
+	}
+	return
+}
+
+// Close and delete the files of the torrent, and the folders left empty
+
+func (fs *fileStorage) Remove() (err os.Error) {
+	fs.Close()
+	for _, file := range (fs.files) {
+		if _, e := os.Stat(file.name); e != nil && file.priority == PRIORITY_SKIP {
+			// Never created
+			continue
+		}
+		if e := os.Remove(file.name); e != nil {
+			err = e
+		}
+		if len(fs.dir) == 0 {
+			continue
+		}
+		for dir := file.name; len(dir) > len(fs.dir) && strings.HasPrefix(dir, fs.dir); {
+			dir = dir[0:strings.LastIndex(dir, "/")]
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return
+}
+
+// Check that the parts of the path are correct
+func joinPath(parts []string) (path string, err os.Error) {
+	// TODO: better, OS-specific sanitization.
+	for key, part := range (parts) {
+		// Sanitize file names.
+		if strings.Index(part, "/") >= 0 || strings.Index(part, "\\") >= 0 || part == ".." {
+			err = os.NewError("Bad path part " + part)
+			return
+		}
+		// Remove tailing and leading spaces
+		if strings.HasPrefix(part, " ") || strings.HasSuffix(part, " ") {
+			parts[key] = strings.TrimSpace(part)
+		}
+	}
+
+	path = strings.Join(parts, "/")
+	return
+}
+
+// Create the appropiate folders (if needed)
+func ensureDirectory(fullPath string) (err os.Error) {
+	pathParts := strings.Split(fullPath, "/", 0)
+	if len(pathParts) < 2 {
+		return
+	}
+	dirParts := pathParts[0 : len(pathParts)-1]
+	path := strings.Join(dirParts, "/")
+	err = os.MkdirAll(path, FOLDER_PERM)
+	return
+}
@@ -8,12 +8,10 @@ package files
 import(
 	"io"
 	"os"
-	"strings"
 	"log"
 	"crypto/sha1"
 	"bytes"
 	"wgo/bencode"
-	"wgo/wgo_io"
 	"wgo/bit_field"
 	"sync"
 	)
@@ -24,6 +22,16 @@ const(
 	checkpiece
 )
 
+// Download priority of a file, skipped files aren't created unless a
+// piece they share with another file is downloaded
+
+const(
+	PRIORITY_SKIP = iota
+	PRIORITY_LOW
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
 const(
 	FILE_PERM = 0666
 	FOLDER_PERM = 0755
@@ -34,21 +42,55 @@ type Files interface {
 	GetReaderAt(index, begin, length int64) (io.Reader)
 	WriteAt(index, begin int64, bytes []byte) (os.Error)
 	CheckPiece(index int64) (os.Error)
+	// Like CheckPiece, done is called with the result from another
+	// goroutine so the caller doesn't wait for the disk
+	HashPiece(index int64, done func(os.Error))
 	CheckPieces() (left int64, bf *bit_field.Bitfield, err os.Error)
+	CheckPiecesResume(have *bit_field.Bitfield, states []FileState) (left int64, bf *bit_field.Bitfield, err os.Error)
+	States() (states []FileState, err os.Error)
+	Priorities() []int
+	SetPriority(file, priority int) (os.Error)
+	PiecePriorities() []int
+	// Write the data in the cache
+	Flush() (os.Error)
+	SetCacheSize(size int64)
+	// Called when the data can't be read or written, e.g. the disk is
+	// full. Data not written stays in the cache until the next Flush.
+	SetErrorHandler(f func(os.Error))
+	Close() (os.Error)
+	Remove() (os.Error)
 }
 
-type fileEntry struct {
-	length int64
-	fd     *os.File
+// Size and modification time (ns) of a file, used to know if it changed
+// since the fast resume data was saved
+
+type FileState struct {
+	Size, Mtime int64
 }
 
+func SameStates(a, b []FileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, _ := range a {
+		if a[i].Size != b[i].Size || a[i].Mtime != b[i].Mtime {
+			return false
+		}
+	}
+	return true
+}
+
+// Pieces of a torrent on top of a Storage
+
 type fileStore struct {
 	mutex *sync.Mutex
+	lengths []int64
 	offsets []int64
 	totalLength int64
-	files   []fileEntry // Stored in increasing globalOffset order
+	priorities []int
 	info *bencode.InfoDict
-	reader io.ReaderAt 
+	storage Storage
+	cache *cache
 }
 
 type CheckPiece struct {
@@ -58,158 +100,170 @@ type CheckPiece struct {
 }
 
 func (fe *fileStore) GetReaderAt(index, begin, length int64) (reader io.Reader) {
-	fe.mutex.Lock()
-	defer fe.mutex.Unlock()
 	globalOffset := index*fe.info.Piece_length + begin
-	return io.NewSectionReader(fe.reader, globalOffset, length)
+	return io.NewSectionReader(readAhead{fe.cache}, globalOffset, length)
 }
 
-func (fe *fileStore) WriteAt(indexp, begin int64, bytes []byte) (err os.Error){
-	fe.mutex.Lock()
-	defer fe.mutex.Unlock()
-	var n int
-	off := indexp*fe.info.Piece_length + begin
-	//_, err = fe.writeAt(bytes, globalOffset)
-	index := fe.find(off)
-	for len(bytes) > 0 && index < len(fe.offsets) {
-		chunk := int64(len(bytes))
-		entry := &fe.files[index]
-		itemOffset := int64(off - fe.offsets[index])
-		if itemOffset < entry.length {
-			space := int64(entry.length - itemOffset)
-			if space < chunk {
-				chunk = space
-			}
-			fd := entry.fd
-			nThisTime, err := fd.WriteAt(bytes[0:chunk], itemOffset)
-			n += nThisTime
-			if err != nil {
-				return
-			}
-			bytes = bytes[nThisTime:]
-			off += int64(nThisTime)
-		}
-		index++
-	}
-	// At this point if there's anything left to write it means we've run off the
-	// end of the file store. Check that the data is zeros.
-	// This is defined by the bittorrent protocol.
-	for i, _ := range (bytes) {
-		if bytes[i] != 0 {
-			err = os.NewError("Unexpected non-zero data at end of store.")
-			n = n + i
-			return
-		}
-	}
-	n = n + len(bytes)
-	return
+// The block is copied to the cache, the errors writing it are given to
+// the error handler
+
+func (fe *fileStore) WriteAt(index, begin int64, bytes []byte) (err os.Error){
+	return fe.cache.WriteAt(index, begin, bytes)
 }
 
+// Pieces complete in the cache are already hashed, the others are read
+
 func (fe *fileStore) CheckPiece(index int64) (os.Error) {
-	fe.mutex.Lock()
-	defer fe.mutex.Unlock()
-	return fe.checkPiece(index)
+	if err, ok := fe.cache.checked(index); ok {
+		return err
+	}
+	err := fe.checkPiece(index)
+	fe.cache.settle(index, err)
+	return err
 }
 
-func (fe *fileEntry) open(name string, length int64) (err os.Error) {
-	fe.length = length
-	fe.fd, err = os.Open(name, os.O_RDWR|os.O_CREAT, FILE_PERM)
-	if err != nil {
-		return
-	}
-	if err = fe.fd.Truncate(length); err != nil {
-		return
-	}
-	return
+func (fe *fileStore) HashPiece(index int64, done func(os.Error)) {
+	go func() {
+		done(fe.CheckPiece(index))
+	}()
 }
 
-func NewFiles(info *bencode.InfoDict, fileDir string) (f Files, totalSize int64, err os.Error) {
+// Open the files of the torrent in fileDir with the priority of each
+// one, nil means PRIORITY_NORMAL for all of them
+
+func NewFiles(info *bencode.InfoDict, fileDir string, priorities []int) (f Files, totalSize int64, err os.Error) {
+	return NewStorageFiles(info, fileDir, priorities, NewFileStorage)
+}
+
+// Like NewFiles, keeping the data in the Storage created by newStorage,
+// nil means NewFileStorage
+
+func NewStorageFiles(info *bencode.InfoDict, fileDir string, priorities []int, newStorage StorageFactory) (f Files, totalSize int64, err os.Error) {
 	fs := new(fileStore)
 	fs.mutex = new(sync.Mutex)
 	fs.info = info
-	//log.Println(info)
-	numFiles := len(info.Files)
-	if numFiles == 0 {
-		// Create dummy Files structure.
-		info = &bencode.InfoDict{Files: []bencode.FileDict{bencode.FileDict{Length: info.Length, Path: []string{info.Name}, Md5sum: info.Md5sum}}}
-		numFiles = 1
-	} else {
-		fileDir = fileDir + "/" + info.Name
+	fs.lengths, fs.offsets, fs.totalLength = layout(info)
+	if priorities != nil && len(priorities) != len(fs.lengths) {
+		return nil, 0, os.NewError("Wrong number of file priorities")
 	}
-	log.Println("Files -> Number of files:", numFiles)
-	fs.files = make([]fileEntry, numFiles)
-	fs.offsets = make([]int64, numFiles)
-	for i, _ := range (info.Files) {
-		src := &info.Files[i]
-		//log.Println("Files ->", src.Path)
-		torrentPath, err := joinPath(src.Path)
-		if err != nil {
-			log.Println("Files ->",err)
-			return
-		}
-		//log.Println("Files ->", torrentPath)
-		if err != nil {
-			log.Println("Files ->",err)
-			return fs, 0, err 
-		}
-		fullPath := fileDir + "/" + torrentPath
-		err = ensureDirectory(fullPath)
-		//log.Println("Files -> Fullpath:", fullPath)
-		if n := strings.LastIndex(fullPath, "/"); n != -1 {
-			if err = os.MkdirAll(fullPath[0:n], FOLDER_PERM); err != nil {
-				log.Println("Files ->",err)
-				return fs, 0, err
-			}
-		}
-		if err != nil {
-			log.Println("Files ->",err)
-			return fs, 0, err
-		}
-		err = fs.files[i].open(fullPath, src.Length)
-		if err != nil {
-			log.Println("Files ->",err)
-			return fs, 0, err
+	fs.priorities = make([]int, len(fs.lengths))
+	for i, _ := range fs.priorities {
+		fs.priorities[i] = PRIORITY_NORMAL
+		if priorities != nil {
+			fs.priorities[i] = priorities[i]
 		}
-		fs.offsets[i] = totalSize
-		totalSize += src.Length
 	}
-	fs.totalLength = totalSize
-	files := make([]*os.File, numFiles)
-	for i, file := range fs.files {
-		files[i] = file.fd
+	if newStorage == nil {
+		newStorage = NewFileStorage
 	}
-	fs.reader, err = wgo_io.MultiReaderAt(files)
-	if err != nil {
-		return
+	if fs.storage, err = newStorage(info, fileDir, fs.Priorities()); err != nil {
+		log.Println("Files ->", err)
+		return nil, 0, err
 	}
-	f = fs
+	fs.cache = newCache(fs.storage, info.Piece_length, fs.totalLength, info.Pieces)
+	return fs, fs.totalLength, nil
+}
+
+func (fs *fileStore) Priorities() (priorities []int) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	priorities = make([]int, len(fs.priorities))
+	copy(priorities, fs.priorities)
 	return
 }
 
-// Find the file that matches the offset
-
-func (f *fileStore) find(offset int64) int {
-	// Binary search
-	offsets := f.offsets
-	low := 0
-	high := len(offsets)
-	for low < high-1 {
-		probe := (low + high) / 2
-		entry := offsets[probe]
-		if offset < entry {
-			high = probe
-		} else {
-			low = probe
+// Change the priority of a file, the storage allocates a skipped file
+// when it's wanted
+
+func (fs *fileStore) SetPriority(file, priority int) (err os.Error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if file < 0 || file >= len(fs.priorities) {
+		return os.NewError("File out of range")
+	}
+	if priority < PRIORITY_SKIP || priority > PRIORITY_HIGH {
+		return os.NewError("Invalid priority")
+	}
+	fs.priorities[file] = priority
+	return fs.storage.SetPriority(file, priority)
+}
+
+// Priority of each piece, the highest one of the files it belongs to
+
+func (fs *fileStore) PiecePriorities() (priorities []int) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	priorities = make([]int, fs.numPieces())
+	for i, length := range fs.lengths {
+		if length == 0 {
+			continue
+		}
+		first := fs.offsets[i] / fs.info.Piece_length
+		last := (fs.offsets[i] + length - 1) / fs.info.Piece_length
+		for piece := first; piece <= last; piece++ {
+			if fs.priorities[i] > priorities[piece] {
+				priorities[piece] = fs.priorities[i]
+			}
 		}
 	}
-	return low
+	return
 }
 
 func (fs *fileStore) CheckPieces() (left int64, bf *bit_field.Bitfield, err os.Error) {
-	numPieces := (fs.totalLength + fs.info.Piece_length - 1) / fs.info.Piece_length
+	return fs.checkPieces(nil, nil)
+}
+
+// Use the pieces in have, from the fast resume data, for the files that
+// still have the size and modification time in states. Only the pieces
+// of the files that changed are checked.
+
+func (fs *fileStore) CheckPiecesResume(have *bit_field.Bitfield, states []FileState) (left int64, bf *bit_field.Bitfield, err os.Error) {
+	current, err := fs.States()
+	if err != nil || have == nil || have.Len() != fs.numPieces() || len(states) != len(current) {
+		log.Println("Files -> Resume data doesn't match the torrent, checking all the pieces")
+		return fs.checkPieces(nil, nil)
+	}
+	recheck := bit_field.NewBitfield(fs.numPieces())
+	for i, state := range current {
+		if fs.lengths[i] == 0 || SameStates([]FileState{state}, states[i:i+1]) {
+			continue
+		}
+		first := fs.offsets[i] / fs.info.Piece_length
+		last := (fs.offsets[i] + fs.lengths[i] - 1) / fs.info.Piece_length
+		for piece := first; piece <= last; piece++ {
+			recheck.Set(piece)
+		}
+	}
+	log.Println("Files -> Using resume data,", recheck.Count(), "pieces have to be checked")
+	return fs.checkPieces(have, recheck)
+}
+
+// Size and modification time of the files in the storage
+
+func (fs *fileStore) States() (states []FileState, err os.Error) {
+	return fs.storage.States()
+}
+
+func (fs *fileStore) numPieces() int64 {
+	return (fs.totalLength + fs.info.Piece_length - 1) / fs.info.Piece_length
+}
+
+// Hash the pieces set in recheck, the others are taken from have. With
+// a nil recheck all the pieces are hashed.
+
+func (fs *fileStore) checkPieces(have, recheck *bit_field.Bitfield) (left int64, bf *bit_field.Bitfield, err os.Error) {
+	numPieces := fs.numPieces()
 	log.Println("Files -> totalLength:", fs.totalLength, "pieceLength:", fs.info.Piece_length, "numPieces:", numPieces)
 	log.Println("Files -> Checking pieces")
 	bf = bit_field.NewBitfield(numPieces)
+	pieces := make([]int64, 0, numPieces)
+	for i := int64(0); i < numPieces; i++ {
+		if recheck == nil || recheck.IsSet(i) {
+			pieces = append(pieces, i)
+		} else if have.IsSet(i) {
+			bf.Set(i)
+		}
+	}
 	input := make(chan *CheckPiece, HASHERS)
 	output := make(chan *CheckPiece, HASHERS)
 	for i := int64(0); i < HASHERS; i++ {
@@ -221,26 +275,30 @@ func (fs *fileStore) CheckPieces() (left int64, bf *bit_field.Bitfield, err os.E
 		}(i, output, input)
 	}
 	go func(input chan *CheckPiece) {
-		for i:= int64(0); i < numPieces; i++ {
+		for _, i := range pieces {
 			piece := new(CheckPiece)
 			piece.index = i
 			input <- piece
 		}
 		close(input)
 	}(input)
-	for i:= int64(0); i < numPieces; i++ {
+	for n := len(pieces); n > 0; n-- {
 		piece := <- output
-		if piece.err != nil {
-			if piece.index == numPieces-1 {
-				left += fs.totalLength-piece.index*fs.info.Piece_length
-			} else {
-				left += fs.info.Piece_length
-			}
-		} else {
+		if piece.err == nil {
 			bf.Set(piece.index)
 		}
 	}
 	close(output)
+	for i := int64(0); i < numPieces; i++ {
+		if bf.IsSet(i) {
+			continue
+		}
+		if i == numPieces-1 {
+			left += fs.totalLength-i*fs.info.Piece_length
+		} else {
+			left += fs.info.Piece_length
+		}
+	}
 	return
 }
 // Check a piece
@@ -267,7 +325,7 @@ func (fs *fileStore) computePieceSum(pieceIndex int64) (sum []byte, err os.Error
 	if pieceIndex == numPieces-1 {
 		length = fs.totalLength-pieceIndex*fs.info.Piece_length
 	}
-	reader := io.NewSectionReader(fs.reader, pieceIndex*fs.info.Piece_length, length)
+	reader := io.NewSectionReader(fs.cache, pieceIndex*fs.info.Piece_length, length)
 	_, err = io.Copy(hasher, reader)
 	if err != nil {
 		return
@@ -276,48 +334,33 @@ func (fs *fileStore) computePieceSum(pieceIndex int64) (sum []byte, err os.Error
 	return
 }
 
-// Close all the files in the torrent
-
-func (f *fileStore) Close() (err os.Error) {
-	for i, _ := range (f.files) {
-		fd := f.files[i].fd
-		if fd != nil {
-			fd.Close()
-			f.files[i].fd = nil
-		}
-	}
-	return
+func (fs *fileStore) Flush() (os.Error) {
+	return fs.cache.Flush()
 }
 
+// Maximum memory used by the cache, in bytes
 
-// Check that the parts of the path are correct
-func joinPath(parts []string) (path string, err os.Error) {
-	// TODO: better, OS-specific sanitization.
-	for key, part := range (parts) {
-		// Sanitize file names.
-		if strings.Index(part, "/") >= 0 || strings.Index(part, "\\") >= 0 || part == ".." {
-			err = os.NewError("Bad path part " + part)
-			return
-		}
-		// Remove tailing and leading spaces
-		if strings.HasPrefix(part, " ") || strings.HasSuffix(part, " ") {
-			parts[key] = strings.TrimSpace(part)
-		}
-	}
+func (fs *fileStore) SetCacheSize(size int64) {
+	fs.cache.SetSize(size)
+}
 
-	path = strings.Join(parts, "/")
-	return
+func (fs *fileStore) SetErrorHandler(f func(os.Error)) {
+	fs.cache.SetErrorHandler(f)
 }
 
-// Create the appropiate folders (if needed)
-func ensureDirectory(fullPath string) (err os.Error) {
-	pathParts := strings.Split(fullPath, "/", 0)
-	if len(pathParts) < 2 {
-		return
+// Flush the cache and close the storage
+
+func (fs *fileStore) Close() (err os.Error) {
+	err = fs.cache.Close()
+	if e := fs.storage.Close(); e != nil {
+		err = e
 	}
-	dirParts := pathParts[0 : len(pathParts)-1]
-	path := strings.Join(dirParts, "/")
-	err = os.MkdirAll(path, FOLDER_PERM)
 	return
 }
 
+// Close and delete the data of the torrent
+
+func (fs *fileStore) Remove() (os.Error) {
+	fs.cache.Close()
+	return fs.storage.Remove()
+}
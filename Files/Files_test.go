@@ -0,0 +1,51 @@
+package files
+
+import(
+	"strings"
+	"testing"
+	"wgo/bencode"
+	)
+
+func checkPiecePriorities(t *testing.T, when string, f Files, expected []int) {
+	priorities := f.PiecePriorities()
+	if len(priorities) != len(expected) {
+		t.Errorf("%s: got piece priorities %v, expected %v", when, priorities, expected)
+		return
+	}
+	for i, priority := range expected {
+		if priorities[i] != priority {
+			t.Errorf("%s: got piece priorities %v, expected %v", when, priorities, expected)
+			return
+		}
+	}
+}
+
+// A piece shared by several files has the highest priority of them, an
+// empty file doesn't have any piece
+
+func TestPiecePriorities(t *testing.T) {
+	p := int64(TEST_PIECE_LENGTH)
+	info := &bencode.InfoDict{Name: "wgo_test", Piece_length: p, Pieces: strings.Repeat("\x00", 4*20)}
+	// Pieces: 0 -> a, 1 -> a and c, 2 -> c and d, 3 -> d
+	info.Files = []bencode.FileDict{
+		bencode.FileDict{Length: p + p/2, Path: []string{"a"}},
+		bencode.FileDict{Length: 0, Path: []string{"b"}},
+		bencode.FileDict{Length: p, Path: []string{"c"}},
+		bencode.FileDict{Length: p/2 + 10, Path: []string{"d"}},
+	}
+	f, _, err := NewStorageFiles(info, "", []int{PRIORITY_LOW, PRIORITY_HIGH, PRIORITY_SKIP, PRIORITY_NORMAL}, NewMemStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkPiecePriorities(t, "Created", f, []int{PRIORITY_LOW, PRIORITY_LOW, PRIORITY_NORMAL, PRIORITY_NORMAL})
+	must(f.SetPriority(2, PRIORITY_HIGH))
+	checkPiecePriorities(t, "File c high", f, []int{PRIORITY_LOW, PRIORITY_HIGH, PRIORITY_HIGH, PRIORITY_NORMAL})
+	must(f.SetPriority(0, PRIORITY_SKIP))
+	must(f.SetPriority(3, PRIORITY_SKIP))
+	checkPiecePriorities(t, "Files a and d skipped", f, []int{PRIORITY_SKIP, PRIORITY_HIGH, PRIORITY_HIGH, PRIORITY_SKIP})
+	if f.SetPriority(4, PRIORITY_NORMAL) == nil || f.SetPriority(0, PRIORITY_HIGH+1) == nil {
+		t.Errorf("Accepted a wrong file or priority")
+	}
+	checkPiecePriorities(t, "Wrong changes", f, []int{PRIORITY_SKIP, PRIORITY_HIGH, PRIORITY_HIGH, PRIORITY_SKIP})
+}
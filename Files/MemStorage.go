@@ -0,0 +1,106 @@
+// Storage keeping the data of a torrent in memory, for tests and caches
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"os"
+	"sync"
+	"time"
+	"wgo/bencode"
+	)
+
+const(
+	// Only the pages written are allocated
+	MEM_PAGE_SIZE = 16*1024
+)
+
+type memStorage struct {
+	mutex *sync.RWMutex
+	pages map[int64][]byte
+	lengths []int64
+	totalLength int64
+	// Data from a previous run is never in memory, so the states must
+	// not match the ones saved in the resume data
+	created int64
+}
+
+// Create an empty store, dir and priorities aren't used
+
+func NewMemStorage(info *bencode.InfoDict, dir string, priorities []int) (s Storage, err os.Error) {
+	ms := new(memStorage)
+	ms.mutex = new(sync.RWMutex)
+	ms.pages = make(map[int64][]byte)
+	ms.lengths, _, ms.totalLength = layout(info)
+	ms.created = time.Nanoseconds()
+	return ms, nil
+}
+
+func (ms *memStorage) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	for len(p) > 0 {
+		page, ok := ms.pages[off/MEM_PAGE_SIZE]
+		chunk := MEM_PAGE_SIZE - int(off%MEM_PAGE_SIZE)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		if ok {
+			copy(p[0:chunk], page[off%MEM_PAGE_SIZE:])
+		} else {
+			for i := 0; i < chunk; i++ {
+				p[i] = 0
+			}
+		}
+		n += chunk
+		p = p[chunk:]
+		off += int64(chunk)
+	}
+	return
+}
+
+func (ms *memStorage) WriteAt(p []byte, off int64) (n int, err os.Error) {
+	if off < 0 || off + int64(len(p)) > ms.totalLength {
+		return 0, os.NewError("Write out of the torrent data")
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for len(p) > 0 {
+		page, ok := ms.pages[off/MEM_PAGE_SIZE]
+		if !ok {
+			page = make([]byte, MEM_PAGE_SIZE)
+			ms.pages[off/MEM_PAGE_SIZE] = page
+		}
+		chunk := copy(page[off%MEM_PAGE_SIZE:], p)
+		n += chunk
+		p = p[chunk:]
+		off += int64(chunk)
+	}
+	return
+}
+
+// Pieces shared with wanted files are still written, so nothing is freed
+
+func (ms *memStorage) SetPriority(file, priority int) (os.Error) {
+	return nil
+}
+
+func (ms *memStorage) States() (states []FileState, err os.Error) {
+	states = make([]FileState, len(ms.lengths))
+	for i, length := range ms.lengths {
+		states[i] = FileState{length, ms.created}
+	}
+	return
+}
+
+func (ms *memStorage) Close() (os.Error) {
+	return nil
+}
+
+func (ms *memStorage) Remove() (os.Error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.pages = make(map[int64][]byte)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Backends keeping the data of a torrent, Files does the piece logic on
+// top of them
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"io"
+	"os"
+	"wgo/bencode"
+	)
+
+// Data of a torrent seen as the concatenation of all its files. The
+// methods can be called from several goroutines at the same time. Reads
+// of data never written return zeros.
+
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	// Files with PRIORITY_SKIP don't have to be kept
+	SetPriority(file, priority int) (os.Error)
+	// State of each file of the torrent, used by the fast resume data to
+	// find out if the data changed while the torrent was stopped
+	States() (states []FileState, err os.Error)
+	Close() (os.Error)
+	// Close and delete all the data
+	Remove() (os.Error)
+}
+
+// Creates the Storage of a torrent in dir, with the priority of each
+// file, nil means PRIORITY_NORMAL for all of them
+
+type StorageFactory func(info *bencode.InfoDict, dir string, priorities []int) (Storage, os.Error)
+
+// Length and offset of each file of the torrent in the concatenation of
+// all of them, a single file torrent has one file
+
+func layout(info *bencode.InfoDict) (lengths, offsets []int64, totalLength int64) {
+	if len(info.Files) == 0 {
+		return []int64{info.Length}, []int64{0}, info.Length
+	}
+	lengths = make([]int64, len(info.Files))
+	offsets = make([]int64, len(info.Files))
+	for i, file := range info.Files {
+		lengths[i] = file.Length
+		offsets[i] = totalLength
+		totalLength += file.Length
+	}
+	return
+}
+
+// Find the file that matches the offset
+
+func findOffset(offsets []int64, offset int64) int {
+	// Binary search
+	low := 0
+	high := len(offsets)
+	for low < high-1 {
+		probe := (low + high) / 2
+		entry := offsets[probe]
+		if offset < entry {
+			high = probe
+		} else {
+			low = probe
+		}
+	}
+	return low
+}
@@ -0,0 +1,150 @@
+package files
+
+import(
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+	"wgo/bencode"
+	)
+
+// Files a, b (empty), sub/c (skipped) and d, 4500 bytes
+
+func testStorageInfo() *bencode.InfoDict {
+	info := &bencode.InfoDict{Name: "wgo_test", Piece_length: 1024}
+	info.Files = []bencode.FileDict{
+		bencode.FileDict{Length: 1000, Path: []string{"a"}},
+		bencode.FileDict{Length: 0, Path: []string{"b"}},
+		bencode.FileDict{Length: 3000, Path: []string{"sub", "c"}},
+		bencode.FileDict{Length: 500, Path: []string{"d"}},
+	}
+	return info
+}
+
+func checkSizes(t *testing.T, when string, s Storage, expected []int64) {
+	states, err := s.States()
+	if err != nil {
+		t.Fatalf("%s: %v", when, err)
+	}
+	if len(states) != len(expected) {
+		t.Fatalf("%s: got %d states, expected %d", when, len(states), len(expected))
+	}
+	for i, size := range expected {
+		if states[i].Size != size {
+			t.Errorf("%s: file %d has size %d, expected %d", when, i, states[i].Size, size)
+		}
+	}
+}
+
+func dirEntries(t *testing.T, dir string) []string {
+	fd, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	names, err := fd.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// Reads and writes across the files, the zeros of the data not written,
+// the states of the files and the removal of all the data
+
+func TestStorages(t *testing.T) {
+	dir := os.TempDir() + "/wgo_storage_" + strconv.Itoa(os.Getpid())
+	if err := os.MkdirAll(dir, FOLDER_PERM); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		newStorage StorageFactory
+		// Sizes of the files before and after the write
+		created, written []int64
+	}{
+		// The skipped file is only created when it's written
+		{"File", NewFileStorage, []int64{1000, 0, 0, 500}, []int64{1000, 0, 3000, 500}},
+		{"Memory", NewMemStorage, []int64{1000, 0, 3000, 500}, []int64{1000, 0, 3000, 500}},
+		{"Blob", NewBlobStorage, []int64{4500, 4500, 4500, 4500}, []int64{4500, 4500, 4500, 4500}},
+	}
+	data := make([]byte, 3700)
+	for i, _ := range data {
+		data[i] = byte(i*7 + 1)
+	}
+	for _, test := range tests {
+		s, err := test.newStorage(testStorageInfo(), dir, []int{PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_NORMAL})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkSizes(t, test.name + " created", s, test.created)
+		// From the middle of a to the middle of d
+		if n, err := s.WriteAt(data, 500); n != len(data) || err != nil {
+			t.Fatalf("%s: wrote %d bytes: %v", test.name, n, err)
+		}
+		if _, err = s.WriteAt([]byte{1}, 4500); err == nil {
+			t.Errorf("%s: wrote data past the end", test.name)
+		}
+		// Past the end reads zeros too
+		p := make([]byte, 4600)
+		if n, err := s.ReadAt(p, 0); n != len(p) || err != nil {
+			t.Fatalf("%s: read %d bytes: %v", test.name, n, err)
+		}
+		expected := make([]byte, 4600)
+		copy(expected[500:], data)
+		if !bytes.Equal(p, expected) {
+			t.Errorf("%s: read different data", test.name)
+		}
+		checkSizes(t, test.name + " written", s, test.written)
+		if err = s.Remove(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if names := dirEntries(t, dir); len(names) != 0 {
+			t.Errorf("%s: %v left after removing", test.name, names)
+		}
+	}
+	// The memory is freed
+	s, _ := NewMemStorage(testStorageInfo(), dir, nil)
+	must2(s.WriteAt(data, 500))
+	must(s.Remove())
+	p := make([]byte, len(data))
+	must2(s.ReadAt(p, 500))
+	if !bytes.Equal(p, make([]byte, len(data))) {
+		t.Errorf("Memory: read data after removing")
+	}
+}
+
+// Late reads and writes fail once closed, the removed files aren't
+// created again
+
+func TestClosedStorages(t *testing.T) {
+	dir := os.TempDir() + "/wgo_closed_" + strconv.Itoa(os.Getpid())
+	if err := os.MkdirAll(dir, FOLDER_PERM); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		newStorage StorageFactory
+	}{
+		{"File", NewFileStorage},
+		{"Blob", NewBlobStorage},
+	}
+	for _, test := range tests {
+		s, err := test.newStorage(testStorageInfo(), dir, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		must(s.Remove())
+		if _, err = s.WriteAt([]byte{1}, 0); err == nil {
+			t.Errorf("%s: wrote after removing", test.name)
+		}
+		if _, err = s.ReadAt(make([]byte, 1), 0); err == nil {
+			t.Errorf("%s: read after removing", test.name)
+		}
+		if names := dirEntries(t, dir); len(names) != 0 {
+			t.Errorf("%s: %v created after removing", test.name, names)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+// Handle of a torrent added to a Session, controls its lifecycle
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package main
+
+import(
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"wgo/bencode"
+	"wgo/bit_field"
+	"wgo/files"
+	"wgo/stats"
+	"wgo/peers"
+	"wgo/tracker"
+	"wgo/mse"
+	"wgo/resume"
+	)
+
+const(
+	STATE_CHECKING = iota
+	STATE_DOWNLOADING
+	STATE_SEEDING
+	STATE_PAUSED
+	STATE_STOPPED
+	STATE_ERROR
+)
+
+// Seconds between saves of the fast resume data
+const RESUME_INTERVAL = 5*60
+
+var stateNames = []string{"checking", "downloading", "seeding", "paused", "stopped", "error"}
+
+func StateString(state int) string {
+	if state < 0 || state >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[state]
+}
+
+type Torrent struct {
+	// Serializes Pause, Resume, Stop and Remove
+	mutex *sync.Mutex
+	// Protects state, err, bitfield, picker, peerMgr and pieceMgr,
+	// which are read while the mutex is held by a long operation like
+	// checking the files
+	stateMutex *sync.Mutex
+	state int
+	err os.Error
+	session *Session
+	MetaInfo *bencode.MetaInfo
+	// Created when the files are checked. The files are closed when the
+	// torrent is stopped, but kept to be able to remove them.
+	files files.Files
+	bitfield *bit_field.Bitfield
+	stats stats.Stats
+	size int64
+	// Priority of each file, nil means files.PRIORITY_NORMAL for all
+	priorities []int
+	// Chooses the pieces to download, nil means rarest first
+	picker peers.PiecePicker
+	// Blocks of the unfinished pieces while there's no PieceMgr
+	partial map[int64][]int
+	// Created while downloading or seeding
+	peerMgr peers.PeerMgr
+	pieceMgr peers.PieceMgr
+	trackerMgr *tracker.TrackerMgr
+	// Stops saving the fast resume data periodically
+	quit chan bool
+}
+
+func newTorrent(s *Session, metaInfo *bencode.MetaInfo) (t *Torrent) {
+	t = new(Torrent)
+	t.mutex = new(sync.Mutex)
+	t.stateMutex = new(sync.Mutex)
+	t.state = STATE_STOPPED
+	t.session = s
+	t.MetaInfo = metaInfo
+	return
+}
+
+func (t *Torrent) Name() string {
+	return t.MetaInfo.Info.Name
+}
+
+func (t *Torrent) Infohash() string {
+	return t.MetaInfo.Infohash
+}
+
+func (t *Torrent) State() int {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	return t.state
+}
+
+// Error that moved the torrent to STATE_ERROR, or to STATE_PAUSED after a
+// disk error
+
+func (t *Torrent) Error() os.Error {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	return t.err
+}
+
+// Percentage of the pieces downloaded, 0 until the files are checked
+
+func (t *Torrent) Done() int64 {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	if t.bitfield == nil || t.bitfield.Len() == 0 {
+		return 0
+	}
+	return (t.bitfield.Count()*100)/t.bitfield.Len()
+}
+
+// PeerMgr of the torrent, nil unless it's downloading or seeding
+
+func (t *Torrent) PeerMgr() peers.PeerMgr {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	return t.peerMgr
+}
+
+// Number of connected peers that have each piece, nil if the torrent
+// isn't downloading or seeding
+
+func (t *Torrent) Availability() []int {
+	t.stateMutex.Lock()
+	pieceMgr := t.pieceMgr
+	t.stateMutex.Unlock()
+	if pieceMgr == nil {
+		return nil
+	}
+	return pieceMgr.Availability()
+}
+
+// Priority of each file of the torrent
+
+func (t *Torrent) FilePriorities() (priorities []int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	priorities = make([]int, t.numFiles())
+	for i, _ := range priorities {
+		priorities[i] = files.PRIORITY_NORMAL
+		if t.priorities != nil {
+			priorities[i] = t.priorities[i]
+		}
+	}
+	return
+}
+
+// Change the priority of a file, files.PRIORITY_SKIP doesn't download
+// it. The pieces shared with other files take the highest priority.
+
+func (t *Torrent) SetFilePriority(file, priority int) (err os.Error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if file < 0 || file >= t.numFiles() {
+		return os.NewError("File out of range")
+	}
+	if priority < files.PRIORITY_SKIP || priority > files.PRIORITY_HIGH {
+		return os.NewError("Invalid priority")
+	}
+	if t.priorities == nil {
+		t.priorities = make([]int, t.numFiles())
+		for i, _ := range t.priorities {
+			t.priorities[i] = files.PRIORITY_NORMAL
+		}
+	}
+	t.priorities[file] = priority
+	// The files are open while downloading, seeding or paused
+	if state := t.State(); t.files == nil || state == STATE_STOPPED || state == STATE_ERROR {
+		return
+	}
+	if err = t.files.SetPriority(file, priority); err != nil {
+		return
+	}
+	if t.pieceMgr == nil {
+		return
+	}
+	t.pieceMgr.SetPriorities(t.files.PiecePriorities())
+	t.peerMgr.CheckInterest()
+	switch completed := t.pieceMgr.Completed(); {
+		case completed:
+			t.completed()
+		case t.State() == STATE_SEEDING:
+			t.setState(STATE_DOWNLOADING, nil)
+	}
+	return
+}
+
+func (t *Torrent) numFiles() int {
+	if n := len(t.MetaInfo.Info.Files); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Change how the pieces to download are chosen, e.g. to a
+// peers.StreamingPicker to play a video while it's downloaded. It's
+// kept if the torrent is paused or stopped.
+
+func (t *Torrent) SetPiecePicker(picker peers.PiecePicker) {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	if picker == nil {
+		picker = peers.NewRarestFirstPicker()
+	}
+	t.picker = picker
+	if t.pieceMgr != nil {
+		t.pieceMgr.SetPicker(picker)
+	}
+}
+
+// Copies of the torrent among the connected peers: the availability of
+// the rarest piece plus the fraction of pieces that are more common
+
+func (t *Torrent) DistributedCopies() float64 {
+	availability := t.Availability()
+	if len(availability) == 0 {
+		return 0
+	}
+	min := availability[0]
+	for _, n := range availability {
+		if n < min {
+			min = n
+		}
+	}
+	above := 0
+	for _, n := range availability {
+		if n > min {
+			above++
+		}
+	}
+	return float64(min) + float64(above)/float64(len(availability))
+}
+
+// Disconnect the peers and stop announcing, the files stay open so
+// Resume doesn't have to check them again
+
+func (t *Torrent) Pause() os.Error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if state := t.State(); state != STATE_DOWNLOADING && state != STATE_SEEDING {
+		return os.NewError("Can't pause a torrent in state " + StateString(state))
+	}
+	t.disconnect()
+	t.saveResume()
+	t.setState(STATE_PAUSED, nil)
+	return nil
+}
+
+// Resume a paused torrent, or start again a stopped one or one that
+// failed, checking its files first
+
+func (t *Torrent) Resume() (err os.Error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch t.State() {
+		case STATE_PAUSED:
+		case STATE_STOPPED, STATE_ERROR:
+			if err = t.check(); err != nil {
+				t.fail(err)
+				return
+			}
+		default:
+			return os.NewError("Can't resume a torrent in state " + StateString(t.State()))
+	}
+	if err = t.connect(); err != nil {
+		t.fail(err)
+	}
+	return
+}
+
+// Disconnect the peers, send the stopped event to the trackers and
+// close the files
+
+func (t *Torrent) Stop() os.Error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.State() == STATE_STOPPED {
+		return nil
+	}
+	t.disconnect()
+	t.closeFiles(true)
+	t.setState(STATE_STOPPED, nil)
+	return nil
+}
+
+// Stop the torrent and remove it from the session, deleting the
+// downloaded data if deleteData is true
+
+func (t *Torrent) Remove(deleteData bool) (err os.Error) {
+	t.Stop()
+	t.session.remove(t)
+	if !deleteData {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if path := t.resumePath(); len(path) > 0 {
+		os.Remove(path)
+	}
+	if t.files == nil {
+		// The files were never opened
+		return
+	}
+	err = t.files.Remove()
+	t.files = nil
+	return
+}
+
+// Open the files and check the pieces already downloaded. With fast
+// resume data only the files that changed since it was saved are
+// checked.
+
+func (t *Torrent) check() (err os.Error) {
+	t.setState(STATE_CHECKING, nil)
+	torr := t.MetaInfo
+	fs, size, err := files.NewStorageFiles(&torr.Info, t.session.config.Folder, t.priorities, t.session.config.Storage)
+	if err != nil {
+		return
+	}
+	if size <= 0 {
+		fs.Close()
+		return os.NewError("Torrent without data")
+	}
+	if cacheSize := t.session.config.CacheSize; cacheSize > 0 {
+		fs.SetCacheSize(int64(cacheSize)*1024)
+	}
+	fs.SetErrorHandler(func(err os.Error) { t.diskError(fs, err) })
+	log.Println("Files -> Total size:", size)
+	var left int64
+	var bitfield *bit_field.Bitfield
+	data := t.loadResume()
+	var have *bit_field.Bitfield
+	if data != nil {
+		if have, err = bit_field.NewBitfieldFromBytes(data.NumPieces, []byte(data.Pieces)); err != nil {
+			log.Println("Torrent -> Invalid resume data:", err)
+			data = nil
+		}
+	}
+	var states []files.FileState
+	if data == nil {
+		left, bitfield, err = fs.CheckPieces()
+	} else {
+		states = make([]files.FileState, len(data.Files))
+		for i, f := range data.Files {
+			states[i] = files.FileState{f.Size, f.Mtime}
+		}
+		left, bitfield, err = fs.CheckPiecesResume(have, states)
+	}
+	if err != nil {
+		fs.Close()
+		return
+	}
+	t.files, t.size = fs, size
+	t.stateMutex.Lock()
+	t.bitfield = bitfield
+	t.stateMutex.Unlock()
+	t.stats = stats.NewStats(left, size, bitfield, torr.Info.Piece_length)
+	t.partial = nil
+	if data != nil {
+		t.stats.SetGlobalStats(data.Uploaded, data.Downloaded)
+		// The blocks of unfinished pieces aren't checked, only use them
+		// if no file changed
+		if current, err := fs.States(); err == nil && files.SameStates(current, states) {
+			t.partial = make(map[int64][]int)
+			for _, p := range data.Partial {
+				for _, block := range p.Blocks {
+					t.partial[p.Piece] = append(t.partial[p.Piece], int(block))
+				}
+			}
+		}
+	}
+	return
+}
+
+func (t *Torrent) resumePath() string {
+	dir := t.session.config.ResumeDir
+	if len(dir) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%x.resume", dir, t.Infohash())
+}
+
+// Fast resume data of the torrent, nil if there isn't any
+
+func (t *Torrent) loadResume() (data *resume.Data) {
+	path := t.resumePath()
+	if len(path) == 0 {
+		return
+	}
+	data, err := resume.Load(path)
+	if err != nil {
+		return nil
+	}
+	if data.Infohash != t.Infohash() {
+		log.Println("Torrent -> Resume data of another torrent in", path)
+		return nil
+	}
+	return
+}
+
+// Write the fast resume data, the caller holds the mutex
+
+func (t *Torrent) saveResume() {
+	path := t.resumePath()
+	if len(path) == 0 || t.files == nil || t.stats == nil {
+		return
+	}
+	// Take the pieces before flushing, so the ones saved are on disk by the
+	// time the states are taken
+	data := &resume.Data{Infohash: t.Infohash(), NumPieces: t.bitfield.Len(), Pieces: string(t.bitfield.Bytes())}
+	partial := t.partial
+	if t.pieceMgr != nil {
+		partial = t.pieceMgr.Partial()
+	}
+	data.Partial = make([]resume.Partial, 0, len(partial))
+	for piece, blocks := range partial {
+		p := resume.Partial{piece, make([]int64, len(blocks))}
+		for i, block := range blocks {
+			p.Blocks[i] = int64(block)
+		}
+		data.Partial = append(data.Partial, p)
+	}
+	if err := t.files.Flush(); err != nil {
+		log.Println("Torrent -> Error saving resume data:", err)
+		return
+	}
+	states, err := t.files.States()
+	if err != nil {
+		log.Println("Torrent -> Error saving resume data:", err)
+		return
+	}
+	data.Files = make([]resume.File, len(states))
+	for i, state := range states {
+		data.Files[i] = resume.File{state.Size, state.Mtime}
+	}
+	data.Uploaded, data.Downloaded = t.stats.GetGlobalStats()
+	if err = data.Save(path); err != nil {
+		log.Println("Torrent -> Error saving resume data:", err)
+	}
+}
+
+// Save the fast resume data every RESUME_INTERVAL until quit is closed
+
+func (t *Torrent) saveResumeLoop(quit chan bool) {
+	ticker := time.NewTicker(RESUME_INTERVAL*NS_PER_S)
+	defer ticker.Stop()
+	for {
+		select {
+			case <- quit:
+				return
+			case <- ticker.C:
+				t.mutex.Lock()
+				select {
+					case <- quit:
+					default:
+						t.saveResume()
+				}
+				t.mutex.Unlock()
+		}
+	}
+}
+
+// Start exchanging pieces with peers
+
+func (t *Torrent) connect() (err os.Error) {
+	s := t.session
+	torr := t.MetaInfo
+	bitfield := t.bitfield
+	lastPieceLength := t.size % torr.Info.Piece_length
+	peerMgr, err := peers.NewPeerMgr(int64(bitfield.Len()), s.peerId, torr.Infohash, bitfield, t.stats, t.files, s.limiter, lastPieceLength)
+	if err != nil {
+		return
+	}
+	// Send the metadata to peers that are fetching it
+	peerMgr.Extensions().Register(peers.NewUtMetadata(torr.Infohash, torr.InfoBytes))
+	peerMgr.Extensions().SetField("metadata_size", int64(len(torr.InfoBytes)))
+	peerMgr.Extensions().SetField("p", int64(s.port))
+	peerMgr.SetEncryption(s.config.Encryption)
+	peerMgr.SetBanList(s.banList)
+	peerMgr.SetFilter(s.filter)
+	peerMgr.SetConnections(s.connections)
+	if s.socket != nil {
+		peerMgr.SetUtp(s.socket)
+	}
+	if s.config.Encryption != mse.PLAINTEXT {
+		// Tell peers we prefer encrypted connections (BEP 10)
+		peerMgr.Extensions().SetField("e", int64(1))
+	}
+	// Private torrents must only get peers from their trackers
+	if torr.Info.Private == 0 {
+		peerMgr.Extensions().Register(peers.NewUtPex(peerMgr))
+	}
+	pieceMgr, err := peers.NewPieceMgr(peerMgr, t.stats, t.files, bitfield, torr.Info.Piece_length, lastPieceLength, bitfield.Len(), t.size)
+	if err != nil {
+		peerMgr.Close()
+		return
+	}
+	peerMgr.SetPieceMgr(pieceMgr)
+	pieceMgr.SetPriorities(t.files.PiecePriorities())
+	if t.partial != nil {
+		pieceMgr.SetPartial(t.partial)
+		t.partial = nil
+	}
+	// The tracker of a magnet link is already announcing
+	if t.trackerMgr == nil {
+		t.trackerMgr = tracker.NewTrackerMgr(torr.Announce_list, torr.Infohash, s.config.Port, peerMgr, bitfield, torr.Info.Piece_length, s.peerId, t.stats)
+	} else {
+		t.trackerMgr.SetTorrent(peerMgr, t.stats, bitfield, torr.Info.Piece_length)
+	}
+	trackerMgr := t.trackerMgr
+	// Called when the wanted pieces are downloaded, the trackers are
+	// only told when all of them are
+	pieceMgr.SetCompleted(func() {
+		if bitfield.Completed() {
+			trackerMgr.Completed()
+		}
+		t.completed()
+	})
+	t.stateMutex.Lock()
+	if t.picker != nil {
+		pieceMgr.SetPicker(t.picker)
+	}
+	t.peerMgr, t.pieceMgr = peerMgr, pieceMgr
+	t.stateMutex.Unlock()
+	s.chokeMgr.AddTorrent(t.stats, peerMgr)
+	s.listener.AddPeerMgr(peerMgr)
+	// Without the DHT the peers aren't sent our DHT port either (BEP 27)
+	if s.dht != nil && torr.Info.Private == 0 {
+		peerMgr.SetDHT(s.dht)
+		s.dht.AddTorrent(torr.Infohash, s.port, peerMgr)
+	}
+	t.quit = make(chan bool)
+	go t.saveResumeLoop(t.quit)
+	if pieceMgr.Completed() {
+		t.setState(STATE_SEEDING, nil)
+	} else {
+		t.setState(STATE_DOWNLOADING, nil)
+	}
+	return
+}
+
+// Stop exchanging pieces, the opposite of connect
+
+func (t *Torrent) disconnect() {
+	s := t.session
+	if t.quit != nil {
+		close(t.quit)
+		t.quit = nil
+	}
+	infohash := t.Infohash()
+	s.listener.RemovePeerMgr(infohash)
+	s.chokeMgr.RemoveTorrent(infohash)
+	if s.dht != nil {
+		s.dht.RemoveTorrent(infohash)
+	}
+	t.stateMutex.Lock()
+	peerMgr := t.peerMgr
+	t.peerMgr = nil
+	t.stateMutex.Unlock()
+	if peerMgr != nil {
+		peerMgr.Close()
+	}
+	if t.pieceMgr != nil {
+		t.partial = t.pieceMgr.Partial()
+		t.pieceMgr.Close()
+		t.stateMutex.Lock()
+		t.pieceMgr = nil
+		t.stateMutex.Unlock()
+	}
+	if t.trackerMgr != nil {
+		t.trackerMgr.Stop()
+		t.trackerMgr = nil
+	}
+}
+
+// Flush and close the files, saving the fast resume data after they
+// are flushed if save is true
+
+func (t *Torrent) closeFiles(save bool) {
+	if t.files != nil {
+		if err := t.files.Close(); err != nil {
+			log.Println("Torrent -> Error closing files:", err)
+		}
+	}
+	if save {
+		t.saveResume()
+	}
+	if t.stats != nil {
+		t.stats.Close()
+		t.stats = nil
+	}
+}
+
+// Release everything and move to STATE_ERROR
+
+func (t *Torrent) fail(err os.Error) {
+	log.Println("Torrent -> Error in", t.Name(), ":", err)
+	t.disconnect()
+	t.closeFiles(false)
+	t.setState(STATE_ERROR, err)
+}
+
+// The files of fs can't be read or written, e.g. the disk is full. The
+// torrent is paused with the error, the data not written yet is kept in
+// memory and written when it's flushed again.
+
+func (t *Torrent) diskError(fs files.Files, err os.Error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if state := t.State(); t.files != fs || (state != STATE_DOWNLOADING && state != STATE_SEEDING) {
+		return
+	}
+	log.Println("Torrent -> Disk error in", t.Name(), ":", err)
+	t.disconnect()
+	t.setState(STATE_PAUSED, err)
+}
+
+// Called by the PieceMgr once the last piece is downloaded
+
+func (t *Torrent) completed() {
+	t.stateMutex.Lock()
+	ok := t.state == STATE_DOWNLOADING
+	t.stateMutex.Unlock()
+	if ok {
+		t.setState(STATE_SEEDING, nil)
+	}
+}
+
+func (t *Torrent) setState(state int, err os.Error) {
+	t.stateMutex.Lock()
+	t.state, t.err = state, err
+	t.stateMutex.Unlock()
+	t.session.stateChanged(t, state)
+}
@@ -0,0 +1,167 @@
+package main
+
+import(
+	"os"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"wgo/bencode"
+	"wgo/files"
+	)
+
+// Torrent of 3 pieces kept in memory, without trackers
+
+func newTestTorrent(s *Session, infohash string) (t *Torrent) {
+	metaInfo := &bencode.MetaInfo{Infohash: infohash, InfoBytes: []byte("d4:name8:wgo_teste")}
+	metaInfo.Info = bencode.InfoDict{Name: "wgo_test", Piece_length: 32*1024, Pieces: strings.Repeat("\x00", 3*20), Length: 80*1024}
+	t = newTorrent(s, metaInfo)
+	s.mutex.Lock()
+	s.torrents[metaInfo.Infohash] = t
+	s.mutex.Unlock()
+	return
+}
+
+func expectState(t *testing.T, torr *Torrent, err os.Error, state int) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torr.State() != state {
+		t.Fatalf("Torrent %s, expected %s", StateString(torr.State()), StateString(state))
+	}
+}
+
+// Wait for the goroutines started since there were n to exit
+
+func waitGoroutines(t *testing.T, n int32, when string) {
+	for i := 0; runtime.Goroutines() > n; i++ {
+		if i == 100 {
+			t.Errorf("%s: %d goroutines left, expected %d", when, runtime.Goroutines(), n)
+			return
+		}
+		time.Sleep(NS_PER_S/20)
+	}
+}
+
+// With check the goroutines of the torrent (PieceMgr, PeerMgr, Stats,
+// TrackerMgr, the cache workers) must exit once it's stopped, and the
+// ones of the session (ChokeMgr, Limiter, Listener) once it's closed
+
+func lifecycle(t *testing.T, check bool) {
+	before := runtime.Goroutines()
+	s, err := NewSession(&Config{Ip: "127.0.0.1", Port: "0", UpLimit: 100, DhtPort: -1, Storage: files.NewMemStorage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := runtime.Goroutines()
+	torr := newTestTorrent(s, strings.Repeat("\x01", 20))
+	if err = torr.Pause(); err == nil {
+		t.Errorf("Paused a stopped torrent")
+	}
+	expectState(t, torr, torr.Resume(), STATE_DOWNLOADING)
+	expectState(t, torr, torr.Pause(), STATE_PAUSED)
+	if torr.PeerMgr() != nil || torr.Availability() != nil {
+		t.Errorf("Paused torrent still connected")
+	}
+	expectState(t, torr, torr.Resume(), STATE_DOWNLOADING)
+	expectState(t, torr, torr.Stop(), STATE_STOPPED)
+	if check {
+		waitGoroutines(t, idle, "Stopped")
+	}
+	expectState(t, torr, torr.Resume(), STATE_DOWNLOADING)
+	if err = torr.Remove(true); err != nil {
+		t.Fatal(err)
+	}
+	if s.Torrent(torr.Infohash()) != nil {
+		t.Errorf("Removed torrent still in the session")
+	}
+	if check {
+		waitGoroutines(t, idle, "Removed")
+	}
+	s.Close()
+	if check {
+		waitGoroutines(t, before, "Session closed")
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	// The runtime starts some goroutines the first time, e.g. for timers
+	lifecycle(t, false)
+	time.Sleep(NS_PER_S/5)
+	lifecycle(t, true)
+}
+
+// Connect to the session as a peer of the torrent, ok if the session
+// answers the handshake for that torrent
+
+func connectPeer(t *testing.T, s *Session, infohash string) (c net.Conn, ok bool) {
+	c, err := net.Dial("tcp4", "", "127.0.0.1:" + s.config.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := "\x13BitTorrent protocol" + strings.Repeat("\x00", 8) + infohash + "-XX0000-000000000000"
+	if _, err = c.Write([]byte(handshake)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(5*NS_PER_S)
+	reply := make([]byte, len(handshake))
+	if _, err = io.ReadFull(c, reply); err != nil || string(reply[28:48]) != infohash {
+		c.Close()
+		return nil, false
+	}
+	return c, true
+}
+
+func waitFor(t *testing.T, when string, f func() bool) {
+	for i := 0; !f(); i++ {
+		if i == 100 {
+			t.Fatalf("%s: timeout", when)
+		}
+		time.Sleep(NS_PER_S/20)
+	}
+}
+
+// Two torrents share the connection slots of the session, incoming
+// connections go to the torrent of their infohash
+
+func TestSharedConnections(t *testing.T) {
+	s, err := NewSession(&Config{Ip: "127.0.0.1", Port: "0", UpLimit: 100, DhtPort: -1, MaxConnections: 1, Storage: files.NewMemStorage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	a := newTestTorrent(s, strings.Repeat("\x01", 20))
+	b := newTestTorrent(s, strings.Repeat("\x02", 20))
+	expectState(t, a, a.Resume(), STATE_DOWNLOADING)
+	expectState(t, b, b.Resume(), STATE_DOWNLOADING)
+	if c, ok := connectPeer(t, s, strings.Repeat("\x03", 20)); ok {
+		c.Close()
+		t.Errorf("Accepted a connection for an unknown torrent")
+	}
+	c, ok := connectPeer(t, s, b.Infohash())
+	if !ok {
+		t.Fatalf("Connection to the second torrent refused")
+	}
+	if a.PeerMgr().IncomingPeers() != 0 || b.PeerMgr().IncomingPeers() != 1 {
+		t.Errorf("Got %d and %d incoming peers, expected 0 and 1", a.PeerMgr().IncomingPeers(), b.PeerMgr().IncomingPeers())
+	}
+	// The only slot is taken by the other torrent
+	if c2, ok := connectPeer(t, s, a.Infohash()); ok {
+		c2.Close()
+		t.Errorf("Connection accepted over the limit of the session")
+	}
+	if s.Connections() != 1 {
+		t.Errorf("Got %d connections, expected 1", s.Connections())
+	}
+	c.Close()
+	waitFor(t, "Slot given back", func() bool { return s.Connections() == 0 })
+	if c, ok = connectPeer(t, s, a.Infohash()); !ok {
+		t.Fatalf("Connection to the first torrent refused once the slot is free")
+	}
+	defer c.Close()
+	if a.PeerMgr().IncomingPeers() != 1 || b.PeerMgr().IncomingPeers() != 0 {
+		t.Errorf("Got %d and %d incoming peers, expected 1 and 0", a.PeerMgr().IncomingPeers(), b.PeerMgr().IncomingPeers())
+	}
+}
@@ -0,0 +1,317 @@
+// IP filter loaded from blocklists: PeerGuardian text (.p2p), eMule
+// ipfilter.dat and plain CIDR or range rules, for IPv4 and IPv6
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package ipfilter
+
+import(
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	)
+
+const(
+	// eMule access levels below this one are blocked
+	DAT_BLOCK_LEVEL = 128
+)
+
+// Inclusive range of addresses, IPv4 ones are stored as IPv4 mapped
+// IPv6 addresses so both families are compared the same way
+
+type ipRange struct {
+	first, last []byte
+}
+
+type ranges []ipRange
+
+func (r ranges) Len() int {
+	return len(r)
+}
+
+func (r ranges) Less(i, j int) bool {
+	return bytes.Compare(r[i].first, r[j].first) < 0
+}
+
+func (r ranges) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+// Sort and merge the overlapping and adjacent ranges, so a lookup is a
+// binary search
+
+func (r ranges) merge() (merged ranges) {
+	sort.Sort(r)
+	for _, cur := range r {
+		if n := len(merged); n > 0 && bytes.Compare(cur.first, next(merged[n-1].last)) <= 0 {
+			if bytes.Compare(cur.last, merged[n-1].last) > 0 {
+				merged[n-1].last = cur.last
+			}
+			continue
+		}
+		merged = append(merged, cur)
+	}
+	return
+}
+
+func (r ranges) contains(ip []byte) bool {
+	// First range that starts after ip, the one before can contain it
+	i := sort.Search(len(r), func(i int) bool { return bytes.Compare(r[i].first, ip) > 0 })
+	return i > 0 && bytes.Compare(ip, r[i-1].last) <= 0
+}
+
+// The address after ip, ip itself if it's the last one
+
+func next(ip []byte) []byte {
+	n := make([]byte, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return n
+		}
+	}
+	return ip
+}
+
+// Addresses in an allow rule are accepted even if a deny rule has them,
+// e.g. to let the local network through a blocklist. An empty filter
+// accepts everything.
+
+type Filter struct {
+	mutex *sync.RWMutex
+	deny, allow ranges
+	// Files loaded, used by Reload
+	paths []string
+	// Rules added with Add, kept when the files are loaded again
+	addedDeny, addedAllow ranges
+}
+
+func NewFilter() (f *Filter) {
+	f = new(Filter)
+	f.mutex = new(sync.RWMutex)
+	return
+}
+
+// Replace the rules with the ones of the files in paths, the ones added
+// with Add are kept
+
+func (f *Filter) Load(paths []string) (err os.Error) {
+	var deny, allow ranges
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		d, a, invalid := parse(string(data))
+		if invalid > 0 {
+			log.Println("IpFilter -> Ignored", invalid, "invalid lines in", path)
+		}
+		deny = append(deny, d...)
+		allow = append(allow, a...)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deny = append(deny, f.addedDeny...).merge()
+	f.allow = append(allow, f.addedAllow...).merge()
+	f.paths = paths
+	log.Println("IpFilter -> Loaded", len(f.deny), "denied and", len(f.allow), "allowed ranges")
+	return
+}
+
+// Load the files again, e.g. after they were updated. If a file can't
+// be read the current rules are kept.
+
+func (f *Filter) Reload() os.Error {
+	f.mutex.RLock()
+	paths := f.paths
+	f.mutex.RUnlock()
+	return f.Load(paths)
+}
+
+// Add a rule for the addresses from first to last, both included
+
+func (f *Filter) Add(first, last net.IP, allow bool) (err os.Error) {
+	r, err := newRange(first, last)
+	if err != nil {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if allow {
+		f.addedAllow = append(f.addedAllow, r)
+		f.allow = append(f.allow, r).merge()
+	} else {
+		f.addedDeny = append(f.addedDeny, r)
+		f.deny = append(f.deny, r).merge()
+	}
+	return
+}
+
+// addr is an IP or host:port
+
+func (f *Filter) Allowed(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		// Host names can't be checked, only allow them without rules
+		return len(f.deny) == 0
+	}
+	ip = ip.To16()
+	return f.allow.contains(ip) || !f.deny.contains(ip)
+}
+
+// Number of denied and allowed ranges, after merging them
+
+func (f *Filter) Len() (deny, allow int) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return len(f.deny), len(f.allow)
+}
+
+// Parse the rules of a blocklist, each line can be in any of the
+// formats:
+//	deny 10.0.0.0/8, allow fe80::/10, allow 1.2.3.4-1.2.3.9
+//	10.0.0.0/8, 1.2.3.4-1.2.3.9 or 1.2.3.4 (deny)
+//	Some description:1.2.3.4-1.2.3.9 (PeerGuardian, deny)
+//	001.002.003.004 - 001.002.003.009 , 000 , Some description (eMule)
+// Empty lines, the ones starting with # or // and the eMule ranges with
+// an access level that isn't blocked are skipped.
+
+func parse(data string) (deny, allow ranges, invalid int) {
+	for _, line := range strings.Split(data, "\n", -1) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, allowed, err := parseLine(line)
+		switch {
+			case err == errNotBlocked:
+			case err != nil:
+				invalid++
+			case allowed:
+				allow = append(allow, r)
+			default:
+				deny = append(deny, r)
+		}
+	}
+	return
+}
+
+// Returned for the eMule ranges that aren't blocked, they aren't rules
+
+var errNotBlocked = os.NewError("Range not blocked")
+
+func parseLine(line string) (r ipRange, allow bool, err os.Error) {
+	switch {
+		case strings.HasPrefix(line, "allow "):
+			r, err = parseRange(line[len("allow "):])
+			return r, true, err
+		case strings.HasPrefix(line, "deny "):
+			r, err = parseRange(line[len("deny "):])
+			return
+	}
+	if r, err = parseRange(line); err == nil {
+		return
+	}
+	// PeerGuardian: description:range, the description can have colons
+	// and commas
+	if i := strings.LastIndex(line, ":"); i != -1 {
+		if r, err = parseRange(line[i+1:]); err == nil {
+			return
+		}
+	}
+	// eMule: range , access level , description
+	parts := strings.Split(line, ",", 3)
+	if len(parts) < 2 {
+		return r, false, os.NewError("Invalid line " + line)
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return
+	}
+	if r, err = parseRange(parts[0]); err == nil && level >= DAT_BLOCK_LEVEL {
+		err = errNotBlocked
+	}
+	return
+}
+
+// CIDR, first-last or a single address
+
+func parseRange(s string) (r ipRange, err os.Error) {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "/"); i != -1 {
+		return parseCIDR(s[:i], s[i+1:])
+	}
+	first, last := s, s
+	if i := strings.Index(s, "-"); i != -1 {
+		first, last = s[:i], s[i+1:]
+	}
+	return newRange(parseIP(first), parseIP(last))
+}
+
+func parseCIDR(addr, prefix string) (r ipRange, err os.Error) {
+	ip := parseIP(addr)
+	bits, err := strconv.Atoi(strings.TrimSpace(prefix))
+	if ip == nil || err != nil {
+		return r, os.NewError("Invalid CIDR " + addr + "/" + prefix)
+	}
+	if ip.To4() != nil {
+		bits += 96
+	}
+	if bits < 0 || bits > 128 {
+		return r, os.NewError("Invalid CIDR prefix " + prefix)
+	}
+	first, last := make([]byte, 16), make([]byte, 16)
+	copy(first, ip.To16())
+	copy(last, ip.To16())
+	for i := bits; i < 128; i++ {
+		first[i/8] &^= 128 >> uint(i%8)
+		last[i/8] |= 128 >> uint(i%8)
+	}
+	return ipRange{first, last}, nil
+}
+
+func newRange(first, last net.IP) (r ipRange, err os.Error) {
+	if first == nil || last == nil {
+		return r, os.NewError("Invalid address")
+	}
+	r = ipRange{[]byte(first.To16()), []byte(last.To16())}
+	if (first.To4() == nil) != (last.To4() == nil) || bytes.Compare(r.first, r.last) > 0 {
+		return r, os.NewError("Invalid range")
+	}
+	return
+}
+
+// Like net.ParseIP, the IPv4 addresses of ipfilter.dat have leading
+// zeros
+
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Index(s, ":") != -1 {
+		return net.ParseIP(s)
+	}
+	parts := strings.Split(s, ".", -1)
+	if len(parts) != 4 {
+		return nil
+	}
+	b := make([]byte, 4)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3])
+}
@@ -0,0 +1,106 @@
+package ipfilter
+
+import(
+	"net"
+	"os"
+	"io/ioutil"
+	"testing"
+	)
+
+const blocklist = `# Comment
+// Another comment
+
+Some company, Inc:1.2.3.0-1.2.3.255
+010.000.000.000 - 010.255.255.255 , 000 , eMule range
+010.001.000.000 - 010.001.255.255 , 200 , eMule range not blocked
+192.168.0.0/16
+allow 192.168.1.0/24
+deny 2001:db8::/32
+5.6.7.8
+not a rule
+`
+
+func TestParse(t *testing.T) {
+	deny, allow, invalid := parse(blocklist)
+	if len(deny) != 5 || len(allow) != 1 || invalid != 1 {
+		t.Errorf("Got %d denied, %d allowed and %d invalid rules, expected 5, 1 and 1", len(deny), len(allow), invalid)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	deny, allow, _ := parse(blocklist)
+	f := NewFilter()
+	f.deny, f.allow = deny.merge(), allow.merge()
+	tests := []struct {
+		addr string
+		allowed bool
+	}{
+		{"1.2.3.4:6881", false},
+		{"1.2.4.0", true},
+		{"10.20.30.40", false},
+		// Not blocked by its own line, but in the blocked 10.0.0.0/8
+		{"10.1.2.3:80", false},
+		{"192.168.5.5", false},
+		{"192.168.1.7", true},
+		{"[2001:db8::1]:6881", false},
+		{"2001:db9::1", true},
+		{"5.6.7.8", false},
+		{"5.6.7.9", true},
+		{"::ffff:5.6.7.8", false},
+	}
+	for _, test := range tests {
+		if f.Allowed(test.addr) != test.allowed {
+			t.Errorf("Allowed(%s) != %v", test.addr, test.allowed)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	deny, _, _ := parse("1.0.0.0-1.0.0.10\n1.0.0.5-1.0.0.20\n1.0.0.21\n2.0.0.0/8\n")
+	if merged := deny.merge(); len(merged) != 2 {
+		t.Errorf("Got %d ranges, expected 2", len(merged))
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	f := NewFilter()
+	if !f.Allowed("1.2.3.4:5") || !f.Allowed("example.com:80") {
+		t.Errorf("Empty filter denies addresses")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := os.TempDir() + "/wgo_ipfilter_test"
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, []byte("1.2.3.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := NewFilter()
+	if err := f.Load([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Allowed("1.2.3.4") {
+		t.Errorf("1.2.3.4 should be denied")
+	}
+	if err := ioutil.WriteFile(path, []byte("4.3.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allowed("1.2.3.4") || f.Allowed("4.3.2.1") {
+		t.Errorf("Rules not reloaded")
+	}
+	if err := f.Add(net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), false); err != nil {
+		t.Fatal(err)
+	}
+	if f.Allowed("1.2.3.4") {
+		t.Errorf("Added rule not used")
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Allowed("1.2.3.4") || f.Allowed("4.3.2.1") {
+		t.Errorf("Rules lost when reloading")
+	}
+}
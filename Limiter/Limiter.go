@@ -17,11 +17,13 @@ type limiter struct {
 	down_mutex *sync.Mutex
 	upload, download, up_reset, down_reset, wait_upload, wait_download int64
 	up_chan, down_chan chan bool
+	quit chan bool
 }
 
 type Limiter interface {
 	WaitSend(size int64) int64
 	WaitReceive(size int64) int64
+	Close()
 }
 
 func NewLimiter(up_limit, down_limit int) (Limiter, os.Error) {
@@ -29,6 +31,7 @@ func NewLimiter(up_limit, down_limit int) (Limiter, os.Error) {
 	l.upload, l.up_reset, l.download, l.down_reset = -1, -1, -1, -1
 	if up_limit > 0 || down_limit > 0 {
 		l.reset = time.NewTicker(NS_PER_S)
+		l.quit = make(chan bool)
 		if up_limit > 0 {
 			l.up_mutex = new(sync.Mutex)
 			l.up_chan = make(chan bool)
@@ -88,9 +91,20 @@ func (l *limiter) WaitReceive(size int64) int64 {
 	return size
 }
 
+// Stop resetting the limits
+
+func (l *limiter) Close() {
+	if l.reset != nil {
+		l.reset.Stop()
+		close(l.quit)
+	}
+}
+
 func (l *limiter) run() {
 	for {
 		select {
+		case <- l.quit:
+			return
 		case <- l.reset.C:
 			// Reset upload limit
 			l.up_mutex.Lock()
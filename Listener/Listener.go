@@ -5,36 +5,154 @@ import(
 	"log"
 	"os"
 	"wgo/peers"
-	"strings"
+	"wgo/mse"
+	"wgo/ipfilter"
+	"sync"
 )
 
+// Accepts the incoming connections of all the torrents and gives each
+// one to the PeerMgr of the infohash it asks for
+
 type Listener struct {
+	mutex *sync.Mutex
 	listener net.Listener
-	peerMgr peers.PeerMgr
+	peerMgrs map[string]peers.PeerMgr
+	encryption int
+	listeners []net.Listener
+	closed bool
+	filter *ipfilter.Filter
 }
 
-func NewListener(ip, port string, peerMgr peers.PeerMgr) (l *Listener, cport string, err os.Error) {
+func NewListener(ip, port string) (l *Listener, cport string, err os.Error) {
 	l = new(Listener)
-	l.listener, err = net.Listen("tcp4", ip + ":" + port)
+	l.mutex = new(sync.Mutex)
+	l.peerMgrs = make(map[string]peers.PeerMgr)
+	l.encryption = mse.PREFER_ENCRYPTED
+	l.filter = ipfilter.NewFilter()
+	// Without ip the socket is dual stack, IPv4 peers use mapped addresses
+	l.listener, err = net.Listen("tcp", net.JoinHostPort(ip, port))
 	if err != nil {
 		log.Println(err)
-		//return
+		return
 	}
-	l.peerMgr = peerMgr
+	l.listeners = []net.Listener{l.listener}
 	log.Println("Listening on:", l.listener.Addr().String())
-	cport = l.listener.Addr().String()[strings.LastIndex(l.listener.Addr().String(), ":")+1:]
+	_, cport, err = net.SplitHostPort(l.listener.Addr().String())
 	go l.Run()
 	return
 }
 
+// Receive the incoming connections of the torrent of peerMgr. Connections
+// for unknown torrents are refused, e.g. while fetching the metadata of
+// a magnet.
+
+func (l *Listener) AddPeerMgr(peerMgr peers.PeerMgr) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.peerMgrs[peerMgr.Infohash()] = peerMgr
+}
+
+func (l *Listener) RemovePeerMgr(infohash string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.peerMgrs[infohash] = nil, false
+}
+
+// Encryption policy of the handshake, before the torrent is known. A
+// torrent that requires encryption still refuses plaintext peers.
+
+func (l *Listener) SetEncryption(policy int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.encryption = policy
+}
+
+// Connections from addresses denied by the filter are closed before the
+// handshake
+
+func (l *Listener) SetFilter(f *ipfilter.Filter) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.filter = f
+}
+
+// Accept connections from another transport too, e.g. a uTP socket
+
+func (l *Listener) AddListener(listener net.Listener) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.listeners = append(l.listeners, listener)
+	go l.run(listener)
+}
+
+// Stop accepting connections, the listeners added are closed too
+
+func (l *Listener) Close() {
+	l.mutex.Lock()
+	l.closed = true
+	listeners := l.listeners
+	l.mutex.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
 func (l *Listener) Run() {
+	l.run(l.listener)
+}
+
+func (l *Listener) run(listener net.Listener) {
 	for {
-		c, err := l.listener.Accept()
+		c, err := listener.Accept()
 		if err != nil {
+			l.mutex.Lock()
+			closed := l.closed
+			l.mutex.Unlock()
+			if closed {
+				return
+			}
 			log.Println(err)
 			continue
 		}
 		//log.Println("Listener -> New connection from:", c.RemoteAddr().String())
-		l.peerMgr.AddPeer(c)
+		l.mutex.Lock()
+		n := len(l.peerMgrs)
+		filter := l.filter
+		l.mutex.Unlock()
+		if n == 0 || !filter.Allowed(c.RemoteAddr().String()) {
+			c.Close()
+			continue
+		}
+		go l.accept(c)
+	}
+}
+
+// Answer the MSE handshake if the peer starts one and find the torrent,
+// from the MSE handshake or from the BitTorrent one
+
+func (l *Listener) accept(c net.Conn) {
+	l.mutex.Lock()
+	infohashes := make([]string, 0, len(l.peerMgrs))
+	for infohash, _ := range l.peerMgrs {
+		infohashes = append(infohashes, infohash)
+	}
+	policy := l.encryption
+	l.mutex.Unlock()
+	conn, infohash, err := mse.Accept(c, infohashes, policy)
+	if err == nil && len(infohash) == 0 {
+		infohash, err = conn.Infohash()
+	}
+	if err != nil {
+		//log.Println("Listener -> Handshake with", c.RemoteAddr().String(), "failed:", err)
+		c.Close()
+		return
+	}
+	l.mutex.Lock()
+	peerMgr, ok := l.peerMgrs[infohash]
+	l.mutex.Unlock()
+	if !ok || (peerMgr.Encryption() == mse.REQUIRE_ENCRYPTED && !conn.Encrypted()) {
+		c.Close()
+		return
 	}
+	peerMgr.AddPeer(conn)
 }
@@ -0,0 +1,97 @@
+// Parse magnet links (BEP 9)
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package main
+
+import(
+	"os"
+	"http"
+	"strings"
+	"encoding/hex"
+	)
+
+type Magnet struct {
+	Infohash string
+	Name string
+	// Trackers of the tr parameters, as a single tier
+	Trackers [][]string
+	// Peer addresses of the x.pe parameters
+	Peers []string
+}
+
+func ParseMagnet(uri string) (m *Magnet, err os.Error) {
+	if !strings.HasPrefix(uri, "magnet:?") {
+		return nil, os.NewError("Not a magnet link " + uri)
+	}
+	params, err := http.ParseQuery(uri[len("magnet:?"):])
+	if err != nil {
+		return
+	}
+	m = new(Magnet)
+	trackers := make([]string, 0)
+	for key, values := range params {
+		// Parameters can be numbered, e.g. tr.1
+		if n := strings.Index(key, "."); n != -1 && key != "x.pe" {
+			key = key[0:n]
+		}
+		for _, value := range values {
+			switch key {
+				case "xt":
+					if strings.HasPrefix(value, "urn:btih:") {
+						if m.Infohash, err = decodeInfohash(value[len("urn:btih:"):]); err != nil {
+							return nil, err
+						}
+					}
+				case "dn":
+					m.Name = value
+				case "tr":
+					trackers = append(trackers, value)
+				case "x.pe":
+					m.Peers = append(m.Peers, value)
+			}
+		}
+	}
+	if len(m.Infohash) == 0 {
+		return nil, os.NewError("Magnet link without BitTorrent infohash")
+	}
+	if len(trackers) > 0 {
+		m.Trackers = [][]string{trackers}
+	}
+	return
+}
+
+// The infohash is encoded in hex (40 characters) or base32 (32 characters)
+
+func decodeInfohash(s string) (infohash string, err os.Error) {
+	var b []byte
+	switch len(s) {
+		case 40:
+			b, err = hex.DecodeString(s)
+		case 32:
+			b, err = decodeBase32(s)
+		default:
+			err = os.NewError("Invalid infohash length")
+	}
+	return string(b), err
+}
+
+func decodeBase32(s string) (b []byte, err os.Error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	s = strings.ToUpper(s)
+	var bits, n uint
+	for i := 0; i < len(s); i++ {
+		v := strings.IndexRune(alphabet, int(s[i]))
+		if v == -1 {
+			return nil, os.NewError("Invalid base32 character")
+		}
+		bits = bits<<5 | uint(v)
+		n += 5
+		if n >= 8 {
+			n -= 8
+			b = append(b, byte(bits>>n))
+			bits &= 1<<n - 1
+		}
+	}
+	return
+}
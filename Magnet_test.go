@@ -0,0 +1,62 @@
+package main
+
+import(
+	"testing"
+	"encoding/hex"
+	)
+
+func TestDecodeBase32(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"MY", "f"},
+		{"MZXQ", "fo"},
+		{"MZXW6", "foo"},
+		{"MZXW6YQ", "foob"},
+		{"MZXW6YTB", "fooba"},
+		{"mzxw6ytboi", "foobar"},
+	}
+	for _, test := range tests {
+		b, err := decodeBase32(test.in)
+		if err != nil || string(b) != test.out {
+			t.Errorf("decodeBase32(%q) = %q, %v, expected %q", test.in, b, err, test.out)
+		}
+	}
+	if _, err := decodeBase32("MZXW1"); err == nil {
+		t.Errorf("Decoded an invalid base32 character")
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	infohash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	m, err := ParseMagnet("magnet:?xt=urn:btih:" + infohash + "&dn=Some+name&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr.1=http%3A%2F%2Fexample.org%2Fannounce&x.pe=10.0.0.1%3A6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString([]byte(m.Infohash)) != infohash {
+		t.Errorf("Got infohash %x, expected %s", m.Infohash, infohash)
+	}
+	if m.Name != "Some name" {
+		t.Errorf("Got name %q", m.Name)
+	}
+	if len(m.Trackers) != 1 || len(m.Trackers[0]) != 2 {
+		t.Errorf("Got trackers %v, expected a tier with two", m.Trackers)
+	}
+	if len(m.Peers) != 1 || m.Peers[0] != "10.0.0.1:6881" {
+		t.Errorf("Got peers %v", m.Peers)
+	}
+	// The same infohash in base32
+	m, err = ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString([]byte(m.Infohash)) != infohash || m.Trackers != nil {
+		t.Errorf("Got infohash %x and trackers %v", m.Infohash, m.Trackers)
+	}
+	for _, uri := range []string{"http://example.com", "magnet:?dn=name", "magnet:?xt=urn:btih:1234"} {
+		if _, err = ParseMagnet(uri); err == nil {
+			t.Errorf("Parsed invalid magnet link %s", uri)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+// Message stream encryption (MSE/PE), obfuscates the BitTorrent
+// handshake and optionally encrypts the whole connection with RC4
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package mse
+
+import(
+	"os"
+	"io"
+	"net"
+	"big"
+	"bufio"
+	"bytes"
+	"crypto/rc4"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	)
+
+// Policies for the connections
+
+const(
+	PLAINTEXT = iota // Never use MSE
+	PREFER_ENCRYPTED // Try MSE first, fall back to plaintext
+	REQUIRE_ENCRYPTED // Only RC4 encrypted connections
+)
+
+// Methods of crypto_provide and crypto_select
+
+const(
+	CRYPTO_PLAINTEXT = 0x01
+	CRYPTO_RC4 = 0x02
+)
+
+const(
+	KEY_LEN = 96 // Length of the DH public keys
+	SECRET_LEN = 20 // Length of the DH private keys
+	MAX_PAD = 512
+	RC4_DISCARD = 1024
+	PROTOCOL = "BitTorrent protocol"
+	HANDSHAKE_TIMEOUT = 30e9 // ns
+)
+
+var P, G *big.Int
+
+func init() {
+	P, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	G = big.NewInt(2)
+}
+
+// Connection after the MSE handshake. Data is encrypted only if RC4 was
+// selected, otherwise it behaves like the underlying connection.
+
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+	// Plaintext already received, e.g. the initial payload
+	pending []byte
+	enc, dec *rc4.Cipher
+}
+
+func newConn(conn net.Conn) (c *Conn) {
+	c = new(Conn)
+	c.Conn = conn
+	c.r = bufio.NewReader(conn)
+	return
+}
+
+func (c *Conn) Read(b []byte) (n int, err os.Error) {
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return
+	}
+	n, err = c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[0:n], b[0:n])
+	}
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err os.Error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Returns true if the connection is encrypted with RC4
+
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+// Infohash of the BitTorrent handshake of a plaintext connection, used
+// to route it to its torrent. The bytes read are returned by Read.
+
+func (c *Conn) Infohash() (infohash string, err os.Error) {
+	if c.dec != nil {
+		return "", os.NewError("Encrypted connection")
+	}
+	// pstrlen, pstr, reserved, info_hash
+	n := 1+len(PROTOCOL)+8+sha1.Size
+	if len(c.pending) < n {
+		buf := make([]byte, n-len(c.pending))
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return
+		}
+		c.pending = append(c.pending, buf...)
+	}
+	if c.pending[0] != byte(len(PROTOCOL)) || string(c.pending[1:1+len(PROTOCOL)]) != PROTOCOL {
+		return "", os.NewError("Invalid handshake")
+	}
+	return string(c.pending[n-sha1.Size:n]), nil
+}
+
+// Start the handshake on an outgoing connection. With PREFER_ENCRYPTED
+// the remote peer can select plaintext.
+
+func Dial(conn net.Conn, infohash string, policy int) (c *Conn, err os.Error) {
+	if policy == PLAINTEXT {
+		return nil, os.NewError("MSE disabled by policy")
+	}
+	provide := uint32(CRYPTO_RC4)
+	if policy == PREFER_ENCRYPTED {
+		provide |= CRYPTO_PLAINTEXT
+	}
+	if err = conn.SetTimeout(HANDSHAKE_TIMEOUT); err != nil {
+		return
+	}
+	c = newConn(conn)
+	x, y, err := keyPair()
+	if err != nil {
+		return
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(append(y, padA...)); err != nil {
+		return
+	}
+	yb := make([]byte, KEY_LEN)
+	if _, err = io.ReadFull(c.r, yb); err != nil {
+		return
+	}
+	s := secret(x, yb)
+	skey := []byte(infohash)
+	enc, err := newRC4(hash([]byte("keyA"), s, skey))
+	if err != nil {
+		return
+	}
+	dec, err := newRC4(hash([]byte("keyB"), s, skey))
+	if err != nil {
+		return
+	}
+	padC, err := randomPad()
+	if err != nil {
+		return
+	}
+	// VC, crypto_provide, len(PadC), PadC, len(IA) with an empty IA,
+	// the BitTorrent handshake is sent afterwards by the Wire
+	msg := make([]byte, 8+4+2+len(padC)+2)
+	binary.BigEndian.PutUint32(msg[8:12], provide)
+	binary.BigEndian.PutUint16(msg[12:14], uint16(len(padC)))
+	copy(msg[14:], padC)
+	enc.XORKeyStream(msg, msg)
+	req := bytes.NewBuffer(hash([]byte("req1"), s))
+	req.Write(xor(hash([]byte("req2"), skey), hash([]byte("req3"), s)))
+	req.Write(msg)
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return
+	}
+	// The encrypted VC marks the end of PadB
+	vc := make([]byte, 8)
+	dec.XORKeyStream(vc, vc)
+	if err = synchronize(c.r, vc, MAX_PAD); err != nil {
+		return
+	}
+	header := make([]byte, 6)
+	if _, err = io.ReadFull(c.r, header); err != nil {
+		return
+	}
+	dec.XORKeyStream(header, header)
+	sel := binary.BigEndian.Uint32(header[0:4])
+	padD := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if len(padD) > MAX_PAD {
+		return nil, os.NewError("Invalid PadD length")
+	}
+	if _, err = io.ReadFull(c.r, padD); err != nil {
+		return
+	}
+	dec.XORKeyStream(padD, padD)
+	switch {
+		case sel == CRYPTO_RC4:
+			c.enc, c.dec = enc, dec
+		case sel == CRYPTO_PLAINTEXT && provide&CRYPTO_PLAINTEXT != 0:
+		default:
+			return nil, os.NewError("Invalid crypto_select")
+	}
+	return
+}
+
+// Answer the handshake of an incoming connection. Plain BitTorrent
+// handshakes are accepted unless the policy requires encryption. The
+// infohash the peer asked for is returned, it's empty for plaintext
+// connections since the Wire reads it from the BitTorrent handshake.
+
+func Accept(conn net.Conn, infohashes []string, policy int) (c *Conn, infohash string, err os.Error) {
+	if err = conn.SetTimeout(HANDSHAKE_TIMEOUT); err != nil {
+		return
+	}
+	c = newConn(conn)
+	head := make([]byte, 1+len(PROTOCOL))
+	if _, err = io.ReadFull(c.r, head); err != nil {
+		return
+	}
+	if head[0] == byte(len(PROTOCOL)) && string(head[1:]) == PROTOCOL {
+		if policy == REQUIRE_ENCRYPTED {
+			return nil, "", os.NewError("Plaintext connection not allowed")
+		}
+		c.pending = head
+		return
+	}
+	if policy == PLAINTEXT {
+		return nil, "", os.NewError("Encrypted connection not allowed")
+	}
+	ya := make([]byte, KEY_LEN)
+	copy(ya, head)
+	if _, err = io.ReadFull(c.r, ya[len(head):]); err != nil {
+		return
+	}
+	x, y, err := keyPair()
+	if err != nil {
+		return
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(append(y, padB...)); err != nil {
+		return
+	}
+	s := secret(x, ya)
+	if err = synchronize(c.r, hash([]byte("req1"), s), MAX_PAD); err != nil {
+		return
+	}
+	// HASH('req2', SKEY) xor HASH('req3', S) tells us the torrent
+	req := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(c.r, req); err != nil {
+		return
+	}
+	req = xor(req, hash([]byte("req3"), s))
+	for _, ih := range infohashes {
+		if bytes.Equal(req, hash([]byte("req2"), []byte(ih))) {
+			infohash = ih
+			break
+		}
+	}
+	if len(infohash) == 0 {
+		return nil, "", os.NewError("Unknown infohash")
+	}
+	skey := []byte(infohash)
+	dec, err := newRC4(hash([]byte("keyA"), s, skey))
+	if err != nil {
+		return
+	}
+	enc, err := newRC4(hash([]byte("keyB"), s, skey))
+	if err != nil {
+		return
+	}
+	header := make([]byte, 8+4+2)
+	if _, err = io.ReadFull(c.r, header); err != nil {
+		return
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[0:8], make([]byte, 8)) {
+		return nil, "", os.NewError("Invalid VC")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:14]))
+	if len(padC) > MAX_PAD {
+		return nil, "", os.NewError("Invalid PadC length")
+	}
+	if _, err = io.ReadFull(c.r, padC); err != nil {
+		return
+	}
+	dec.XORKeyStream(padC, padC)
+	length := make([]byte, 2)
+	if _, err = io.ReadFull(c.r, length); err != nil {
+		return
+	}
+	dec.XORKeyStream(length, length)
+	ia := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err = io.ReadFull(c.r, ia); err != nil {
+		return
+	}
+	dec.XORKeyStream(ia, ia)
+	c.pending = ia
+	var sel uint32
+	switch {
+		case provide&CRYPTO_RC4 != 0:
+			sel = CRYPTO_RC4
+		case provide&CRYPTO_PLAINTEXT != 0 && policy != REQUIRE_ENCRYPTED:
+			sel = CRYPTO_PLAINTEXT
+		default:
+			return nil, "", os.NewError("No suitable crypto method")
+	}
+	padD, err := randomPad()
+	if err != nil {
+		return
+	}
+	msg := make([]byte, 8+4+2+len(padD))
+	binary.BigEndian.PutUint32(msg[8:12], sel)
+	binary.BigEndian.PutUint16(msg[12:14], uint16(len(padD)))
+	copy(msg[14:], padD)
+	enc.XORKeyStream(msg, msg)
+	if _, err = conn.Write(msg); err != nil {
+		return
+	}
+	if sel == CRYPTO_RC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return
+}
+
+// Private key and public key (G^X mod P) of a DH key exchange
+
+func keyPair() (x *big.Int, y []byte, err os.Error) {
+	b := make([]byte, SECRET_LEN)
+	if _, err = io.ReadFull(rand.Reader, b); err != nil {
+		return
+	}
+	x = new(big.Int).SetBytes(b)
+	y = pad(new(big.Int).Exp(G, x, P).Bytes())
+	return
+}
+
+// Shared secret S from our private key and the remote public key
+
+func secret(x *big.Int, y []byte) []byte {
+	return pad(new(big.Int).Exp(new(big.Int).SetBytes(y), x, P).Bytes())
+}
+
+// Left pad a big endian number to KEY_LEN bytes
+
+func pad(b []byte) []byte {
+	if len(b) >= KEY_LEN {
+		return b
+	}
+	r := make([]byte, KEY_LEN)
+	copy(r[KEY_LEN-len(b):], b)
+	return r
+}
+
+// Random padding of 0 to MAX_PAD bytes
+
+func randomPad() (b []byte, err os.Error) {
+	n := make([]byte, 2)
+	if _, err = io.ReadFull(rand.Reader, n); err != nil {
+		return
+	}
+	b = make([]byte, int(binary.BigEndian.Uint16(n))%(MAX_PAD+1))
+	_, err = io.ReadFull(rand.Reader, b)
+	return
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum()
+}
+
+func xor(a, b []byte) []byte {
+	r := make([]byte, len(a))
+	for i := range r {
+		r[i] = a[i] ^ b[i]
+	}
+	return r
+}
+
+// RC4 cipher with the first RC4_DISCARD bytes of keystream discarded
+
+func newRC4(key []byte) (c *rc4.Cipher, err os.Error) {
+	if c, err = rc4.NewCipher(key); err != nil {
+		return
+	}
+	discard := make([]byte, RC4_DISCARD)
+	c.XORKeyStream(discard, discard)
+	return
+}
+
+// Read until mark is found, skipping at most maxPad bytes before it
+
+func synchronize(r *bufio.Reader, mark []byte, maxPad int) (err os.Error) {
+	window := make([]byte, 0, len(mark))
+	for i := 0; i < maxPad+len(mark); i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(mark) {
+			copy(window, window[1:])
+			window = window[0:len(mark)-1]
+		}
+		window = append(window, b)
+		if bytes.Equal(window, mark) {
+			return nil
+		}
+	}
+	return os.NewError("MSE synchronization failed")
+}
@@ -0,0 +1,146 @@
+package mse
+
+import(
+	"io"
+	"os"
+	"net"
+	"bufio"
+	"bytes"
+	"testing"
+	)
+
+const INFOHASH = "abcdefghij0123456789"
+
+type acceptResult struct {
+	c *Conn
+	infohash string
+	err os.Error
+}
+
+// Run a handshake over a loopback connection, the outgoing side uses
+// dialPolicy and the incoming side acceptPolicy
+
+func handshake(t *testing.T, dialPolicy, acceptPolicy int, infohashes []string) (out *Conn, in acceptResult, err os.Error) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan acceptResult)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- acceptResult{err: err}
+			return
+		}
+		c, infohash, err := Accept(conn, infohashes, acceptPolicy)
+		if err != nil {
+			conn.Close()
+		}
+		done <- acceptResult{c, infohash, err}
+	}()
+	conn, err := net.Dial("tcp4", "", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = Dial(conn, INFOHASH, dialPolicy)
+	if err != nil {
+		conn.Close()
+	}
+	in = <- done
+	return
+}
+
+func exchange(t *testing.T, a, b *Conn) {
+	msg := []byte("\x13BitTorrent protocol message")
+	go a.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("Got %q, expected %q", buf, msg)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	out, in, err := handshake(t, REQUIRE_ENCRYPTED, PREFER_ENCRYPTED, []string{"01234567890123456789", INFOHASH})
+	if err != nil || in.err != nil {
+		t.Fatal(err, in.err)
+	}
+	defer out.Close()
+	defer in.c.Close()
+	if in.infohash != INFOHASH {
+		t.Errorf("Got infohash %q, expected %q", in.infohash, INFOHASH)
+	}
+	if !out.Encrypted() || !in.c.Encrypted() {
+		t.Errorf("Connection not encrypted")
+	}
+	exchange(t, out, in.c)
+	exchange(t, in.c, out)
+}
+
+func TestPlaintextFallback(t *testing.T) {
+	// A plain BitTorrent handshake is accepted unless encryption is required
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan acceptResult)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- acceptResult{err: err}
+			return
+		}
+		c, infohash, err := Accept(conn, []string{INFOHASH}, PREFER_ENCRYPTED)
+		done <- acceptResult{c, infohash, err}
+	}()
+	conn, err := net.Dial("tcp4", "", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00" + INFOHASH)
+	conn.Write(msg)
+	in := <- done
+	if in.err != nil {
+		t.Fatal(in.err)
+	}
+	defer in.c.Close()
+	if in.c.Encrypted() {
+		t.Errorf("Plaintext connection marked as encrypted")
+	}
+	if infohash, err := in.c.Infohash(); err != nil || infohash != INFOHASH {
+		t.Errorf("Got infohash %q, %v, expected %q", infohash, err, INFOHASH)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(in.c, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("Got %q, expected %q", buf, msg)
+	}
+}
+
+func TestUnknownInfohash(t *testing.T) {
+	out, in, _ := handshake(t, REQUIRE_ENCRYPTED, REQUIRE_ENCRYPTED, []string{"01234567890123456789"})
+	if out != nil {
+		out.Close()
+	}
+	if in.err == nil {
+		in.c.Close()
+		t.Errorf("Unknown infohash accepted")
+	}
+}
+
+func TestSynchronize(t *testing.T) {
+	for _, n := range []int{0, 1, MAX_PAD} {
+		r := bufio.NewReader(bytes.NewBuffer(append(make([]byte, n), []byte("mark")...)))
+		if err := synchronize(r, []byte("mark"), MAX_PAD); err != nil {
+			t.Errorf("Padding of %d bytes: %s", n, err)
+		}
+	}
+	r := bufio.NewReader(bytes.NewBuffer(append(make([]byte, MAX_PAD+1), []byte("mark")...)))
+	if err := synchronize(r, []byte("mark"), MAX_PAD); err == nil {
+		t.Errorf("Synchronized after more than MAX_PAD bytes")
+	}
+}
@@ -0,0 +1,101 @@
+// Hosts banned for sending corrupt data, shared by the PeerMgrs of
+// several torrents and saved between runs
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	)
+
+type BanList struct {
+	mutex *sync.Mutex
+	hosts map[string]bool
+	// One host per line, empty keeps the list in memory
+	path string
+}
+
+// Load the hosts banned in a previous run from path
+
+func NewBanList(path string) (b *BanList) {
+	b = new(BanList)
+	b.mutex = new(sync.Mutex)
+	b.hosts = make(map[string]bool)
+	b.path = path
+	if len(path) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, host := range strings.Split(string(data), "\n", -1) {
+		if host = strings.TrimSpace(host); len(host) > 0 {
+			b.hosts[host] = true
+		}
+	}
+	log.Println("BanList -> Loaded", len(b.hosts), "banned hosts from", path)
+	return
+}
+
+// Ban the host of addr, every port of it
+
+func (b *BanList) Ban(addr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	host := hostOf(addr)
+	if b.hosts[host] {
+		return
+	}
+	b.hosts[host] = true
+	b.save()
+}
+
+func (b *BanList) Banned(addr string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.hosts[hostOf(addr)]
+}
+
+func (b *BanList) Hosts() (hosts []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	hosts = make([]string, 0, len(b.hosts))
+	for host, _ := range b.hosts {
+		hosts = append(hosts, host)
+	}
+	return
+}
+
+func (b *BanList) save() {
+	if len(b.path) == 0 {
+		return
+	}
+	hosts := make([]string, 0, len(b.hosts))
+	for host, _ := range b.hosts {
+		hosts = append(hosts, host)
+	}
+	// Write to a temporary file and rename it so the list is never left
+	// half written
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(hosts, "\n") + "\n"), 0644); err != nil {
+		log.Println("BanList -> Error saving banned hosts:", err)
+		return
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		log.Println("BanList -> Error saving banned hosts:", err)
+	}
+}
+
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(normalizeAddr(addr)); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,49 @@
+// Limit of peer connections shared by the PeerMgrs of several torrents
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"sync"
+	)
+
+type Connections struct {
+	mutex *sync.Mutex
+	max, count int
+}
+
+// max <= 0 means no limit
+
+func NewConnections(max int) (c *Connections) {
+	c = new(Connections)
+	c.mutex = new(sync.Mutex)
+	c.max = max
+	return
+}
+
+// Take a connection, returns false if the limit has been reached
+
+func (c *Connections) Acquire() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.max > 0 && c.count >= c.max {
+		return false
+	}
+	c.count++
+	return true
+}
+
+func (c *Connections) Release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.count > 0 {
+		c.count--
+	}
+}
+
+func (c *Connections) Count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.count
+}
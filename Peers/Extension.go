@@ -0,0 +1,241 @@
+// Extension protocol (BEP 10), extensions are registered by name and
+// receive the extended messages sent by peers
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"os"
+	"net"
+	"sync"
+	"bytes"
+	"wgo/bencode"
+	)
+
+const(
+	EXTENDED_HANDSHAKE = 0 // extended message id of the handshake
+	EXTENDED_REQQ = 250 // outstanding requests we accept
+	CLIENT_VERSION = "wgo 0.1"
+)
+
+// An extension built on top of the extension protocol
+
+type Extension interface {
+	// Name used in the "m" dictionary, e.g. "ut_metadata"
+	Name() string
+	// The peer sent its extended handshake
+	Handshake(p ExtendedPeer, h *ExtHandshake)
+	// Extended message for this extension, without the extended id
+	Message(p ExtendedPeer, payLoad []byte) os.Error
+	PeerExit(addr string)
+}
+
+// Connection that talks the extension protocol, implemented by Peer and
+// by the connections used to fetch the metadata of magnet links
+
+type ExtendedPeer interface {
+	Addr() string
+	Extended() *ExtHandshake
+	SendExtended(name string, payLoad []byte) os.Error
+}
+
+// Data negotiated with the extended handshake
+
+type ExtHandshake struct {
+	// Extension name -> extended message id used by the peer
+	M map[string]int64
+	V string
+	P int64
+	Reqq int64
+	Yourip string
+	Metadata_size int64
+	// Complete handshake dictionary, for fields not decoded above
+	Dict map[string]interface{}
+}
+
+// Registry of the extensions used by a torrent. Local extended ids are
+// assigned in registration order, starting at 1.
+
+type Extensions struct {
+	mutex *sync.Mutex
+	extensions []Extension
+	// Extra fields sent in our handshake
+	fields map[string]interface{}
+}
+
+func NewExtensions() (e *Extensions) {
+	e = new(Extensions)
+	e.mutex = new(sync.Mutex)
+	e.fields = make(map[string]interface{})
+	e.fields["v"] = CLIENT_VERSION
+	e.fields["reqq"] = int64(EXTENDED_REQQ)
+	return
+}
+
+func (e *Extensions) Register(ext Extension) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.extensions = append(e.extensions, ext)
+}
+
+// Set a field of our extended handshake, like "p" or "metadata_size"
+
+func (e *Extensions) SetField(key string, value interface{}) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.fields[key] = value
+}
+
+func (e *Extensions) Get(name string) Extension {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, ext := range e.extensions {
+		if ext.Name() == name {
+			return ext
+		}
+	}
+	return nil
+}
+
+// Extension that uses the local extended id
+
+func (e *Extensions) ById(id uint8) Extension {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if id == EXTENDED_HANDSHAKE || int(id) > len(e.extensions) {
+		return nil
+	}
+	return e.extensions[id-1]
+}
+
+// Notify the extensions supported by both sides of the handshake of p
+
+func (e *Extensions) PeerHandshake(p ExtendedPeer, h *ExtHandshake) {
+	for name, _ := range h.M {
+		if ext := e.Get(name); ext != nil {
+			ext.Handshake(p, h)
+		}
+	}
+}
+
+// Dispatch an extended message that isn't a handshake
+
+func (e *Extensions) Message(p ExtendedPeer, payLoad []byte) os.Error {
+	ext := e.ById(payLoad[0])
+	if ext == nil {
+		return os.NewError("Unknown extended message")
+	}
+	return ext.Message(p, payLoad[1:])
+}
+
+func (e *Extensions) PeerExit(addr string) {
+	e.mutex.Lock()
+	extensions := e.extensions
+	e.mutex.Unlock()
+	for _, ext := range extensions {
+		ext.PeerExit(addr)
+	}
+}
+
+// Build our extended handshake for the peer at addr
+
+func (e *Extensions) Handshake(addr string) (payLoad []byte, err os.Error) {
+	e.mutex.Lock()
+	h := make(map[string]interface{})
+	for k, v := range e.fields {
+		h[k] = v
+	}
+	m := make(map[string]interface{})
+	for i, ext := range e.extensions {
+		m[ext.Name()] = int64(i+1)
+	}
+	e.mutex.Unlock()
+	h["m"] = m
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			h["yourip"] = string(ip)
+		}
+	}
+	var b bytes.Buffer
+	b.WriteByte(EXTENDED_HANDSHAKE)
+	if err = bencode.Marshal(&b, h); err != nil {
+		return
+	}
+	return b.Bytes(), nil
+}
+
+func decodeExtHandshake(data []byte) (h *ExtHandshake, err os.Error) {
+	v, err := bencode.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, os.NewError("Extended handshake is not a dictionary")
+	}
+	h = new(ExtHandshake)
+	h.Dict = d
+	h.M = make(map[string]int64)
+	if m, ok := d["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if i, ok := id.(int64); ok && i > 0 && i < 256 {
+				h.M[name] = i
+			}
+		}
+	}
+	h.V, _ = d["v"].(string)
+	h.P, _ = d["p"].(int64)
+	h.Reqq, _ = d["reqq"].(int64)
+	h.Yourip, _ = d["yourip"].(string)
+	h.Metadata_size, _ = d["metadata_size"].(int64)
+	return
+}
+
+// Decode a handshake received after prev, nil for the first one, and
+// return the resulting handshake
+
+func mergeExtHandshake(prev *ExtHandshake, data []byte) (h *ExtHandshake, err os.Error) {
+	if h, err = decodeExtHandshake(data); err != nil || prev == nil {
+		return
+	}
+	prev.update(h)
+	return prev, nil
+}
+
+// Merge a later handshake into h, as allowed by BEP 10: only the fields
+// present are updated and an id of 0 disables an extension
+
+func (h *ExtHandshake) update(n *ExtHandshake) {
+	if m, ok := n.Dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if i, ok := id.(int64); ok && i == 0 {
+				h.M[name] = 0, false
+			}
+		}
+	}
+	for name, id := range n.M {
+		h.M[name] = id
+	}
+	for k, v := range n.Dict {
+		h.Dict[k] = v
+	}
+	if _, ok := n.Dict["v"]; ok {
+		h.V = n.V
+	}
+	if _, ok := n.Dict["p"]; ok {
+		h.P = n.P
+	}
+	if _, ok := n.Dict["reqq"]; ok {
+		h.Reqq = n.Reqq
+	}
+	if _, ok := n.Dict["yourip"]; ok {
+		h.Yourip = n.Yourip
+	}
+	if _, ok := n.Dict["metadata_size"]; ok {
+		h.Metadata_size = n.Metadata_size
+	}
+}
@@ -0,0 +1,206 @@
+package peers
+
+import(
+	"os"
+	"testing"
+	)
+
+// Extension that counts what it receives
+
+type fakeExtension struct {
+	name string
+	handshakes int
+	messages [][]byte
+	exits []string
+}
+
+func (f *fakeExtension) Name() string {
+	return f.name
+}
+
+func (f *fakeExtension) Handshake(p ExtendedPeer, h *ExtHandshake) {
+	f.handshakes++
+}
+
+func (f *fakeExtension) Message(p ExtendedPeer, payLoad []byte) os.Error {
+	f.messages = append(f.messages, payLoad)
+	return nil
+}
+
+func (f *fakeExtension) PeerExit(addr string) {
+	f.exits = append(f.exits, addr)
+}
+
+func sameIds(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, id := range a {
+		if i, ok := b[name]; !ok || i != id {
+			return false
+		}
+	}
+	return true
+}
+
+// Local ids in registration order, messages and handshakes reach only
+// the extensions they are for
+
+func TestExtensionsRegistry(t *testing.T) {
+	e := NewExtensions()
+	a, b := &fakeExtension{name: "a"}, &fakeExtension{name: "b"}
+	e.Register(a)
+	e.Register(b)
+	tests := []struct {
+		id uint8
+		ext Extension
+	}{
+		{EXTENDED_HANDSHAKE, nil},
+		{1, a},
+		{2, b},
+		{3, nil},
+		{255, nil},
+	}
+	for _, test := range tests {
+		if ext := e.ById(test.id); ext != test.ext {
+			t.Errorf("ById(%d) got %v, expected %v", test.id, ext, test.ext)
+		}
+	}
+	if e.Get("b") != b || e.Get("c") != nil {
+		t.Errorf("Get found the wrong extensions")
+	}
+	peer := newFakeExtPeer("10.0.0.1:6881", 0)
+	if err := e.Message(peer, []byte{2, 'x'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Message(peer, []byte{3, 'x'}); err == nil {
+		t.Errorf("Accepted a message for an unknown extension")
+	}
+	if len(a.messages) != 0 || len(b.messages) != 1 || string(b.messages[0]) != "x" {
+		t.Errorf("Got messages %v and %v, expected only x for b", a.messages, b.messages)
+	}
+	// c isn't ours, a isn't the peer's
+	e.PeerHandshake(peer, &ExtHandshake{M: map[string]int64{"b": 5, "c": 1}})
+	if a.handshakes != 0 || b.handshakes != 1 {
+		t.Errorf("Got %d and %d handshakes, expected 0 and 1", a.handshakes, b.handshakes)
+	}
+	e.PeerExit(peer.Addr())
+	if len(a.exits) != 1 || len(b.exits) != 1 {
+		t.Errorf("Peer exit not sent to every extension")
+	}
+}
+
+// Our handshake decoded as a peer would, with the address it sees us at
+
+func TestExtHandshakeEncoding(t *testing.T) {
+	e := NewExtensions()
+	e.Register(&fakeExtension{name: "ut_metadata"})
+	e.Register(&fakeExtension{name: "ut_pex"})
+	e.SetField("p", int64(6881))
+	e.SetField("metadata_size", int64(31235))
+	tests := []struct {
+		addr, yourip string
+	}{
+		{"10.0.0.1:6881", "\x0a\x00\x00\x01"},
+		{"[2001:db8::1]:6881", "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"},
+		{"unknown", ""},
+	}
+	for _, test := range tests {
+		payLoad, err := e.Handshake(test.addr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.addr, err)
+		}
+		if payLoad[0] != EXTENDED_HANDSHAKE {
+			t.Fatalf("%s: got extended id %d, expected the handshake", test.addr, payLoad[0])
+		}
+		h, err := decodeExtHandshake(payLoad[1:])
+		if err != nil {
+			t.Fatalf("%s: %s", test.addr, err)
+		}
+		if !sameIds(h.M, map[string]int64{"ut_metadata": 1, "ut_pex": 2}) {
+			t.Errorf("%s: got m %v", test.addr, h.M)
+		}
+		if h.V != CLIENT_VERSION || h.P != 6881 || h.Reqq != EXTENDED_REQQ || h.Metadata_size != 31235 {
+			t.Errorf("%s: got v %q p %d reqq %d metadata_size %d", test.addr, h.V, h.P, h.Reqq, h.Metadata_size)
+		}
+		if h.Yourip != test.yourip {
+			t.Errorf("%s: got yourip %q, expected %q", test.addr, h.Yourip, test.yourip)
+		}
+	}
+}
+
+func TestExtHandshakeDecoding(t *testing.T) {
+	tests := []struct {
+		name, data string
+		valid bool
+		m map[string]int64
+	}{
+		{"not a dictionary", "i5e", false, nil},
+		{"truncated", "d1:md6:ut_pexi1e", false, nil},
+		{"without m", "d1:v4:wgo1e", true, map[string]int64{}},
+		// Ids must fit in a byte and 0 only disables
+		{"ids", "d1:md1:ai0e1:bi-1e1:ci256e1:d1:x1:ei255e6:ut_pexi1eee", true, map[string]int64{"e": 255, "ut_pex": 1}},
+	}
+	for _, test := range tests {
+		h, err := decodeExtHandshake([]byte(test.data))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: accepted", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !sameIds(h.M, test.m) {
+			t.Errorf("%s: got m %v, expected %v", test.name, h.M, test.m)
+		}
+	}
+}
+
+// Later handshakes only change what they carry (BEP 10)
+
+func TestMergeExtHandshake(t *testing.T) {
+	first := "d1:md11:ut_metadatai3e6:ut_pexi1ee1:pi6881e1:v4:wgo1e"
+	tests := []struct {
+		name, later string
+		m map[string]int64
+		p int64
+		v string
+	}{
+		{"added", "d1:md11:lt_donthavei7eee", map[string]int64{"ut_metadata": 3, "ut_pex": 1, "lt_donthave": 7}, 6881, "wgo1"},
+		{"removed with id 0", "d1:md6:ut_pexi0eee", map[string]int64{"ut_metadata": 3}, 6881, "wgo1"},
+		{"new id", "d1:md11:ut_metadatai5eee", map[string]int64{"ut_metadata": 5, "ut_pex": 1}, 6881, "wgo1"},
+		{"other fields", "d1:pi7000e1:v4:wgo2e", map[string]int64{"ut_metadata": 3, "ut_pex": 1}, 7000, "wgo2"},
+		{"removing unknown", "d1:md1:xi0eee", map[string]int64{"ut_metadata": 3, "ut_pex": 1}, 6881, "wgo1"},
+	}
+	for _, test := range tests {
+		prev, err := mergeExtHandshake(nil, []byte(first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := mergeExtHandshake(prev, []byte(test.later))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if h != prev {
+			t.Errorf("%s: got a new handshake instead of the merged one", test.name)
+		}
+		if !sameIds(h.M, test.m) {
+			t.Errorf("%s: got m %v, expected %v", test.name, h.M, test.m)
+		}
+		if h.P != test.p || h.V != test.v {
+			t.Errorf("%s: got p %d v %q, expected %d %q", test.name, h.P, h.V, test.p, test.v)
+		}
+	}
+	// A broken handshake leaves the previous one alone
+	prev, _ := mergeExtHandshake(nil, []byte(first))
+	if _, err := mergeExtHandshake(prev, []byte("d1:m")); err == nil {
+		t.Errorf("Merged a broken handshake")
+	}
+	if !sameIds(prev.M, map[string]int64{"ut_metadata": 3, "ut_pex": 1}) {
+		t.Errorf("Broken handshake changed m to %v", prev.M)
+	}
+}
@@ -0,0 +1,271 @@
+// Fetches the metadata of magnet links from the peers of the swarm,
+// before the torrent can be started
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"os"
+	"log"
+	"sync"
+	"time"
+	"container/list"
+	"wgo/limiter"
+	"wgo/ipfilter"
+	)
+
+const(
+	METADATA_PEERS = 10 // simultaneous connections while fetching the metadata
+	METADATA_UNUSED_PEERS = 50
+)
+
+type MetadataFetcher struct {
+	mutex *sync.Mutex
+	infohash, peerId string
+	l limiter.Limiter
+	extensions *Extensions
+	metadata *UtMetadata
+	unusedPeers *list.List
+	// Every peer address we know about
+	known map[string]bool
+	conns map[string]*Wire
+	closed bool
+	// Closed by Close, stops the wait for the metadata
+	quit chan bool
+	encryption int
+	utp Dialer
+	filter *ipfilter.Filter
+}
+
+// Connection to a peer used only to exchange extended messages
+
+type metadataConn struct {
+	// Other connections may send requests through this one
+	mutex *sync.Mutex
+	addr string
+	wire *Wire
+	ext *ExtHandshake
+}
+
+func (c *metadataConn) Addr() string {
+	return c.addr
+}
+
+func (c *metadataConn) Extended() *ExtHandshake {
+	return c.ext
+}
+
+func (c *metadataConn) SendExtended(name string, payLoad []byte) os.Error {
+	id, ok := c.ext.M[name]
+	if !ok {
+		return os.NewError("Peer doesn't support extension " + name)
+	}
+	msg := &message{msgId: extended, payLoad: make([]byte, 1+len(payLoad))}
+	msg.payLoad[0] = uint8(id)
+	copy(msg.payLoad[1:], payLoad)
+	msg.length = uint32(1 + len(msg.payLoad))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.wire.WriteMsg(msg)
+}
+
+func NewMetadataFetcher(infohash, peerId string, l limiter.Limiter) (m *MetadataFetcher) {
+	m = new(MetadataFetcher)
+	m.mutex = new(sync.Mutex)
+	m.infohash = infohash
+	m.peerId = peerId
+	m.l = l
+	m.metadata = NewUtMetadata(infohash, nil)
+	m.extensions = NewExtensions()
+	m.extensions.Register(m.metadata)
+	m.unusedPeers = list.New()
+	m.known = make(map[string]bool)
+	m.conns = make(map[string]*Wire)
+	m.quit = make(chan bool)
+	return
+}
+
+func (m *MetadataFetcher) Extensions() *Extensions {
+	return m.extensions
+}
+
+// Encryption policy of the connections, one of the mse policies
+
+func (m *MetadataFetcher) SetEncryption(policy int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.encryption = policy
+}
+
+// Connect to peers with uTP before trying TCP
+
+func (m *MetadataFetcher) SetUtp(d Dialer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.utp = d
+}
+
+// Peers denied by the filter aren't dialled
+
+func (m *MetadataFetcher) SetFilter(f *ipfilter.Filter) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.filter = f
+}
+
+func (m *MetadataFetcher) AddPeers(peers *list.List) {
+	m.mutex.Lock()
+	for e := peers.Front(); e != nil; e = e.Next() {
+		if addr, ok := e.Value.(string); ok && !m.known[addr] && (m.filter == nil || m.filter.Allowed(addr)) {
+			m.known[addr] = true
+			m.unusedPeers.PushBack(addr)
+		}
+	}
+	m.mutex.Unlock()
+	m.connect()
+}
+
+func (m *MetadataFetcher) RequestPeers() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if n := METADATA_UNUSED_PEERS - m.unusedPeers.Len(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Block until the info dictionary has been downloaded and checked, the
+// fetcher is closed or timeout ns have passed, 0 waits forever
+
+func (m *MetadataFetcher) Metadata(timeout int64) (info []byte, err os.Error) {
+	var expired <-chan int64
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+		case <- m.metadata.Done():
+			return m.metadata.Info(), nil
+		case <- m.quit:
+			return nil, os.NewError("Metadata fetch cancelled")
+		case <- expired:
+			return nil, os.NewError("Timeout fetching the metadata")
+	}
+	return
+}
+
+// Every peer learned while fetching the metadata, so they can be
+// given to the PeerMgr of the torrent
+
+func (m *MetadataFetcher) Peers() (peers *list.List) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	peers = list.New()
+	for addr, _ := range m.known {
+		peers.PushBack(addr)
+	}
+	return
+}
+
+func (m *MetadataFetcher) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.quit)
+	for _, wire := range m.conns {
+		if wire != nil {
+			wire.Close()
+		}
+	}
+}
+
+// Open connections until there are METADATA_PEERS
+
+func (m *MetadataFetcher) connect() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for len(m.conns) < METADATA_PEERS && m.unusedPeers.Len() > 0 && !m.closed {
+		addr := m.unusedPeers.Remove(m.unusedPeers.Front()).(string)
+		m.conns[addr] = nil
+		go m.fetch(addr)
+	}
+}
+
+func (m *MetadataFetcher) fetch(addr string) {
+	c := &metadataConn{mutex: new(sync.Mutex), addr: addr}
+	defer func() {
+		m.mutex.Lock()
+		m.conns[addr] = nil, false
+		m.mutex.Unlock()
+		m.extensions.PeerExit(addr)
+		if c.wire != nil {
+			c.wire.Close()
+		}
+		select {
+			case <- m.metadata.Done():
+			default:
+				m.connect()
+		}
+	}()
+	m.mutex.Lock()
+	policy, utp := m.encryption, m.utp
+	m.mutex.Unlock()
+	conn, err := dialPeer(addr, m.infohash, policy, utp)
+	if err != nil {
+		return
+	}
+	if c.wire, err = NewWire(m.infohash, m.peerId, conn, m.l, nil); err != nil {
+		conn.Close()
+		return
+	}
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return
+	}
+	m.conns[addr] = c.wire
+	m.mutex.Unlock()
+	c.wire.SetReserved(EXTENSION_BYTE, EXTENSION_BIT)
+	if _, err = c.wire.Handshake(); err != nil || !c.wire.Extended() {
+		return
+	}
+	payLoad, err := m.extensions.Handshake(addr)
+	if err != nil {
+		return
+	}
+	if err = c.wire.WriteMsg(&message{length: uint32(1 + len(payLoad)), msgId: extended, payLoad: payLoad}); err != nil {
+		return
+	}
+	for {
+		msg, err := c.wire.ReadMsg(nil)
+		if err != nil {
+			return
+		}
+		// Only extended messages are useful until we have the metadata
+		if msg.length == 0 || msg.msgId != extended || len(msg.payLoad) < 1 {
+			continue
+		}
+		if msg.payLoad[0] == EXTENDED_HANDSHAKE {
+			if c.ext, err = mergeExtHandshake(c.ext, msg.payLoad[1:]); err != nil {
+				return
+			}
+			if _, ok := c.ext.M[m.metadata.Name()]; !ok {
+				return
+			}
+			m.extensions.PeerHandshake(c, c.ext)
+		} else if c.ext != nil {
+			if err = m.extensions.Message(c, msg.payLoad); err != nil {
+				log.Println("MetadataFetcher -> Error from", addr, err)
+				return
+			}
+		}
+		select {
+			case <- m.metadata.Done():
+				return
+			default:
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package peers
+
+import(
+	"strings"
+	"testing"
+	)
+
+// Without peers the wait for the metadata ends with the timeout or
+// when the fetcher is closed
+
+func TestMetadataCancel(t *testing.T) {
+	m := NewMetadataFetcher(strings.Repeat("\x01", 20), strings.Repeat("\x02", 20), nil)
+	if info, err := m.Metadata(NS_PER_S/10); err == nil || info != nil {
+		t.Errorf("Got metadata without peers")
+	}
+	go m.Close()
+	if _, err := m.Metadata(0); err == nil {
+		t.Errorf("Got metadata from a closed fetcher")
+	}
+	// Closing it again is harmless
+	m.Close()
+}
@@ -11,6 +11,9 @@ import(
 	"time"
 	"encoding/binary"
 	"sync"
+	"strconv"
+	"crypto/sha1"
+	"wgo/mse"
 	"wgo/limiter"
 	"wgo/bit_field"
 	"wgo/files"
@@ -19,6 +22,9 @@ import(
 	
 const(
 	KEEP_ALIVE_MSG = 120*NS_PER_S
+	ALLOWED_FAST_SET = 10 // pieces a choked peer can request (BEP 6)
+	MAX_SUGGESTED = 10
+	UTP_CONNECT_TIMEOUT = 2*NS_PER_S // a SYN and a retransmission
 )
 
 type Peer struct {
@@ -55,6 +61,20 @@ type Peer struct {
 	lastPiece int64
 	lastPieceLength int64
 	is_incoming bool
+	// The connection goes over uTP
+	utp bool
+	// Extended handshake of the peer, nil if it wasn't received
+	ext *ExtHandshake
+	// Fast extension (BEP 6)
+	fast bool
+	// Pieces the peer can request while choked, and pieces we can
+	// request while the peer chokes us
+	allowedFast map[int64]bool
+	peerAllowedFast map[int64]bool
+	// Pieces suggested by the peer, most recent last. Their own mutex, the
+	// PieceMgr reads them with its mutex held.
+	suggestedMutex *sync.Mutex
+	suggested []int64
 }
 
 func (p *Peer) Choke() {
@@ -69,6 +89,10 @@ func (p *Peer) Connected() bool {
 	return p.connected
 }
 
+func (p *Peer) Utp() bool {
+	return p.utp
+}
+
 func (p *Peer) Completed() bool {
 	return p.bitfield.Completed()
 }
@@ -89,6 +113,62 @@ func (p *Peer) Peer_interested() bool {
 	return p.peer_interested
 }
 
+// Address of the peer
+
+func (p *Peer) Addr() string {
+	return p.addr
+}
+
+// Data negotiated with the extended handshake, nil if the peer doesn't
+// support the extension protocol or didn't send it yet
+
+func (p *Peer) Extended() *ExtHandshake {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.ext
+}
+
+// Check if the peer supports the named extension
+
+func (p *Peer) SupportsExtension(name string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.ext == nil {
+		return false
+	}
+	_, ok := p.ext.M[name]
+	return ok
+}
+
+// Send an extended message, using the id the peer assigned to name
+
+func (p *Peer) SendExtended(name string, payLoad []byte) os.Error {
+	p.mutex.Lock()
+	var id int64
+	ok := false
+	if p.ext != nil {
+		id, ok = p.ext.M[name]
+	}
+	p.mutex.Unlock()
+	if !ok {
+		return os.NewError("Peer doesn't support extension " + name)
+	}
+	msg := &message{msgId: extended, payLoad: make([]byte, 1+len(payLoad))}
+	msg.payLoad[0] = uint8(id)
+	copy(msg.payLoad[1:], payLoad)
+	msg.length = uint32(1 + len(msg.payLoad))
+	p.incoming <- msg
+	return nil
+}
+
+// Pieces suggested by the peer with the Fast extension
+
+func (p *Peer) Suggested() (suggested []int64) {
+	p.suggestedMutex.Lock()
+	defer p.suggestedMutex.Unlock()
+	return append(suggested, p.suggested...)
+}
+
 func (p *Peer) LastPiece() int64 {
 	return p.lastPiece
 }
@@ -116,6 +196,7 @@ func (p *Peer) Request(piece int64, block int) {
 func NewPeer(addr, infohash, peerId string, peerMgr PeerMgr, numPieces, lastPieceLength int64, pieceMgr PieceMgr, our_bitfield *bit_field.Bitfield, st stats.Stats, fl files.Files, l limiter.Limiter) (p *Peer, err os.Error) {
 	p = new(Peer)
 	p.mutex = new(sync.Mutex)
+	p.suggestedMutex = new(sync.Mutex)
 	p.once = new(sync.Once)
 	p.addr = addr
 	//p.log, err = NewLogger(p.addr)
@@ -140,6 +221,8 @@ func NewPeer(addr, infohash, peerId string, peerMgr PeerMgr, numPieces, lastPiec
 	p.peerMgr = peerMgr
 	p.stats = st
 	p.delete = make(chan *message)
+	p.allowedFast = make(map[int64]bool)
+	p.peerAllowedFast = make(map[int64]bool)
 	// Start writting queue
 	p.in = make(chan *message)
 	p.keepAlive = time.NewTicker(KEEP_ALIVE_MSG)
@@ -153,10 +236,11 @@ func NewPeer(addr, infohash, peerId string, peerMgr PeerMgr, numPieces, lastPiec
 }
 
 func NewPeerFromConn(conn net.Conn, infohash, peerId string, peerMgr PeerMgr, numPieces, lastPieceLength int64, pieceMgr PieceMgr, our_bitfield *bit_field.Bitfield, st stats.Stats, fl files.Files, l limiter.Limiter) (p *Peer, err os.Error) {
-	addr := conn.RemoteAddr().String()
+	addr := normalizeAddr(conn.RemoteAddr().String())
 	p, err = NewPeer(addr, infohash, peerId, peerMgr, numPieces, lastPieceLength, pieceMgr, our_bitfield, st, fl, l)
 	p.wire, err = NewWire(p.infohash, p.our_peerId, conn, p.l, fl)
 	p.is_incoming = true
+	_, p.utp = conn.RemoteAddr().(*net.UDPAddr)
 	return
 }
 
@@ -179,8 +263,13 @@ func (p *Peer) preprocessMessage(msg *message) (skip bool, err os.Error) {
 				skip = true
 			} else {
 				p.am_choking = true
-				// Flush peer request queue
-				p.incoming <- &message{length: 1, msgId: flush}
+				// Flush peer request queue, with the Fast extension
+				// every request must be rejected
+				if p.fast {
+					p.incoming <- &message{length: 1, msgId: reject_flush}
+				} else {
+					p.incoming <- &message{length: 1, msgId: flush}
+				}
 			}
 		case interested:
 			if p.am_interested {
@@ -196,6 +285,11 @@ func (p *Peer) preprocessMessage(msg *message) (skip bool, err os.Error) {
 			}
 		case have:
 			p.CheckInterested()
+		case check_interest:
+			// The wanted pieces changed
+			p.CheckInterested()
+			p.TryToRequestPiece()
+			skip = true
 		case piece:
 			msg.length = uint32(9 + int64(binary.BigEndian.Uint32(msg.payLoad[8:12])))
 			msg.payLoad = msg.payLoad[0:8]
@@ -209,12 +303,7 @@ func (p *Peer) PeerWriter() {
 	defer p.once.Do(func() { p.Close() })
 	var err os.Error
 	if p.wire == nil {
-		addrTCP, err := net.ResolveTCPAddr(p.addr)
-		if err != nil {
-			//p.log.Output(err, p.addr)
-			return
-		}
-		conn, err := net.DialTCP("tcp4", nil, addrTCP)
+		conn, err := dialPeer(p.addr, p.infohash, p.peerMgr.Encryption(), p.peerMgr.Utp())
 		if err != nil {
 			//p.log.Output(err, p.addr)
 			return
@@ -229,7 +318,14 @@ func (p *Peer) PeerWriter() {
 		if err != nil {
 			return
 		}
+		_, p.utp = conn.RemoteAddr().(*net.UDPAddr)
 	}
+	dhtPort := p.peerMgr.DHTPort()
+	if dhtPort > 0 {
+		p.wire.SetReserved(DHT_BYTE, DHT_BIT)
+	}
+	p.wire.SetReserved(EXTENSION_BYTE, EXTENSION_BIT)
+	p.wire.SetReserved(FAST_BYTE, FAST_BIT)
 	// Send handshake
 	p.remote_peerId, err = p.wire.Handshake()
 	if err != nil {
@@ -240,15 +336,58 @@ func (p *Peer) PeerWriter() {
 		//p.log.Output("Local loopback")
 		return
 	}
+	p.fast = p.wire.Fast()
+	if p.fast {
+		for _, piece := range allowedFastSet(p.addr, p.infohash, p.numPieces, ALLOWED_FAST_SET) {
+			p.allowedFast[piece] = true
+		}
+	}
 	// Launch peer reader
 	go p.PeerReader()
 	// Send the have message
-	our_bitfield := p.our_bitfield.Bytes()
-	err = p.wire.WriteMsg(&message{length: uint32(1 + len(our_bitfield)), msgId: bitfield, payLoad: our_bitfield})
+	switch {
+		case p.fast && p.our_bitfield.Completed():
+			err = p.wire.WriteMsg(&message{length: 1, msgId: have_all})
+		case p.fast && p.our_bitfield.Count() == 0:
+			err = p.wire.WriteMsg(&message{length: 1, msgId: have_none})
+		default:
+			our_bitfield := p.our_bitfield.Bytes()
+			err = p.wire.WriteMsg(&message{length: uint32(1 + len(our_bitfield)), msgId: bitfield, payLoad: our_bitfield})
+	}
 	if err != nil {
 		//p.log.Output(err, p.is_incoming, p.addr)
 		return
 	}
+	// Pieces the peer can download while choked
+	for piece, _ := range p.allowedFast {
+		if !p.our_bitfield.IsSet(piece) {
+			continue
+		}
+		payLoad := make([]byte, 4)
+		binary.BigEndian.PutUint32(payLoad, uint32(piece))
+		if err = p.wire.WriteMsg(&message{length: 5, msgId: allowed_fast, payLoad: payLoad}); err != nil {
+			return
+		}
+	}
+	// Send our extended handshake
+	if p.wire.Extended() {
+		payLoad, err := p.peerMgr.Extensions().Handshake(p.addr)
+		if err != nil {
+			log.Println("Peer -> Error building extended handshake:", err)
+			return
+		}
+		if err = p.wire.WriteMsg(&message{length: uint32(1 + len(payLoad)), msgId: extended, payLoad: payLoad}); err != nil {
+			return
+		}
+	}
+	// Send our DHT port
+	if dhtPort > 0 && p.wire.PeerReserved(DHT_BYTE, DHT_BIT) {
+		payLoad := make([]byte, 2)
+		binary.BigEndian.PutUint16(payLoad, uint16(dhtPort))
+		if err = p.wire.WriteMsg(&message{length: 3, msgId: port, payLoad: payLoad}); err != nil {
+			return
+		}
+	}
 	// Peer writer main bucle
 	p.connected = true
 	for {
@@ -329,9 +468,12 @@ func (p *Peer) ProcessMessage(msg *message) (err os.Error){
 			// Choke peer
 			p.peer_choking = true
 			//p.log.Output("Peer", p.addr, "choked")
-			// If choked, clear request list
+			// If choked, clear request list. With the Fast extension
+			// requests are kept until they are rejected
 			//p.log.Output("Cleaning request list")
-			p.pieceMgr.PeerExit(p.addr)
+			if !p.fast {
+				p.pieceMgr.PeerExit(p.addr)
+			}
 			//p.requests <- &PieceMgrRequest{msg: &message{length: 1, msgId: exit, addr: []string{p.addr}}}
 			//p.log.Output("Finished cleaning")
 		case unchoke:
@@ -351,8 +493,18 @@ func (p *Peer) ProcessMessage(msg *message) (err os.Error){
 			p.peer_interested = false
 			//log.Println("Peer", p.addr, "uninterested")
 		case have:
+			if len(msg.payLoad) != 4 {
+				return os.NewError("Invalid have message")
+			}
 			// Update peer bitfield
-			p.bitfield.Set(int64(binary.BigEndian.Uint32(msg.payLoad)))
+			index := int64(binary.BigEndian.Uint32(msg.payLoad))
+			if index >= p.numPieces {
+				return os.NewError("Have out of range")
+			}
+			if !p.bitfield.IsSet(index) {
+				p.bitfield.Set(index)
+				p.pieceMgr.Have(index)
+			}
 			if p.our_bitfield.Completed() && p.bitfield.Completed() {
 				err = os.NewError("Peer not useful")
 				return
@@ -364,10 +516,13 @@ func (p *Peer) ProcessMessage(msg *message) (err os.Error){
 		case bitfield:
 			// Set peer bitfield
 			//log.Println(msg)
-			p.bitfield, err = bit_field.NewBitfieldFromBytes(p.numPieces, msg.payLoad)
-			if err != nil {
+			var bf *bit_field.Bitfield
+			if bf, err = bit_field.NewBitfieldFromBytes(p.numPieces, msg.payLoad); err != nil {
 				return os.NewError("Invalid bitfield")
 			}
+			p.pieceMgr.RemoveBitfield(p.bitfield)
+			p.bitfield = bf
+			p.pieceMgr.AddBitfield(p.bitfield)
 			if p.our_bitfield.Completed() && p.bitfield.Completed() {
 				err = os.NewError("Peer not useful")
 				return
@@ -375,26 +530,78 @@ func (p *Peer) ProcessMessage(msg *message) (err os.Error){
 			p.CheckInterested()
 			p.TryToRequestPiece()
 			//log.Println("Peer", p.addr, "bitfield")
+		case have_all:
+			if !p.fast {
+				return os.NewError("Unexpected have all message")
+			}
+			p.pieceMgr.RemoveBitfield(p.bitfield)
+			p.bitfield = bit_field.NewBitfield(p.numPieces)
+			for i := int64(0); i < p.numPieces; i++ {
+				p.bitfield.Set(i)
+			}
+			p.pieceMgr.AddBitfield(p.bitfield)
+			if p.our_bitfield.Completed() {
+				err = os.NewError("Peer not useful")
+				return
+			}
+			p.CheckInterested()
+			p.TryToRequestPiece()
+		case have_none:
+			if !p.fast {
+				return os.NewError("Unexpected have none message")
+			}
+		case suggest:
+			if !p.fast || len(msg.payLoad) != 4 {
+				return os.NewError("Unexpected suggest message")
+			}
+			p.suggestedMutex.Lock()
+			p.suggested = append(p.suggested, int64(binary.BigEndian.Uint32(msg.payLoad)))
+			if len(p.suggested) > MAX_SUGGESTED {
+				p.suggested = p.suggested[1:]
+			}
+			p.suggestedMutex.Unlock()
+		case reject:
+			if !p.fast || len(msg.payLoad) != 12 {
+				return os.NewError("Unexpected reject message")
+			}
+			p.pieceMgr.Rejected(p.addr, int64(binary.BigEndian.Uint32(msg.payLoad[0:4])), int64(binary.BigEndian.Uint32(msg.payLoad[4:8])))
+			p.TryToRequestPiece()
+		case allowed_fast:
+			if !p.fast || len(msg.payLoad) != 4 {
+				return os.NewError("Unexpected allowed fast message")
+			}
+			index := int64(binary.BigEndian.Uint32(msg.payLoad))
+			if index >= p.numPieces {
+				return os.NewError("Allowed fast piece out of range")
+			}
+			p.peerAllowedFast[index] = true
+			p.TryToRequestPiece()
 		case request:
 			// Peer requests a block
 			//log.Println("Peer", p.addr, "requests a block")
-			if !p.am_choking {
-				// p.requests <- &PieceMgrRequest{msg: msg, response: p.incoming}
-				if msg.length < 9 {
-					return os.NewError("Unexpected message length")
+			if msg.length != 13 {
+				return os.NewError("Unexpected message length")
+			}
+			index := int64(binary.BigEndian.Uint32(msg.payLoad[0:4]))
+			if p.am_choking && !(p.fast && p.allowedFast[index]) || !p.our_bitfield.IsSet(index) {
+				if p.fast {
+					// Tell the peer instead of silently dropping it
+					p.incoming <- &message{length: 13, msgId: reject, payLoad: msg.payLoad}
+					return
 				}
-				index := binary.BigEndian.Uint32(msg.payLoad[0:4])
-				if !p.our_bitfield.IsSet(int64(index)) {
+				if !p.am_choking {
 					return os.NewError("Peer requests unfinished piece, ignoring request")
 				}
-				msg.msgId = piece
-				p.incoming <- msg
+				return
 			}
+			// p.requests <- &PieceMgrRequest{msg: msg, response: p.incoming}
+			msg.msgId = piece
+			p.incoming <- msg
 			//log.Println("Peer -> Received request from", p.addr)
 		case piece:
 			//p.log.Output("Received piece, sending to pieceMgr")
 			//p.requests <- &PieceMgrRequest{msg: msg}
-			err = p.pieceMgr.SavePiece(p.addr, int64(binary.BigEndian.Uint32(msg.payLoad[0:4])), int64(binary.BigEndian.Uint32(msg.payLoad[4:8])), int64(msg.length-9))
+			err = p.pieceMgr.SavePiece(p.addr, int64(binary.BigEndian.Uint32(msg.payLoad[0:4])), int64(binary.BigEndian.Uint32(msg.payLoad[4:8])), msg.block)
 			p.lastPiece = time.Seconds()
 			// Check if the peer is still interesting
 			//p.log.Output("Checking if interesting")
@@ -405,9 +612,22 @@ func (p *Peer) ProcessMessage(msg *message) (err os.Error){
 			//p.log.Output("Finished requesting new piece")
 		case cancel:
 			// Send the message to the sending queue to delete the "piece" message
+			if p.fast {
+				msg.msgId = reject
+			}
 			p.delete <- msg
 		case port:
-			// DHT stuff
+			// Peer is running a DHT node
+			if len(msg.payLoad) != 2 {
+				return os.NewError("Invalid port message")
+			}
+			host, _, err := net.SplitHostPort(p.addr)
+			if err != nil {
+				return err
+			}
+			p.peerMgr.AddDHTNode(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(msg.payLoad)))))
+		case extended:
+			return p.processExtended(msg)
 		default:
 			//p.log.Output("Unknown message")
 			return os.NewError("Unknown message")
@@ -416,19 +636,43 @@ func (p *Peer) ProcessMessage(msg *message) (err os.Error){
 	return
 }
 
+func (p *Peer) processExtended(msg *message) (err os.Error) {
+	if !p.wire.Extended() || len(msg.payLoad) < 1 {
+		return os.NewError("Unexpected extended message")
+	}
+	extensions := p.peerMgr.Extensions()
+	if msg.payLoad[0] != EXTENDED_HANDSHAKE {
+		return extensions.Message(p, msg.payLoad)
+	}
+	// Later handshakes only update the previous one
+	p.mutex.Lock()
+	h, err := mergeExtHandshake(p.ext, msg.payLoad[1:])
+	if err == nil {
+		p.ext = h
+	}
+	p.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	extensions.PeerHandshake(p, h)
+	return
+}
+
+// Only the pieces that we want make the peer interesting
+
 func (p *Peer) CheckInterested() {
 	if p.am_interested && p.our_bitfield.Completed() {
 		p.incoming <- &message{length: 1, msgId: uninterested}
 		return
 	}
-	bf := p.bitfield.Bytes()
-	if p.am_interested && !p.our_bitfield.HasMorePieces(bf) {
+	wanted := p.pieceMgr.Interesting(p.bitfield)
+	if p.am_interested && !wanted {
 		//p.am_interested = false
 		p.incoming <- &message{length: 1, msgId: uninterested}
 		//log.Println("Peer", p.addr, "marked as uninteresting")
 		return
 	}
-	if !p.am_interested && p.our_bitfield.HasMorePieces(bf) {
+	if !p.am_interested && wanted {
 		//p.am_interested = true
 		p.incoming <- &message{length: 1, msgId: interested}
 		//log.Println("Peer", p.addr, "marked as interesting")
@@ -437,6 +681,17 @@ func (p *Peer) CheckInterested() {
 }
 
 func (p *Peer) TryToRequestPiece() {
+	if p.peer_choking && len(p.peerAllowedFast) > 0 && !p.our_bitfield.Completed() {
+		// Only the allowed fast pieces can be requested
+		bf := bit_field.NewBitfield(p.numPieces)
+		for piece, _ := range p.peerAllowedFast {
+			if p.bitfield.IsSet(piece) {
+				bf.Set(piece)
+			}
+		}
+		p.pieceMgr.Request(p.addr, p, bf)
+		return
+	}
 	if !p.peer_choking && !p.our_bitfield.Completed() {
 		//p.log.Output("Sending request for new piece")
 		p.pieceMgr.Request(p.addr, p, p.bitfield)
@@ -445,18 +700,26 @@ func (p *Peer) TryToRequestPiece() {
 	}
 }
 
+// Close the connection from outside of the goroutines of the peer
+
+func (p *Peer) Disconnect() {
+	p.once.Do(func() { p.Close() })
+}
+
 func (p *Peer) Close() {
 	//p.log.Output("Finishing peer")
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	p.keepAlive.Stop()
 	//p.log.Output("Sending message to peerMgr")
-	p.peerMgr.DeletePeer(p.addr)
+	p.peerMgr.DeletePeer(p)
 	//p.outgoing <- &p.addr
 	//p.log.Output("Finished sending message")
 	//p.log.Output("Sending message to pieceMgr")
 	//p.requests <- &PieceMgrRequest{msg: &message{length: 1, msgId: exit, addr: []string{p.addr}}}
 	p.pieceMgr.PeerExit(p.addr)
+	p.pieceMgr.RemoveBitfield(p.bitfield)
+	p.peerMgr.Extensions().PeerExit(p.addr)
 	//p.log.Output("Finished sending message")
 	// Sending message to Stats
 	p.stats.Update(p.addr, 0, 0)
@@ -470,3 +733,88 @@ func (p *Peer) Close() {
 	close(p.delete)
 	// Here we could have a crash
 }
+
+// Allowed fast set of the peer at addr, as described in BEP 6. Only
+// defined for IPv4 peers.
+
+func allowedFastSet(addr, infohash string, numPieces int64, k int) (set []int64) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return
+	}
+	if int64(k) > numPieces {
+		k = int(numPieces)
+	}
+	x := make([]byte, 4, 4+len(infohash))
+	copy(x, ip)
+	x[3] = 0
+	x = append(x, []byte(infohash)...)
+	seen := make(map[int64]bool)
+	for len(set) < k {
+		h := sha1.New()
+		h.Write(x)
+		x = h.Sum()
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int64(binary.BigEndian.Uint32(x[i*4:i*4+4])) % numPieces
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return
+}
+
+// Open a connection to addr following the encryption policy, with
+// PREFER_ENCRYPTED peers that don't understand MSE are dialed again
+// without it, using the transport that worked
+
+func dialPeer(addr, infohash string, policy int, utp Dialer) (conn net.Conn, err os.Error) {
+	c, err := dialTransport(addr, utp)
+	if err != nil {
+		return
+	}
+	if policy == mse.PLAINTEXT {
+		return c, nil
+	}
+	encrypted, err := mse.Dial(c, infohash, policy)
+	if err == nil {
+		return encrypted, nil
+	}
+	c.Close()
+	if policy == mse.REQUIRE_ENCRYPTED {
+		return
+	}
+	if _, ok := c.(*net.TCPConn); ok {
+		return dialTCP(addr)
+	}
+	return utp.DialTimeout(addr, UTP_CONNECT_TIMEOUT)
+}
+
+// Try uTP first if available, so LEDBAT keeps the uploads from filling
+// the uplink, then TCP. Peers without uTP only wait UTP_CONNECT_TIMEOUT.
+
+func dialTransport(addr string, utp Dialer) (conn net.Conn, err os.Error) {
+	if utp != nil {
+		if conn, err = utp.DialTimeout(addr, UTP_CONNECT_TIMEOUT); err == nil {
+			return
+		}
+	}
+	return dialTCP(addr)
+}
+
+func dialTCP(addr string) (conn net.Conn, err os.Error) {
+	addrTCP, err := net.ResolveTCPAddr(addr)
+	if err != nil {
+		return
+	}
+	c, err := net.DialTCP("tcp", nil, addrTCP)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
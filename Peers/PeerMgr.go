@@ -11,9 +11,9 @@ import(
 	"log"
 	"container/list"
 	"net"
-	"strings"
 	"wgo/limiter"
 	"wgo/bit_field"
+	"wgo/ipfilter"
 	"wgo/files"
 	"wgo/stats"
 	"sync"
@@ -22,7 +22,6 @@ import(
 const(
 	UNUSED_PEERS = 200
 	PERCENT_UNUSED_PEERS = 20
-	MAX_BAD_PIECES = 5
 )
 
 // We will use 1 channel to send the data from all peers (Readers)
@@ -37,7 +36,8 @@ type peerMgr struct {
 	mutex *sync.Mutex
 	activePeers map[string] *Peer // List of active peers
 	incomingPeers map[string] *Peer // List of incoming connections
-	badPeers map[string]int
+	banList *BanList
+	filter *ipfilter.Filter
 	unusedPeers *list.List
 	pieceMgr PieceMgr
 	stats stats.Stats
@@ -46,46 +46,81 @@ type peerMgr struct {
 	infohash, peerid string
 	files files.Files
 	l limiter.Limiter
+	dht DHT
+	extensions *Extensions
+	encryption int
+	utp Dialer
+	connections *Connections
+	// Closed, new peers are refused
+	closed bool
+	// Closed with the PeerMgr, for the goroutines that use it
+	quit chan bool
+}
+
+// DHT node, receives the DHT port announced by peers
+
+type DHT interface {
+	AddNode(addr string)
+	Port() int
+}
+
+// Transport tried before TCP when connecting to peers, e.g. uTP
+
+type Dialer interface {
+	DialTimeout(addr string, timeout int64) (net.Conn, os.Error)
 }
 
 type PeerMgr interface {
-	DeletePeer(addr string)
+	DeletePeer(peer *Peer)
 	AddPeers(peers *list.List)
 	AddPeer(conn net.Conn)
 	GetPeers() (map[string]*Peer)
 	SendHave(index int64)
+	CheckInterest()
 	SendCancel(addr []string, index, begin, length int64)
 	SetPieceMgr(pm PieceMgr)
 	ActivePeers() int
 	IncomingPeers() int
 	UnusedPeers() int
 	RequestPeers() int
-	AddBadPeers(peers []string)
+	BanPeer(addr string)
+	SetBanList(b *BanList)
+	SetFilter(f *ipfilter.Filter)
+	DisconnectFiltered()
+	Refused(addr string) bool
+	SetDHT(d DHT)
+	AddDHTNode(addr string)
+	DHTPort() int
+	Extensions() *Extensions
+	Infohash() string
+	SetEncryption(policy int)
+	Encryption() int
+	SetUtp(d Dialer)
+	Utp() Dialer
+	SetConnections(c *Connections)
+	Quit() <-chan bool
+	Close()
 }
 
-func (p *peerMgr) DeletePeer(addr string) {
+func (p *peerMgr) DeletePeer(peer *Peer) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	if _, ok := p.badPeers[addr]; ok {
-		p.badPeers[addr] = 0, false
-	}
-	if peer, err := p.SearchPeer(addr); err == nil {
-		p.Remove(peer)
-	}
-	return
+	p.Remove(peer)
 }
 
 func (p *peerMgr) AddPeers(peers *list.List) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	for i, addr := len(p.activePeers), peers.Front(); i < ACTIVE_PEERS && addr != nil; i, addr = i+1, peers.Front() {
+	if p.closed {
+		return
+	}
+	for addr := peers.Front(); len(p.activePeers) < ACTIVE_PEERS && addr != nil; addr = peers.Front() {
 		//log.Println("PeerMgr -> Adding Active Peer:", addr.Value.(string))
-		if _, err := p.SearchPeer(addr.Value.(string)); err != nil {
-			p.activePeers[addr.Value.(string)], err = NewPeer(addr.Value.(string), p.infohash, p.peerid, p, p.numPieces, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.l)
-			if err != nil {
-				log.Println("PeerMgr -> Error creating peer:", err)
+		a := normalizeAddr(addr.Value.(string))
+		if _, err := p.SearchPeer(a); err != nil && !p.refused(a) {
+			if err = p.connect(a); err != nil {
+				break
 			}
-			go p.activePeers[addr.Value.(string)].PeerWriter()
 		}
 		peers.Remove(addr)
 	}
@@ -96,24 +131,43 @@ func (p *peerMgr) AddPeers(peers *list.List) {
 func (p *peerMgr) AddPeer(c net.Conn) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	if len(p.incomingPeers) >= INCOMING_PEERS {
+	if p.closed || len(p.incomingPeers) >= INCOMING_PEERS {
+		c.Close()
+		return
+	}
+	addr := normalizeAddr(c.RemoteAddr().String())
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || p.refused(addr) {
+		c.Close()
+		return
+	}
+	if _, err = p.SearchPeer(addr); err == nil {
 		c.Close()
 		return
 	}
-	addr := c.RemoteAddr().String()
-	addr = addr[0:strings.Index(addr, ":")]
 	// Check if peer has already connected
 	// We should do this with peerId + ip, not only ip
 	for p_addr, _ := range(p.incomingPeers) {
-		if strings.HasPrefix(p_addr, addr) {
+		if p_host, _, err := net.SplitHostPort(p_addr); err == nil && p_host == host {
 			log.Println("PeerMgr -> Incoming peer is already present")
 			c.Close()
 			return
 		}
 	}
+	if !p.acquire() {
+		c.Close()
+		return
+	}
 	//log.Println("PeerMgr -> Adding incoming peer with address:", addr)
-	p.incomingPeers[c.RemoteAddr().String()], _ = NewPeerFromConn(c, p.infohash, p.peerid, p, p.numPieces, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.l)
-	go p.incomingPeers[c.RemoteAddr().String()].PeerWriter()
+	peer, err := NewPeerFromConn(c, p.infohash, p.peerid, p, p.numPieces, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.l)
+	if err != nil {
+		log.Println("PeerMgr -> Error creating peer:", err)
+		p.release()
+		c.Close()
+		return
+	}
+	p.incomingPeers[addr] = peer
+	go peer.PeerWriter()
 }
 
 func (p *peerMgr) GetPeers() (peers map[string]*Peer) {
@@ -143,6 +197,20 @@ func (p *peerMgr) SendHave(index int64) {
 	}
 }
 
+// The wanted pieces changed, every peer has to check if it's still
+// interesting and request the new pieces
+
+func (p *peerMgr) CheckInterest() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, peer := range(p.activePeers) {
+		peer.incoming <- &message{length: 1, msgId: check_interest}
+	}
+	for _, peer := range(p.incomingPeers) {
+		peer.incoming <- &message{length: 1, msgId: check_interest}
+	}
+}
+
 func (p *peerMgr) SendCancel(addr []string, index, begin, length int64) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
@@ -187,23 +255,184 @@ func (p *peerMgr) RequestPeers() int {
 	return 0
 }
 
-func (p *peerMgr) AddBadPeers(peers []string) {
+// Disconnect a peer that sent corrupt data and never connect to its
+// host again
+
+func (p *peerMgr) BanPeer(addr string) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	pr := make(map[string]int)
+	log.Println("PeerMgr -> Banning peer:", addr)
+	p.banList.Ban(addr)
+	if peer, err := p.SearchPeer(addr); err == nil {
+		go peer.Disconnect()
+	}
+}
+
+// Share the banned hosts with other torrents
+
+func (p *peerMgr) SetBanList(b *BanList) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.banList = b
+}
+
+// Addresses checked before dialling and on accept
+
+func (p *peerMgr) SetFilter(f *ipfilter.Filter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.filter = f
+}
+
+// Disconnect the peers that the filter doesn't allow anymore, after it's
+// reloaded
+
+func (p *peerMgr) DisconnectFiltered() {
+	p.mutex.Lock()
+	peers := make([]*Peer, 0)
+	for addr, peer := range(p.activePeers) {
+		if !p.filter.Allowed(addr) {
+			peers = append(peers, peer)
+		}
+	}
+	for addr, peer := range(p.incomingPeers) {
+		if !p.filter.Allowed(addr) {
+			peers = append(peers, peer)
+		}
+	}
+	p.mutex.Unlock()
 	for _, peer := range(peers) {
-		pr[peer]++
-	}
-	for peer, _ := range(pr) {
-		p.badPeers[peer]++
-		if p.badPeers[peer] > MAX_BAD_PIECES {
-			if p, err := p.SearchPeer(peer); err == nil {
-				log.Println("PeerMgr -> Disconnecting peer:", peer)
-				go p.Close()
-			}
+		if peer != nil {
+			log.Println("PeerMgr -> Disconnecting filtered peer:", peer.addr)
+			peer.Disconnect()
+		}
+	}
+}
+
+// Banned for sending corrupt data or denied by the IP filter
+
+func (p *peerMgr) refused(addr string) bool {
+	return p.banList.Banned(addr) || !p.filter.Allowed(addr)
+}
+
+func (p *peerMgr) Refused(addr string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.refused(normalizeAddr(addr))
+}
+
+func (p *peerMgr) SetDHT(d DHT) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.dht = d
+}
+
+func (p *peerMgr) AddDHTNode(addr string) {
+	p.mutex.Lock()
+	d := p.dht
+	p.mutex.Unlock()
+	if d != nil {
+		d.AddNode(addr)
+	}
+}
+
+// Port of the DHT node, 0 if the DHT is disabled
+
+func (p *peerMgr) DHTPort() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.dht == nil {
+		return 0
+	}
+	return p.dht.Port()
+}
+
+// Registry of the extensions used with the peers of this torrent
+
+func (p *peerMgr) Extensions() *Extensions {
+	return p.extensions
+}
+
+func (p *peerMgr) Infohash() string {
+	return p.infohash
+}
+
+// Encryption policy of the connections, one of the mse policies
+
+func (p *peerMgr) SetEncryption(policy int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.encryption = policy
+}
+
+func (p *peerMgr) Encryption() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.encryption
+}
+
+// Connect to peers with uTP before trying TCP, nil disables it
+
+func (p *peerMgr) SetUtp(d Dialer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.utp = d
+}
+
+func (p *peerMgr) Utp() Dialer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.utp
+}
+
+// Share the limit of connections with other torrents, nil means no
+// limit besides ACTIVE_PEERS and INCOMING_PEERS
+
+func (p *peerMgr) SetConnections(c *Connections) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.connections = c
+}
+
+func (p *peerMgr) Quit() <-chan bool {
+	return p.quit
+}
+
+// Disconnect all the peers and refuse new ones
+
+func (p *peerMgr) Close() {
+	p.mutex.Lock()
+	if !p.closed {
+		close(p.quit)
+	}
+	p.closed = true
+	peers := make([]*Peer, 0, len(p.activePeers)+len(p.incomingPeers))
+	for _, peer := range(p.activePeers) {
+		peers = append(peers, peer)
+	}
+	for _, peer := range(p.incomingPeers) {
+		peers = append(peers, peer)
+	}
+	p.unusedPeers.Init()
+	p.mutex.Unlock()
+	// Peers remove themselves from the PeerMgr when closed
+	for _, peer := range(peers) {
+		if peer != nil {
+			peer.Disconnect()
 		}
 	}
 }
+
+func (p *peerMgr) acquire() bool {
+	return p.connections == nil || p.connections.Acquire()
+}
+
+func (p *peerMgr) release() {
+	if p.connections != nil {
+		p.connections.Release()
+	}
+}
+
 // Create a PeerMgr
 
 func NewPeerMgr(numPieces int64, peerid, infohash string, our_bitfield *bit_field.Bitfield, st stats.Stats, fl files.Files, l limiter.Limiter, lastPieceLength int64) (pm PeerMgr, err os.Error) {
@@ -215,7 +444,8 @@ func NewPeerMgr(numPieces int64, peerid, infohash string, our_bitfield *bit_fiel
 	p.peerid = peerid
 	p.activePeers = make(map[string] *Peer, ACTIVE_PEERS)
 	p.incomingPeers = make(map[string] *Peer, INCOMING_PEERS)
-	p.badPeers = make(map[string]int, ACTIVE_PEERS+INCOMING_PEERS)
+	p.banList = NewBanList("")
+	p.filter = ipfilter.NewFilter()
 	p.unusedPeers = list.New()
 	//p.pieceMgr = pieceMgr
 	p.our_bitfield = our_bitfield
@@ -224,10 +454,29 @@ func NewPeerMgr(numPieces int64, peerid, infohash string, our_bitfield *bit_fiel
 	//p.up_limit = up_limit
 	//p.down_limit = down_limit
 	p.l = l
+	p.extensions = NewExtensions()
+	p.quit = make(chan bool)
 	pm = p
 	return
 }
 
+// Canonical form of host:port, used as the key of the peer everywhere.
+// IPv4 mapped addresses of dual stack sockets are written as IPv4.
+
+func normalizeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
 // Search the peer
 
 func (p *peerMgr) SearchPeer(addr string) (peer *Peer, err os.Error) {
@@ -241,38 +490,64 @@ func (p *peerMgr) SearchPeer(addr string) (peer *Peer, err os.Error) {
 	return peer, os.NewError("PeerMgr -> Peer " + addr + " not found")
 }
 
-// Remove a peer
+// Remove a peer, only if it's the one stored with its address: a peer
+// replaced by a new connection to the same address keeps its slot
 
 func (p *peerMgr) Remove(peer *Peer) {
 	//peer.Close()
-	if _, ok := p.activePeers[peer.addr]; ok {
+	if current, ok := p.activePeers[peer.addr]; ok && current == peer {
 		p.activePeers[peer.addr] = peer, false
+		p.release()
 		p.AddNewPeer()
 		return
 	}
-	if _, ok := p.incomingPeers[peer.addr]; ok {
+	if current, ok := p.incomingPeers[peer.addr]; ok && current == peer {
 		p.incomingPeers[peer.addr] = peer, false
+		p.release()
 		return
 	}
 }
 
-// Add a new peer to the activePeers map
+// Add a new peer to the activePeers map, the first unused one that isn't
+// connected, banned or filtered
 
 func (p *peerMgr) AddNewPeer() (err os.Error) {
-	addr := p.unusedPeers.Front()
-	if addr == nil {
-		// Requests new peers to the tracker module (check inactive peers & active peers also)
-		//p.inTracker <- (UNUSED_PEERS + (ACTIVE_PEERS - len(p.activePeers)))
-		return os.NewError("Unused peers list is empty")
-	}
-	// Check how much of the unsued peers list is used, and request more if needed
-	/*if (p.unusedPeers.Len()/UNUSED_PEERS * 100) < PERCENT_UNUSED_PEERS {
-		// request new peers to tracker
-		p.inTracker <- (UNUSED_PEERS - p.unusedPeers.Len())
-	}*/
-	//log.Println("Adding Inactive Peer:", addr.Value.(string))
-	p.activePeers[addr.Value.(string)], _ = NewPeer(addr.Value.(string), p.infohash, p.peerid, p, p.numPieces, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.l)
-	p.unusedPeers.Remove(addr)
-	go p.activePeers[addr.Value.(string)].PeerWriter()
+	for {
+		addr := p.unusedPeers.Front()
+		if p.closed || addr == nil {
+			// Requests new peers to the tracker module (check inactive peers & active peers also)
+			//p.inTracker <- (UNUSED_PEERS + (ACTIVE_PEERS - len(p.activePeers)))
+			return os.NewError("Unused peers list is empty")
+		}
+		// Check how much of the unsued peers list is used, and request more if needed
+		/*if (p.unusedPeers.Len()/UNUSED_PEERS * 100) < PERCENT_UNUSED_PEERS {
+			// request new peers to tracker
+			p.inTracker <- (UNUSED_PEERS - p.unusedPeers.Len())
+		}*/
+		//log.Println("Adding Inactive Peer:", addr.Value.(string))
+		a := normalizeAddr(addr.Value.(string))
+		p.unusedPeers.Remove(addr)
+		if _, err := p.SearchPeer(a); err == nil || p.refused(a) {
+			continue
+		}
+		return p.connect(a)
+	}
+	return
+}
+
+// Create an outgoing peer, with a connection slot
+
+func (p *peerMgr) connect(addr string) (err os.Error) {
+	if !p.acquire() {
+		return os.NewError("Connection limit reached")
+	}
+	peer, err := NewPeer(addr, p.infohash, p.peerid, p, p.numPieces, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.l)
+	if err != nil {
+		log.Println("PeerMgr -> Error creating peer:", err)
+		p.release()
+		return
+	}
+	p.activePeers[addr] = peer
+	go peer.PeerWriter()
 	return
 }
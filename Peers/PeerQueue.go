@@ -55,11 +55,26 @@ func (q *PeerQueue) FlushPieces() {
 	}
 }
 
+// Flush the queued pieces, rejecting each request (BEP 6)
+
+func (q *PeerQueue) RejectPieces() {
+	for key := q.ptail; key < q.phead; key++ {
+		if m, ok := q.pieces[key]; ok {
+			q.Push(&message{length: 13, msgId: reject, payLoad: m.payLoad[0:12]})
+		}
+	}
+	q.FlushPieces()
+}
+
 func (q *PeerQueue) Push(m *message) {
 	if m.msgId == flush {
 		q.FlushPieces()
 		return
 	}
+	if m.msgId == reject_flush {
+		q.RejectPieces()
+		return
+	}
 	if m.msgId == piece {
 		//if q.pn >= MAX_PIECE_BUFFER { return }
 		q.pieces[q.phead] = m
@@ -74,11 +89,16 @@ func (q *PeerQueue) Push(m *message) {
 }
 
 func (q *PeerQueue) Remove(m *message) {
-	if m.msgId == cancel {
+	if m.msgId == cancel || m.msgId == reject {
 		key, err := q.SearchPiece(m)
 		if err == nil { // Piece found
 			// Delete this piece & reorder queue
 			q.remove(key)
+			// Peers with the Fast extension expect a reject for the
+			// cancelled request
+			if m.msgId == reject {
+				q.Push(m)
+			}
 		}
 		return
 	}
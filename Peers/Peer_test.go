@@ -0,0 +1,96 @@
+package peers
+
+import(
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	)
+
+// Test vectors of BEP 6
+
+func TestAllowedFastSet(t *testing.T) {
+	infohash := strings.Repeat("\xaa", 20)
+	expected := []int64{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	for _, k := range []int{7, 9} {
+		set := allowedFastSet("80.4.4.200:6881", infohash, 1313, k)
+		if len(set) != k {
+			t.Fatalf("Got %d pieces, expected %d", len(set), k)
+		}
+		for i, index := range set {
+			if index != expected[i] {
+				t.Errorf("k=%d: got %v, expected %v", k, set, expected[0:k])
+				break
+			}
+		}
+	}
+	if set := allowedFastSet("[2001:db8::1]:6881", infohash, 1313, 9); len(set) != 0 {
+		t.Errorf("Got an allowed fast set for an IPv6 peer")
+	}
+	// Can't have more pieces than the torrent
+	if set := allowedFastSet("80.4.4.200:6881", infohash, 5, 9); len(set) != 5 {
+		t.Errorf("Got %d pieces of 5", len(set))
+	}
+}
+
+// uTP Dialer that connects, or fails if conn is nil
+
+type fakeUtp struct {
+	conn net.Conn
+	timeout int64
+}
+
+func (f *fakeUtp) DialTimeout(addr string, timeout int64) (net.Conn, os.Error) {
+	f.timeout = timeout
+	if f.conn == nil {
+		return nil, os.NewError("uTP timeout")
+	}
+	return f.conn, nil
+}
+
+func TestDialTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+	// uTP is used when it connects, even if TCP would
+	a, b := net.Pipe()
+	defer b.Close()
+	utp := &fakeUtp{conn: a}
+	if conn, err := dialTransport(addr, utp); err != nil || conn != a {
+		t.Errorf("Got %T, %v, expected the uTP connection", conn, err)
+	}
+	if utp.timeout != UTP_CONNECT_TIMEOUT {
+		t.Errorf("Dialed uTP with timeout %d, expected %d", utp.timeout, UTP_CONNECT_TIMEOUT)
+	}
+	a.Close()
+	// Then TCP
+	conn, err := dialTransport(addr, &fakeUtp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("Got %T, expected TCP", conn)
+	}
+	conn.Close()
+	// Both fail
+	l.Close()
+	if conn, err = dialTransport(addr, &fakeUtp{}); err == nil {
+		conn.Close()
+		t.Errorf("Connected to a closed port")
+	}
+}
+
+// The PieceMgr gets a copy, the reader of the peer keeps changing them
+
+func TestSuggested(t *testing.T) {
+	p := &Peer{suggestedMutex: new(sync.Mutex), suggested: []int64{1, 2}}
+	suggested := p.Suggested()
+	suggested[0] = 5
+	if p.suggested[0] != 1 || len(p.Suggested()) != 2 {
+		t.Errorf("Got %v, the suggested pieces changed", p.suggested)
+	}
+}
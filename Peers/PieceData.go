@@ -7,8 +7,8 @@ package peers
 import(
 	"time"
 	"os"
-	"rand"
 	"wgo/bit_field"
+	"wgo/files"
 	//"log"
 	)
 	
@@ -17,12 +17,20 @@ type PieceData struct {
 	peers map[string]map[uint64]int64
 	bitfield *bit_field.Bitfield
 	pieceLength, lastPieceLength int64
+	// Number of connected peers that have each piece
+	availability []int
+	picker PiecePicker
+	// Priority of each piece from the priorities of the files, nil
+	// means all of them have files.PRIORITY_NORMAL
+	priorities []int
 }
 
 type Piece struct {
 	downloaderCount []int // -1 means piece is already downloaded
 	peersAddr       []string
+	sums            []string // SHA-1 of each block as it was received
 	pieceLength     int64
+	requested       []int64 // time of the last request of each block
 }
 
 func NewPieceData(bitfield *bit_field.Bitfield, pieceLength, lastPieceLength int64) (p *PieceData) {
@@ -32,6 +40,8 @@ func NewPieceData(bitfield *bit_field.Bitfield, pieceLength, lastPieceLength int
 	p.bitfield = bitfield
 	p.pieceLength = pieceLength
 	p.lastPieceLength = lastPieceLength
+	p.availability = make([]int, bitfield.Len())
+	p.picker = NewRarestFirstPicker()
 	return
 }
 
@@ -40,6 +50,8 @@ func NewPiece(pieceCount, pieceLength int64) (p *Piece) {
 	p.pieceLength = pieceLength
 	p.downloaderCount = make([]int, pieceCount)
 	p.peersAddr = make([]string, pieceCount)
+	p.sums = make([]string, pieceCount)
+	p.requested = make([]int64, pieceCount)
 	return
 }
 
@@ -55,6 +67,7 @@ func (pd *PieceData) Add(addr string, pieceNum int64, blockNum int) {
 		pd.pieces[pieceNum] = NewPiece(pieceCount, pieceLength)
 		pd.pieces[pieceNum].downloaderCount[blockNum]++
 	}
+	pd.pieces[pieceNum].requested[blockNum] = time.Seconds()
 	// Mark peer as downloading this piece
 	ref := uint64(pieceNum) << 32 | uint64(blockNum)
 	if _, ok := pd.peers[addr]; ok {
@@ -77,7 +90,23 @@ func (pd *PieceData) CheckRequested(addr string, pieceNum int64, blockNum int) b
 	return false
 }
 
-func (pd *PieceData) Remove(addr string, pieceNum, blockNum int64, finished bool) (pieceFinished bool, others []string, downloaders []string) {
+// The block was requested and its data hasn't arrived yet
+
+func (pd *PieceData) Pending(pieceNum, blockNum int64) bool {
+	piece, ok := pd.pieces[pieceNum]
+	return ok && blockNum < int64(len(piece.downloaderCount)) && piece.downloaderCount[blockNum] != -1
+}
+
+// Keep the SHA-1 of a block before it's marked as downloaded, it's
+// returned by Remove with the senders once the piece is finished
+
+func (pd *PieceData) SetSum(pieceNum, blockNum int64, sum string) {
+	if piece, ok := pd.pieces[pieceNum]; ok && blockNum < int64(len(piece.sums)) {
+		piece.sums[blockNum] = sum
+	}
+}
+
+func (pd *PieceData) Remove(addr string, pieceNum, blockNum int64, finished bool) (pieceFinished bool, others []string, downloaders []string, sums []string) {
 	if _, ok := pd.pieces[pieceNum]; ok {
 		if finished {
 			if pd.pieces[pieceNum].downloaderCount[blockNum] > 1 {
@@ -90,7 +119,7 @@ func (pd *PieceData) Remove(addr string, pieceNum, blockNum int64, finished bool
 				pd.pieces[pieceNum].downloaderCount[blockNum]--
 			}
 		}
-		pieceFinished = true
+		pieceFinished = finished
 		for _, block := range(pd.pieces[pieceNum].downloaderCount) {
 			if block != -1 {
 				pieceFinished = false
@@ -98,8 +127,9 @@ func (pd *PieceData) Remove(addr string, pieceNum, blockNum int64, finished bool
 			}
 		}
 		if pieceFinished {
+			// Kept until Checked, so it isn't picked again
 			downloaders = pd.pieces[pieceNum].peersAddr
-			pd.pieces[pieceNum] = pd.pieces[pieceNum], false
+			sums = pd.pieces[pieceNum].sums
 		}
 	}
 	// Remove from peers
@@ -115,6 +145,13 @@ func (pd *PieceData) Remove(addr string, pieceNum, blockNum int64, finished bool
 	return
 }
 
+// The hash check of a finished piece is done, it's downloaded again if
+// it isn't set in the bitfield
+
+func (pd *PieceData) Checked(pieceNum int64) {
+	pd.pieces[pieceNum] = nil, false
+}
+
 func (pd *PieceData) RemoveAll(addr string) {
 	//log.Println("PieceData -> Removing peer", addr)
 	if peer, ok := pd.peers[addr]; ok {
@@ -150,10 +187,19 @@ func (pd *PieceData) SearchPeers(rpiece, rblock, size int64, our_addr string) (o
 	return
 }
 
-func (pd *PieceData) SearchPiece(addr string, bitfield *bit_field.Bitfield) (rpiece int64, rblock int, err os.Error) {
-	// Check if peer has some of the active pieces to finish them
+func (pd *PieceData) SetPicker(picker PiecePicker) {
+	pd.picker = picker
+}
+
+func (pd *PieceData) SearchPiece(addr string, bitfield *bit_field.Bitfield, suggested []int64) (rpiece int64, rblock int, err os.Error) {
+	// Check if peer has some of the active pieces to finish them, the
+	// ones with a deadline first and in order
 	//log.Println("PieceData -> Searching for an already present piece")
+	rpiece, urgent := -1, false
 	for k, piece := range (pd.pieces) {
+		if !bitfield.IsSet(k) || pd.priority(k) == files.PRIORITY_SKIP || (urgent && k > rpiece) {
+			continue
+		}
 		available := -1
 		for block, downloads := range piece.downloaderCount {
 			if downloads == 0 {
@@ -161,44 +207,58 @@ func (pd *PieceData) SearchPiece(addr string, bitfield *bit_field.Bitfield) (rpi
 				break
 			}
 		}
-		if available != -1 && bitfield.IsSet(k) {
-			// Send request piece k, block available
-			pd.Add(addr, k, available)
-			rpiece, rblock = k, available
-			return
+		if available == -1 {
+			continue
 		}
+		if deadline := pd.picker.Deadline(k); rpiece == -1 || deadline > 0 {
+			rpiece, rblock, urgent = k, available, deadline > 0
+		}
+	}
+	if rpiece != -1 {
+		pd.Add(addr, rpiece, rblock)
+		return
 	}
 	//log.Println("PieceData -> No suitable piece found in active set")
-	// Check what piece we can request
-	totalPieces := pd.bitfield.Len()
-	bytes := bitfield.Bytes()
-	start := rand.Int63n(totalPieces)
-	// Search fordward
-	//log.Println("PieceData -> Searching fordwards")
-	for piece := pd.bitfield.FindNextPiece(start, bytes); piece != -1 && piece < totalPieces; piece = pd.bitfield.FindNextPiece(piece+1, bytes) {
-		//log.Println("PieceData -> Piece found, see if it's already in active piece set:", piece)
+	// Blocks that missed their deadline are requested from this peer too
+	now := time.Seconds()
+	for k, piece := range (pd.pieces) {
+		deadline := pd.picker.Deadline(k)
+		if deadline == 0 || !bitfield.IsSet(k) || pd.priority(k) == files.PRIORITY_SKIP {
+			continue
+		}
+		for block, downloads := range piece.downloaderCount {
+			if downloads > 0 && downloads < MAX_PIECE_REQUESTS && now - piece.requested[block] > deadline && !pd.CheckRequested(addr, k, block) {
+				pd.Add(addr, k, block)
+				rpiece, rblock = k, block
+				return
+			}
+		}
+	}
+	// Pieces suggested by the peer are probably in its disk cache
+	for i := len(suggested)-1; i >= 0; i-- {
+		piece := suggested[i]
+		if piece < 0 || piece >= pd.bitfield.Len() || pd.bitfield.IsSet(piece) || !bitfield.IsSet(piece) || pd.priority(piece) == files.PRIORITY_SKIP {
+			continue
+		}
 		if _, ok := pd.pieces[piece]; !ok {
-			// Add new piece to set
 			pd.Add(addr, piece, 0)
 			rpiece, rblock = piece, 0
 			return
 		}
 	}
-	// Search backwards
-	//log.Println("PieceData -> Searching backwards")
-	for piece := pd.bitfield.FindNextPiece(0, bytes); piece != -1 && piece < start; piece = pd.bitfield.FindNextPiece(piece+1, bytes) {
-		//log.Println("PieceData -> Piece found, see if it's already in active piece set:", piece)
-		if _, ok := pd.pieces[piece]; !ok {
-			// Add new piece to set
+	// Let the picker choose a new piece, from the highest priority
+	bytes := bitfield.Bytes()
+	for priority := files.PRIORITY_HIGH; priority > files.PRIORITY_SKIP; priority-- {
+		if piece := pd.picker.Pick(&candidates{pd, bytes, priority}); piece != -1 {
 			pd.Add(addr, piece, 0)
 			rpiece, rblock = piece, 0
 			return
 		}
 	}
 	// If all pieces are taken, double up on an active piece
-	// if only 20% of pieces remaining
+	// if only 20% of the wanted pieces are remaining
 	//log.Println("PieceData -> Trying to enter endgame mode")
-	if float64(pd.bitfield.Count())/float64(pd.bitfield.Len()) < 0.80 {
+	if done, wanted := pd.wantedCount(); float64(done)/float64(wanted) < 0.80 {
 		err = os.NewError("No available block found")
 		return
 	}
@@ -207,7 +267,7 @@ func (pd *PieceData) SearchPiece(addr string, bitfield *bit_field.Bitfield) (rpi
 	min := 0
 	for k, piece := range (pd.pieces) {
 		for block, downloads := range piece.downloaderCount {
-			if bitfield.IsSet(k) && !pd.CheckRequested(addr, k, block) {
+			if bitfield.IsSet(k) && pd.priority(k) != files.PRIORITY_SKIP && !pd.CheckRequested(addr, k, block) {
 				if first && downloads != -1 {
 					rpiece, rblock, min = k, block, downloads
 					first = false
@@ -226,6 +286,170 @@ func (pd *PieceData) SearchPiece(addr string, bitfield *bit_field.Bitfield) (rpi
 	return
 }
 
+// Pieces the picker can choose from, with the bitfield of the peer and
+// the priority
+
+type candidates struct {
+	pd *PieceData
+	bytes []byte
+	priority int
+}
+
+func (c *candidates) Len() int64 {
+	return c.pd.bitfield.Len()
+}
+
+func (c *candidates) Count() int64 {
+	return c.pd.bitfield.Count()
+}
+
+func (c *candidates) Next(start int64) int64 {
+	for piece := c.pd.bitfield.FindNextPiece(start, c.bytes); piece != -1 && piece < c.Len(); piece = c.pd.bitfield.FindNextPiece(piece+1, c.bytes) {
+		if _, ok := c.pd.pieces[piece]; !ok && c.pd.priority(piece) == c.priority {
+			return piece
+		}
+	}
+	return -1
+}
+
+func (c *candidates) Availability(piece int64) int {
+	return c.pd.availability[piece]
+}
+
+func (pd *PieceData) SetPriorities(priorities []int) {
+	pd.priorities = priorities
+}
+
+func (pd *PieceData) priority(piece int64) int {
+	if pd.priorities == nil {
+		return files.PRIORITY_NORMAL
+	}
+	return pd.priorities[piece]
+}
+
+// Pieces of the peer with bitfield that we want and don't have
+
+func (pd *PieceData) Interesting(bitfield *bit_field.Bitfield) bool {
+	bytes := bitfield.Bytes()
+	for piece := pd.bitfield.FindNextPiece(0, bytes); piece != -1 && piece < pd.bitfield.Len(); piece = pd.bitfield.FindNextPiece(piece+1, bytes) {
+		if pd.priority(piece) != files.PRIORITY_SKIP {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of wanted pieces and how many of them we have
+
+func (pd *PieceData) wantedCount() (done, wanted int64) {
+	if pd.priorities == nil {
+		return pd.bitfield.Count(), pd.bitfield.Len()
+	}
+	for i, priority := range pd.priorities {
+		if priority == files.PRIORITY_SKIP {
+			continue
+		}
+		wanted++
+		if pd.bitfield.IsSet(int64(i)) {
+			done++
+		}
+	}
+	return
+}
+
+// All the wanted pieces are downloaded
+
+func (pd *PieceData) Completed() bool {
+	done, wanted := pd.wantedCount()
+	return done == wanted
+}
+
+// A peer announced that it has piece index
+
+func (pd *PieceData) Have(index int64) {
+	if index >= 0 && index < int64(len(pd.availability)) {
+		pd.availability[index]++
+	}
+}
+
+// Count the pieces of the bitfield of a peer, when it's received or
+// when the peer is gone
+
+func (pd *PieceData) AddAvailability(bitfield *bit_field.Bitfield) {
+	pd.updateAvailability(bitfield, 1)
+}
+
+func (pd *PieceData) RemoveAvailability(bitfield *bit_field.Bitfield) {
+	pd.updateAvailability(bitfield, -1)
+}
+
+func (pd *PieceData) updateAvailability(bitfield *bit_field.Bitfield, n int) {
+	if bitfield == nil || bitfield.Len() != int64(len(pd.availability)) || bitfield.Count() == 0 {
+		return
+	}
+	for i := range pd.availability {
+		if bitfield.IsSet(int64(i)) {
+			pd.availability[i] += n
+			if pd.availability[i] < 0 {
+				pd.availability[i] = 0
+			}
+		}
+	}
+}
+
+// Number of connected peers that have each piece
+
+func (pd *PieceData) Availability() (availability []int) {
+	availability = make([]int, len(pd.availability))
+	copy(availability, pd.availability)
+	return
+}
+
+// Blocks already downloaded of the pieces that aren't finished
+
+func (pd *PieceData) Partial() (partial map[int64][]int) {
+	partial = make(map[int64][]int)
+	for k, piece := range (pd.pieces) {
+		for block, downloads := range piece.downloaderCount {
+			if downloads == -1 {
+				partial[k] = append(partial[k], block)
+			}
+		}
+	}
+	return
+}
+
+// Mark the blocks of partial as downloaded, e.g. from the fast resume
+// data. Pieces already finished or with all the blocks are skipped, the
+// later have to be downloaded again since their hash wasn't checked.
+
+func (pd *PieceData) SetPartial(partial map[int64][]int) {
+	for k, blocks := range (partial) {
+		if k < 0 || k >= pd.bitfield.Len() || pd.bitfield.IsSet(k) || len(blocks) == 0 {
+			continue
+		}
+		if _, ok := pd.pieces[k]; ok {
+			continue
+		}
+		pieceLength := pd.pieceLength
+		if k == pd.bitfield.Len()-1 {
+			pieceLength = pd.lastPieceLength
+		}
+		pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
+		piece := NewPiece(pieceCount, pieceLength)
+		done := 0
+		for _, block := range blocks {
+			if block >= 0 && int64(block) < pieceCount && piece.downloaderCount[block] != -1 {
+				piece.downloaderCount[block] = -1
+				done++
+			}
+		}
+		if done > 0 && int64(done) < pieceCount {
+			pd.pieces[k] = piece
+		}
+	}
+}
+
 func (pd *PieceData) NumPieces(addr string) (n int64) {
 	if peer, ok := pd.peers[addr]; ok {
 		n = int64(len(peer))
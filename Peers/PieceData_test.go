@@ -0,0 +1,120 @@
+package peers
+
+import(
+	"testing"
+	"wgo/bit_field"
+	"wgo/files"
+	)
+
+func newTestBitfield(n int64, pieces ...int64) (b *bit_field.Bitfield) {
+	b = bit_field.NewBitfield(n)
+	for _, piece := range pieces {
+		b.Set(piece)
+	}
+	return
+}
+
+func checkAvailability(t *testing.T, when string, pd *PieceData, expected []int) {
+	availability := pd.Availability()
+	for i, n := range expected {
+		if availability[i] != n {
+			t.Errorf("%s: got availability %v, expected %v", when, availability, expected)
+			return
+		}
+	}
+}
+
+// The availability is updated the way Peer does it for each message
+
+func TestAvailability(t *testing.T) {
+	pd := NewPieceData(bit_field.NewBitfield(10), 32*1024, 32*1024)
+	// Bitfield, then have
+	a := newTestBitfield(10, 0, 1)
+	pd.AddAvailability(a)
+	a.Set(2)
+	pd.Have(2)
+	// Have all
+	b := newTestBitfield(10, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	pd.AddAvailability(b)
+	// Empty bitfield, then have
+	c := bit_field.NewBitfield(10)
+	pd.AddAvailability(c)
+	c.Set(9)
+	pd.Have(9)
+	checkAvailability(t, "Connected", pd, []int{2, 2, 2, 1, 1, 1, 1, 1, 1, 2})
+	pd.Have(10)
+	pd.Have(-1)
+	pd.AddAvailability(newTestBitfield(5, 0, 1, 2, 3, 4))
+	checkAvailability(t, "Out of range", pd, []int{2, 2, 2, 1, 1, 1, 1, 1, 1, 2})
+	// A new bitfield replaces the pieces of the peer
+	pd.RemoveAvailability(a)
+	a = newTestBitfield(10, 5)
+	pd.AddAvailability(a)
+	checkAvailability(t, "Bitfield replaced", pd, []int{1, 1, 1, 1, 1, 2, 1, 1, 1, 2})
+	// The pieces received with have are in the bitfield removed
+	pd.RemoveAvailability(c)
+	pd.RemoveAvailability(b)
+	checkAvailability(t, "Disconnected", pd, []int{0, 0, 0, 0, 0, 1, 0, 0, 0, 0})
+	pd.RemoveAvailability(a)
+	pd.RemoveAvailability(a)
+	checkAvailability(t, "Disconnected twice", pd, []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+}
+
+// Pieces of skipped files don't make a peer interesting, and aren't
+// needed to complete the torrent
+
+func TestSkippedPieces(t *testing.T) {
+	have := bit_field.NewBitfield(4)
+	pd := NewPieceData(have, 32*1024, 32*1024)
+	peer := newTestBitfield(4, 1, 3)
+	if !pd.Interesting(peer) || pd.Completed() {
+		t.Fatalf("Without priorities: interesting %v, completed %v", pd.Interesting(peer), pd.Completed())
+	}
+	pd.SetPriorities([]int{files.PRIORITY_NORMAL, files.PRIORITY_SKIP, files.PRIORITY_HIGH, files.PRIORITY_SKIP})
+	if pd.Interesting(peer) {
+		t.Errorf("Interested in a peer with only skipped pieces")
+	}
+	if !pd.Interesting(newTestBitfield(4, 1, 2)) {
+		t.Errorf("Not interested in a peer with a wanted piece")
+	}
+	have.Set(0)
+	if pd.Completed() {
+		t.Errorf("Completed with the wanted piece 2 missing")
+	}
+	have.Set(2)
+	if !pd.Completed() {
+		t.Errorf("Not completed with all the wanted pieces")
+	}
+	if pd.Interesting(newTestBitfield(4, 0, 2)) {
+		t.Errorf("Interested in a peer with pieces we have")
+	}
+	// A file wanted again
+	pd.SetPriorities([]int{files.PRIORITY_NORMAL, files.PRIORITY_LOW, files.PRIORITY_HIGH, files.PRIORITY_SKIP})
+	if pd.Completed() || !pd.Interesting(peer) {
+		t.Errorf("Piece 1 wanted again: interesting %v, completed %v", pd.Interesting(peer), pd.Completed())
+	}
+}
+
+// A finished piece isn't picked again while it's being checked, and it's
+// downloaded again if the check fails
+
+func TestFinishedUntilChecked(t *testing.T) {
+	pd := NewPieceData(bit_field.NewBitfield(1), STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH)
+	peer := newTestBitfield(1, 0)
+	if piece, block, err := pd.SearchPiece("a", peer, nil); err != nil || piece != 0 || block != 0 {
+		t.Fatalf("Got piece %d, block %d: %v", piece, block, err)
+	}
+	if finished, _, downloaders, _ := pd.Remove("a", 0, 0, true); !finished || len(downloaders) != 1 || downloaders[0] != "a" {
+		t.Fatalf("Piece not finished, downloaders %v", downloaders)
+	}
+	if _, _, err := pd.SearchPiece("b", peer, nil); err == nil {
+		t.Errorf("Picked a piece being checked")
+	}
+	if finished, _, _, _ := pd.Remove("a", 0, 0, false); finished {
+		t.Errorf("Piece finished twice")
+	}
+	pd.Checked(0)
+	if piece, _, err := pd.SearchPiece("b", peer, nil); err != nil || piece != 0 {
+		t.Errorf("Failed piece not picked again: %v", err)
+	}
+}
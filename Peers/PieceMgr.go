@@ -6,15 +6,16 @@
 package peers
 
 import(
+	"io"
 	"os"
 	"log"
+	"crypto/sha1"
 	"time"
 	"math"
 	"wgo/bit_field"
 	"wgo/files"
 	"wgo/stats"
 	"sync"
-	"strconv"
 	)
 
 const(
@@ -28,6 +29,7 @@ const(
 	NS_PER_S = 1000000000
 	MAX_REQUESTS = 2048
 	MAX_PIECE_LENGTH = 128*1024
+	RANDOM_PIECES = 4 // pieces picked randomly before going rarest first
 )
 	
 type pieceMgr struct {
@@ -38,12 +40,29 @@ type pieceMgr struct {
 	pieceLength, lastPieceLength, totalPieces, totalSize int64
 	files files.Files
 	bitfield *bit_field.Bitfield
+	// Called once the last piece is downloaded, without the mutex
+	completed func()
+	quit chan bool
+	smartBan *smartBan
 }
 
 type PieceMgr interface {
 	Request(addr string, peer *Peer, bitfield *bit_field.Bitfield)
-	SavePiece(addr string, index, begin, length int64) (os.Error)
+	SavePiece(addr string, index, begin int64, block []byte) (os.Error)
 	PeerExit(addr string)
+	Rejected(addr string, index, begin int64)
+	SetCompleted(f func())
+	Have(index int64)
+	AddBitfield(bitfield *bit_field.Bitfield)
+	RemoveBitfield(bitfield *bit_field.Bitfield)
+	Availability() []int
+	SetPicker(picker PiecePicker)
+	SetPriorities(priorities []int)
+	Interesting(bitfield *bit_field.Bitfield) bool
+	Completed() bool
+	Partial() map[int64][]int
+	SetPartial(partial map[int64][]int)
+	Close()
 }
 
 func (p *pieceMgr) Request(addr string, peer *Peer, bitfield *bit_field.Bitfield) {
@@ -58,7 +77,7 @@ func (p *pieceMgr) Request(addr string, peer *Peer, bitfield *bit_field.Bitfield
 	//log.Println("PieceMgr -> Requesting", requests, "from peer", msg.our_addr, "with speed:", speed.upload)
 	for i := p.pieceData.NumPieces(addr); i < MAX_REQUESTS && i < requests; i++ {
 		//log.Println("PieceMgr -> Searching new piece")
-		piece, block, err := p.pieceData.SearchPiece(addr, bitfield)
+		piece, block, err := p.pieceData.SearchPiece(addr, bitfield, peer.Suggested())
 		//log.Println("PieceMgr -> Finished searching piece")
 		if err != nil {
 			//log.Println(err)
@@ -70,10 +89,11 @@ func (p *pieceMgr) Request(addr string, peer *Peer, bitfield *bit_field.Bitfield
 	}
 }
 
-func (p *pieceMgr) SavePiece(addr string, index, begin, length int64) (os.Error) {
+func (p *pieceMgr) SavePiece(addr string, index, begin int64, block []byte) (os.Error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	if length < 9 {
+	length := int64(len(block))
+	if length == 0 {
 		return os.NewError("Unexpected message length")
 	}
 	if index >= p.bitfield.Len() {
@@ -92,7 +112,30 @@ func (p *pieceMgr) SavePiece(addr string, index, begin, length int64) (os.Error)
 	if length > MAX_PIECE_LENGTH {
 		return os.NewError("Block length too large")
 	}
-	finished, others, downloaders := p.pieceData.Remove(addr, index, begin/STANDARD_BLOCK_LENGTH, true)
+	if begin%STANDARD_BLOCK_LENGTH != 0 {
+		return os.NewError("Unaligned block")
+	}
+	if !p.pieceData.CheckRequested(addr, index, int(begin/STANDARD_BLOCK_LENGTH)) {
+		return os.NewError("Block not requested")
+	}
+	// Only the first copy of a block is stored, so the peer recorded as
+	// its sender is the one whose data is checked
+	if !p.pieceData.Pending(index, begin/STANDARD_BLOCK_LENGTH) {
+		p.pieceData.Remove(addr, index, begin/STANDARD_BLOCK_LENGTH, false)
+		return nil
+	}
+	if err := p.files.WriteAt(index, begin, block); err != nil {
+		return os.NewError("Write piece " + err.String())
+	}
+	// A piece that failed before is compared with the blocks of the bad
+	// one once it passes, Files won't have them then. The sums of other
+	// pieces are only needed if they fail, and taken from the cache.
+	if p.smartBan.pending(index) {
+		hasher := sha1.New()
+		hasher.Write(block)
+		p.pieceData.SetSum(index, begin/STANDARD_BLOCK_LENGTH, string(hasher.Sum()))
+	}
+	finished, others, downloaders, sums := p.pieceData.Remove(addr, index, begin/STANDARD_BLOCK_LENGTH, true)
 	if len(others) > 0 {
 		// Send message to cancel request to other peers
 		p.peerMgr.SendCancel(others, index, begin, STANDARD_BLOCK_LENGTH)
@@ -100,9 +143,60 @@ func (p *pieceMgr) SavePiece(addr string, index, begin, length int64) (os.Error)
 	if !finished {
 		return nil
 	}
-	if err := p.files.CheckPiece(index); err != nil {
-		p.peerMgr.AddBadPeers(downloaders)
-		return os.NewError("Ignoring bad piece " + strconv.Itoa64(index))
+	// The peer doesn't wait for the hash check, the cache has the result
+	// or reads the piece in the disk workers
+	p.files.HashPiece(index, func(err os.Error) {
+		if err != nil {
+			sums = p.blockSums(index, sums)
+		}
+		p.pieceChecked(index, downloaders, sums, err)
+	})
+	return nil
+}
+
+// SHA-1 of the blocks of a piece that failed the hash check, the ones
+// missing in sums are read from the cache, that keeps a bad piece as it
+// was received
+
+func (p *pieceMgr) blockSums(index int64, sums []string) (filled []string) {
+	filled = make([]string, len(sums))
+	copy(filled, sums)
+	length := p.pieceLength
+	if index == p.totalPieces-1 {
+		length = p.totalSize - index*p.pieceLength
+	}
+	for i, sum := range filled {
+		begin := int64(i)*STANDARD_BLOCK_LENGTH
+		if len(sum) > 0 || begin >= length {
+			continue
+		}
+		size := length - begin
+		if size > STANDARD_BLOCK_LENGTH {
+			size = STANDARD_BLOCK_LENGTH
+		}
+		hasher := sha1.New()
+		if _, err := io.Copy(hasher, p.files.GetReaderAt(index, begin, size)); err != nil {
+			continue
+		}
+		filled[i] = string(hasher.Sum())
+	}
+	return
+}
+
+// Apply the result of the hash check of a finished piece. The completed
+// callback is called without the mutex, it can use the PieceMgr.
+
+func (p *pieceMgr) pieceChecked(index int64, downloaders, sums []string, err os.Error) {
+	p.mutex.Lock()
+	p.pieceData.Checked(index)
+	if err != nil {
+		log.Println("PieceMgr -> Ignoring bad piece", index)
+		p.hashFailed(index, downloaders, sums)
+		p.mutex.Unlock()
+		return
+	}
+	if p.smartBan.pending(index) {
+		p.hashPassed(index, sums)
 	}
 	// Mark piece as finished and delete it from activePieces
 	p.bitfield.Set(index)
@@ -110,7 +204,14 @@ func (p *pieceMgr) SavePiece(addr string, index, begin, length int64) (os.Error)
 	p.peerMgr.SendHave(index)
 	log.Println("-------> Piece ", index, "finished")
 	log.Println("Finished Pieces:", p.bitfield.Count(), "/", p.totalPieces)
-	return nil
+	var completed func()
+	if p.pieceData.Completed() {
+		completed = p.completed
+	}
+	p.mutex.Unlock()
+	if completed != nil {
+		completed()
+	}
 }
 
 func (p *pieceMgr) PeerExit(addr string) {
@@ -119,6 +220,22 @@ func (p *pieceMgr) PeerExit(addr string) {
 	p.pieceData.RemoveAll(addr)
 }
 
+// The peer rejected a request (BEP 6), the block can be requested again
+
+func (p *pieceMgr) Rejected(addr string, index, begin int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pieceData.CheckRequested(addr, index, int(begin/STANDARD_BLOCK_LENGTH)) {
+		p.pieceData.Remove(addr, index, begin/STANDARD_BLOCK_LENGTH, false)
+	}
+}
+
+func (p *pieceMgr) SetCompleted(f func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.completed = f
+}
+
 func NewPieceMgr(peerMgr PeerMgr, st stats.Stats, fl files.Files, bitfield *bit_field.Bitfield, pieceLength, lastPieceLength, totalPieces, totalSize int64) (p PieceMgr, err os.Error){
 	pieceMgr := new(pieceMgr)
 	pieceMgr.mutex = new(sync.Mutex)
@@ -132,17 +249,118 @@ func NewPieceMgr(peerMgr PeerMgr, st stats.Stats, fl files.Files, bitfield *bit_
 	pieceMgr.peerMgr = peerMgr
 	pieceMgr.stats = st
 	pieceMgr.files = fl
+	pieceMgr.quit = make(chan bool)
+	pieceMgr.smartBan = newSmartBan()
 	p = pieceMgr
 	go pieceMgr.Run()
 	return
 }
 
+// Remember who sent each block of the bad piece, it's downloaded again
+// and the peers whose blocks differ from the good ones are banned
+
+func (p *pieceMgr) hashFailed(index int64, downloaders, sums []string) {
+	for _, addr := range p.smartBan.failed(index, downloaders, sums) {
+		p.peerMgr.BanPeer(addr)
+	}
+}
+
+func (p *pieceMgr) hashPassed(index int64, sums []string) {
+	for _, addr := range p.smartBan.passed(index, sums) {
+		p.peerMgr.BanPeer(addr)
+	}
+}
+
+// Keep the availability of the pieces in the swarm, from the have and
+// bitfield messages of the peers. RemoveBitfield is called with the
+// bitfield of a peer that is replaced or gone.
+
+func (p *pieceMgr) Have(index int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.Have(index)
+}
+
+func (p *pieceMgr) AddBitfield(bitfield *bit_field.Bitfield) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.AddAvailability(bitfield)
+}
+
+func (p *pieceMgr) RemoveBitfield(bitfield *bit_field.Bitfield) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.RemoveAvailability(bitfield)
+}
+
+// Number of connected peers that have each piece
+
+func (p *pieceMgr) Availability() []int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pieceData.Availability()
+}
+
+// Strategy to choose new pieces, it can be changed while downloading
+
+func (p *pieceMgr) SetPicker(picker PiecePicker) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.SetPicker(picker)
+}
+
+// Priority of each piece from the priorities of the files, the skipped
+// pieces aren't downloaded
+
+func (p *pieceMgr) SetPriorities(priorities []int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.SetPriorities(priorities)
+}
+
+// The peer with bitfield has pieces that we want
+
+func (p *pieceMgr) Interesting(bitfield *bit_field.Bitfield) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pieceData.Interesting(bitfield)
+}
+
+// All the wanted pieces are downloaded, the skipped ones can be missing
+
+func (p *pieceMgr) Completed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pieceData.Completed()
+}
+
+// Blocks downloaded of the pieces not finished, for the fast resume data
+
+func (p *pieceMgr) Partial() map[int64][]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pieceData.Partial()
+}
+
+func (p *pieceMgr) SetPartial(partial map[int64][]int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.SetPartial(partial)
+}
+
+func (p *pieceMgr) Close() {
+	close(p.quit)
+}
+
 func (p *pieceMgr) Run() {
-	cleanPieceData := time.Tick(CLEAN_REQUESTS*NS_PER_S)
+	cleanPieceData := time.NewTicker(CLEAN_REQUESTS*NS_PER_S)
+	defer cleanPieceData.Stop()
 	for {
 		//log.Println("PieceMgr -> Waiting for messages")
 		select {
-			case <- cleanPieceData:
+			case <- p.quit:
+				return
+			case <- cleanPieceData.C:
 				p.mutex.Lock()
 				//log.Println("PieceMgr -> Cleaning piece data")
 				p.pieceData.Clean()
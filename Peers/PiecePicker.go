@@ -0,0 +1,160 @@
+// Strategies to choose the next piece to download
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"rand"
+	"sync"
+	)
+
+const(
+	STREAMING_WINDOW = 20 // pieces after the playback position
+	STREAMING_DEADLINE = 4 // seconds for the piece at the playback position
+)
+
+// Pieces a picker can choose from: the peer has them, we don't and
+// they aren't being downloaded yet
+
+type Pieces interface {
+	// Number of pieces of the torrent
+	Len() int64
+	// Number of pieces we have
+	Count() int64
+	// First piece that can be chosen starting at start, -1 if none
+	Next(start int64) int64
+	// Number of connected peers that have the piece
+	Availability(piece int64) int
+}
+
+type PiecePicker interface {
+	// New piece to download, -1 if none of pieces is wanted
+	Pick(pieces Pieces) int64
+	// Seconds a block of piece can take before it's requested from
+	// another peer too, 0 means no deadline. Active pieces with a
+	// deadline are completed before the others.
+	Deadline(piece int64) int64
+}
+
+// Random pieces until we have RANDOM_PIECES to trade, then the rarest
+// ones
+
+type rarestFirst struct {}
+
+func NewRarestFirstPicker() PiecePicker {
+	return new(rarestFirst)
+}
+
+func (r *rarestFirst) Pick(pieces Pieces) int64 {
+	if pieces.Count() < RANDOM_PIECES {
+		return randomPiece(pieces)
+	}
+	return rarestPiece(pieces)
+}
+
+func (r *rarestFirst) Deadline(piece int64) int64 {
+	return 0
+}
+
+func randomPiece(pieces Pieces) (piece int64) {
+	start := rand.Int63n(pieces.Len())
+	if piece = pieces.Next(start); piece == -1 {
+		piece = pieces.Next(0)
+	}
+	return
+}
+
+// Piece with the lowest availability, ties are broken randomly
+
+func rarestPiece(pieces Pieces) (rpiece int64) {
+	rpiece = -1
+	min, ties := 0, 0
+	for piece := pieces.Next(0); piece != -1; piece = pieces.Next(piece+1) {
+		switch n := pieces.Availability(piece); {
+			case rpiece == -1 || n < min:
+				rpiece, min, ties = piece, n, 1
+			case n == min:
+				// Keep each of the tied pieces with the same probability
+				ties++
+				if rand.Intn(ties) == 0 {
+					rpiece = piece
+				}
+		}
+	}
+	return
+}
+
+// Pieces in order, e.g. to open the files while they are downloaded
+
+type sequential struct {}
+
+func NewSequentialPicker() PiecePicker {
+	return new(sequential)
+}
+
+func (s *sequential) Pick(pieces Pieces) int64 {
+	return pieces.Next(0)
+}
+
+func (s *sequential) Deadline(piece int64) int64 {
+	return 0
+}
+
+// The window of pieces after the playback position is downloaded first,
+// in order and with deadlines, and the rest rarest first. The position
+// can be moved at any time, e.g. when the player seeks.
+
+type StreamingPicker struct {
+	mutex *sync.Mutex
+	position, window int64
+	rarest PiecePicker
+}
+
+// window <= 0 means STREAMING_WINDOW
+
+func NewStreamingPicker(window int64) (s *StreamingPicker) {
+	s = new(StreamingPicker)
+	s.mutex = new(sync.Mutex)
+	if window <= 0 {
+		window = STREAMING_WINDOW
+	}
+	s.window = window
+	s.rarest = NewRarestFirstPicker()
+	return
+}
+
+func (s *StreamingPicker) SetPosition(piece int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if piece >= 0 {
+		s.position = piece
+	}
+}
+
+func (s *StreamingPicker) Position() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.position
+}
+
+func (s *StreamingPicker) Pick(pieces Pieces) int64 {
+	s.mutex.Lock()
+	position, window := s.position, s.window
+	s.mutex.Unlock()
+	if piece := pieces.Next(position); piece != -1 && piece < position + window {
+		return piece
+	}
+	return s.rarest.Pick(pieces)
+}
+
+// The deadline grows a second per piece from the playback position
+
+func (s *StreamingPicker) Deadline(piece int64) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if piece < s.position || piece >= s.position + s.window {
+		return 0
+	}
+	return STREAMING_DEADLINE + piece - s.position
+}
@@ -0,0 +1,151 @@
+package peers
+
+import(
+	"testing"
+	"time"
+	"wgo/bit_field"
+	)
+
+// Pieces with the candidates and availability given
+
+type testPieces struct {
+	count int64
+	candidates []bool
+	availability []int
+}
+
+func (p *testPieces) Len() int64 {
+	return int64(len(p.candidates))
+}
+
+func (p *testPieces) Count() int64 {
+	return p.count
+}
+
+func (p *testPieces) Next(start int64) int64 {
+	for piece := start; piece < p.Len(); piece++ {
+		if p.candidates[piece] {
+			return piece
+		}
+	}
+	return -1
+}
+
+func (p *testPieces) Availability(piece int64) int {
+	return p.availability[piece]
+}
+
+func newTestPieces(count int64, availability []int, candidates ...int64) (p *testPieces) {
+	p = &testPieces{count, make([]bool, len(availability)), availability}
+	for _, piece := range candidates {
+		p.candidates[piece] = true
+	}
+	return
+}
+
+func TestRarestFirst(t *testing.T) {
+	picker := NewRarestFirstPicker()
+	availability := []int{1, 3, 2, 5, 2, 1, 4}
+	if piece := picker.Pick(newTestPieces(RANDOM_PIECES, availability, 1, 2, 3, 6)); piece != 2 {
+		t.Errorf("Picked %d, expected the rarest 2", piece)
+	}
+	// Ties are broken randomly
+	seen := make(map[int64]int)
+	for i := 0; i < 100; i++ {
+		seen[picker.Pick(newTestPieces(RANDOM_PIECES, availability, 1, 2, 3, 4))]++
+	}
+	if len(seen) != 2 || seen[2] == 0 || seen[4] == 0 {
+		t.Errorf("Picked %v, expected 2 and 4", seen)
+	}
+	// Random pieces until there are some to trade
+	for i := 0; i < 20; i++ {
+		if piece := picker.Pick(newTestPieces(0, availability, 3, 6)); piece != 3 && piece != 6 {
+			t.Fatalf("Picked %d, not a candidate", piece)
+		}
+	}
+	if piece := picker.Pick(newTestPieces(RANDOM_PIECES, availability)); piece != -1 {
+		t.Errorf("Picked %d without candidates", piece)
+	}
+}
+
+func TestSequential(t *testing.T) {
+	picker := NewSequentialPicker()
+	availability := []int{1, 3, 2, 5, 2, 1, 4}
+	if piece := picker.Pick(newTestPieces(RANDOM_PIECES, availability, 3, 5, 6)); piece != 3 {
+		t.Errorf("Picked %d, expected 3", piece)
+	}
+	if picker.Deadline(3) != 0 {
+		t.Errorf("Sequential pieces have a deadline")
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	picker := NewStreamingPicker(3)
+	picker.SetPosition(2)
+	availability := []int{1, 3, 2, 5, 2, 1, 4}
+	// In order in the window, rarest first after it
+	if piece := picker.Pick(newTestPieces(RANDOM_PIECES, availability, 0, 3, 4, 5)); piece != 3 {
+		t.Errorf("Picked %d, expected 3", piece)
+	}
+	if piece := picker.Pick(newTestPieces(RANDOM_PIECES, availability, 0, 6)); piece != 0 {
+		t.Errorf("Picked %d, expected the rarest 0", piece)
+	}
+	// Seeking moves the window
+	picker.SetPosition(5)
+	if piece := picker.Pick(newTestPieces(RANDOM_PIECES, availability, 0, 6)); piece != 6 {
+		t.Errorf("Picked %d after seeking, expected 6", piece)
+	}
+	picker.SetPosition(-1)
+	if picker.Position() != 5 {
+		t.Errorf("Moved to a negative position")
+	}
+	deadlines := []int64{0, 0, 0, 0, 0, STREAMING_DEADLINE, STREAMING_DEADLINE+1, STREAMING_DEADLINE+2, 0}
+	for piece, deadline := range deadlines {
+		if d := picker.Deadline(int64(piece)); d != deadline {
+			t.Errorf("Deadline of piece %d is %d, expected %d", piece, d, deadline)
+		}
+	}
+}
+
+// Pieces with a deadline are finished first, and their blocks are
+// requested from other peers once it's missed
+
+func TestSearchPieceDeadline(t *testing.T) {
+	// Two blocks per piece
+	pd := NewPieceData(bit_field.NewBitfield(10), 2*STANDARD_BLOCK_LENGTH, 2*STANDARD_BLOCK_LENGTH)
+	picker := NewStreamingPicker(3)
+	picker.SetPosition(4)
+	pd.SetPicker(picker)
+	all := newTestBitfield(10, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	expected := []struct {
+		piece int64
+		block int
+	}{
+		{4, 0},
+		{4, 1},
+		{5, 0},
+	}
+	for _, e := range expected {
+		if piece, block, err := pd.SearchPiece("1.1.1.1:1", all, nil); err != nil || piece != e.piece || block != e.block {
+			t.Fatalf("Got piece %d block %d (%v), expected piece %d block %d", piece, block, err, e.piece, e.block)
+		}
+	}
+	// Piece 9 is active without a deadline, the rest of 5 goes first
+	pd.Add("2.2.2.2:2", 9, 0)
+	if piece, block, err := pd.SearchPiece("3.3.3.3:3", all, nil); err != nil || piece != 5 || block != 1 {
+		t.Fatalf("Got piece %d block %d (%v), expected piece 5 block 1", piece, block, err)
+	}
+	// Another peer with piece 4 gets nothing until the deadline is missed
+	four := newTestBitfield(10, 4)
+	if _, _, err := pd.SearchPiece("4.4.4.4:4", four, nil); err == nil {
+		t.Fatalf("Requested a block of piece 4 before its deadline")
+	}
+	pd.pieces[4].requested[1] = time.Seconds() - STREAMING_DEADLINE - 1
+	if piece, block, err := pd.SearchPiece("4.4.4.4:4", four, nil); err != nil || piece != 4 || block != 1 {
+		t.Fatalf("Got piece %d block %d (%v), expected piece 4 block 1", piece, block, err)
+	}
+	// Only once from each peer
+	if _, _, err := pd.SearchPiece("4.4.4.4:4", four, nil); err == nil {
+		t.Errorf("Requested the same block twice from a peer")
+	}
+}
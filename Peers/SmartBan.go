@@ -0,0 +1,95 @@
+// Smart ban: find the peer that sent the corrupt block of a piece that
+// failed the hash check, instead of blaming everyone that sent a block
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+const(
+	// Failed pieces sent entirely by a peer before it's banned, a single
+	// one could be a disk error
+	SMART_BAN_STRIKES = 2
+)
+
+type blockSource struct {
+	addr string
+	sum string // SHA-1 of the block as it was received
+}
+
+type smartBan struct {
+	// Sources of each block of the pieces that failed, by piece
+	pieces map[int64][][]blockSource
+	// Failed pieces sent entirely by each peer
+	strikes map[string]int
+}
+
+func newSmartBan() (s *smartBan) {
+	s = new(smartBan)
+	s.pieces = make(map[int64][][]blockSource)
+	s.strikes = make(map[string]int)
+	return
+}
+
+// The piece failed the hash check, addrs and sums are the sender and
+// the SHA-1 of each block. The blocks are kept until the piece passes,
+// so the peers that sent different data can be found. A peer that sent
+// all the blocks of SMART_BAN_STRIKES failed pieces is returned as bad.
+
+func (s *smartBan) failed(index int64, addrs []string, sums []string) (bad []string) {
+	blocks, ok := s.pieces[index]
+	if !ok || len(blocks) != len(sums) {
+		blocks = make([][]blockSource, len(sums))
+		s.pieces[index] = blocks
+	}
+	for i, sum := range sums {
+		// Blocks that couldn't be read don't have a sum
+		if i < len(addrs) && len(addrs[i]) > 0 && len(sum) > 0 {
+			blocks[i] = append(blocks[i], blockSource{addrs[i], sum})
+		}
+	}
+	if len(addrs) == 0 || len(addrs) != len(sums) || len(addrs[0]) == 0 {
+		return
+	}
+	for _, addr := range addrs {
+		if addr != addrs[0] {
+			return
+		}
+	}
+	if s.strikes[addrs[0]]++; s.strikes[addrs[0]] >= SMART_BAN_STRIKES {
+		s.strikes[addrs[0]] = 0, false
+		return []string{addrs[0]}
+	}
+	return
+}
+
+// The piece passed the hash check with the blocks in sums, the peers
+// that sent a different block before are the bad ones
+
+func (s *smartBan) passed(index int64, sums []string) (bad []string) {
+	blocks, ok := s.pieces[index]
+	if !ok {
+		return
+	}
+	s.pieces[index] = nil, false
+	found := make(map[string]bool)
+	for i, sources := range blocks {
+		if i >= len(sums) {
+			break
+		}
+		for _, source := range sources {
+			// Blocks from the resume data don't have a sum
+			if len(sums[i]) > 0 && source.sum != sums[i] && !found[source.addr] {
+				found[source.addr] = true
+				bad = append(bad, source.addr)
+			}
+		}
+	}
+	return
+}
+
+// Pieces waiting to be downloaded again
+
+func (s *smartBan) pending(index int64) bool {
+	_, ok := s.pieces[index]
+	return ok
+}
@@ -0,0 +1,71 @@
+package peers
+
+import(
+	"sort"
+	"strings"
+	"testing"
+	)
+
+type smartBanStep struct {
+	// Check the piece with these senders and block sums
+	passed bool
+	addrs, sums []string
+	bad []string
+}
+
+var smartBanTests = []struct {
+	name string
+	steps []smartBanStep
+}{
+	{"one bad block among several peers", []smartBanStep{
+		{false, []string{"a", "b", "c"}, []string{"1", "2", "x"}, nil},
+		{true, []string{"d", "d", "d"}, []string{"1", "2", "3"}, []string{"c"}},
+	}},
+	{"all blocks from one peer", []smartBanStep{
+		{false, []string{"a", "a"}, []string{"1", "x"}, nil},
+		{false, []string{"a", "a"}, []string{"1", "x"}, []string{"a"}},
+	}},
+	{"all blocks from one peer, then from others", []smartBanStep{
+		{false, []string{"a", "a"}, []string{"1", "x"}, nil},
+		{true, []string{"b", "c"}, []string{"1", "2"}, []string{"a"}},
+	}},
+	{"re-download with different sources", []smartBanStep{
+		{false, []string{"a", "b"}, []string{"1", "x"}, nil},
+		{false, []string{"c", "d"}, []string{"y", "2"}, nil},
+		{true, []string{"e", "f"}, []string{"1", "2"}, []string{"b", "c"}},
+	}},
+	{"blocks from the resume data", []smartBanStep{
+		{false, []string{"", "a"}, []string{"", "x"}, nil},
+		{true, []string{"", "b"}, []string{"", "2"}, []string{"a"}},
+	}},
+	{"block that couldn't be read", []smartBanStep{
+		{false, []string{"a", "b"}, []string{"", "x"}, nil},
+		{true, []string{"c", "c"}, []string{"1", "2"}, []string{"b"}},
+	}},
+	{"piece that passes the first time", []smartBanStep{
+		{true, []string{"a", "b"}, []string{"1", "2"}, nil},
+	}},
+}
+
+func TestSmartBan(t *testing.T) {
+	for _, test := range smartBanTests {
+		s := newSmartBan()
+		for i, step := range test.steps {
+			var bad []string
+			if step.passed {
+				bad = s.passed(0, step.sums)
+			} else {
+				bad = s.failed(0, step.addrs, step.sums)
+			}
+			sort.Strings(bad)
+			if strings.Join(bad, ",") != strings.Join(step.bad, ",") {
+				t.Errorf("%s, step %d: banned %v, expected %v", test.name, i, bad, step.bad)
+			}
+		}
+		if s.pending(0) {
+			if last := test.steps[len(test.steps)-1]; last.passed {
+				t.Errorf("%s: piece still pending after passing", test.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Metadata exchange (BEP 9), downloads the info dictionary of magnet
+// links and sends it to the peers that ask for it
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"os"
+	"log"
+	"sync"
+	"bytes"
+	"bufio"
+	"io/ioutil"
+	"crypto/sha1"
+	"wgo/bencode"
+	)
+
+const(
+	METADATA_PIECE_SIZE = 16*1024
+	MAX_METADATA_SIZE = 8*1024*1024
+)
+
+// ut_metadata message types
+
+const(
+	METADATA_REQUEST = iota
+	METADATA_DATA
+	METADATA_REJECT
+)
+
+type UtMetadata struct {
+	mutex *sync.Mutex
+	infohash string
+	// Verified info dictionary, nil while downloading it
+	info []byte
+	size int64
+	pieces [][]byte
+	// Piece -> address of the peer it was requested to
+	requested map[int]string
+	// Peers that can send us the metadata
+	peers map[string]ExtendedPeer
+	// Piece -> address of the peer that sent it
+	senders map[int]string
+	// Peers that sent pieces of metadata that didn't match the infohash
+	bad map[string]bool
+	done chan bool
+}
+
+// Create the extension, info is nil when the metadata has to be fetched
+
+func NewUtMetadata(infohash string, info []byte) (u *UtMetadata) {
+	u = new(UtMetadata)
+	u.mutex = new(sync.Mutex)
+	u.infohash = infohash
+	u.info = info
+	u.requested = make(map[int]string)
+	u.peers = make(map[string]ExtendedPeer)
+	u.senders = make(map[int]string)
+	u.bad = make(map[string]bool)
+	u.done = make(chan bool)
+	if info != nil {
+		close(u.done)
+	}
+	return
+}
+
+func (u *UtMetadata) Name() string {
+	return "ut_metadata"
+}
+
+// Closed when the info dictionary is available
+
+func (u *UtMetadata) Done() <-chan bool {
+	return u.done
+}
+
+func (u *UtMetadata) Info() []byte {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.info
+}
+
+func (u *UtMetadata) Handshake(p ExtendedPeer, h *ExtHandshake) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.info != nil || u.bad[p.Addr()] {
+		return
+	}
+	u.addPeer(p, h.Metadata_size)
+}
+
+// The first peer with a valid size sets the size of the metadata. Must be
+// called with the mutex locked.
+
+func (u *UtMetadata) addPeer(p ExtendedPeer, size int64) {
+	if u.size == 0 {
+		if size <= 0 || size > MAX_METADATA_SIZE {
+			return
+		}
+		u.size = size
+		u.pieces = make([][]byte, (u.size+METADATA_PIECE_SIZE-1)/METADATA_PIECE_SIZE)
+	}
+	u.peers[p.Addr()] = p
+	u.request(p)
+}
+
+func (u *UtMetadata) Message(p ExtendedPeer, payLoad []byte) (err os.Error) {
+	u.mutex.Lock()
+	bad := u.bad[p.Addr()]
+	u.mutex.Unlock()
+	if bad {
+		return os.NewError("Peer sent invalid metadata")
+	}
+	// The dictionary is followed by the data of the piece
+	r := bufio.NewReader(bytes.NewBuffer(payLoad))
+	v, err := bencode.Decode(r)
+	if err != nil {
+		return
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return os.NewError("Invalid ut_metadata message")
+	}
+	msgType, _ := d["msg_type"].(int64)
+	piece, ok := d["piece"].(int64)
+	if !ok || piece < 0 || int64(int(piece)) != piece {
+		return os.NewError("Invalid ut_metadata piece")
+	}
+	switch msgType {
+		case METADATA_REQUEST:
+			return u.sendPiece(p, int(piece))
+		case METADATA_DATA:
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			return u.savePiece(p, int(piece), data)
+		case METADATA_REJECT:
+			u.mutex.Lock()
+			if u.requested[int(piece)] == p.Addr() {
+				u.requested[int(piece)] = "", false
+			}
+			u.mutex.Unlock()
+	}
+	return
+}
+
+// Requests sent to the peer are given to the rest of peers
+
+func (u *UtMetadata) PeerExit(addr string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, ok := u.peers[addr]; !ok {
+		return
+	}
+	u.peers[addr] = nil, false
+	for piece, a := range u.requested {
+		if a == addr {
+			u.requested[piece] = "", false
+		}
+	}
+	if u.info != nil {
+		return
+	}
+	for _, p := range u.peers {
+		u.request(p)
+	}
+}
+
+// Ask p for a piece that hasn't been requested, or for a piece requested
+// to another peer if all of them are. Must be called with the mutex locked.
+
+func (u *UtMetadata) request(p ExtendedPeer) {
+	piece := -1
+	for i, data := range u.pieces {
+		if data != nil {
+			continue
+		}
+		if addr, ok := u.requested[i]; !ok {
+			piece = i
+			break
+		} else if piece == -1 && addr != p.Addr() {
+			piece = i
+		}
+	}
+	if piece == -1 {
+		return
+	}
+	payLoad, err := encodeMetadataMsg(METADATA_REQUEST, piece, 0)
+	if err != nil {
+		return
+	}
+	if err = p.SendExtended(u.Name(), payLoad); err == nil {
+		u.requested[piece] = p.Addr()
+	}
+}
+
+func (u *UtMetadata) sendPiece(p ExtendedPeer, piece int) (err os.Error) {
+	info := u.Info()
+	// The piece comes from the peer, check it before multiplying it
+	if info == nil || piece >= (len(info)+METADATA_PIECE_SIZE-1)/METADATA_PIECE_SIZE {
+		payLoad, err := encodeMetadataMsg(METADATA_REJECT, piece, 0)
+		if err != nil {
+			return err
+		}
+		return p.SendExtended(u.Name(), payLoad)
+	}
+	begin := piece*METADATA_PIECE_SIZE
+	end := begin + METADATA_PIECE_SIZE
+	if end > len(info) {
+		end = len(info)
+	}
+	payLoad, err := encodeMetadataMsg(METADATA_DATA, piece, int64(len(info)))
+	if err != nil {
+		return
+	}
+	return p.SendExtended(u.Name(), append(payLoad, info[begin:end]...))
+}
+
+func (u *UtMetadata) savePiece(p ExtendedPeer, piece int, data []byte) (err os.Error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.info != nil || piece >= len(u.pieces) {
+		return
+	}
+	length := int64(METADATA_PIECE_SIZE)
+	if piece == len(u.pieces)-1 {
+		length = u.size - int64(piece)*METADATA_PIECE_SIZE
+	}
+	if int64(len(data)) != length {
+		return os.NewError("Invalid metadata piece length")
+	}
+	u.pieces[piece] = data
+	u.senders[piece] = p.Addr()
+	u.requested[piece] = "", false
+	for _, data := range u.pieces {
+		if data == nil {
+			u.request(p)
+			return
+		}
+	}
+	// Check the info dictionary against the infohash
+	info := bytes.Join(u.pieces, nil)
+	hash := sha1.New()
+	hash.Write(info)
+	if string(hash.Sum()) != u.infohash {
+		log.Println("UtMetadata -> Metadata hash doesn't match, downloading it again")
+		// Any of the senders could have lied, and so could have the peer
+		// that gave us the size
+		for _, addr := range u.senders {
+			u.bad[addr] = true
+			u.peers[addr] = nil, false
+		}
+		u.size = 0
+		u.pieces = nil
+		u.senders = make(map[int]string)
+		u.requested = make(map[int]string)
+		for _, p := range u.peers {
+			u.addPeer(p, p.Extended().Metadata_size)
+		}
+		return os.NewError("Metadata hash doesn't match")
+	}
+	log.Println("UtMetadata -> Metadata downloaded,", u.size, "bytes")
+	u.info = info
+	u.peers = make(map[string]ExtendedPeer)
+	close(u.done)
+	return
+}
+
+func encodeMetadataMsg(msgType, piece int, totalSize int64) (payLoad []byte, err os.Error) {
+	m := map[string]interface{}{"msg_type": int64(msgType), "piece": int64(piece)}
+	if totalSize > 0 {
+		m["total_size"] = totalSize
+	}
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, m); err != nil {
+		return
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,185 @@
+package peers
+
+import(
+	"os"
+	"bytes"
+	"bufio"
+	"testing"
+	"io/ioutil"
+	"crypto/sha1"
+	"wgo/bencode"
+	)
+
+// Peer that keeps the extended messages sent to it
+
+type fakeExtPeer struct {
+	addr string
+	ext *ExtHandshake
+	sent [][]byte
+}
+
+func newFakeExtPeer(addr string, size int64) *fakeExtPeer {
+	return &fakeExtPeer{addr: addr, ext: &ExtHandshake{M: map[string]int64{"ut_metadata": 3}, Metadata_size: size}}
+}
+
+func (f *fakeExtPeer) Addr() string {
+	return f.addr
+}
+
+func (f *fakeExtPeer) Extended() *ExtHandshake {
+	return f.ext
+}
+
+func (f *fakeExtPeer) SendExtended(name string, payLoad []byte) os.Error {
+	f.sent = append(f.sent, payLoad)
+	return nil
+}
+
+func decodeMetadataMsg(t *testing.T, payLoad []byte) (msgType, piece int64, data []byte) {
+	r := bufio.NewReader(bytes.NewBuffer(payLoad))
+	v, err := bencode.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := v.(map[string]interface{})
+	if data, err = ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	return d["msg_type"].(int64), d["piece"].(int64), data
+}
+
+func testInfo(size int) []byte {
+	info := make([]byte, size)
+	for i, _ := range info {
+		info[i] = byte(i * 7)
+	}
+	return info
+}
+
+func TestSendPieceOutOfRange(t *testing.T) {
+	info := testInfo(METADATA_PIECE_SIZE + 100)
+	u := NewUtMetadata("", info)
+	p := newFakeExtPeer("1.2.3.4:5", 0)
+	tests := []struct {
+		piece int64
+		msgType int64
+		length int
+	}{
+		{0, METADATA_DATA, METADATA_PIECE_SIZE},
+		{1, METADATA_DATA, 100},
+		{2, METADATA_REJECT, 0},
+		// Would overflow piece*METADATA_PIECE_SIZE
+		{1 << 50, METADATA_REJECT, 0},
+	}
+	for _, test := range tests {
+		payLoad, err := encodeMetadataMsg(METADATA_REQUEST, int(test.piece), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = u.Message(p, payLoad); err != nil {
+			t.Fatalf("Request of piece %d: %v", test.piece, err)
+		}
+		msgType, piece, data := decodeMetadataMsg(t, p.sent[len(p.sent)-1])
+		if msgType != test.msgType || piece != test.piece || len(data) != test.length {
+			t.Errorf("Request of piece %d: got type %d, piece %d, %d bytes", test.piece, msgType, piece, len(data))
+		}
+	}
+}
+
+func metadataData(t *testing.T, piece int, size int64, data []byte) []byte {
+	payLoad, err := encodeMetadataMsg(METADATA_DATA, piece, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(payLoad, data...)
+}
+
+// The last request sent to p, -1 if it wasn't asked for anything
+
+func lastRequest(t *testing.T, p *fakeExtPeer) int64 {
+	if len(p.sent) == 0 {
+		return -1
+	}
+	msgType, piece, _ := decodeMetadataMsg(t, p.sent[len(p.sent)-1])
+	if msgType != METADATA_REQUEST {
+		t.Fatalf("Sent message type %d, expected a request", msgType)
+	}
+	return piece
+}
+
+func TestFetchMetadata(t *testing.T) {
+	info := testInfo(2*METADATA_PIECE_SIZE + 10)
+	hash := sha1.New()
+	hash.Write(info)
+	u := NewUtMetadata(string(hash.Sum()), nil)
+	a := newFakeExtPeer("1.1.1.1:1", int64(len(info)))
+	b := newFakeExtPeer("2.2.2.2:2", int64(len(info)))
+	u.Handshake(a, a.ext)
+	u.Handshake(b, b.ext)
+	if lastRequest(t, a) != 0 || lastRequest(t, b) != 1 {
+		t.Fatalf("Requested pieces %d and %d, expected 0 and 1", lastRequest(t, a), lastRequest(t, b))
+	}
+	// Pieces can arrive in any order
+	if err := u.Message(b, metadataData(t, 1, int64(len(info)), info[METADATA_PIECE_SIZE:2*METADATA_PIECE_SIZE])); err != nil {
+		t.Fatal(err)
+	}
+	if lastRequest(t, b) != 2 {
+		t.Fatalf("Requested piece %d, expected 2", lastRequest(t, b))
+	}
+	if err := u.Message(b, metadataData(t, 2, int64(len(info)), info[2*METADATA_PIECE_SIZE:])); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Message(a, metadataData(t, 0, int64(len(info)), info[0:METADATA_PIECE_SIZE-1])); err == nil {
+		t.Errorf("Accepted a short piece")
+	}
+	if err := u.Message(a, metadataData(t, 0, int64(len(info)), info[0:METADATA_PIECE_SIZE])); err != nil {
+		t.Fatal(err)
+	}
+	select {
+		case <- u.Done():
+		default:
+			t.Fatal("Metadata not done")
+	}
+	if !bytes.Equal(u.Info(), info) {
+		t.Errorf("Got different metadata")
+	}
+}
+
+func TestFetchMetadataMismatch(t *testing.T) {
+	info := testInfo(METADATA_PIECE_SIZE + 10)
+	hash := sha1.New()
+	hash.Write(info)
+	u := NewUtMetadata(string(hash.Sum()), nil)
+	// The liar announces a wrong size and sends garbage
+	liar := newFakeExtPeer("1.1.1.1:1", 20)
+	good := newFakeExtPeer("2.2.2.2:2", int64(len(info)))
+	u.Handshake(liar, liar.ext)
+	u.Handshake(good, good.ext)
+	if lastRequest(t, liar) != 0 || lastRequest(t, good) != 0 {
+		t.Fatalf("Requested pieces %d and %d, expected 0 and 0", lastRequest(t, liar), lastRequest(t, good))
+	}
+	if err := u.Message(liar, metadataData(t, 0, 20, make([]byte, 20))); err == nil {
+		t.Fatal("Accepted metadata that doesn't match the infohash")
+	}
+	// The size of the good peer is used now, and the liar is dropped
+	if lastRequest(t, good) != 0 {
+		t.Fatalf("Requested piece %d, expected 0", lastRequest(t, good))
+	}
+	sent := len(liar.sent)
+	u.Handshake(liar, liar.ext)
+	if len(liar.sent) != sent {
+		t.Errorf("Sent requests to the peer that sent bad metadata")
+	}
+	if err := u.Message(liar, metadataData(t, 0, 20, make([]byte, 20))); err == nil {
+		t.Errorf("Accepted a message from the peer that sent bad metadata")
+	}
+	if err := u.Message(good, metadataData(t, 0, int64(len(info)), info[0:METADATA_PIECE_SIZE])); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Message(good, metadataData(t, 1, int64(len(info)), info[METADATA_PIECE_SIZE:])); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(u.Info(), info) {
+		t.Errorf("Got different metadata")
+	}
+}
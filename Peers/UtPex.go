@@ -0,0 +1,262 @@
+// Peer exchange (BEP 11), sends the list of connected peers to the peers
+// that support it and adds the peers received to the PeerMgr
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"os"
+	"net"
+	"sync"
+	"time"
+	"bytes"
+	"strconv"
+	"encoding/binary"
+	"container/list"
+	"wgo/bencode"
+	)
+
+const(
+	PEX_INTERVAL = 60 // seconds between messages to the same peer
+	PEX_MIN_INTERVAL = 45 // messages received more often are ignored
+	PEX_MAX_PEERS = 50 // added and dropped peers per message
+)
+
+// Flags of the added peers
+
+const(
+	PEX_ENCRYPTION = 0x01
+	PEX_SEED = 0x02
+	PEX_UTP = 0x04
+	PEX_HOLEPUNCH = 0x08
+	PEX_REACHABLE = 0x10
+)
+
+type UtPex struct {
+	mutex *sync.Mutex
+	peerMgr PeerMgr
+	// Peers that support ut_pex, by address
+	peers map[string]*pexPeer
+}
+
+type pexPeer struct {
+	peer ExtendedPeer
+	// Connected peers we told it about, with their flags
+	sent map[string]byte
+	lastReceived int64
+}
+
+func NewUtPex(peerMgr PeerMgr) (u *UtPex) {
+	u = new(UtPex)
+	u.mutex = new(sync.Mutex)
+	u.peerMgr = peerMgr
+	u.peers = make(map[string]*pexPeer)
+	go u.Run()
+	return
+}
+
+func (u *UtPex) Name() string {
+	return "ut_pex"
+}
+
+func (u *UtPex) Handshake(p ExtendedPeer, h *ExtHandshake) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, ok := u.peers[p.Addr()]; !ok {
+		u.peers[p.Addr()] = &pexPeer{peer: p, sent: make(map[string]byte)}
+	}
+}
+
+func (u *UtPex) Message(p ExtendedPeer, payLoad []byte) (err os.Error) {
+	u.mutex.Lock()
+	pp, ok := u.peers[p.Addr()]
+	now := time.Seconds()
+	if !ok || now-pp.lastReceived < PEX_MIN_INTERVAL {
+		// Peers sending too often are ignored
+		u.mutex.Unlock()
+		return
+	}
+	pp.lastReceived = now
+	u.mutex.Unlock()
+	v, err := bencode.Decode(bytes.NewBuffer(payLoad))
+	if err != nil {
+		return
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return os.NewError("Invalid ut_pex message")
+	}
+	peers := list.New()
+	added, _ := d["added"].(string)
+	added6, _ := d["added6"].(string)
+	addrs := append(decodePexPeers(added, net.IPv4len), decodePexPeers(added6, net.IPv6len)...)
+	for _, addr := range addrs {
+		// Don't let a peer fill our lists with hosts we won't connect to
+		if !u.peerMgr.Refused(addr) {
+			peers.PushBack(addr)
+		}
+	}
+	if peers.Len() > 0 {
+		u.peerMgr.AddPeers(peers)
+	}
+	return
+}
+
+func (u *UtPex) PeerExit(addr string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.peers[addr] = nil, false
+}
+
+// Send the changes in the set of connected peers every PEX_INTERVAL,
+// until the PeerMgr is closed
+
+func (u *UtPex) Run() {
+	ticker := time.NewTicker(PEX_INTERVAL*NS_PER_S)
+	defer ticker.Stop()
+	for {
+		select {
+			case <- u.peerMgr.Quit():
+				return
+			case <- ticker.C:
+		}
+		connected := u.connectedPeers()
+		u.mutex.Lock()
+		for addr, pp := range u.peers {
+			payLoad, err := pp.update(addr, connected)
+			if err != nil || payLoad == nil {
+				continue
+			}
+			go pp.peer.SendExtended(u.Name(), payLoad)
+		}
+		u.mutex.Unlock()
+	}
+}
+
+// Listening address and flags of the connected peers, leaving out the
+// ones banned or filtered that haven't been disconnected yet
+
+func (u *UtPex) connectedPeers() (connected map[string]byte) {
+	connected = make(map[string]byte)
+	for addr, peer := range u.peerMgr.GetPeers() {
+		if !peer.Connected() || u.peerMgr.Refused(addr) {
+			continue
+		}
+		flags := byte(0)
+		ext := peer.Extended()
+		if peer.is_incoming {
+			// The port of incoming connections is not the one the peer
+			// listens to, only the one sent in the handshake can be used
+			if ext == nil || ext.P <= 0 {
+				continue
+			}
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				continue
+			}
+			addr = net.JoinHostPort(host, strconv.Itoa64(ext.P))
+		} else {
+			flags |= PEX_REACHABLE
+		}
+		if peer.Completed() {
+			flags |= PEX_SEED
+		}
+		if peer.Utp() {
+			flags |= PEX_UTP
+		}
+		if ext != nil {
+			if e, ok := ext.Dict["e"].(int64); ok && e != 0 {
+				flags |= PEX_ENCRYPTION
+			}
+		}
+		connected[addr] = flags
+	}
+	return
+}
+
+// Build the message for the peer at addr with the peers added and dropped
+// since the last one, nil if there are no changes
+
+func (pp *pexPeer) update(addr string, connected map[string]byte) (payLoad []byte, err os.Error) {
+	var added, added6, dropped, dropped6 bytes.Buffer
+	var addedF, added6F bytes.Buffer
+	n := 0
+	for a, flags := range connected {
+		if _, ok := pp.sent[a]; ok || a == addr || n == PEX_MAX_PEERS {
+			continue
+		}
+		compact := encodePexPeer(a)
+		switch len(compact) {
+			case net.IPv4len+2:
+				added.Write(compact)
+				addedF.WriteByte(flags)
+			case net.IPv6len+2:
+				added6.Write(compact)
+				added6F.WriteByte(flags)
+			default:
+				continue
+		}
+		pp.sent[a] = flags
+		n++
+	}
+	n = 0
+	for a, _ := range pp.sent {
+		if _, ok := connected[a]; ok || n == PEX_MAX_PEERS {
+			continue
+		}
+		compact := encodePexPeer(a)
+		if len(compact) == net.IPv4len+2 {
+			dropped.Write(compact)
+		} else {
+			dropped6.Write(compact)
+		}
+		pp.sent[a] = 0, false
+		n++
+	}
+	if added.Len()+added6.Len()+dropped.Len()+dropped6.Len() == 0 {
+		return
+	}
+	m := map[string]interface{}{
+		"added": added.String(),
+		"added.f": addedF.String(),
+		"added6": added6.String(),
+		"added6.f": added6F.String(),
+		"dropped": dropped.String(),
+		"dropped6": dropped6.String()}
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, m); err != nil {
+		return
+	}
+	return b.Bytes(), nil
+}
+
+// Compact form of an address, 4 or 16 bytes of ip and 2 of port
+
+func encodePexPeer(addr string) []byte {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoui(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(p))
+	return compact
+}
+
+func decodePexPeers(compact string, ipLen int) (peers []string) {
+	for i := 0; i+ipLen+2 <= len(compact) && len(peers) < PEX_MAX_PEERS; i += ipLen+2 {
+		ip := net.IP([]byte(compact[i:i+ipLen]))
+		port := binary.BigEndian.Uint16([]byte(compact[i+ipLen:i+ipLen+2]))
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return
+}
@@ -0,0 +1,213 @@
+package peers
+
+import(
+	"sync"
+	"bytes"
+	"strconv"
+	"testing"
+	"container/list"
+	"wgo/bencode"
+	"wgo/bit_field"
+	)
+
+// PeerMgr with the connected peers given by the test, it keeps the peers
+// added and refuses the addresses in refused
+
+type fakePexMgr struct {
+	PeerMgr
+	peers map[string]*Peer
+	refused map[string]bool
+	added []string
+	quit chan bool
+}
+
+func newFakePexMgr() *fakePexMgr {
+	return &fakePexMgr{peers: make(map[string]*Peer), refused: make(map[string]bool), quit: make(chan bool)}
+}
+
+func (f *fakePexMgr) AddPeers(peers *list.List) {
+	for e := peers.Front(); e != nil; e = e.Next() {
+		f.added = append(f.added, e.Value.(string))
+	}
+}
+
+func (f *fakePexMgr) GetPeers() map[string]*Peer {
+	return f.peers
+}
+
+func (f *fakePexMgr) Refused(addr string) bool {
+	return f.refused[addr]
+}
+
+func (f *fakePexMgr) Quit() <-chan bool {
+	return f.quit
+}
+
+func decodePexMsg(t *testing.T, payLoad []byte) map[string]string {
+	v, err := bencode.Decode(bytes.NewBuffer(payLoad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for k, v := range v.(map[string]interface{}) {
+		m[k] = v.(string)
+	}
+	return m
+}
+
+func pexMsg(t *testing.T, addrs ...string) []byte {
+	var added, added6 bytes.Buffer
+	for _, addr := range addrs {
+		if compact := encodePexPeer(addr); len(compact) == 6 {
+			added.Write(compact)
+		} else {
+			added6.Write(compact)
+		}
+	}
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, map[string]interface{}{"added": added.String(), "added6": added6.String()}); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// At most PEX_MAX_PEERS added and dropped in each message, the rest wait
+// for the next one
+
+func TestPexLimits(t *testing.T) {
+	pp := &pexPeer{sent: make(map[string]byte)}
+	connected := make(map[string]byte)
+	for i := 0; i < PEX_MAX_PEERS+10; i++ {
+		connected["10.0.0." + strconv.Itoa(i+1) + ":6881"] = PEX_REACHABLE
+	}
+	tests := []struct {
+		connected map[string]byte
+		added, dropped int
+	}{
+		{connected, PEX_MAX_PEERS, 0},
+		{connected, 10, 0},
+		{connected, 0, 0},
+		{map[string]byte{}, 0, PEX_MAX_PEERS},
+		{map[string]byte{}, 0, 10},
+	}
+	for i, test := range tests {
+		payLoad, err := pp.update("10.0.0.200:6881", test.connected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.added == 0 && test.dropped == 0 {
+			if payLoad != nil {
+				t.Errorf("%d: message sent without changes", i)
+			}
+			continue
+		}
+		m := decodePexMsg(t, payLoad)
+		if len(m["added"]) != 6*test.added || len(m["added.f"]) != test.added || len(m["dropped"]) != 6*test.dropped {
+			t.Errorf("%d: got %d added, %d flags and %d dropped, expected %d, %d and %d", i, len(m["added"])/6, len(m["added.f"]), len(m["dropped"])/6, test.added, test.added, test.dropped)
+		}
+	}
+	// Received messages are cut too
+	var b bytes.Buffer
+	for i := 0; i < PEX_MAX_PEERS+10; i++ {
+		b.Write(encodePexPeer("10.0.1." + strconv.Itoa(i+1) + ":6881"))
+	}
+	if peers := decodePexPeers(b.String(), 4); len(peers) != PEX_MAX_PEERS {
+		t.Errorf("Decoded %d peers, expected %d", len(peers), PEX_MAX_PEERS)
+	}
+}
+
+// Flags of the connected peers and the port incoming peers listen to
+
+func TestPexFlags(t *testing.T) {
+	m := newFakePexMgr()
+	u := NewUtPex(m)
+	defer close(m.quit)
+	seed := bit_field.NewBitfield(1)
+	seed.Set(0)
+	tests := []struct {
+		addr string
+		peer *Peer
+		// Address advertised, empty if left out
+		pexAddr string
+		flags byte
+	}{
+		{"10.0.0.1:6881", &Peer{connected: true, bitfield: bit_field.NewBitfield(1)}, "10.0.0.1:6881", PEX_REACHABLE},
+		{"10.0.0.2:6881", &Peer{connected: true, bitfield: seed, utp: true, ext: &ExtHandshake{Dict: map[string]interface{}{"e": int64(1)}}}, "10.0.0.2:6881", PEX_REACHABLE | PEX_SEED | PEX_UTP | PEX_ENCRYPTION},
+		{"10.0.0.3:51000", &Peer{connected: true, bitfield: bit_field.NewBitfield(1), is_incoming: true, ext: &ExtHandshake{P: 7000}}, "10.0.0.3:7000", 0},
+		{"[2001:db8::4]:51000", &Peer{connected: true, bitfield: seed, is_incoming: true, ext: &ExtHandshake{P: 7000}}, "[2001:db8::4]:7000", PEX_SEED},
+		// The listening port isn't known
+		{"10.0.0.5:51000", &Peer{connected: true, bitfield: bit_field.NewBitfield(1), is_incoming: true}, "", 0},
+		{"10.0.0.6:6881", &Peer{bitfield: bit_field.NewBitfield(1)}, "", 0},
+		// Banned or filtered, not disconnected yet
+		{"10.0.0.7:6881", &Peer{connected: true, bitfield: bit_field.NewBitfield(1)}, "", 0},
+	}
+	m.refused["10.0.0.7:6881"] = true
+	for _, test := range tests {
+		test.peer.mutex = new(sync.Mutex)
+		m.peers[test.addr] = test.peer
+	}
+	connected := u.connectedPeers()
+	for _, test := range tests {
+		if test.pexAddr == "" {
+			continue
+		}
+		if flags, ok := connected[test.pexAddr]; !ok || flags != test.flags {
+			t.Errorf("%s: got %s with flags %x, expected %x", test.addr, test.pexAddr, flags, test.flags)
+		}
+		connected[test.pexAddr] = 0, false
+	}
+	if len(connected) != 0 {
+		t.Errorf("Advertising %v", connected)
+	}
+	// Each flag goes with its address
+	pp := &pexPeer{sent: make(map[string]byte)}
+	payLoad, err := pp.update("10.0.0.200:6881", u.connectedPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := decodePexMsg(t, payLoad)
+	for _, family := range []struct{ key string; ipLen int }{{"added", 4}, {"added6", 16}} {
+		peers := decodePexPeers(msg[family.key], family.ipLen)
+		flags := msg[family.key + ".f"]
+		if len(flags) != len(peers) {
+			t.Fatalf("%s: got %d flags for %d peers", family.key, len(flags), len(peers))
+		}
+		for i, addr := range peers {
+			for _, test := range tests {
+				if test.pexAddr == addr && flags[i] != test.flags {
+					t.Errorf("%s: sent flags %x, expected %x", addr, flags[i], test.flags)
+				}
+			}
+		}
+	}
+}
+
+// Messages from peers that didn't send the handshake, sent too often or
+// with addresses we refuse are ignored
+
+func TestPexReceived(t *testing.T) {
+	m := newFakePexMgr()
+	u := NewUtPex(m)
+	defer close(m.quit)
+	peer := newFakeExtPeer("10.0.0.1:6881", 0)
+	m.refused["10.0.0.3:6881"] = true
+	msg := pexMsg(t, "10.0.0.2:6881", "10.0.0.3:6881", "[2001:db8::4]:6881")
+	if err := u.Message(peer, msg); err != nil || len(m.added) != 0 {
+		t.Errorf("Added %v without the handshake", m.added)
+	}
+	u.Handshake(peer, peer.Extended())
+	if err := u.Message(peer, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.added) != 2 || m.added[0] != "10.0.0.2:6881" || m.added[1] != "[2001:db8::4]:6881" {
+		t.Errorf("Got %v, expected 10.0.0.2:6881 and [2001:db8::4]:6881", m.added)
+	}
+	m.added = nil
+	if err := u.Message(peer, msg); err != nil || len(m.added) != 0 {
+		t.Errorf("Added %v before PEX_MIN_INTERVAL", m.added)
+	}
+	u.peers[peer.Addr()].lastReceived -= PEX_MIN_INTERVAL
+	if err := u.Message(peer, msg); err != nil || len(m.added) != 2 {
+		t.Errorf("Got %v after PEX_MIN_INTERVAL, expected 2 peers", m.added)
+	}
+}
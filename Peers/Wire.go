@@ -28,9 +28,45 @@ const (
 	piece
 	cancel
 	port
-	exit
+)
+
+// Fast extension (BEP 6)
+
+const(
+	suggest = 0x0d
+	have_all = 0x0e
+	have_none = 0x0f
+	reject = 0x10
+	allowed_fast = 0x11
+)
+
+// Internal messages, never sent to the peers
+
+const(
+	exit = 0x80 + iota
 	our_request
 	flush
+	// Flush the queued pieces, sending a reject for each one
+	reject_flush
+	// Update the interest and the requests after a priority change
+	check_interest
+)
+
+// Extended messages (BEP 10)
+
+const(
+	extended = 20
+)
+
+// Reserved bits of the handshake, as byte index and mask
+
+const(
+	EXTENSION_BYTE = 5
+	EXTENSION_BIT = 0x10
+	FAST_BYTE = 7
+	FAST_BIT = 0x04
+	DHT_BYTE = 7
+	DHT_BIT = 0x01
 )
 
 const(
@@ -43,6 +79,7 @@ type Wire struct {
 	pstrlen uint8
 	pstr string
 	reserved []byte
+	peerReserved []byte
 	infohash []byte
 	peerid	[]byte
 	conn net.Conn
@@ -58,6 +95,8 @@ type message struct {
 	msgId	uint8
 	payLoad	[]byte
 	addr	[]string
+	// Data of a piece message, valid until the next ReadMsg
+	block	[]byte
 }
 
 func NewWire(infohash, peerid string, conn net.Conn, l limiter.Limiter, fl files.Files) (wire *Wire, err os.Error) {
@@ -126,11 +165,38 @@ func (wire *Wire) Handshake() (peerid string, err os.Error) {
 	if !bytes.Equal(header[28:48], wire.infohash) {
 		return peerid, os.NewError("InfoHash doesn't match")
 	}
+	wire.peerReserved = make([]byte, 8)
+	copy(wire.peerReserved, header[20:28])
 	peerid = string(header[48:68])
 	//log.Println("Received header", header)
 	return 
 }
 
+// Announce support of an extension in the reserved bytes, must be called
+// before the handshake
+
+func (wire *Wire) SetReserved(i int, bit byte) {
+	wire.reserved[i] |= bit
+}
+
+// Check if the peer set a reserved bit in its handshake
+
+func (wire *Wire) PeerReserved(i int, bit byte) bool {
+	return wire.peerReserved != nil && wire.peerReserved[i]&bit != 0
+}
+
+// Both sides support the extension protocol
+
+func (wire *Wire) Extended() bool {
+	return wire.reserved[EXTENSION_BYTE]&EXTENSION_BIT != 0 && wire.PeerReserved(EXTENSION_BYTE, EXTENSION_BIT)
+}
+
+// Both sides support the Fast extension
+
+func (wire *Wire) Fast() bool {
+	return wire.reserved[FAST_BYTE]&FAST_BIT != 0 && wire.PeerReserved(FAST_BYTE, FAST_BIT)
+}
+
 func (wire *Wire) ReadMsg(piece_buf []byte) (msg *message, err os.Error) {
 	var n int
 	
@@ -165,6 +231,9 @@ func (wire *Wire) ReadMsg(piece_buf []byte) (msg *message, err os.Error) {
 		return msg, os.NewError("Read message id " + err.String())
 	}
 	msg.msgId = msgId[0]
+	if msg.msgId == piece && wire.files == nil {
+		return msg, os.NewError("Unexpected piece message")
+	}
 	var message_body []byte
 	//var piece_buf []byte
 	if msg.msgId == piece {
@@ -178,6 +247,10 @@ func (wire *Wire) ReadMsg(piece_buf []byte) (msg *message, err os.Error) {
 		return msg, os.NewError("Read message body " + err.String())
 	}
 	if msg.msgId == piece {
+		if msg.length < 9 || int(msg.length-9) > len(piece_buf) {
+			return msg, os.NewError("Invalid piece length")
+		}
+		piece_buf = piece_buf[0:msg.length-9]
 		var send int64
 		start := 0
 		size := int64(len(piece_buf))
@@ -191,8 +264,8 @@ func (wire *Wire) ReadMsg(piece_buf []byte) (msg *message, err os.Error) {
 			}
 			start += n
 		}
-		// Send piece to Files to store it
-		wire.files.WriteAt(int64(binary.BigEndian.Uint32(message_body[0:4])), int64(binary.BigEndian.Uint32(message_body[4:8])), piece_buf)
+		// PieceMgr stores it in Files if it was requested
+		msg.block = piece_buf
 	}
 	//n += 4
 	// Assign to the message struct
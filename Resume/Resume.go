@@ -0,0 +1,91 @@
+// Fast resume data of a torrent: what was downloaded and the state of
+// the files when it was saved, so the files don't have to be checked
+// again on startup
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package resume
+
+import(
+	"os"
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"wgo/bencode"
+	)
+
+const(
+	FILE_PERM = 0644
+	FOLDER_PERM = 0755
+)
+
+// Size and modification time (ns) of a file of the torrent
+
+type File struct {
+	Size int64
+	Mtime int64
+}
+
+// Blocks downloaded of a piece that isn't finished
+
+type Partial struct {
+	Piece int64
+	Blocks []int64
+}
+
+type Data struct {
+	Infohash string "info_hash"
+	NumPieces int64 "num_pieces"
+	// Bitfield of the pieces downloaded
+	Pieces string
+	Files []File
+	Partial []Partial
+	Uploaded int64
+	Downloaded int64
+}
+
+// Read the resume data from path
+
+func Load(path string) (d *Data, err os.Error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	d = new(Data)
+	if err = bencode.Unmarshal(bytes.NewBuffer(data), d); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Write the resume data to path, through a temporary file synced before
+// the rename so a crash never leaves it half written
+
+func (d *Data) Save(path string) (err os.Error) {
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, *d); err != nil {
+		return
+	}
+	if n := strings.LastIndex(path, "/"); n > 0 {
+		if err = os.MkdirAll(path[0:n], FOLDER_PERM); err != nil {
+			return
+		}
+	}
+	tmp := path + ".tmp"
+	fd, err := os.Open(tmp, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, FILE_PERM)
+	if err != nil {
+		return
+	}
+	// The data must be on disk before the rename is
+	if _, err = fd.Write(b.Bytes()); err == nil {
+		err = fd.Sync()
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return os.Rename(tmp, path)
+}
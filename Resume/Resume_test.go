@@ -0,0 +1,45 @@
+package resume
+
+import(
+	"os"
+	"testing"
+	)
+
+func TestSaveLoad(t *testing.T) {
+	d := &Data{
+		Infohash: "abcdefghij0123456789",
+		NumPieces: 12,
+		Pieces: "\xff\x10",
+		Files: []File{File{100, 1300000000000000000}, File{0, 5}},
+		Partial: []Partial{Partial{4, []int64{0, 2, 3}}},
+		Uploaded: 1234,
+		Downloaded: 5678,
+	}
+	path := os.TempDir() + "/wgo_resume_test/torrent.resume"
+	defer os.RemoveAll(os.TempDir() + "/wgo_resume_test")
+	if err := d.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Infohash != d.Infohash || l.NumPieces != d.NumPieces || l.Pieces != d.Pieces || l.Uploaded != d.Uploaded || l.Downloaded != d.Downloaded {
+		t.Errorf("Got %v, expected %v", l, d)
+	}
+	if len(l.Files) != len(d.Files) || l.Files[0].Size != 100 || l.Files[0].Mtime != d.Files[0].Mtime || l.Files[1].Mtime != 5 {
+		t.Errorf("Got files %v, expected %v", l.Files, d.Files)
+	}
+	if len(l.Partial) != 1 || l.Partial[0].Piece != 4 || len(l.Partial[0].Blocks) != 3 || l.Partial[0].Blocks[2] != 3 {
+		t.Errorf("Got partial pieces %v, expected %v", l.Partial, d.Partial)
+	}
+	if _, err = os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("Temporary file left behind")
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	if _, err := Load(os.TempDir() + "/wgo_resume_missing"); err == nil {
+		t.Errorf("Loaded a missing file")
+	}
+}
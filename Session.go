@@ -0,0 +1,289 @@
+// Session of several torrents sharing the listener, the bandwidth
+// limiter, the choker, the uTP socket and the DHT
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package main
+
+import(
+	"log"
+	"os"
+	"rand"
+	"sync"
+	"strconv"
+	"strings"
+	"container/list"
+	"wgo/bencode"
+	"wgo/limiter"
+	"wgo/peers"
+	"wgo/choke"
+	"wgo/listener"
+	"wgo/tracker"
+	"wgo/dht"
+	"wgo/utp"
+	"wgo/ipfilter"
+	"wgo/files"
+	)
+
+type Config struct {
+	Ip, Port string
+	Folder string
+	UpLimit, DownLimit int // KB/s, 0 means no limit
+	Utp bool
+	DhtPort int // 0 shares the uTP socket, -1 disables the DHT
+	DhtNodes string
+	DhtBootstrap []string
+	Encryption int
+	MaxConnections int // for all the torrents, 0 means no limit
+	UploadSlots int // for all the torrents, 0 uses UPLOADING_PEERS
+	ResumeDir string // fast resume data, empty disables it
+	BanFile string // hosts banned for sending corrupt data, empty doesn't save them
+	IpFilter []string // blocklists of addresses, see ipfilter for the formats
+	Storage files.StorageFactory // where the data is kept, nil uses files.NewFileStorage
+	CacheSize int // KB of disk cache of each torrent, 0 uses files.DEFAULT_CACHE_SIZE
+}
+
+type Session struct {
+	mutex *sync.Mutex
+	config *Config
+	peerId string
+	port int
+	limiter limiter.Limiter
+	listener *listener.Listener
+	socket *utp.Socket
+	dht *dht.DHT
+	chokeMgr *choke.ChokeMgr
+	connections *peers.Connections
+	banList *peers.BanList
+	filter *ipfilter.Filter
+	// Torrents by infohash
+	torrents map[string]*Torrent
+	// Called on every state transition of a torrent
+	stateHandler func(t *Torrent, state int)
+	// Closed by Close, cancels the metadata fetches
+	quit chan bool
+}
+
+func NewSession(c *Config) (s *Session, err os.Error) {
+	s = new(Session)
+	s.mutex = new(sync.Mutex)
+	s.config = c
+	s.torrents = make(map[string]*Torrent)
+	s.quit = make(chan bool)
+	s.peerId = (CLIENT_ID + "-" + strconv.Itoa(os.Getpid()) + strconv.Itoa64(rand.Int63()))[0:20]
+	log.Println("Peer ID:", s.peerId)
+	if s.limiter, err = limiter.NewLimiter(c.UpLimit, c.DownLimit); err != nil {
+		return nil, err
+	}
+	s.connections = peers.NewConnections(c.MaxConnections)
+	s.banList = peers.NewBanList(c.BanFile)
+	s.filter = ipfilter.NewFilter()
+	if len(c.IpFilter) > 0 {
+		if err = s.filter.Load(c.IpFilter); err != nil {
+			return nil, err
+		}
+	}
+	if s.chokeMgr, err = choke.NewChokeMgr(c.UploadSlots); err != nil {
+		return nil, err
+	}
+	// Incoming connections are refused until a torrent is added
+	l, cport, err := listener.NewListener(c.Ip, c.Port)
+	if err != nil {
+		return nil, err
+	}
+	l.SetEncryption(c.Encryption)
+	l.SetFilter(s.filter)
+	s.listener = l
+	c.Port = cport
+	s.port, _ = strconv.Atoi(cport)
+	// uTP socket, shared with the DHT and the UDP trackers
+	if c.Utp {
+		if s.socket, err = utp.NewSocket(c.Ip + ":" + c.Port); err != nil {
+			return nil, err
+		}
+		l.AddListener(s.socket)
+		s.socket.AddHandler(tracker.ShareUdpSocket(s.socket))
+	}
+	if c.DhtPort == 0 && s.socket != nil {
+		s.dht = dht.NewSharedDHT(s.socket, c.DhtNodes, c.DhtBootstrap)
+		s.socket.AddHandler(s.dht)
+	} else if c.DhtPort >= 0 {
+		if s.dht, err = dht.NewDHT(c.DhtPort, c.DhtNodes, c.DhtBootstrap); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Add a torrent from a file, an url or a magnet link and start it. The
+// metadata of magnet links is fetched from the peers before returning,
+// giving up after METADATA_TIMEOUT or when the session is closed.
+// If the torrent can't be started it's added in STATE_ERROR and the
+// error is returned too.
+
+func (s *Session) AddTorrent(torrent string) (t *Torrent, err os.Error) {
+	var metaInfo *bencode.MetaInfo
+	var fetcher *peers.MetadataFetcher
+	var trackerMgr *tracker.TrackerMgr
+	if strings.HasPrefix(torrent, "magnet:") {
+		magnet, err := ParseMagnet(torrent)
+		if err != nil {
+			return nil, err
+		}
+		if s.Torrent(magnet.Infohash) != nil {
+			return nil, os.NewError("Torrent already added")
+		}
+		log.Println("Fetching metadata of:", magnet.Name)
+		fetcher = peers.NewMetadataFetcher(magnet.Infohash, s.peerId, s.limiter)
+		fetcher.Extensions().SetField("p", int64(s.port))
+		fetcher.SetEncryption(s.config.Encryption)
+		fetcher.SetFilter(s.filter)
+		if s.socket != nil {
+			fetcher.SetUtp(s.socket)
+		}
+		trackerMgr = tracker.NewTrackerMgr(magnet.Trackers, magnet.Infohash, s.config.Port, fetcher, nil, 0, s.peerId, nil)
+		if s.dht != nil {
+			s.dht.AddTorrent(magnet.Infohash, s.port, fetcher)
+		}
+		pe := list.New()
+		for _, addr := range magnet.Peers {
+			pe.PushBack(addr)
+		}
+		fetcher.AddPeers(pe)
+		fetched := make(chan bool)
+		go func() {
+			select {
+				case <- s.quit:
+					fetcher.Close()
+				case <- fetched:
+			}
+		}()
+		info, err := fetcher.Metadata(METADATA_TIMEOUT)
+		close(fetched)
+		fetcher.Close()
+		if err == nil {
+			metaInfo, err = NewTorrentFromMagnet(magnet, info)
+		}
+		// The metadata is fetched from the DHT peers, but a private
+		// torrent must not be announced once we know it is (BEP 27)
+		if s.dht != nil && (err != nil || metaInfo.Info.Private != 0) {
+			s.dht.RemoveTorrent(magnet.Infohash)
+		}
+		if err != nil {
+			trackerMgr.Stop()
+			return nil, err
+		}
+	} else if metaInfo, err = NewTorrent(torrent); err != nil {
+		return
+	}
+	t = newTorrent(s, metaInfo)
+	t.trackerMgr = trackerMgr
+	s.mutex.Lock()
+	if _, ok := s.torrents[metaInfo.Infohash]; ok {
+		s.mutex.Unlock()
+		if trackerMgr != nil {
+			trackerMgr.Stop()
+		}
+		return nil, os.NewError("Torrent already added")
+	}
+	s.torrents[metaInfo.Infohash] = t
+	s.mutex.Unlock()
+	if err = t.Resume(); err != nil {
+		return
+	}
+	if fetcher != nil {
+		t.PeerMgr().AddPeers(fetcher.Peers())
+	}
+	return
+}
+
+func (s *Session) Torrent(infohash string) *Torrent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.torrents[infohash]
+}
+
+func (s *Session) Torrents() (torrents []*Torrent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	torrents = make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	return
+}
+
+func (s *Session) remove(t *Torrent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.torrents[t.Infohash()] == t {
+		s.torrents[t.Infohash()] = nil, false
+	}
+}
+
+// Called with the torrent and its new state on every state transition,
+// from the goroutine that caused it
+
+func (s *Session) SetStateHandler(f func(t *Torrent, state int)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stateHandler = f
+}
+
+func (s *Session) stateChanged(t *Torrent, state int) {
+	s.mutex.Lock()
+	f := s.stateHandler
+	s.mutex.Unlock()
+	if f != nil {
+		f(t, state)
+	}
+}
+
+// Load the blocklists of the IP filter again, the peers that aren't
+// allowed anymore are disconnected. If a list can't be read the current
+// rules are kept.
+
+func (s *Session) ReloadIpFilter() (err os.Error) {
+	if err = s.filter.Reload(); err != nil {
+		return
+	}
+	for _, t := range s.Torrents() {
+		if peerMgr := t.PeerMgr(); peerMgr != nil {
+			peerMgr.DisconnectFiltered()
+		}
+	}
+	return
+}
+
+// Peer connections of all the torrents
+
+func (s *Session) Connections() int {
+	return s.connections.Count()
+}
+
+func (s *Session) DHT() *dht.DHT {
+	return s.dht
+}
+
+// Stop all the torrents, announcing it to the trackers, save the DHT
+// nodes and release the shared resources
+
+func (s *Session) Close() {
+	s.mutex.Lock()
+	select {
+		case <- s.quit:
+		default:
+			close(s.quit)
+	}
+	s.mutex.Unlock()
+	for _, t := range s.Torrents() {
+		t.Stop()
+	}
+	if s.dht != nil {
+		s.dht.Close()
+	}
+	// Closes the uTP socket too
+	s.listener.Close()
+	s.chokeMgr.Close()
+	s.limiter.Close()
+}
@@ -24,6 +24,12 @@ type Status struct {
 	Addr string
 }
 
+// Swarm health as reported by a tracker
+
+type Swarm struct {
+	Seeders, Leechers, Downloaded int64
+}
+
 type PeerStat struct {
 	size_up int64 // bytes
 	size_down int64
@@ -40,6 +46,8 @@ type stats struct {
 	n int
 	bitfield *bit_field.Bitfield
 	pieceLength int64
+	swarms map[string]*Swarm
+	quit chan bool
 }
 
 type Stats interface {
@@ -47,6 +55,11 @@ type Stats interface {
 	GetStats() (map[string]*Status)
 	GetSpeed(addr string) (speed int64)
 	GetGlobalStats() (uploaded, downloaded int64)
+	SetGlobalStats(uploaded, downloaded int64)
+	UpdateSwarm(tracker string, swarm *Swarm)
+	GetSwarm() (swarm *Swarm)
+	GetSwarms() (map[string]*Swarm)
+	Close()
 }
 
 func (s *stats) Update(addr string, uploaded, downloaded int64) {
@@ -110,14 +123,63 @@ func (s *stats) GetGlobalStats() (int64, int64) {
 	return s.uploaded, s.downloaded
 }
 
+// Restore the totals of a previous run, from the fast resume data
+
+func (s *stats) SetGlobalStats(uploaded, downloaded int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.uploaded, s.downloaded = uploaded, downloaded
+}
+
+func (s *stats) UpdateSwarm(tracker string, swarm *Swarm) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sw := *swarm
+	s.swarms[tracker] = &sw
+}
+
+// Best known swarm information, trackers usually see only part of the
+// swarm so we keep the highest numbers reported
+
+func (s *stats) GetSwarm() (swarm *Swarm) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	swarm = new(Swarm)
+	for _, sw := range(s.swarms) {
+		if sw.Seeders > swarm.Seeders {
+			swarm.Seeders = sw.Seeders
+		}
+		if sw.Leechers > swarm.Leechers {
+			swarm.Leechers = sw.Leechers
+		}
+		if sw.Downloaded > swarm.Downloaded {
+			swarm.Downloaded = sw.Downloaded
+		}
+	}
+	return
+}
+
+func (s *stats) GetSwarms() (map[string]*Swarm) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	swarms := make(map[string]*Swarm)
+	for tracker, sw := range(s.swarms) {
+		swarm := *sw
+		swarms[tracker] = &swarm
+	}
+	return swarms
+}
+
 func NewStats(left, size int64, bitfield *bit_field.Bitfield, pieceLength int64) (st Stats) {
 	s := new(stats)
 	s.mutex = new(sync.Mutex)
 	s.size = size
 	s.peers = make(map[string] *PeerStat)
+	s.swarms = make(map[string] *Swarm)
 	s.pod_up, s.pod_down = make([]int64, PONDERATION_TIME), make([]int64, PONDERATION_TIME)
 	s.bitfield = bitfield
 	s.pieceLength = pieceLength
+	s.quit = make(chan bool)
 	go s.run()
 	st = s
 	return
@@ -181,12 +243,21 @@ func (s *stats) round() {
 	log.Println("Stats -> Downloading speed:", total_up/1000, "KB/s Uploading Speed:", total_down/1000, "KB/s Left:", (s.bitfield.Len() - s.bitfield.Count())*s.pieceLength/1000000, "MB Downloaded:", s.downloaded/1000000, "MB Uploaded:", s.uploaded/1000000, "MB Ratio:", fmt.Sprintf("%4.2f", ratio))
 }
 
+// Stop computing the speeds
+
+func (s *stats) Close() {
+	close(s.quit)
+}
+
 func (s *stats) run() {
-	round := time.Tick(NS_PER_S)
+	round := time.NewTicker(NS_PER_S)
+	defer round.Stop()
 	for {
 		//log.Println("Stats -> Waiting for messages")
 		select {
-			case <- round:
+			case <- s.quit:
+				return
+			case <- round.C:
 				//log.Println("Stats -> Started processing stats")
 				s.mutex.Lock()
 				s.round()
@@ -22,17 +22,23 @@ func getString(m map[string]interface{}, k string) string {
 	return ""
 }
 
-func getArrayString(m map[string]interface{}, k string) (list []string) {
-	list = make([]string, 0)
+// Obtain the list of tiers of the announce-list (BEP 12)
+
+func getAnnounceList(m map[string]interface{}, k string) (tiers [][]string) {
+	tiers = make([][]string, 0)
 	if v, ok := m[k]; ok {
 		if f, ok := v.(vector.Vector); ok {
 			for _, s := range f {
 				if l, ok := s.(vector.Vector); ok {
+					tier := make([]string, 0, len(l))
 					for _, q := range l {
 						if e, ok := q.(string); ok {
-							list = append(list, e)
+							tier = append(tier, e)
 						}
 					}
+					if len(tier) > 0 {
+						tiers = append(tiers, tier)
+					}
 				}
 			}
 		}
@@ -85,6 +91,8 @@ func NewTorrent(torrent string) (metaInfo *bencode.MetaInfo, err os.Error) {
 	hash.Write(b.Bytes())
 
 	var m2 bencode.MetaInfo
+	m2.InfoBytes = make([]byte, b.Len())
+	copy(m2.InfoBytes, b.Bytes())
 	err = bencode.Unmarshal(&b, &m2.Info)
 	if err != nil {
 		return
@@ -96,8 +104,67 @@ func NewTorrent(torrent string) (metaInfo *bencode.MetaInfo, err os.Error) {
 	m2.Comment = getString(topMap, "comment")
 	m2.CreatedBy = getString(topMap, "created by")
 	m2.Encoding = getString(topMap, "encoding")
-	m2.Announce_list = append(getArrayString(topMap, "announce-list"), m2.Announce)
+	// If announce-list is present announce must be ignored
+	m2.Announce_list = getAnnounceList(topMap, "announce-list")
+	if len(m2.Announce_list) == 0 && len(m2.Announce) > 0 {
+		m2.Announce_list = [][]string{[]string{m2.Announce}}
+	}
 
 	metaInfo = &m2
 	return
 }
+
+// Build the metainfo of a magnet link once the info dictionary has been
+// fetched from the peers
+
+func NewTorrentFromMagnet(m *Magnet, info []byte) (metaInfo *bencode.MetaInfo, err os.Error) {
+	metaInfo = new(bencode.MetaInfo)
+	if err = bencode.Unmarshal(bytes.NewBuffer(info), &metaInfo.Info); err != nil {
+		return nil, os.NewError("Couldn't parse metadata: " + err.String())
+	}
+	metaInfo.Infohash = m.Infohash
+	metaInfo.InfoBytes = info
+	metaInfo.Announce_list = m.Trackers
+	if len(m.Trackers) > 0 {
+		metaInfo.Announce = m.Trackers[0][0]
+	}
+	return
+}
+
+// Write a .torrent file. The info dictionary is written as it was
+// received, so the infohash doesn't change.
+
+func SaveTorrent(metaInfo *bencode.MetaInfo, path string) (err os.Error) {
+	top := make(map[string]interface{})
+	if len(metaInfo.Announce) > 0 {
+		top["announce"] = metaInfo.Announce
+	}
+	if len(metaInfo.Announce_list) > 0 {
+		top["announce-list"] = metaInfo.Announce_list
+	}
+	if len(metaInfo.Comment) > 0 {
+		top["comment"] = metaInfo.Comment
+	}
+	if len(metaInfo.CreatedBy) > 0 {
+		top["created by"] = metaInfo.CreatedBy
+	}
+	if len(metaInfo.Encoding) > 0 {
+		top["encoding"] = metaInfo.Encoding
+	}
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, top); err != nil {
+		return
+	}
+	// Keys are sorted and "info" goes after the ones above
+	data := b.Bytes()
+	data = append(data[0:len(data)-1], []byte("4:info")...)
+	data = append(data, metaInfo.InfoBytes...)
+	data = append(data, 'e')
+	f, err := os.Open(path, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return
+}
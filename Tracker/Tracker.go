@@ -6,15 +6,18 @@ package tracker
 
 import(
 	"http"
+	"net"
+	"bytes"
 	"strconv"
 	"log"
 	"os"
 	"fmt"
 	"io/ioutil"
 	"container/list"
+	"strings"
 	"time"
 	"wgo/bencode"
-	"wgo/bit_field"
+	"wgo/stats"
 	"encoding/binary"
 	)
 	
@@ -24,6 +27,14 @@ const(
 	NS_PER_S = 1000000000
 	ACTIVE_PEERS = 45
 	UNUSED_PEERS = 200
+	MAX_NUMWANT = 200
+	SCRAPE_INTERVAL = 1800
+	MAX_TRACKER_BACKOFF = 3600
+	MIN_ANNOUNCE_INTERVAL = 30 // used when the tracker doesn't send min interval
+	TRACKER_STOP_TIMEOUT = 5*NS_PER_S
+	TRACKER_TIMEOUT = 60*NS_PER_S // time a tracker has to answer before trying the next one
+	ANNOUNCE_TIMEOUT = 5*60*NS_PER_S // time spent on the trackers of an announce
+	UNKNOWN_LEFT = 16*1024 // sent while the metadata is being fetched
 )
 
 // 1 channel to send new peers to peerMgr
@@ -34,19 +45,23 @@ const(
 type Tracker struct {
 	// Chanels
 	trackerMgr *TrackerMgr
-	announce *time.Ticker
 	//inStatus		<- chan statusMsg
 	// Internal data for tracker requests
 	infohash, peerId, url, port, trackerId string
 	interval, min_interval int64
 	// Updated from the Status module
 	uploaded, downloaded int64
-	completed bool
-	status string
-	// Bitfield
-	bitfield *bit_field.Bitfield
-	pieceLength int64
-	retry_time int64
+	// The tracker has accepted our "started" event
+	started bool
+	// Swarm information from announces and scrapes
+	swarm stats.Swarm
+	// Last warning message sent by the tracker
+	warning string
+	// Backoff after errors
+	failures uint
+	next_try int64
+	// UDP tracker, nil for HTTP trackers
+	udp *udpTracker
 }
 
 // Struct to send data to the PeerMgr goroutine
@@ -62,63 +77,90 @@ type trackerStatusMsg struct {
 	Complete, Incomplete, Interval int
 }
 
-func NewTracker(url, infohash, port string, tm *TrackerMgr, left int64, bf *bit_field.Bitfield, pieceLength int64, peerId string) (t *Tracker) {
+// Error sent by the tracker, either as a "failure reason" or as an UDP
+// error response
+
+type TrackerError struct {
+	Url, Reason string
+}
+
+func (e *TrackerError) String() string {
+	return "Tracker " + e.Url + " failed: " + e.Reason
+}
+
+func NewTracker(url, infohash, port string, tm *TrackerMgr, peerId string) (t *Tracker, err os.Error) {
 	t = &Tracker{url: url, 
 		infohash: infohash, 
-		status: "started", 
 		port: port, 
 		peerId: peerId, 
-		trackerMgr: tm,
-		announce: time.NewTicker(1*NS_PER_S),
-		bitfield: bf,
-		pieceLength: pieceLength,
-		retry_time: TRACKER_ERR_INTERVAL}
-	if t.bitfield.Completed() {
-		t.completed = true
+		trackerMgr: tm}
+	if strings.HasPrefix(url, "udp://") {
+		t.udp, err = newUdpTracker(url)
 	}
 	return
 }
 
-func (t *Tracker) Run() {
-	for {
-		select {
-			case <- t.announce.C:
-				num_peers := t.trackerMgr.RequestPeers()
-				//log.Println("Tracker -> Requesting", num_peers, "peers")
-				if num_peers > 0 {
-					t.uploaded, t.downloaded = t.trackerMgr.Stats()
-					log.Println("Tracker -> Requesting Tracker info:", t.url)
-					err := t.Request(num_peers)
-					if err != nil {
-						log.Println("Tracker -> Error requesting Tracker info", err, t.url)
-						t.announce.Stop()
-						t.announce = time.NewTicker(t.retry_time*NS_PER_S)
-						t.retry_time *= 2
-					} else {
-						log.Println("Tracker -> Requesting Tracker info finished OK, next announce:", t.interval, t.url)
-						t.retry_time = TRACKER_ERR_INTERVAL
-						t.announce.Stop()
-						if t.min_interval > 0 {
-							t.announce = time.NewTicker(t.min_interval*NS_PER_S)
-						} else if t.interval > 0 {
-							t.announce = time.NewTicker(t.interval*NS_PER_S)
-						} else {
-							t.announce = time.NewTicker(DEFAULT_TRACKER_INTERVAL*NS_PER_S)
-						}
-					}
-				}
+// Announce to the tracker, event can be "started", "completed", "stopped"
+// or empty for regular announces. UDP trackers give up retransmitting at
+// deadline (in ns).
+
+func (t *Tracker) Request(num_peers int, event string, deadline int64) (err os.Error) {
+	// Prepare request to make to the tracker
+	left := t.trackerMgr.Left()
+	if t.udp != nil {
+		err = t.udpRequest(num_peers, left, event, deadline)
+	} else {
+		err = t.httpRequest(num_peers, left, event)
+	}
+	if err != nil {
+		// Back off exponentially
+		backoff := int64(MAX_TRACKER_BACKOFF)
+		if t.failures < 6 {
+			backoff = TRACKER_ERR_INTERVAL << t.failures
 		}
+		if backoff > MAX_TRACKER_BACKOFF {
+			backoff = MAX_TRACKER_BACKOFF
+		}
+		t.failures++
+		t.next_try = time.Seconds() + backoff
+		return
+	}
+	t.failures = 0
+	t.next_try = 0
+	switch event {
+		case "started":
+			t.started = true
+		case "stopped":
+			t.started = false
 	}
+	return
 }
 
-func (t *Tracker) Request(num_peers int) (err os.Error) {
-	// Prepare request to make to the tracker
-	left := (t.bitfield.Len() - t.bitfield.Count())*t.pieceLength
-	if len(t.status) == 0 && !t.completed {
-		if left == 0 {
-			t.status = "completed"
-		}
+// The tracker isn't backing off after an error
+
+func (t *Tracker) Available() bool {
+	return time.Seconds() >= t.next_try
+}
+
+// Interval until the next regular announce
+
+func (t *Tracker) Interval() int64 {
+	if t.interval > 0 {
+		return t.interval
+	}
+	return DEFAULT_TRACKER_INTERVAL
+}
+
+// Minimum interval between forced announces
+
+func (t *Tracker) MinInterval() int64 {
+	if t.min_interval > 0 {
+		return t.min_interval
 	}
+	return MIN_ANNOUNCE_INTERVAL
+}
+
+func (t *Tracker) httpRequest(num_peers int, left int64, event string) (err os.Error) {
 	url:= fmt.Sprint(t.url,
 		"?",
 		"info_hash=",http.URLEscape(t.infohash),
@@ -128,12 +170,22 @@ func (t *Tracker) Request(num_peers int) (err os.Error) {
 		"&downloaded=",http.URLEscape(strconv.Itoa64(t.downloaded)),
 		"&left=",http.URLEscape(strconv.Itoa64(left)),
 		"&numwant=",http.URLEscape(strconv.Itoa(num_peers)),
-		"&status=",http.URLEscape(t.status),
+		"&key=",http.URLEscape(fmt.Sprintf("%08x", t.trackerMgr.key)),
 		"&compact=1")
 	
+	if len(event) > 0 {
+		url += "&event=" + http.URLEscape(event)
+	}
 	if len(t.trackerId) > 0 {
 		url += "&tracker_id=" + http.URLEscape(t.trackerId)
 	}
+	// Let dual-stack hosts receive peers from both families (BEP 7)
+	if len(t.trackerMgr.ipv4) > 0 {
+		url += "&ipv4=" + http.URLEscape(t.trackerMgr.ipv4)
+	}
+	if len(t.trackerMgr.ipv6) > 0 {
+		url += "&ipv6=" + http.URLEscape(t.trackerMgr.ipv6)
+	}
 	/*
 	r, _, err := http.Get(url)
 	if err != nil {
@@ -169,36 +221,199 @@ func (t *Tracker) Request(num_peers int) (err os.Error) {
 	}
 	
 	// Create new TrackerResponse and decode the data
-	var tr bencode.TrackerResponse
-	err = bencode.Unmarshal(response.Body, &tr)
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
+	tr, peers, err := decodeTrackerResponse(data)
 	if err != nil {
 		return
 	}
+	// A failure reason means that no other keys are present
+	if len(tr.FailureReason) > 0 {
+		return &TrackerError{t.url, tr.FailureReason}
+	}
+	t.setWarning(tr.WarningMessage)
 	t.interval = tr.Interval
 	t.min_interval = tr.Min_interval
+	t.updateSwarm(int64(tr.Complete), int64(tr.Incomplete), -1)
 	if len(tr.Tracker_id) > 0 {
 		t.trackerId = tr.Tracker_id
 	} 
-	// Obtain new peers list
-	peers := list.New()
-	
-	//log.Println("Tracker -> Decoded", len(tr.Peers), "peers")
-	for i := 0; i < len(tr.Peers); i = i+6 {
-		peers.PushFront(fmt.Sprintf("%d.%d.%d.%d:%d", tr.Peers[i+0], tr.Peers[i+1], tr.Peers[i+2], tr.Peers[i+3], binary.BigEndian.Uint16([]byte(tr.Peers[i+4:i+6]))))
-		//ip := fmt.Sprintf("%d.%d.%d.%d", peers[i+0], peers[i+1], peers[i+2], peers[i+3])
-		//port := int64(binary.BigEndian.Uint16(peers[i+4:i+6]))
-		//tracker.Peers = appendPeer(tracker.Peers, Peer{Ip: ip, Port: port})
-	}
-	/*for _, peer := range tr.Peers {
-		peers.PushFront(fmt.Sprintf("%s:%d", peer.Ip, peer.Port))
-	}*/
 	//log.Println("Tracker -> Received", msgPeers.Len(), "peers")
 	// Send the new data to the PeerMgr process
 	t.trackerMgr.SavePeers(peers)
-	if t.status == "completed" {
-		t.completed = true
+	return
+}
+
+func (t *Tracker) udpRequest(num_peers int, left int64, event string, deadline int64) (err os.Error) {
+	port, err := strconv.Atoui(t.port)
+	if err != nil {
+		return
+	}
+	a := &udpAnnounce{infohash: t.infohash,
+		peerId: t.peerId,
+		downloaded: t.downloaded,
+		left: left,
+		uploaded: t.uploaded,
+		key: t.trackerMgr.key,
+		numWant: int32(num_peers),
+		port: uint16(port)}
+	switch event {
+		case "started":
+			a.event = UDP_EVENT_STARTED
+		case "completed":
+			a.event = UDP_EVENT_COMPLETED
+		case "stopped":
+			a.event = UDP_EVENT_STOPPED
+	}
+	r, err := t.udp.announce(a, deadline)
+	if err != nil {
+		return
+	}
+	t.interval = r.interval
+	t.min_interval = 0
+	t.updateSwarm(r.seeders, r.leechers, -1)
+	// IPv6 trackers send 18 byte peer entries
+	if t.udp.ipv6 {
+		t.trackerMgr.SavePeers(decodeCompactPeers6(r.peers))
+	} else {
+		t.trackerMgr.SavePeers(decodeCompactPeers(r.peers))
 	}
-	t.status = ""
 	return
 }
 
+// Obtain the number of seeders, leechers and completed downloads
+// from the tracker
+
+func (t *Tracker) Scrape(deadline int64) (err os.Error) {
+	if t.udp != nil {
+		r, err := t.udp.scrape([]string{t.infohash}, deadline)
+		if err != nil {
+			return err
+		}
+		t.updateSwarm(r[0].seeders, r[0].leechers, r[0].completed)
+		return nil
+	}
+	url, err := scrapeUrl(t.url)
+	if err != nil {
+		return
+	}
+	if strings.Index(url, "?") != -1 {
+		url += "&"
+	} else {
+		url += "?"
+	}
+	url += "info_hash=" + http.URLEscape(t.infohash)
+	response, _, err := http.Get(url)
+	if err != nil { return }
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(response.Body)
+		return os.NewError("Bad Request " + string(data))
+	}
+	var sr bencode.ScrapeResponse
+	if err = bencode.Unmarshal(response.Body, &sr); err != nil {
+		return
+	}
+	if len(sr.FailureReason) > 0 {
+		return &TrackerError{t.url, sr.FailureReason}
+	}
+	f, ok := sr.Files[t.infohash]
+	if !ok {
+		return os.NewError("Torrent not present in scrape response")
+	}
+	t.updateSwarm(f.Complete, f.Incomplete, f.Downloaded)
+	return
+}
+
+func (t *Tracker) setWarning(warning string) {
+	if len(warning) > 0 {
+		log.Println("Tracker -> Warning from", t.url, ":", warning)
+	}
+	t.trackerMgr.mutex.Lock()
+	t.warning = warning
+	t.trackerMgr.mutex.Unlock()
+}
+
+// Derive the scrape url from the announce url, as described in
+// http://wiki.theory.org/BitTorrentSpecification#Tracker_.27scrape.27_Convention
+
+func scrapeUrl(announce string) (url string, err os.Error) {
+	n := strings.LastIndex(announce, "/")
+	if n == -1 || !strings.HasPrefix(announce[n+1:], "announce") {
+		return "", os.NewError("Tracker doesn't support scrape " + announce)
+	}
+	return announce[0:n+1] + "scrape" + announce[n+1+len("announce"):], nil
+}
+
+// Save swarm information, negative values are unknown and keep the
+// previous value
+
+func (t *Tracker) updateSwarm(seeders, leechers, downloaded int64) {
+	t.trackerMgr.mutex.Lock()
+	if seeders >= 0 {
+		t.swarm.Seeders = seeders
+	}
+	if leechers >= 0 {
+		t.swarm.Leechers = leechers
+	}
+	if downloaded >= 0 {
+		t.swarm.Downloaded = downloaded
+	}
+	swarm := t.swarm
+	s := t.trackerMgr.stats
+	t.trackerMgr.mutex.Unlock()
+	if s != nil {
+		s.UpdateSwarm(t.url, &swarm)
+	}
+}
+
+// Decode the response of a HTTP tracker. Peers can come as a compact
+// string, as a list of dictionaries, and as a compact IPv6 string in
+// "peers6" (BEP 7).
+
+func decodeTrackerResponse(data []byte) (tr *bencode.TrackerResponse, peers *list.List, err os.Error) {
+	tr = new(bencode.TrackerResponse)
+	if err = bencode.Unmarshal(bytes.NewBuffer(data), tr); err != nil {
+		return
+	}
+	peers = decodeCompactPeers(tr.Peers)
+	if len(tr.Peers) == 0 {
+		var pl bencode.TrackerPeerList
+		if err = bencode.Unmarshal(bytes.NewBuffer(data), &pl); err != nil {
+			return
+		}
+		for _, peer := range pl.Peers {
+			if len(peer.Ip) > 0 && peer.Port > 0 && peer.Port < 65536 {
+				peers.PushFront(net.JoinHostPort(peer.Ip, strconv.Itoa64(peer.Port)))
+			}
+		}
+	}
+	peers.PushFrontList(decodeCompactPeers6(tr.Peers6))
+	return
+}
+
+// Convert a compact peer list (6 bytes per peer) into a list of
+// ip:port strings
+
+func decodeCompactPeers(compact string) (peers *list.List) {
+	return decodeCompact(compact, net.IPv4len)
+}
+
+// Convert a compact IPv6 peer list (18 bytes per peer) into a list of
+// [ip]:port strings
+
+func decodeCompactPeers6(compact string) (peers *list.List) {
+	return decodeCompact(compact, net.IPv6len)
+}
+
+func decodeCompact(compact string, ipLen int) (peers *list.List) {
+	peers = list.New()
+	for i := 0; i+ipLen+2 <= len(compact); i = i+ipLen+2 {
+		ip := net.IP([]byte(compact[i:i+ipLen]))
+		port := binary.BigEndian.Uint16([]byte(compact[i+ipLen:i+ipLen+2]))
+		peers.PushFront(net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return
+}
@@ -6,19 +6,47 @@ package tracker
 
 import(
 	"log"
+	"os"
+	"net"
+	"rand"
+	"strconv"
+	"time"
+	"sync"
 	"strings"
 	"wgo/bit_field"
 	"wgo/stats"
 	"container/list"
-	"wgo/peers"
 	)
 
 
 type TrackerMgr struct {
+	// Protects the data of the trackers read from other goroutines
+	mutex *sync.Mutex
 	// Chanels
 	trackers map[string]*Tracker
+	// Trackers grouped by tier, as in the announce-list (BEP 12)
+	tiers [][]*Tracker
+	announce *time.Ticker
+	retry_time int64
+	// Signals that the download has just finished
+	completedCh chan bool
+	// A "completed" event has to be sent
+	completedPending bool
+	quit chan bool
+	// Closed once Run has returned
+	stopped chan bool
+	force chan chan os.Error
+	// An announce is in progress
+	announcing bool
+	// Last successful announce and the tracker that answered it
+	lastAnnounce int64
+	current *Tracker
+	// Random key sent to the trackers, identifies us if our IP changes
+	key uint32
+	// Public addresses of this host, sent as hints to the trackers
+	ipv4, ipv6 string
 	//outPeerMgr chan <- *list.List
-	peerMgr peers.PeerMgr
+	peerMgr PeerSource
 	// outStatus chan <- *Status
 	stats stats.Stats
 	//stats stats.Stats
@@ -36,33 +64,394 @@ type TrackerMgr struct {
 	pieceLength int64
 }
 
+// Receives the peers obtained from the trackers, either the PeerMgr of
+// the torrent or the metadata fetcher of a magnet link
+
+type PeerSource interface {
+	AddPeers(peers *list.List)
+	RequestPeers() int
+}
+
 func (t *TrackerMgr) RequestPeers() int {
-	return t.peerMgr.RequestPeers()
+	t.mutex.Lock()
+	peerMgr := t.peerMgr
+	t.mutex.Unlock()
+	return peerMgr.RequestPeers()
 }
 
 func (t *TrackerMgr) Stats() (int64, int64) {
-	return t.stats.GetGlobalStats()
+	t.mutex.Lock()
+	s := t.stats
+	t.mutex.Unlock()
+	if s == nil {
+		return 0, 0
+	}
+	return s.GetGlobalStats()
 }
 
 func (t* TrackerMgr) SavePeers(peers *list.List) {
-	t.peerMgr.AddPeers(peers)
+	t.mutex.Lock()
+	peerMgr := t.peerMgr
+	t.mutex.Unlock()
+	peerMgr.AddPeers(peers)
+}
+
+// Bytes left to download, unknown until the metadata is available
+
+func (t *TrackerMgr) Left() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.bitfield == nil {
+		return UNKNOWN_LEFT
+	}
+	return (t.bitfield.Len() - t.bitfield.Count())*t.pieceLength
+}
+
+// Start announcing the torrent once the metadata of a magnet link has
+// been fetched, peers are sent to peerMgr from now on
+
+func (t *TrackerMgr) SetTorrent(peerMgr PeerSource, s stats.Stats, bf *bit_field.Bitfield, pieceLength int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.peerMgr = peerMgr
+	t.stats = s
+	t.bitfield = bf
+	t.pieceLength = pieceLength
+}
+
+// Called when the last piece has been downloaded, sends the "completed"
+// event without waiting for the next announce
+
+func (t *TrackerMgr) Completed() {
+	select {
+		case t.completedCh <- true:
+		default:
+	}
+}
+
+// Stop announcing and send the "stopped" event to every tracker that
+// knows about us, giving up after TRACKER_STOP_TIMEOUT
+
+func (t *TrackerMgr) Stop() {
+	timeout := time.After(TRACKER_STOP_TIMEOUT)
+	deadline := time.Nanoseconds() + TRACKER_STOP_TIMEOUT
+	select {
+		case t.quit <- true:
+		case <- t.stopped:
+			// Already stopped
+			return
+		case <- timeout:
+			log.Println("TrackerMgr -> Timeout waiting for the announce loop")
+			return
+	}
+	// The requests left after the timeout must not block
+	done := make(chan bool, len(t.trackers))
+	n := 0
+	for _, tracker := range(t.trackers) {
+		if !tracker.started {
+			continue
+		}
+		n++
+		go func(tracker *Tracker) {
+			tracker.uploaded, tracker.downloaded = t.Stats()
+			if err := tracker.Request(0, "stopped", deadline); err != nil {
+				log.Println("TrackerMgr -> Error sending stopped event", err, tracker.url)
+			}
+			done <- true
+		}(tracker)
+	}
+	for ; n > 0; n-- {
+		select {
+			case <- done:
+			case <- timeout:
+				log.Println("TrackerMgr -> Timeout sending stopped event")
+				return
+		}
+	}
+}
+
+// Number of peers to ask for
+
+func (t *TrackerMgr) numWant() (num_peers int) {
+	num_peers = t.RequestPeers()
+	if num_peers > MAX_NUMWANT {
+		num_peers = MAX_NUMWANT
+	}
+	return
 }
 
-func NewTrackerMgr(urls []string, infohash, port string, peerMgr peers.PeerMgr, left int64, bf *bit_field.Bitfield, pieceLength int64, peerId string, s stats.Stats) (t *TrackerMgr) {
+// Announce the torrent to the trackers in tiers. For magnet links bf and
+// s are nil until SetTorrent is called.
+
+func NewTrackerMgr(tiers [][]string, infohash, port string, peerMgr PeerSource, bf *bit_field.Bitfield, pieceLength int64, peerId string, s stats.Stats) (t *TrackerMgr) {
 	//sid := CLIENT_ID + "-" + strconv.Itoa(os.Getpid()) + strconv.Itoa64(rand.Int63())
 	t = new(TrackerMgr)
+	t.mutex = new(sync.Mutex)
 	t.peerId = peerId
 	t.trackers = make(map[string]*Tracker)
+	t.tiers = make([][]*Tracker, 0, len(tiers))
 	//t.outPeerMgr = outPeerMgr
 	t.peerMgr = peerMgr
 	t.stats = s
+	t.bitfield = bf
+	t.pieceLength = pieceLength
 	t.num_peers = ACTIVE_PEERS + UNUSED_PEERS
-	for _, url := range(urls) {
-		if _, ok := t.trackers[url]; strings.HasPrefix(url, "http") && !ok {
-			log.Println("TrackerMgr -> Creating new tracker:", url)
-			t.trackers[url] = NewTracker(url, infohash, port, t, left, bf, pieceLength, t.peerId)
-			go t.trackers[url].Run()
+	t.retry_time = TRACKER_ERR_INTERVAL
+	t.completedCh = make(chan bool, 1)
+	t.quit = make(chan bool)
+	t.stopped = make(chan bool)
+	t.force = make(chan chan os.Error)
+	t.key = uint32(rand.Int31())
+	t.ipv4, t.ipv6 = localAddr("udp4", net.IPv4(8, 8, 8, 8)), localAddr("udp6", net.ParseIP("2001:4860:4860::8888"))
+	for _, urls := range(tiers) {
+		tier := make([]*Tracker, 0, len(urls))
+		for _, url := range(urls) {
+			if _, ok := t.trackers[url]; (strings.HasPrefix(url, "http") || strings.HasPrefix(url, "udp")) && !ok {
+				log.Println("TrackerMgr -> Creating new tracker:", url)
+				tracker, err := NewTracker(url, infohash, port, t, t.peerId)
+				if err != nil {
+					log.Println("TrackerMgr -> Error creating tracker:", err, url)
+					continue
+				}
+				t.trackers[url] = tracker
+				tier = append(tier, tracker)
+			}
+		}
+		if len(tier) > 0 {
+			shuffle(tier)
+			t.tiers = append(t.tiers, tier)
+		}
+	}
+	t.announce = time.NewTicker(1*NS_PER_S)
+	go t.Run()
+	go t.scrapeLoop()
+	return
+}
+
+func (t *TrackerMgr) Run() {
+	defer close(t.stopped)
+	for {
+		select {
+			case <- t.announce.C:
+				t.announceAndReschedule()
+			case <- t.completedCh:
+				t.completedPending = true
+				t.announceAndReschedule()
+			case result := <- t.force:
+				result <- t.forceAnnounce()
+			case <- t.quit:
+				t.announce.Stop()
+				return
+		}
+	}
+}
+
+func (t *TrackerMgr) announceAndReschedule() (err os.Error) {
+	t.mutex.Lock()
+	t.announcing = true
+	t.mutex.Unlock()
+	tracker, err := t.Announce(t.numWant())
+	t.mutex.Lock()
+	t.announcing = false
+	t.mutex.Unlock()
+	t.announce.Stop()
+	if err != nil {
+		log.Println("TrackerMgr -> Error requesting Tracker info", err)
+		t.announce = time.NewTicker(t.retry_time*NS_PER_S)
+		if t.retry_time < MAX_TRACKER_BACKOFF {
+			t.retry_time *= 2
+		}
+		return
+	}
+	log.Println("TrackerMgr -> Requesting Tracker info finished OK, next announce:", tracker.Interval(), tracker.url)
+	t.retry_time = TRACKER_ERR_INTERVAL
+	t.lastAnnounce = time.Seconds()
+	t.current = tracker
+	t.announce = time.NewTicker(tracker.Interval()*NS_PER_S)
+	return
+}
+
+// Announce now instead of waiting for the next interval. Fails if the
+// last announce was made less than min interval ago, if an announce is
+// in progress or once stopped.
+
+func (t *TrackerMgr) ForceAnnounce() os.Error {
+	t.mutex.Lock()
+	announcing := t.announcing
+	t.mutex.Unlock()
+	if announcing {
+		return os.NewError("Tracker announce in progress")
+	}
+	result := make(chan os.Error, 1)
+	select {
+		case t.force <- result:
+		case <- t.stopped:
+			return os.NewError("Tracker announces stopped")
+	}
+	return <- result
+}
+
+func (t *TrackerMgr) forceAnnounce() os.Error {
+	if t.current != nil {
+		if wait := t.lastAnnounce + t.current.MinInterval() - time.Seconds(); wait > 0 {
+			return os.NewError("Tracker announce not allowed for another " + strconv.Itoa64(wait) + " seconds")
+		}
+	}
+	return t.announceAndReschedule()
+}
+
+// Announce following BEP 12: trackers of a tier are tried in order, a
+// tracker that answers is moved to the front of its tier, and the next
+// tier is only used when every tracker of the previous one failed. Each
+// tracker has TRACKER_TIMEOUT to answer and the whole announce
+// ANNOUNCE_TIMEOUT, the rest are tried in the next one.
+
+func (t *TrackerMgr) Announce(num_peers int) (tracker *Tracker, err os.Error) {
+	uploaded, downloaded := t.Stats()
+	end := time.Nanoseconds() + ANNOUNCE_TIMEOUT
+	for _, tier := range(t.tiers) {
+		for i, tracker := range(tier) {
+			if !tracker.Available() {
+				continue
+			}
+			deadline := time.Nanoseconds() + TRACKER_TIMEOUT
+			if deadline > end {
+				deadline = end
+			}
+			if deadline <= time.Nanoseconds() {
+				return nil, os.NewError("Timeout announcing to the trackers")
+			}
+			tracker.uploaded, tracker.downloaded = uploaded, downloaded
+			// A tracker that hasn't seen us yet must receive "started" first
+			event := ""
+			if !tracker.started {
+				event = "started"
+			} else if t.completedPending {
+				event = "completed"
+			}
+			log.Println("TrackerMgr -> Requesting Tracker info:", tracker.url, event)
+			if err = tracker.Request(num_peers, event, deadline); err != nil {
+				log.Println("TrackerMgr -> Error requesting Tracker info", err, tracker.url)
+				continue
+			}
+			if event == "started" && t.completedPending {
+				// Don't make it wait an interval to know we're done
+				log.Println("TrackerMgr -> Requesting Tracker info:", tracker.url, "completed")
+				if tracker.Request(num_peers, "completed", time.Nanoseconds() + TRACKER_TIMEOUT) == nil {
+					t.completedPending = false
+				}
+			} else if event == "completed" {
+				t.completedPending = false
+			}
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = tracker
+			return tracker, nil
+		}
+	}
+	return nil, os.NewError("No tracker answered the announce")
+}
+
+// Scrape now and every SCRAPE_INTERVAL until Run returns, apart from the
+// announces so a slow tracker doesn't delay them
+
+func (t *TrackerMgr) scrapeLoop() {
+	ticker := time.NewTicker(SCRAPE_INTERVAL*NS_PER_S)
+	defer ticker.Stop()
+	t.Scrape()
+	for {
+		select {
+			case <- ticker.C:
+				t.Scrape()
+			case <- t.stopped:
+				return
+		}
+	}
+}
+
+// Scrape every tracker, the results are stored per tracker and
+// published through Stats
+
+func (t *TrackerMgr) Scrape() {
+	for _, tracker := range(t.trackers) {
+		if err := tracker.Scrape(time.Nanoseconds() + TRACKER_TIMEOUT); err != nil {
+			log.Println("TrackerMgr -> Error scraping tracker", err, tracker.url)
+		}
+	}
+}
+
+// Swarm information known by each tracker
+
+func (t *TrackerMgr) Swarm() (swarms map[string]stats.Swarm) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	swarms = make(map[string]stats.Swarm)
+	for url, tracker := range(t.trackers) {
+		swarms[url] = tracker.swarm
+	}
+	return
+}
+
+// Last warning message sent by each tracker
+
+func (t *TrackerMgr) Warnings() (warnings map[string]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	warnings = make(map[string]string)
+	for url, tracker := range(t.trackers) {
+		if len(tracker.warning) > 0 {
+			warnings[url] = tracker.warning
 		}
 	}
 	return
 }
+
+// Obtain the public address used to reach remote. No packet is sent, this
+// only asks the system which source address would be used.
+
+func localAddr(network string, remote net.IP) string {
+	conn, err := net.DialUDP(network, nil, &net.UDPAddr{IP: remote, Port: 53})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || !isPublicIP(addr.IP) {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// Check if the address is a global unicast address
+
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		switch {
+			case ip4[0] == 10, ip4[0] == 127, ip4[0] == 0:
+				return false
+			case ip4[0] == 172 && ip4[1]&0xf0 == 16:
+				return false
+			case ip4[0] == 192 && ip4[1] == 168:
+				return false
+			case ip4[0] == 169 && ip4[1] == 254:
+				return false
+		}
+		return true
+	}
+	if len(ip) != net.IPv6len {
+		return false
+	}
+	// Link local (fe80::/10), unique local (fc00::/7), loopback and multicast
+	if ip[0] == 0xfe && ip[1]&0xc0 == 0x80 || ip[0]&0xfe == 0xfc || ip[0] == 0xff || ip.String() == "::1" {
+		return false
+	}
+	return true
+}
+
+// Shuffle the trackers of a tier
+
+func shuffle(tier []*Tracker) {
+	for i := len(tier)-1; i > 0; i-- {
+		j := rand.Intn(i+1)
+		tier[i], tier[j] = tier[j], tier[i]
+	}
+}
@@ -0,0 +1,155 @@
+package tracker
+
+import(
+	"time"
+	"strconv"
+	"testing"
+	"container/list"
+	)
+
+// Keeps the peers received from the trackers
+
+type fakePeerSource struct {
+	peers chan *list.List
+}
+
+func (f *fakePeerSource) AddPeers(peers *list.List) {
+	f.peers <- peers
+}
+
+func (f *fakePeerSource) RequestPeers() int {
+	return 50
+}
+
+func TestForceAnnounce(t *testing.T) {
+	f := newFakeUdpTracker(t, 0)
+	defer f.conn.Close()
+	peers := &fakePeerSource{make(chan *list.List, 10)}
+	m := NewTrackerMgr([][]string{[]string{f.url()}}, "01234567890123456789", "6881", peers, nil, 0, "-wg0001-000000000000", nil)
+	if err := m.ForceAnnounce(); err != nil {
+		t.Fatalf("Forced announce failed: %s", err)
+	}
+	if l := <- peers.peers; l.Len() != 2 {
+		t.Errorf("Got %d peers, expected 2", l.Len())
+	}
+	// The tracker didn't send a min interval, MIN_ANNOUNCE_INTERVAL is used
+	if err := m.ForceAnnounce(); err == nil {
+		t.Errorf("Forced announce allowed before the min interval")
+	}
+	m.mutex.Lock()
+	m.announcing = true
+	m.mutex.Unlock()
+	if err := m.ForceAnnounce(); err == nil {
+		t.Errorf("Forced announce allowed while announcing")
+	}
+	m.mutex.Lock()
+	m.announcing = false
+	m.mutex.Unlock()
+	m.Stop()
+	if err := m.ForceAnnounce(); err == nil {
+		t.Errorf("Forced announce allowed once stopped")
+	}
+}
+
+func TestCompletedAfterStarted(t *testing.T) {
+	f := newFakeUdpTracker(t, 0)
+	defer f.conn.Close()
+	peers := &fakePeerSource{make(chan *list.List, 10)}
+	m := NewTrackerMgr([][]string{[]string{f.url()}}, "01234567890123456789", "6881", peers, nil, 0, "-wg0001-000000000000", nil)
+	// Announce from here, without the loop
+	m.Stop()
+	m.completedPending = true
+	if _, err := m.Announce(50); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if m.completedPending {
+		t.Errorf("\"completed\" still pending after \"started\"")
+	}
+	if _, err := m.Announce(50); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	// Both right away, then a regular announce
+	events := f.announced()
+	if len(events) != 3 || events[0] != UDP_EVENT_STARTED || events[1] != UDP_EVENT_COMPLETED || events[2] != UDP_EVENT_NONE {
+		t.Errorf("Got events %v, expected started, completed and none", events)
+	}
+	// Already stopped, it must return at once
+	m.Stop()
+}
+
+func TestScrapeAtStart(t *testing.T) {
+	f := newFakeUdpTracker(t, 0)
+	defer f.conn.Close()
+	peers := &fakePeerSource{make(chan *list.List, 10)}
+	m := NewTrackerMgr([][]string{[]string{f.url()}}, "01234567890123456789", "6881", peers, nil, 0, "-wg0001-000000000000", nil)
+	defer m.Stop()
+	// Only scrapes tell the completed downloads
+	for i := 0; m.Swarm()[f.url()].Downloaded != 9; i++ {
+		if i == 100 {
+			t.Fatalf("Not scraped at start")
+		}
+		time.Sleep(NS_PER_S/100)
+	}
+}
+
+// BEP 12: the trackers of a tier are shuffled, a failing tracker makes
+// the next one of its tier be tried, the one that answered moves to the
+// front and the next tier is used only when a whole tier fails
+
+func TestTiers(t *testing.T) {
+	bad, good := newFailingUdpTracker(t), newFakeUdpTracker(t, 0)
+	defer bad.conn.Close()
+	defer good.conn.Close()
+	backup := newFakeUdpTracker(t, 0)
+	defer backup.conn.Close()
+	peers := &fakePeerSource{make(chan *list.List, 10)}
+	urls := make([]string, 10)
+	for i, _ := range urls {
+		urls[i] = "udp://127.0.0.1:" + strconv.Itoa(7000+i)
+	}
+	shuffled := false
+	for i := 0; i < 5 && !shuffled; i++ {
+		m := NewTrackerMgr([][]string{urls}, "01234567890123456789", "6881", peers, nil, 0, "-wg0001-000000000000", nil)
+		m.Stop()
+		if len(m.tiers) != 1 || len(m.tiers[0]) != len(urls) {
+			t.Fatalf("Got tiers %v, expected one with %d trackers", m.tiers, len(urls))
+		}
+		for j, tracker := range m.tiers[0] {
+			if tracker.url != urls[j] {
+				shuffled = true
+			}
+		}
+	}
+	if !shuffled {
+		t.Errorf("The trackers of the tier weren't shuffled")
+	}
+	m := NewTrackerMgr([][]string{[]string{bad.url(), good.url()}, []string{backup.url()}}, "01234567890123456789", "6881", peers, nil, 0, "-wg0001-000000000000", nil)
+	m.Stop()
+	// The failing tracker first, whatever the shuffle did
+	if m.tiers[0][0].url != bad.url() {
+		m.tiers[0][0], m.tiers[0][1] = m.tiers[0][1], m.tiers[0][0]
+	}
+	tracker, err := m.Announce(50)
+	if err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if tracker.url != good.url() || m.tiers[0][0].url != good.url() || m.tiers[0][1].url != bad.url() {
+		t.Errorf("Got %s answering and tier %s, %s, expected %s first", tracker.url, m.tiers[0][0].url, m.tiers[0][1].url, good.url())
+	}
+	if _, announces, _ := bad.counts(); announces != 1 {
+		t.Errorf("Failing tracker got %d announces, expected 1", announces)
+	}
+	if _, announces, _ := backup.counts(); announces != 0 {
+		t.Errorf("Next tier used while the first one answered")
+	}
+	// The whole first tier fails now
+	good.mutex.Lock()
+	good.fail = true
+	good.mutex.Unlock()
+	if tracker, err = m.Announce(50); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if tracker.url != backup.url() {
+		t.Errorf("Got %s answering, expected the next tier", tracker.url)
+	}
+}
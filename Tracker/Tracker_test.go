@@ -0,0 +1,68 @@
+package tracker
+
+import "testing"
+
+type scrapeUrlTest struct {
+	announce, scrape string
+	ok bool
+}
+
+var scrapeUrlTests = []scrapeUrlTest{
+	scrapeUrlTest{"http://example.com/announce", "http://example.com/scrape", true},
+	scrapeUrlTest{"http://example.com/x/announce", "http://example.com/x/scrape", true},
+	scrapeUrlTest{"http://example.com/announce.php", "http://example.com/scrape.php", true},
+	scrapeUrlTest{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644", true},
+	scrapeUrlTest{"http://example.com/a", "", false},
+	scrapeUrlTest{"http://example.com/announce?x=2/4", "", false},
+	scrapeUrlTest{"http://example.com/x%064announce", "", false},
+}
+
+func TestScrapeUrl(t *testing.T) {
+	for _, st := range scrapeUrlTests {
+		url, err := scrapeUrl(st.announce)
+		if st.ok && (err != nil || url != st.scrape) {
+			t.Errorf("scrapeUrl(%s) = %s, %v, expected %s", st.announce, url, err, st.scrape)
+		} else if !st.ok && err == nil {
+			t.Errorf("scrapeUrl(%s) = %s, expected error", st.announce, url)
+		}
+	}
+}
+
+type trackerResponseTest struct {
+	response string
+	peers []string
+}
+
+var trackerResponseTests = []trackerResponseTest{
+	trackerResponseTest{"d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e", []string{"10.0.0.1:6881"}},
+	trackerResponseTest{"d8:intervali1800e5:peersld2:ip8:10.0.0.27:peer id20:-wg0001-0000000000004:porti6881eed2:ip3:::14:porti80eeee", []string{"10.0.0.2:6881", "[::1]:80"}},
+	trackerResponseTest{"d8:intervali1800e5:peers0:6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e", []string{"[2001:db8::1]:6881"}},
+}
+
+func TestDecodeTrackerResponse(t *testing.T) {
+	for _, rt := range trackerResponseTests {
+		tr, peers, err := decodeTrackerResponse([]byte(rt.response))
+		if err != nil {
+			t.Errorf("Unable to decode %q: %s", rt.response, err)
+			continue
+		}
+		if tr.Interval != 1800 {
+			t.Errorf("Got interval %d, expected 1800", tr.Interval)
+		}
+		if peers.Len() != len(rt.peers) {
+			t.Errorf("Got %d peers, expected %d", peers.Len(), len(rt.peers))
+			continue
+		}
+		for e := peers.Front(); e != nil; e = e.Next() {
+			found := false
+			for _, p := range rt.peers {
+				if p == e.Value.(string) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Unexpected peer %s", e.Value.(string))
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Sends the requests of the UDP trackers through a socket shared with
+// other protocols (uTP, DHT) and routes the responses back by
+// transaction id and address.
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package tracker
+
+import(
+	"net"
+	"os"
+	"sync"
+	"encoding/binary"
+	)
+
+type PacketConn interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, os.Error)
+}
+
+type UdpMux struct {
+	mutex *sync.Mutex
+	conn PacketConn
+	// Requests waiting for a response, by transaction id
+	pending map[uint32]*udpRequest
+}
+
+type udpRequest struct {
+	// Address of the tracker, the only one allowed to answer
+	raddr *net.UDPAddr
+	ch chan []byte
+}
+
+var sharedMutex = new(sync.Mutex)
+var sharedMux *UdpMux
+
+// Use conn for the UDP trackers created from now on. The owner of conn
+// must give the packets that Match to HandlePacket of the returned mux.
+// IPv6 trackers keep using their own socket.
+
+func ShareUdpSocket(conn PacketConn) (m *UdpMux) {
+	m = new(UdpMux)
+	m.mutex = new(sync.Mutex)
+	m.conn = conn
+	m.pending = make(map[uint32]*udpRequest)
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+	sharedMux = m
+	return
+}
+
+func sharedUdpMux() *UdpMux {
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+	return sharedMux
+}
+
+// Tracker responses start with the action and a transaction id we are
+// waiting for
+
+func (m *UdpMux) Match(data []byte) bool {
+	if len(data) < 8 || binary.BigEndian.Uint32(data[0:4]) > UDP_ERROR {
+		return false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.pending[binary.BigEndian.Uint32(data[4:8])]
+	return ok
+}
+
+// Responses that don't come from the tracker the request was sent to are
+// dropped, a guessed transaction id isn't enough to answer
+
+func (m *UdpMux) HandlePacket(data []byte, addr *net.UDPAddr) {
+	if len(data) < 8 {
+		return
+	}
+	m.mutex.Lock()
+	r, ok := m.pending[binary.BigEndian.Uint32(data[4:8])]
+	m.mutex.Unlock()
+	if !ok || addr == nil || !addr.IP.Equal(r.raddr.IP) || addr.Port != r.raddr.Port {
+		return
+	}
+	resp := make([]byte, len(data))
+	copy(resp, data)
+	select {
+		case r.ch <- resp:
+		default:
+	}
+}
+
+func (m *UdpMux) register(transactionId uint32, raddr *net.UDPAddr) (ch chan []byte) {
+	ch = make(chan []byte, 1)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pending[transactionId] = &udpRequest{raddr, ch}
+	return
+}
+
+func (m *UdpMux) unregister(transactionId uint32) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pending[transactionId] = nil, false
+}
@@ -0,0 +1,273 @@
+// Communication with UDP trackers (BEP 15).
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package tracker
+
+import(
+	"net"
+	"os"
+	"rand"
+	"sync"
+	"time"
+	"strings"
+	"encoding/binary"
+	)
+
+const(
+	UDP_MAGIC = 0x41727101980
+	UDP_CONNECT = 0
+	UDP_ANNOUNCE = 1
+	UDP_SCRAPE = 2
+	UDP_ERROR = 3
+	UDP_TIMEOUT = 15 // seconds, retransmissions wait 15*2^n
+	// As in BEP 15, the callers bound the time with a deadline
+	UDP_MAX_RETRIES = 8
+	UDP_CONNECTION_TTL = 60 // a connection id can be used for 1 minute
+	UDP_PACKET_SIZE = 2048
+)
+
+// Announce events as defined by BEP 15
+
+const(
+	UDP_EVENT_NONE = iota
+	UDP_EVENT_COMPLETED
+	UDP_EVENT_STARTED
+	UDP_EVENT_STOPPED
+)
+
+type udpTracker struct {
+	// Announces and scrapes are made one at a time, they share the
+	// connection id, conn and buf
+	mutex *sync.Mutex
+	addr string
+	ipv6 bool
+	conn *net.UDPConn
+	// Shared socket, used instead of conn if set
+	mux *UdpMux
+	raddr *net.UDPAddr
+	connectionId uint64
+	connected int64 // time the connection id was obtained
+	timeout int64 // base retransmission timeout in ns
+	buf []byte
+}
+
+type udpAnnounce struct {
+	infohash, peerId string
+	downloaded, left, uploaded int64
+	event uint32
+	key uint32
+	numWant int32
+	port uint16
+}
+
+type udpAnnounceResponse struct {
+	interval, leechers, seeders int64
+	peers string // compact peer list
+}
+
+type udpScrapeResponse struct {
+	seeders, completed, leechers int64
+}
+
+// Create a new UDP tracker from an url of the form
+// udp://host:port[/announce]
+
+func newUdpTracker(url string) (u *udpTracker, err os.Error) {
+	if !strings.HasPrefix(url, "udp://") {
+		return nil, os.NewError("Invalid UDP tracker url " + url)
+	}
+	addr := url[len("udp://"):]
+	if n := strings.Index(addr, "/"); n != -1 {
+		addr = addr[0:n]
+	}
+	raddr, err := net.ResolveUDPAddr(addr)
+	if err != nil {
+		return
+	}
+	u = new(udpTracker)
+	u.mutex = new(sync.Mutex)
+	u.addr = addr
+	u.ipv6 = raddr.IP.To4() == nil
+	u.timeout = UDP_TIMEOUT*NS_PER_S
+	u.buf = make([]byte, UDP_PACKET_SIZE)
+	if m := sharedUdpMux(); m != nil && !u.ipv6 {
+		u.mux, u.raddr = m, raddr
+		return
+	}
+	u.conn, err = net.DialUDP("udp", nil, raddr)
+	return
+}
+
+// Obtain a connection id, reusing the cached one while it is valid
+
+func (u *udpTracker) connect(deadline int64) (connectionId uint64, err os.Error) {
+	if u.connected > 0 && time.Seconds()-u.connected < UDP_CONNECTION_TTL {
+		return u.connectionId, nil
+	}
+	resp, err := u.send(UDP_CONNECT, nil, deadline)
+	if err != nil {
+		return
+	}
+	if len(resp) < 8 {
+		return 0, os.NewError("Invalid connect response from " + u.addr)
+	}
+	u.connectionId = binary.BigEndian.Uint64(resp[0:8])
+	u.connected = time.Seconds()
+	return u.connectionId, nil
+}
+
+// Send a request to the tracker and wait for the response, retransmitting
+// with an exponential backoff until deadline (in ns, 0 for no limit).
+// Returns the payload of the response, without the action and
+// transaction id.
+
+func (u *udpTracker) send(action uint32, payload []byte, deadline int64) (resp []byte, err os.Error) {
+	for n := uint(0); n <= UDP_MAX_RETRIES; n++ {
+		timeout := u.timeout<<n
+		if deadline > 0 {
+			left := deadline - time.Nanoseconds()
+			if left <= 0 {
+				break
+			}
+			if timeout > left {
+				timeout = left
+			}
+		}
+		connectionId := uint64(UDP_MAGIC)
+		if action != UDP_CONNECT {
+			if connectionId, err = u.connect(deadline); err != nil {
+				return
+			}
+		}
+		transactionId := uint32(rand.Int31())
+		packet := make([]byte, 16+len(payload))
+		binary.BigEndian.PutUint64(packet[0:8], connectionId)
+		binary.BigEndian.PutUint32(packet[8:12], action)
+		binary.BigEndian.PutUint32(packet[12:16], transactionId)
+		copy(packet[16:], payload)
+		var ch chan []byte
+		if u.mux != nil {
+			ch = u.mux.register(transactionId, u.raddr)
+			_, err = u.mux.conn.WriteToUDP(packet, u.raddr)
+		} else {
+			_, err = u.conn.Write(packet)
+		}
+		if err == nil {
+			resp, err = u.receive(action, transactionId, timeout, ch)
+		}
+		if u.mux != nil {
+			u.mux.unregister(transactionId)
+		}
+		if err != errUdpTimeout {
+			return
+		}
+	}
+	return nil, os.NewError("UDP tracker " + u.addr + " timed out")
+}
+
+var errUdpTimeout = os.NewError("UDP tracker timeout")
+
+// Wait for the response matching transactionId, read from our socket or
+// received from the shared one through ch
+
+func (u *udpTracker) receive(action, transactionId uint32, timeout int64, ch chan []byte) (resp []byte, err os.Error) {
+	deadline := time.Nanoseconds() + timeout
+	for {
+		left := deadline - time.Nanoseconds()
+		if left <= 0 {
+			return nil, errUdpTimeout
+		}
+		var n int
+		if ch != nil {
+			select {
+				case data := <- ch:
+					n = copy(u.buf, data)
+				case <- time.After(left):
+					return nil, errUdpTimeout
+			}
+		} else {
+			if err = u.conn.SetReadTimeout(left); err != nil {
+				return
+			}
+			if n, err = u.conn.Read(u.buf); err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					return nil, errUdpTimeout
+				}
+				return nil, err
+			}
+		}
+		if n < 8 || binary.BigEndian.Uint32(u.buf[4:8]) != transactionId {
+			// Stale or foreign packet
+			continue
+		}
+		switch binary.BigEndian.Uint32(u.buf[0:4]) {
+			case action:
+				resp = make([]byte, n-8)
+				copy(resp, u.buf[8:n])
+				return resp, nil
+			case UDP_ERROR:
+				return nil, &TrackerError{"udp://" + u.addr, string(u.buf[8:n])}
+		}
+		return nil, os.NewError("Unexpected action in response from " + u.addr)
+	}
+	return
+}
+
+func (u *udpTracker) announce(a *udpAnnounce, deadline int64) (r *udpAnnounceResponse, err os.Error) {
+	payload := make([]byte, 82)
+	copy(payload[0:20], a.infohash)
+	copy(payload[20:40], a.peerId)
+	binary.BigEndian.PutUint64(payload[40:48], uint64(a.downloaded))
+	binary.BigEndian.PutUint64(payload[48:56], uint64(a.left))
+	binary.BigEndian.PutUint64(payload[56:64], uint64(a.uploaded))
+	binary.BigEndian.PutUint32(payload[64:68], a.event)
+	binary.BigEndian.PutUint32(payload[68:72], 0) // ip, let the tracker use the source address
+	binary.BigEndian.PutUint32(payload[72:76], a.key)
+	binary.BigEndian.PutUint32(payload[76:80], uint32(a.numWant))
+	binary.BigEndian.PutUint16(payload[80:82], a.port)
+	u.mutex.Lock()
+	resp, err := u.send(UDP_ANNOUNCE, payload, deadline)
+	u.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	if len(resp) < 12 {
+		return nil, os.NewError("Invalid announce response from " + u.addr)
+	}
+	r = new(udpAnnounceResponse)
+	r.interval = int64(binary.BigEndian.Uint32(resp[0:4]))
+	r.leechers = int64(binary.BigEndian.Uint32(resp[4:8]))
+	r.seeders = int64(binary.BigEndian.Uint32(resp[8:12]))
+	r.peers = string(resp[12:])
+	return
+}
+
+func (u *udpTracker) scrape(infohashes []string, deadline int64) (r []udpScrapeResponse, err os.Error) {
+	payload := make([]byte, 20*len(infohashes))
+	for i, infohash := range infohashes {
+		copy(payload[i*20:(i+1)*20], infohash)
+	}
+	u.mutex.Lock()
+	resp, err := u.send(UDP_SCRAPE, payload, deadline)
+	u.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	if len(resp) < 12*len(infohashes) {
+		return nil, os.NewError("Invalid scrape response from " + u.addr)
+	}
+	r = make([]udpScrapeResponse, len(infohashes))
+	for i, _ := range infohashes {
+		r[i].seeders = int64(binary.BigEndian.Uint32(resp[i*12:i*12+4]))
+		r[i].completed = int64(binary.BigEndian.Uint32(resp[i*12+4:i*12+8]))
+		r[i].leechers = int64(binary.BigEndian.Uint32(resp[i*12+8:i*12+12]))
+	}
+	return
+}
+
+func (u *udpTracker) Close() {
+	if u.conn != nil {
+		u.conn.Close()
+	}
+}
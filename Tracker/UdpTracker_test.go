@@ -0,0 +1,289 @@
+package tracker
+
+import(
+	"net"
+	"sync"
+	"time"
+	"testing"
+	"encoding/binary"
+	)
+
+const testConnectionId = 0x1234567890
+
+// Minimal in-process UDP tracker. It drops the first "drop" packets it
+// receives to exercise retransmission.
+
+type fakeUdpTracker struct {
+	conn *net.UDPConn
+	// Protects the counters, run updates them while the tests read them
+	mutex *sync.Mutex
+	drop int
+	connects, announces, scrapes int
+	// Event of each announce
+	events []uint32
+	// Announces are answered with an error
+	fail bool
+}
+
+func newFakeUdpTracker(t *testing.T, drop int) (f *fakeUdpTracker) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	f = &fakeUdpTracker{conn: conn, mutex: new(sync.Mutex), drop: drop}
+	go f.run()
+	return
+}
+
+func newFailingUdpTracker(t *testing.T) (f *fakeUdpTracker) {
+	f = newFakeUdpTracker(t, 0)
+	f.mutex.Lock()
+	f.fail = true
+	f.mutex.Unlock()
+	return
+}
+
+func (f *fakeUdpTracker) url() string {
+	return "udp://" + f.conn.LocalAddr().String() + "/announce"
+}
+
+func (f *fakeUdpTracker) run() {
+	buf := make([]byte, UDP_PACKET_SIZE)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		drop := f.drop > 0
+		if drop {
+			f.drop--
+		}
+		f.mutex.Unlock()
+		if drop || n < 16 {
+			continue
+		}
+		connectionId := binary.BigEndian.Uint64(buf[0:8])
+		action := binary.BigEndian.Uint32(buf[8:12])
+		resp := make([]byte, 8, 128)
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		copy(resp[4:8], buf[12:16])
+		f.mutex.Lock()
+		switch {
+			case action == UDP_CONNECT && connectionId == UDP_MAGIC:
+				f.connects++
+				id := make([]byte, 8)
+				binary.BigEndian.PutUint64(id, testConnectionId)
+				resp = append(resp, id...)
+			case action == UDP_ANNOUNCE && f.fail:
+				f.announces++
+				binary.BigEndian.PutUint32(resp[0:4], UDP_ERROR)
+				resp = append(resp, []byte("failing")...)
+			case action == UDP_ANNOUNCE && connectionId == testConnectionId:
+				f.announces++
+				if n >= 84 {
+					f.events = append(f.events, binary.BigEndian.Uint32(buf[80:84]))
+				}
+				body := make([]byte, 12)
+				binary.BigEndian.PutUint32(body[0:4], 1800)
+				binary.BigEndian.PutUint32(body[4:8], 3)
+				binary.BigEndian.PutUint32(body[8:12], 7)
+				resp = append(resp, body...)
+				resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1, 192, 168, 1, 2, 0, 80)
+			case action == UDP_SCRAPE && connectionId == testConnectionId:
+				f.scrapes++
+				for i := 16; i+20 <= n; i += 20 {
+					resp = append(resp, 0, 0, 0, 5, 0, 0, 0, 9, 0, 0, 0, 2)
+				}
+			default:
+				binary.BigEndian.PutUint32(resp[0:4], UDP_ERROR)
+				resp = append(resp, []byte("bad request")...)
+		}
+		f.mutex.Unlock()
+		f.conn.WriteTo(resp, addr)
+	}
+}
+
+func (f *fakeUdpTracker) counts() (connects, announces, scrapes int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.connects, f.announces, f.scrapes
+}
+
+func (f *fakeUdpTracker) announced() (events []uint32) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append(events, f.events...)
+}
+
+func newTestUdpTracker(t *testing.T, f *fakeUdpTracker) (u *udpTracker) {
+	u, err := newUdpTracker(f.url())
+	if err != nil {
+		t.Fatalf("Unable to create UDP tracker: %s", err)
+	}
+	u.timeout = NS_PER_S/20
+	return
+}
+
+func TestUdpAnnounce(t *testing.T) {
+	f := newFakeUdpTracker(t, 0)
+	defer f.conn.Close()
+	u := newTestUdpTracker(t, f)
+	defer u.Close()
+	a := &udpAnnounce{infohash: "01234567890123456789", peerId: "-wg0001-000000000000", left: 100, event: UDP_EVENT_STARTED, numWant: 50, port: 6881}
+	r, err := u.announce(a, 0)
+	if err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if r.interval != 1800 || r.leechers != 3 || r.seeders != 7 {
+		t.Errorf("Got interval %d leechers %d seeders %d", r.interval, r.leechers, r.seeders)
+	}
+	peers := decodeCompactPeers(r.peers)
+	if peers.Len() != 2 {
+		t.Fatalf("Got %d peers, expected 2", peers.Len())
+	}
+	expected := map[string]bool{"10.0.0.1:6881": true, "192.168.1.2:80": true}
+	for e := peers.Front(); e != nil; e = e.Next() {
+		if !expected[e.Value.(string)] {
+			t.Errorf("Unexpected peer %s", e.Value.(string))
+		}
+	}
+	// The connection id must be cached
+	if _, err = u.announce(a, 0); err != nil {
+		t.Fatalf("Second announce failed: %s", err)
+	}
+	if connects, announces, _ := f.counts(); connects != 1 || announces != 2 {
+		t.Errorf("Got %d connects and %d announces, expected 1 and 2", connects, announces)
+	}
+}
+
+func TestUdpRetransmit(t *testing.T) {
+	f := newFakeUdpTracker(t, 2)
+	defer f.conn.Close()
+	u := newTestUdpTracker(t, f)
+	defer u.Close()
+	if _, err := u.connect(0); err != nil {
+		t.Fatalf("Connect failed after retransmission: %s", err)
+	}
+	if u.connectionId != testConnectionId {
+		t.Errorf("Got connection id %x, expected %x", u.connectionId, testConnectionId)
+	}
+}
+
+func TestUdpScrape(t *testing.T) {
+	f := newFakeUdpTracker(t, 0)
+	defer f.conn.Close()
+	u := newTestUdpTracker(t, f)
+	defer u.Close()
+	r, err := u.scrape([]string{"01234567890123456789", "abcdefghijabcdefghij"}, 0)
+	if err != nil {
+		t.Fatalf("Scrape failed: %s", err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("Got %d scrape results, expected 2", len(r))
+	}
+	for _, s := range r {
+		if s.seeders != 5 || s.completed != 9 || s.leechers != 2 {
+			t.Errorf("Got seeders %d completed %d leechers %d", s.seeders, s.completed, s.leechers)
+		}
+	}
+}
+
+func TestUdpSharedSocket(t *testing.T) {
+	f := newFakeUdpTracker(t, 1)
+	defer f.conn.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+	m := ShareUdpSocket(conn)
+	defer func() {
+		sharedMutex.Lock()
+		sharedMux = nil
+		sharedMutex.Unlock()
+	}()
+	go func() {
+		buf := make([]byte, UDP_PACKET_SIZE)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if m.Match(buf[0:n]) {
+				m.HandlePacket(buf[0:n], addr)
+			}
+		}
+	}()
+	u := newTestUdpTracker(t, f)
+	defer u.Close()
+	if u.mux == nil {
+		t.Fatalf("UDP tracker is not using the shared socket")
+	}
+	if _, err := u.connect(0); err != nil {
+		t.Fatalf("Connect through the shared socket failed: %s", err)
+	}
+	if u.connectionId != testConnectionId {
+		t.Errorf("Got connection id %x, expected %x", u.connectionId, testConnectionId)
+	}
+	if len(m.pending) != 0 {
+		t.Errorf("%d requests still pending", len(m.pending))
+	}
+}
+
+// Without the deadline the retransmissions would go on for 25 seconds
+
+func TestUdpDeadline(t *testing.T) {
+	f := newFakeUdpTracker(t, 1000)
+	defer f.conn.Close()
+	u := newTestUdpTracker(t, f)
+	defer u.Close()
+	start := time.Nanoseconds()
+	if _, err := u.connect(start + NS_PER_S/4); err == nil {
+		t.Fatalf("Connected to a tracker that doesn't answer")
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed > NS_PER_S {
+		t.Errorf("Gave up after %d ms, the deadline was 250 ms", elapsed/1000000)
+	}
+}
+
+// Only the tracker the request was sent to can answer it
+
+func TestUdpMuxAddress(t *testing.T) {
+	m := ShareUdpSocket(nil)
+	defer func() {
+		sharedMutex.Lock()
+		sharedMux = nil
+		sharedMutex.Unlock()
+	}()
+	raddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6969}
+	ch := m.register(7, raddr)
+	defer m.unregister(7)
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint32(data[4:8], 7)
+	if !m.Match(data) {
+		t.Fatalf("Response to a pending request not matched")
+	}
+	tests := []struct {
+		addr *net.UDPAddr
+		accepted bool
+	}{
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6969}, false},
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6970}, false},
+		{nil, false},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 6969}, true},
+	}
+	for _, test := range tests {
+		m.HandlePacket(data, test.addr)
+		select {
+			case <- ch:
+				if !test.accepted {
+					t.Errorf("Accepted a response from %v", test.addr)
+				}
+			default:
+				if test.accepted {
+					t.Errorf("Dropped a response from %v", test.addr)
+				}
+		}
+	}
+}
@@ -0,0 +1,542 @@
+// uTP connection, implements net.Conn so the Wire can use it like a TCP
+// connection
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package utp
+
+import(
+	"os"
+	"net"
+	"sync"
+	"time"
+	"bytes"
+	)
+
+const(
+	PACKET_SIZE = 1400
+	MAX_PAYLOAD = PACKET_SIZE - HEADER_LEN
+	RECV_BUFFER = 1024*1024
+	MIN_RTO = 500*NS_PER_MS
+	MAX_RTO = 60*NS_PER_S
+	INIT_RTO = 1*NS_PER_S
+	MAX_TIMEOUTS = 6 // consecutive timeouts before the connection is dropped
+	DUP_ACKS = 3 // duplicate or selective acks that mark a packet as lost
+	REORDER_WINDOW = 0x1000 // out of order packets accepted ahead of ack
+	SACK_BYTES = 4
+	KEEP_ALIVE = 29*NS_PER_S // keeps NAT mappings open
+)
+
+const(
+	NS_PER_S = 1000000000
+	NS_PER_MS = 1000000
+)
+
+// Connection states
+
+const(
+	CS_SYN_SENT = iota
+	CS_CONNECTED
+	CS_FIN_SENT
+	CS_CLOSED
+)
+
+var errClosed = os.NewError("uTP connection closed")
+var errReset = os.NewError("uTP connection reset by peer")
+
+type timeoutError struct{}
+
+func (e *timeoutError) String() string { return "uTP timeout" }
+func (e *timeoutError) Timeout() bool { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var errTimeout = &timeoutError{}
+
+// Sent packet waiting for an ack
+
+type outPacket struct {
+	pkt *packet
+	size int
+	sent int64 // ns
+	transmissions int
+}
+
+type Conn struct {
+	mutex *sync.Mutex
+	s *Socket
+	raddr *net.UDPAddr
+	sendId, recvId uint16
+	state int
+	// Next sequence number to send and last one received in order
+	seq, ack uint16
+	outQueue []*outPacket
+	inFlight int
+	reorder map[uint16]*packet
+	// Payload of the out of order packets, with readBuf it's kept within
+	// the window we advertise
+	reorderBytes int
+	readBuf *bytes.Buffer
+	gotFin, eof, closed bool
+	eofSeq uint16
+	err os.Error
+	cc *ledbat
+	peerWnd uint32
+	advertisedWnd uint32
+	// Delay measured for the last packet received, sent back to the peer
+	replyMicro uint32
+	rtt, rttVar, rto int64 // ns
+	timeouts int
+	dupAcks int
+	lastAck uint16
+	lastSent int64
+	readTimeout, writeTimeout int64
+	// Notifications, buffered so none is lost
+	readable, writable, connected chan bool
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvId, sendId uint16) (c *Conn) {
+	c = new(Conn)
+	c.mutex = new(sync.Mutex)
+	c.s = s
+	c.raddr = raddr
+	c.recvId = recvId
+	c.sendId = sendId
+	c.reorder = make(map[uint16]*packet)
+	c.readBuf = new(bytes.Buffer)
+	c.cc = newLedbat()
+	c.peerWnd = PACKET_SIZE
+	c.rto = INIT_RTO
+	c.readable = make(chan bool, 1)
+	c.writable = make(chan bool, 1)
+	c.connected = make(chan bool, 1)
+	return
+}
+
+func notify(ch chan bool) {
+	select {
+		case ch <- true:
+		default:
+	}
+}
+
+// Wait for a notification until deadline, 0 waits forever
+
+func wait(ch chan bool, deadline int64) bool {
+	if deadline == 0 {
+		<- ch
+		return true
+	}
+	left := deadline - time.Nanoseconds()
+	if left <= 0 {
+		return false
+	}
+	select {
+		case <- ch:
+			return true
+		case <- time.After(left):
+	}
+	return false
+}
+
+func deadline(timeout int64) int64 {
+	if timeout <= 0 {
+		return 0
+	}
+	return time.Nanoseconds() + timeout
+}
+
+func micro() uint32 {
+	return uint32(time.Nanoseconds() / 1000)
+}
+
+func (c *Conn) Read(b []byte) (n int, err os.Error) {
+	d := deadline(c.readTimeout)
+	for {
+		c.mutex.Lock()
+		if c.readBuf.Len() > 0 {
+			n, _ = c.readBuf.Read(b)
+			// Tell the peer our window is open again
+			if c.advertisedWnd < MAX_PAYLOAD && c.recvWindow() >= RECV_BUFFER/2 {
+				c.sendState()
+			}
+			c.mutex.Unlock()
+			return
+		}
+		switch {
+			case c.closed:
+				err = errClosed
+			case c.eof:
+				err = os.EOF
+			case c.err != nil:
+				err = c.err
+		}
+		c.mutex.Unlock()
+		if err != nil {
+			return
+		}
+		if !wait(c.readable, d) {
+			return 0, errTimeout
+		}
+	}
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err os.Error) {
+	d := deadline(c.writeTimeout)
+	for n < len(b) {
+		c.mutex.Lock()
+		switch {
+			case c.closed:
+				err = errClosed
+			case c.err != nil:
+				err = c.err
+		}
+		if err != nil {
+			c.mutex.Unlock()
+			return
+		}
+		size := len(b) - n
+		if size > MAX_PAYLOAD {
+			size = MAX_PAYLOAD
+		}
+		// A single packet is always allowed, so a zero window is probed
+		if c.inFlight == 0 || c.inFlight+size <= c.window() {
+			c.sendData(ST_DATA, b[n:n+size])
+			n += size
+			c.mutex.Unlock()
+			continue
+		}
+		c.mutex.Unlock()
+		if !wait(c.writable, d) {
+			return n, errTimeout
+		}
+	}
+	return
+}
+
+// Send a FIN after the queued data, the connection stays in the Socket
+// until it's acked
+
+func (c *Conn) Close() os.Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.err == nil && c.state == CS_CONNECTED {
+		c.sendData(ST_FIN, nil)
+		c.state = CS_FIN_SENT
+	} else {
+		c.state = CS_CLOSED
+		c.s.remove(c)
+	}
+	notify(c.readable)
+	notify(c.writable)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetTimeout(nsec int64) os.Error {
+	c.readTimeout, c.writeTimeout = nsec, nsec
+	return nil
+}
+
+func (c *Conn) SetReadTimeout(nsec int64) os.Error {
+	c.readTimeout = nsec
+	return nil
+}
+
+func (c *Conn) SetWriteTimeout(nsec int64) os.Error {
+	c.writeTimeout = nsec
+	return nil
+}
+
+// Bytes that can be in flight, limited by congestion control and by the
+// receive window of the peer
+
+func (c *Conn) window() int {
+	if int(c.peerWnd) < c.cc.window {
+		return int(c.peerWnd)
+	}
+	return c.cc.window
+}
+
+func (c *Conn) recvWindow() uint32 {
+	if c.readBuf.Len() >= RECV_BUFFER {
+		return 0
+	}
+	return uint32(RECV_BUFFER - c.readBuf.Len())
+}
+
+// Queue and send a packet that takes a sequence number, must be called
+// with the mutex held
+
+func (c *Conn) sendData(typ byte, payLoad []byte) {
+	p := &packet{typ: typ, connId: c.sendId, seq: c.seq}
+	if typ == ST_SYN {
+		p.connId = c.recvId
+	}
+	if len(payLoad) > 0 {
+		p.payLoad = make([]byte, len(payLoad))
+		copy(p.payLoad, payLoad)
+	}
+	c.seq++
+	op := &outPacket{pkt: p, size: len(payLoad)}
+	c.outQueue = append(c.outQueue, op)
+	c.inFlight += op.size
+	c.transmit(op)
+}
+
+func (c *Conn) transmit(op *outPacket) {
+	op.sent = time.Nanoseconds()
+	op.transmissions++
+	c.send(op.pkt)
+}
+
+func (c *Conn) send(p *packet) {
+	p.timestamp = micro()
+	p.timestampDiff = c.replyMicro
+	p.wndSize = c.recvWindow()
+	if p.typ != ST_SYN {
+		p.ack = c.ack
+	}
+	c.advertisedWnd = p.wndSize
+	c.lastSent = time.Nanoseconds()
+	c.s.send(p, c.raddr)
+}
+
+// Ack what we have received, with the out of order packets in a
+// selective ack
+
+func (c *Conn) sendState() {
+	p := &packet{typ: ST_STATE, connId: c.sendId, seq: c.seq}
+	if len(c.reorder) > 0 {
+		p.sack = make([]byte, SACK_BYTES)
+		for seq, _ := range c.reorder {
+			i := int(seq - c.ack - 2)
+			if i >= 0 && i < SACK_BYTES*8 {
+				p.sack[i/8] |= 1 << uint(i%8)
+			}
+		}
+	}
+	c.send(p)
+}
+
+func (c *Conn) fail(err os.Error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = CS_CLOSED
+	c.s.remove(c)
+	notify(c.readable)
+	notify(c.writable)
+	notify(c.connected)
+}
+
+// Process a packet received from the peer
+
+func (c *Conn) handle(p *packet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == CS_CLOSED {
+		return
+	}
+	c.replyMicro = micro() - p.timestamp
+	c.peerWnd = p.wndSize
+	switch p.typ {
+		case ST_RESET:
+			c.fail(errReset)
+			return
+		case ST_SYN:
+			// Our STATE was lost, the initiator sent the SYN again
+			c.sendState()
+			return
+	}
+	if c.state == CS_SYN_SENT {
+		if p.typ != ST_STATE {
+			return
+		}
+		c.ack = p.seq - 1
+		c.state = CS_CONNECTED
+		notify(c.connected)
+	}
+	c.processAck(p)
+	if p.typ == ST_DATA || p.typ == ST_FIN {
+		c.receive(p)
+		c.sendState()
+	}
+	if c.state == CS_FIN_SENT && len(c.outQueue) == 0 {
+		c.state = CS_CLOSED
+		c.s.remove(c)
+	}
+}
+
+// Remove the acked packets from outQueue, update the rtt and the window,
+// and resend the packets the peer reports as lost
+
+func (c *Conn) processAck(p *packet) {
+	now := time.Nanoseconds()
+	acked := 0
+	rttSample := int64(-1)
+	ackPacket := func(i int) {
+		op := c.outQueue[i]
+		acked += op.size
+		c.inFlight -= op.size
+		// Karn's algorithm, retransmitted packets give no sample
+		if op.transmissions == 1 {
+			rttSample = now - op.sent
+		}
+		c.outQueue = append(c.outQueue[0:i], c.outQueue[i+1:]...)
+	}
+	for len(c.outQueue) > 0 && !seqLess(p.ack, c.outQueue[0].pkt.seq) {
+		ackPacket(0)
+	}
+	lost := false
+	if len(p.sack) > 0 {
+		sacked := make([]uint16, 0, len(p.sack)*8)
+		for i := 0; i < len(p.sack)*8; i++ {
+			if p.sack[i/8]&(1<<uint(i%8)) != 0 {
+				sacked = append(sacked, p.ack+2+uint16(i))
+			}
+		}
+		for _, seq := range sacked {
+			for i, op := range c.outQueue {
+				if op.pkt.seq == seq {
+					ackPacket(i)
+					break
+				}
+			}
+		}
+		// A packet is lost if DUP_ACKS packets sent after it arrived
+		for _, op := range c.outQueue {
+			after := 0
+			for _, seq := range sacked {
+				if seqLess(op.pkt.seq, seq) {
+					after++
+				}
+			}
+			if after >= DUP_ACKS && now-op.sent > c.rtt {
+				c.transmit(op)
+				lost = true
+			}
+		}
+	}
+	if acked == 0 && p.typ == ST_STATE && p.ack == c.lastAck && len(c.outQueue) > 0 {
+		c.dupAcks++
+		if c.dupAcks == DUP_ACKS {
+			c.transmit(c.outQueue[0])
+			lost = true
+		}
+	} else if acked > 0 {
+		c.dupAcks = 0
+	}
+	c.lastAck = p.ack
+	if rttSample >= 0 {
+		c.updateRtt(rttSample)
+	}
+	if acked > 0 {
+		c.timeouts = 0
+		c.cc.onAck(acked, p.timestampDiff)
+		notify(c.writable)
+	}
+	if lost {
+		c.cc.onLoss(c.rtt)
+	}
+}
+
+func (c *Conn) updateRtt(sample int64) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < MIN_RTO {
+		c.rto = MIN_RTO
+	}
+}
+
+// Deliver the payload in order, keeping packets that arrive early. The
+// data that doesn't fit in the window we advertised is dropped, the peer
+// sends it again once the application reads.
+
+func (c *Conn) receive(p *packet) {
+	if c.readBuf.Len() + c.reorderBytes + len(p.payLoad) > RECV_BUFFER {
+		return
+	}
+	if p.typ == ST_FIN && !c.gotFin {
+		c.gotFin = true
+		c.eofSeq = p.seq
+	}
+	diff := p.seq - (c.ack + 1)
+	if diff == 0 {
+		c.deliver(p)
+		for {
+			next, ok := c.reorder[c.ack+1]
+			if !ok {
+				break
+			}
+			c.reorder[c.ack+1] = nil, false
+			c.reorderBytes -= len(next.payLoad)
+			c.deliver(next)
+		}
+	} else if _, ok := c.reorder[p.seq]; !ok && diff < REORDER_WINDOW {
+		c.reorder[p.seq] = p
+		c.reorderBytes += len(p.payLoad)
+	}
+	// Older packets are duplicates, the ack is sent again
+}
+
+func (c *Conn) deliver(p *packet) {
+	c.ack = p.seq
+	if len(p.payLoad) > 0 {
+		c.readBuf.Write(p.payLoad)
+		notify(c.readable)
+	}
+	if c.gotFin && c.ack == c.eofSeq {
+		c.eof = true
+		notify(c.readable)
+	}
+}
+
+// Called periodically by the Socket, resends the oldest packet when the
+// retransmission timer expires
+
+func (c *Conn) tick(now int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == CS_CLOSED {
+		return
+	}
+	if len(c.outQueue) > 0 && now-c.outQueue[0].sent > c.rto {
+		c.timeouts++
+		if c.timeouts > MAX_TIMEOUTS {
+			c.fail(errTimeout)
+			return
+		}
+		c.rto *= 2
+		if c.rto > MAX_RTO {
+			c.rto = MAX_RTO
+		}
+		c.cc.onTimeout()
+		c.transmit(c.outQueue[0])
+		return
+	}
+	if c.state == CS_CONNECTED && now-c.lastSent > KEEP_ALIVE {
+		c.sendState()
+	}
+}
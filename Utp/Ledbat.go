@@ -0,0 +1,103 @@
+// LEDBAT congestion control for uTP. The window grows while the one way
+// delay is below CCONTROL_TARGET and shrinks when it's above, so uTP
+// backs off before other traffic notices a full uplink.
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package utp
+
+import(
+	"time"
+	)
+
+const(
+	CCONTROL_TARGET = 100000 // microseconds
+	MAX_CWND_INCREASE = 3000 // bytes per RTT
+	MIN_WINDOW = PACKET_SIZE
+	INIT_WINDOW = 3*PACKET_SIZE
+	MAX_WINDOW = RECV_BUFFER
+	BASE_HISTORY = 2 // minutes of delay history for the base delay
+)
+
+type ledbat struct {
+	window int // bytes
+	// Minimum delay of each of the last BASE_HISTORY minutes
+	baseDelays [BASE_HISTORY]uint32
+	baseMinute int64
+	current int
+	lastLoss int64 // ns
+}
+
+func newLedbat() (l *ledbat) {
+	l = new(ledbat)
+	l.window = INIT_WINDOW
+	for i, _ := range l.baseDelays {
+		l.baseDelays[i] = 0xffffffff
+	}
+	l.baseMinute = time.Seconds()/60
+	return
+}
+
+func (l *ledbat) addDelaySample(delay uint32) {
+	minute := time.Seconds()/60
+	if minute != l.baseMinute {
+		l.baseMinute = minute
+		l.current = (l.current+1) % BASE_HISTORY
+		l.baseDelays[l.current] = delay
+	} else if delay < l.baseDelays[l.current] {
+		l.baseDelays[l.current] = delay
+	}
+}
+
+// Lowest delay seen, taken as the delay of the link without queuing
+
+func (l *ledbat) baseDelay() (base uint32) {
+	base = l.baseDelays[0]
+	for _, d := range l.baseDelays[1:] {
+		if d < base {
+			base = d
+		}
+	}
+	return
+}
+
+// Update the window with the bytes acked by a packet and the delay the
+// remote peer measured for it
+
+func (l *ledbat) onAck(bytesAcked int, delay uint32) {
+	if delay == 0 {
+		// The peer hasn't received anything from us yet
+		return
+	}
+	l.addDelaySample(delay)
+	ourDelay := float64(delay - l.baseDelay())
+	offTarget := (CCONTROL_TARGET - ourDelay) / CCONTROL_TARGET
+	windowFactor := float64(bytesAcked) / float64(l.window)
+	l.window += int(MAX_CWND_INCREASE * offTarget * windowFactor)
+	l.clamp()
+}
+
+// Halve the window, at most once per rtt
+
+func (l *ledbat) onLoss(rtt int64) {
+	now := time.Nanoseconds()
+	if now-l.lastLoss < rtt {
+		return
+	}
+	l.lastLoss = now
+	l.window /= 2
+	l.clamp()
+}
+
+func (l *ledbat) onTimeout() {
+	l.window = MIN_WINDOW
+}
+
+func (l *ledbat) clamp() {
+	if l.window < MIN_WINDOW {
+		l.window = MIN_WINDOW
+	}
+	if l.window > MAX_WINDOW {
+		l.window = MAX_WINDOW
+	}
+}
@@ -0,0 +1,112 @@
+// uTP packets (BEP 29)
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package utp
+
+import(
+	"os"
+	"encoding/binary"
+	)
+
+// Packet types
+
+const(
+	ST_DATA = iota
+	ST_FIN
+	ST_STATE
+	ST_RESET
+	ST_SYN
+)
+
+const(
+	VERSION = 1
+	HEADER_LEN = 20
+	EXT_NONE = 0
+	EXT_SACK = 1 // Selective ACK
+)
+
+type packet struct {
+	typ byte
+	connId uint16
+	timestamp, timestampDiff uint32 // microseconds
+	wndSize uint32
+	seq, ack uint16
+	// Selective ACK bitmask, bit 0 is ack+2
+	sack []byte
+	payLoad []byte
+}
+
+// Returns true if data looks like a uTP packet. DHT (bencoded) and UDP
+// tracker packets never have version 1 in the low nibble.
+
+func isUtp(data []byte) bool {
+	return len(data) >= HEADER_LEN && data[0]&0x0f == VERSION && data[0]>>4 <= ST_SYN
+}
+
+func (p *packet) encode() (data []byte) {
+	ext := 0
+	if len(p.sack) > 0 {
+		ext = 2 + len(p.sack)
+	}
+	data = make([]byte, HEADER_LEN+ext+len(p.payLoad))
+	data[0] = p.typ<<4 | VERSION
+	binary.BigEndian.PutUint16(data[2:4], p.connId)
+	binary.BigEndian.PutUint32(data[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(data[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(data[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(data[16:18], p.seq)
+	binary.BigEndian.PutUint16(data[18:20], p.ack)
+	if ext > 0 {
+		data[1] = EXT_SACK
+		data[HEADER_LEN] = EXT_NONE
+		data[HEADER_LEN+1] = byte(len(p.sack))
+		copy(data[HEADER_LEN+2:], p.sack)
+	}
+	copy(data[HEADER_LEN+ext:], p.payLoad)
+	return
+}
+
+func decodePacket(data []byte) (p *packet, err os.Error) {
+	if !isUtp(data) {
+		return nil, os.NewError("Not a uTP packet")
+	}
+	p = new(packet)
+	p.typ = data[0] >> 4
+	p.connId = binary.BigEndian.Uint16(data[2:4])
+	p.timestamp = binary.BigEndian.Uint32(data[4:8])
+	p.timestampDiff = binary.BigEndian.Uint32(data[8:12])
+	p.wndSize = binary.BigEndian.Uint32(data[12:16])
+	p.seq = binary.BigEndian.Uint16(data[16:18])
+	p.ack = binary.BigEndian.Uint16(data[18:20])
+	// Walk the extension chain
+	next := data[1]
+	off := HEADER_LEN
+	for next != EXT_NONE {
+		if off+2 > len(data) {
+			return nil, os.NewError("Truncated uTP extension")
+		}
+		ext := next
+		next = data[off]
+		length := int(data[off+1])
+		off += 2
+		if off+length > len(data) {
+			return nil, os.NewError("Truncated uTP extension")
+		}
+		if ext == EXT_SACK {
+			p.sack = make([]byte, length)
+			copy(p.sack, data[off:off+length])
+		}
+		off += length
+	}
+	p.payLoad = make([]byte, len(data)-off)
+	copy(p.payLoad, data[off:])
+	return
+}
+
+// Sequence numbers wrap around, a is before b if the distance is less
+// than half of the space
+
+func seqLess(a, b uint16) bool {
+	return a != b && b-a < 0x8000
+}
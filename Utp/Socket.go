@@ -0,0 +1,269 @@
+// UDP socket shared by the uTP connections and by other UDP protocols,
+// like the DHT and the UDP trackers. Implements net.Listener for the
+// incoming uTP connections.
+// Roger Pau Monné - 2011
+// Distributed under the terms of the GNU GPLv3
+
+package utp
+
+import(
+	"os"
+	"log"
+	"net"
+	"rand"
+	"sync"
+	"time"
+	"strconv"
+	)
+
+const(
+	TICK_INTERVAL = 100*NS_PER_MS
+	CONNECT_TIMEOUT = 6*NS_PER_S
+	ACCEPT_BACKLOG = 16
+	UDP_PACKET_SIZE = 4096
+)
+
+// Receives the packets that are not uTP
+
+type PacketHandler interface {
+	Match(data []byte) bool
+	HandlePacket(data []byte, addr *net.UDPAddr)
+}
+
+type Socket struct {
+	mutex *sync.Mutex
+	conn *net.UDPConn
+	// Connections by remote address and receive id
+	conns map[string]*Conn
+	accept chan *Conn
+	handlers []PacketHandler
+	quit chan bool
+}
+
+func NewSocket(laddr string) (s *Socket, err os.Error) {
+	addr, err := net.ResolveUDPAddr(laddr)
+	if err != nil {
+		return
+	}
+	s = new(Socket)
+	s.mutex = new(sync.Mutex)
+	s.conns = make(map[string]*Conn)
+	s.accept = make(chan *Conn, ACCEPT_BACKLOG)
+	s.quit = make(chan bool)
+	// Without an ip the socket is dual stack
+	if s.conn, err = net.ListenUDP("udp", addr); err != nil {
+		return nil, err
+	}
+	log.Println("uTP -> Listening on:", s.conn.LocalAddr().String())
+	go s.read()
+	go s.tick()
+	return
+}
+
+func connKey(addr *net.UDPAddr, id uint16) string {
+	return addr.String() + "/" + strconv.Itoa(int(id))
+}
+
+// Packets that don't belong to uTP are given to the first handler that
+// matches them
+
+func (s *Socket) AddHandler(h PacketHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers = append(s.handlers, h)
+}
+
+func (s *Socket) WriteToUDP(b []byte, addr *net.UDPAddr) (int, os.Error) {
+	return s.conn.WriteToUDP(b, addr)
+}
+
+func (s *Socket) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Socket) Port() int {
+	return s.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (s *Socket) Accept() (c net.Conn, err os.Error) {
+	select {
+		case conn := <- s.accept:
+			return conn, nil
+		case <- s.quit:
+	}
+	return nil, errClosed
+}
+
+// Open a uTP connection to addr
+
+func (s *Socket) Dial(addr string) (c net.Conn, err os.Error) {
+	return s.DialTimeout(addr, CONNECT_TIMEOUT)
+}
+
+// Like Dial, giving up if the peer doesn't answer in timeout ns
+
+func (s *Socket) DialTimeout(addr string, timeout int64) (c net.Conn, err os.Error) {
+	raddr, err := net.ResolveUDPAddr(addr)
+	if err != nil {
+		return
+	}
+	var conn *Conn
+	s.mutex.Lock()
+	for conn == nil {
+		id := uint16(rand.Intn(0x10000))
+		if _, ok := s.conns[connKey(raddr, id)]; !ok {
+			conn = newConn(s, raddr, id, id+1)
+			s.conns[connKey(raddr, id)] = conn
+		}
+	}
+	s.mutex.Unlock()
+	conn.mutex.Lock()
+	conn.state = CS_SYN_SENT
+	conn.seq = 1
+	conn.sendData(ST_SYN, nil)
+	conn.mutex.Unlock()
+	if !wait(conn.connected, time.Nanoseconds()+timeout) {
+		conn.mutex.Lock()
+		conn.fail(errTimeout)
+		conn.mutex.Unlock()
+		return nil, errTimeout
+	}
+	conn.mutex.Lock()
+	err = conn.err
+	conn.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socket) Close() os.Error {
+	close(s.quit)
+	s.mutex.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mutex.Unlock()
+	for _, c := range conns {
+		c.mutex.Lock()
+		c.fail(errClosed)
+		c.mutex.Unlock()
+	}
+	return s.conn.Close()
+}
+
+func (s *Socket) send(p *packet, addr *net.UDPAddr) {
+	s.conn.WriteToUDP(p.encode(), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := connKey(c.raddr, c.recvId)
+	if s.conns[key] == c {
+		s.conns[key] = nil, false
+	}
+}
+
+func (s *Socket) read() {
+	buf := make([]byte, UDP_PACKET_SIZE)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+				case <- s.quit:
+					return
+				default:
+			}
+			log.Println("uTP -> Error reading:", err)
+			continue
+		}
+		data := buf[0:n]
+		if isUtp(data) {
+			s.handleUtp(data, addr)
+			continue
+		}
+		s.mutex.Lock()
+		handlers := s.handlers
+		s.mutex.Unlock()
+		for _, h := range handlers {
+			if h.Match(data) {
+				h.HandlePacket(data, addr)
+				break
+			}
+		}
+	}
+}
+
+func (s *Socket) handleUtp(data []byte, addr *net.UDPAddr) {
+	p, err := decodePacket(data)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	if p.typ == ST_SYN {
+		key := connKey(addr, p.connId+1)
+		c, ok := s.conns[key]
+		if !ok {
+			c = newConn(s, addr, p.connId+1, p.connId)
+			c.state = CS_CONNECTED
+			c.ack = p.seq
+			c.seq = uint16(rand.Intn(0x10000))
+			select {
+				case s.accept <- c:
+					s.conns[key] = c
+				default:
+					// Backlog full, the initiator will retry
+					s.mutex.Unlock()
+					return
+			}
+		}
+		s.mutex.Unlock()
+		c.handle(p)
+		return
+	}
+	c, ok := s.conns[connKey(addr, p.connId)]
+	if !ok && p.typ == ST_RESET {
+		// Resets can carry our send id
+		for _, id := range []uint16{p.connId - 1, p.connId + 1} {
+			if c, ok = s.conns[connKey(addr, id)]; ok && c.sendId == p.connId {
+				break
+			}
+			ok = false
+		}
+	}
+	s.mutex.Unlock()
+	if !ok {
+		if p.typ != ST_RESET {
+			s.send(&packet{typ: ST_RESET, connId: p.connId, seq: uint16(rand.Intn(0x10000)), ack: p.seq}, addr)
+		}
+		return
+	}
+	c.handle(p)
+}
+
+func (s *Socket) tick() {
+	ticker := time.NewTicker(TICK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+			case <- s.quit:
+				return
+			case now := <- ticker.C:
+				s.mutex.Lock()
+				conns := make([]*Conn, 0, len(s.conns))
+				for _, c := range s.conns {
+					conns = append(conns, c)
+				}
+				s.mutex.Unlock()
+				for _, c := range conns {
+					c.tick(now)
+				}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package utp
+
+import(
+	"io"
+	"os"
+	"net"
+	"bytes"
+	"testing"
+	)
+
+func TestPacket(t *testing.T) {
+	p := &packet{typ: ST_STATE, connId: 1234, timestamp: 5, timestampDiff: 6, wndSize: 7, seq: 8, ack: 9, sack: []byte{1, 0, 0, 0x80}, payLoad: []byte("data")}
+	data := p.encode()
+	if !isUtp(data) {
+		t.Fatalf("Encoded packet not recognized as uTP")
+	}
+	d, err := decodePacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.typ != p.typ || d.connId != p.connId || d.timestamp != p.timestamp || d.timestampDiff != p.timestampDiff || d.wndSize != p.wndSize || d.seq != p.seq || d.ack != p.ack {
+		t.Errorf("Got %v, expected %v", d, p)
+	}
+	if !bytes.Equal(d.sack, p.sack) || !bytes.Equal(d.payLoad, p.payLoad) {
+		t.Errorf("Got sack %v payload %q", d.sack, d.payLoad)
+	}
+	// KRPC and UDP tracker packets must not be taken as uTP
+	for _, other := range []string{"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe", "\x00\x00\x00\x01\x00\x00\x00\x02abcdefghijklmnop"} {
+		if isUtp([]byte(other)) {
+			t.Errorf("%q taken as uTP", other)
+		}
+	}
+}
+
+func TestSeq(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) || seqLess(3, 3) || !seqLess(0xffff, 0) {
+		t.Errorf("Wrong sequence number comparison")
+	}
+}
+
+func TestLedbat(t *testing.T) {
+	l := newLedbat()
+	l.onAck(PACKET_SIZE, 1000)
+	// Delay at the base, the window grows
+	w := l.window
+	l.onAck(PACKET_SIZE, 1000)
+	if l.window <= w {
+		t.Errorf("Window didn't grow below target: %d -> %d", w, l.window)
+	}
+	// Delay well above target, the window shrinks
+	w = l.window
+	l.onAck(PACKET_SIZE, 1000+3*CCONTROL_TARGET)
+	if l.window >= w {
+		t.Errorf("Window didn't shrink above target: %d -> %d", w, l.window)
+	}
+	l.onTimeout()
+	if l.window != MIN_WINDOW {
+		t.Errorf("Got window %d after timeout, expected %d", l.window, MIN_WINDOW)
+	}
+}
+
+// A peer that ignores our window can't make us buffer more than
+// RECV_BUFFER, in order or not
+
+func TestReceiveWindow(t *testing.T) {
+	c := newConn(nil, nil, 1, 2)
+	half := make([]byte, RECV_BUFFER/2)
+	c.receive(&packet{typ: ST_DATA, seq: 2, payLoad: half})
+	c.receive(&packet{typ: ST_DATA, seq: 2, payLoad: half})
+	c.receive(&packet{typ: ST_DATA, seq: 3, payLoad: make([]byte, RECV_BUFFER/2+1)})
+	if len(c.reorder) != 1 || c.reorderBytes != len(half) {
+		t.Fatalf("Kept %d out of order packets of %d bytes", len(c.reorder), c.reorderBytes)
+	}
+	c.receive(&packet{typ: ST_DATA, seq: 1, payLoad: half})
+	c.receive(&packet{typ: ST_DATA, seq: 3, payLoad: []byte{1}})
+	if c.ack != 2 || c.readBuf.Len() != RECV_BUFFER || c.reorderBytes != 0 {
+		t.Fatalf("Got ack %d with %d bytes buffered, expected 2 and %d", c.ack, c.readBuf.Len(), RECV_BUFFER)
+	}
+	if c.recvWindow() != 0 {
+		t.Errorf("Advertising a window of %d with the buffer full", c.recvWindow())
+	}
+	// Once read, the data is accepted again
+	c.readBuf.Reset()
+	c.receive(&packet{typ: ST_DATA, seq: 3, payLoad: []byte{1}})
+	if c.ack != 3 || c.readBuf.Len() != 1 {
+		t.Errorf("Got ack %d with %d bytes buffered after reading, expected 3 and 1", c.ack, c.readBuf.Len())
+	}
+}
+
+func newTestSockets(t *testing.T) (a, b *Socket) {
+	var err os.Error
+	if a, err = NewSocket("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = NewSocket("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Send data in both directions and check it arrives complete
+
+func transfer(t *testing.T, dialer, listener *Socket, size int) {
+	data := make([]byte, size)
+	for i, _ := range data {
+		data[i] = byte(i * 7)
+	}
+	done := make(chan os.Error)
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		c.SetTimeout(30*NS_PER_S)
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(c, buf); err != nil {
+			done <- err
+			return
+		}
+		if !bytes.Equal(buf, data) {
+			done <- os.NewError("Received data differs")
+			return
+		}
+		_, err = c.Write(buf)
+		done <- err
+	}()
+	c, err := dialer.Dial(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(30*NS_PER_S)
+	if _, err = c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	if _, err = io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Echoed data differs")
+	}
+	if err = <- done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	a, b := newTestSockets(t)
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		// Accepted on b, dialed from a
+		c, err := b.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	c, err := a.Dial(b.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(10*NS_PER_S)
+	msg := []byte("\x13BitTorrent protocol")
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("Got %q, %v", buf, err)
+	}
+	c.Close()
+	transfer(t, a, b, 512*1024)
+}
+
+// UDP relay between a client and a server that drops every nth packet
+
+type lossyRelay struct {
+	conn *net.UDPConn
+	server, client *net.UDPAddr
+	n, count int
+}
+
+func (r *lossyRelay) run() {
+	buf := make([]byte, UDP_PACKET_SIZE)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		r.count++
+		if r.count%r.n == 0 {
+			continue
+		}
+		if addr.String() == r.server.String() {
+			if r.client != nil {
+				r.conn.WriteToUDP(buf[0:n], r.client)
+			}
+		} else {
+			r.client = addr
+			r.conn.WriteToUDP(buf[0:n], r.server)
+		}
+	}
+}
+
+func TestPacketLoss(t *testing.T) {
+	a, b := newTestSockets(t)
+	defer a.Close()
+	defer b.Close()
+	raddr, _ := net.ResolveUDPAddr("127.0.0.1:0")
+	conn, err := net.ListenUDP("udp4", raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := &lossyRelay{conn: conn, server: b.LocalAddr().(*net.UDPAddr), n: 10}
+	go r.run()
+	// a dials b through the relay
+	done := make(chan os.Error)
+	data := make([]byte, 256*1024)
+	for i, _ := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		c, err := b.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		c.SetTimeout(30*NS_PER_S)
+		buf := make([]byte, len(data))
+		if _, err = io.ReadFull(c, buf); err == nil && !bytes.Equal(buf, data) {
+			err = os.NewError("Received data differs")
+		}
+		done <- err
+	}()
+	c, err := a.Dial(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(30*NS_PER_S)
+	if _, err = c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = <- done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testHandler struct {
+	received chan string
+}
+
+func (h *testHandler) Match(data []byte) bool {
+	return len(data) > 0 && data[0] == 'd'
+}
+
+func (h *testHandler) HandlePacket(data []byte, addr *net.UDPAddr) {
+	h.received <- string(data)
+}
+
+func TestHandlers(t *testing.T) {
+	a, b := newTestSockets(t)
+	defer a.Close()
+	defer b.Close()
+	h := &testHandler{make(chan string, 1)}
+	b.AddHandler(h)
+	msg := "d1:y1:qe"
+	a.WriteToUDP([]byte(msg), b.LocalAddr().(*net.UDPAddr))
+	if got := <- h.received; got != msg {
+		t.Errorf("Got %q, expected %q", got, msg)
+	}
+}
+
+func TestTransfer6(t *testing.T) {
+	a, err := NewSocket("[::1]:0")
+	if err != nil {
+		t.Log("IPv6 not available:", err)
+		return
+	}
+	defer a.Close()
+	b, err := NewSocket("[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	transfer(t, a, b, 64*1024)
+}
@@ -486,8 +486,9 @@ type InfoDict struct {
 type MetaInfo struct {
 	Info         InfoDict
 	Infohash     string
+	InfoBytes    []byte // bencoded info dictionary, as hashed
 	Announce     string
-	Announce_list []string
+	Announce_list [][]string // tiers of trackers
 	CreationDate string "creation date"
 	Comment      string
 	CreatedBy    string "created by"
@@ -502,5 +503,29 @@ type TrackerResponse struct {
 	Complete       int
 	Incomplete     int
 	Peers          string
+	Peers6         string
+}
+
+// Non-compact form of the peer list of a tracker response
+
+type PeerDict struct {
+	Peer_id string "peer id"
+	Ip      string
+	Port    int64
+}
+
+type TrackerPeerList struct {
+	Peers []PeerDict
+}
+
+type ScrapeFile struct {
+	Complete   int64
+	Downloaded int64
+	Incomplete int64
+}
+
+type ScrapeResponse struct {
+	FailureReason string "failure reason"
+	Files map[string]ScrapeFile
 }
 
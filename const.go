@@ -35,6 +35,7 @@ const(
 	SNUBBED_PERIOD = 60
 	REQUESTS_LENGTH = 10 // time of requests to ask to a peer (10s of pieces)
 	MAX_PIECE_REQUESTS = 4
+	METADATA_TIMEOUT = 10*60*NS_PER_S // to fetch the metadata of a magnet link
 	)
 
 /*const (
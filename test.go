@@ -9,28 +9,39 @@ import(
 	"flag"
 	"time"
 	"runtime"
-	"wgo/limiter"
-	"wgo/files"
-	"wgo/stats"
+	"wgo/mse"
 	"wgo/peers"
-	"wgo/choke"
-	"wgo/listener"
-	"wgo/tracker"
+	"wgo/files"
 	"strconv"
+	"strings"
 	"os"
-	"rand"
+	"os/signal"
 	"http"
 	)
 	
 import _ "http/pprof"
 
-var torrent *string = flag.String("torrent", "", "url or path to a torrent file")
+var torrent *string = flag.String("torrent", "", "url or path to a torrent file, or a magnet link, more can be given as arguments")
 var folder *string = flag.String("folder", ".", "local folder to save the download")
 var ip *string = flag.String("ip", "", "local address to listen to")
 var listen_port *string = flag.String("port", "0", "local port to listen to")
 var procs *int = flag.Int("procs", 1, "number of processes")
 var up_limit *int = flag.Int("up_limit", 0, "Upload limit in KB/s")
 var down_limit *int = flag.Int("down_limit", 0, "Download limit in KB/s")
+var save_torrent *string = flag.String("save_torrent", "", "file where the torrent of a magnet link is saved")
+var use_utp *bool = flag.Bool("utp", true, "connect to peers with uTP before trying TCP, on the UDP port of the listening port")
+var dht_port *int = flag.Int("dht_port", 0, "local UDP port for the DHT, 0 shares the uTP socket, -1 disables it")
+var dht_nodes *string = flag.String("dht_nodes", "dht.nodes", "file used to save the DHT routing table")
+var dht_bootstrap *string = flag.String("dht_bootstrap", "router.bittorrent.com:6881,router.utorrent.com:6881", "comma separated list of DHT bootstrap nodes")
+var encryption *string = flag.String("encryption", "prefer", "encryption of the peer connections: plaintext, prefer or require")
+var picker *string = flag.String("picker", "rarest", "order to download the pieces: rarest, sequential or streaming")
+var max_connections *int = flag.Int("max_connections", 500, "maximum number of peer connections of all the torrents, 0 means no limit")
+var upload_slots *int = flag.Int("upload_slots", UPLOADING_PEERS, "number of peers unchoked of all the torrents")
+var resume_dir *string = flag.String("resume_dir", "resume", "folder where the fast resume data of the torrents is saved, empty disables it")
+var ban_file *string = flag.String("ban_file", "banned.peers", "file where the hosts banned for sending corrupt data are saved")
+var ip_filter *string = flag.String("ip_filter", "", "comma separated list of blocklists (PeerGuardian, eMule ipfilter.dat or CIDR), reloaded on SIGHUP")
+var storage *string = flag.String("storage", "files", "where the data is kept: files, blob (one preallocated file per torrent) or memory")
+var cache_size *int = flag.Int("cache_size", files.DEFAULT_CACHE_SIZE/1024, "KB of memory used to cache the pieces of each torrent")
 var pprof_port *int = flag.Int("pprof_port", 0, "Pprof port to listen for connections (debug only)")
 
 func prof(port int) {
@@ -40,6 +51,55 @@ func prof(port int) {
 	}
 }
 
+func encryptionPolicy(name string) (policy int, err os.Error) {
+	switch name {
+		case "plaintext":
+			policy = mse.PLAINTEXT
+		case "prefer":
+			policy = mse.PREFER_ENCRYPTED
+		case "require":
+			policy = mse.REQUIRE_ENCRYPTED
+		default:
+			err = os.NewError("Unknown encryption policy " + name)
+	}
+	return
+}
+
+func piecePicker(name string) (picker peers.PiecePicker, err os.Error) {
+	switch name {
+		case "rarest":
+			picker = peers.NewRarestFirstPicker()
+		case "sequential":
+			picker = peers.NewSequentialPicker()
+		case "streaming":
+			picker = peers.NewStreamingPicker(peers.STREAMING_WINDOW)
+		default:
+			err = os.NewError("Unknown piece picker " + name)
+	}
+	return
+}
+
+func storageFactory(name string) (factory files.StorageFactory, err os.Error) {
+	switch name {
+		case "files":
+			factory = files.NewFileStorage
+		case "blob":
+			factory = files.NewBlobStorage
+		case "memory":
+			factory = files.NewMemStorage
+		default:
+			err = os.NewError("Unknown storage " + name)
+	}
+	return
+}
+
+func filterLists(lists string) []string {
+	if len(lists) == 0 {
+		return nil
+	}
+	return strings.Split(lists, ",", -1)
+}
+
 func main() {
 	flag.Parse()
 	if *pprof_port > 0 {
@@ -47,61 +107,92 @@ func main() {
 		log.Println("Pprof listening at port:", *pprof_port)
 	}
 	runtime.GOMAXPROCS(*procs)
-	peerId := (CLIENT_ID + "-" + strconv.Itoa(os.Getpid()) + strconv.Itoa64(rand.Int63()))[0:20]
-	log.Println("Peer ID:", peerId)
-	// Load torrent file
-	torr, err := NewTorrent(*torrent)
+	policy, err := encryptionPolicy(*encryption)
 	if err != nil {
-		log.Println("Error parsing torrent metainfo:", err)
-		return
-	}
-	// Create File Store
-	fs, size, err := files.NewFiles(&torr.Info, *folder)
-	if err != nil || size <= 0 {
-		log.Println("Error parsing files:", err)
+		log.Println(err)
 		return
 	}
-	log.Println("Files -> Total size:", size)
-	left, bitfield, err := fs.CheckPieces()
-	if err != nil {
-		log.Println("Error checking pieces:",err)
+	if _, err = piecePicker(*picker); err != nil {
+		log.Println(err)
 		return
 	}
-	// BW Limiter
-	limiter, err := limiter.NewLimiter(*up_limit, *down_limit)
+	factory, err := storageFactory(*storage)
 	if err != nil {
+		log.Println(err)
 		return
 	}
-	// Perform test of the tracker request
-	// Initilize Stats
-	s := stats.NewStats(left, size, bitfield, torr.Info.Piece_length)
-	//go s.Run()
-	// Initialize peerMgr
-	lastPieceLength := size % torr.Info.Piece_length
-	peerMgr, err := peers.NewPeerMgr(int64(bitfield.Len()), peerId, torr.Infohash, bitfield, s, fs, limiter, lastPieceLength)
+	s, err := NewSession(&Config{
+		Ip: *ip,
+		Port: *listen_port,
+		Folder: *folder,
+		UpLimit: *up_limit,
+		DownLimit: *down_limit,
+		Utp: *use_utp,
+		DhtPort: *dht_port,
+		DhtNodes: *dht_nodes,
+		DhtBootstrap: strings.Split(*dht_bootstrap, ",", -1),
+		Encryption: policy,
+		MaxConnections: *max_connections,
+		UploadSlots: *upload_slots,
+		ResumeDir: *resume_dir,
+		BanFile: *ban_file,
+		IpFilter: filterLists(*ip_filter),
+		Storage: factory,
+		CacheSize: *cache_size,
+	})
 	if err != nil {
-		log.Println("Error creating peer manager:", err)
+		log.Println("Error creating session:", err)
 		return
 	}
-	if _, *listen_port, err = listener.NewListener(*ip, *listen_port, peerMgr); err != nil {
-		log.Println("Error creating listener:", err)
-		return
+	s.SetStateHandler(func(t *Torrent, state int) {
+		log.Println(t.Name(), "->", StateString(state))
+	})
+	torrents := flag.Args()
+	if len(*torrent) > 0 {
+		torrents = append([]string{*torrent}, torrents...)
 	}
-	//go peerMgr.Run()
-	// Initialize ChokeMgr
-	choke.NewChokeMgr(s, peerMgr)
-	// Initialize pieceMgr
-	pieceMgr, err := peers.NewPieceMgr(peerMgr, s, fs, bitfield, torr.Info.Piece_length, lastPieceLength, bitfield.Len(), size)
-	if err != nil {
-		log.Println("Error creating piece manager:", err)
-		return
+	for _, torrent := range torrents {
+		go func(torrent string) {
+			t, err := s.AddTorrent(torrent)
+			if err != nil {
+				log.Println("Error adding torrent", torrent, ":", err)
+				return
+			}
+			p, _ := piecePicker(*picker)
+			t.SetPiecePicker(p)
+			if strings.HasPrefix(torrent, "magnet:") && len(*save_torrent) > 0 {
+				if err = SaveTorrent(t.MetaInfo, *save_torrent); err != nil {
+					log.Println("Error saving torrent file:", err)
+				}
+			}
+		}(torrent)
 	}
-	peerMgr.SetPieceMgr(pieceMgr)
-	tracker.NewTrackerMgr(torr.Announce_list, torr.Infohash, *listen_port, peerMgr, left, bitfield, torr.Info.Piece_length, peerId, s)
+	status := time.Tick(30*NS_PER_S)
 	for {
-		log.Println("Active Peers:", peerMgr.ActivePeers(), "Incoming Peers:", peerMgr.IncomingPeers(), "Unused Peers:", peerMgr.UnusedPeers())
-		log.Println("Done:", (bitfield.Count()*100)/bitfield.Len(), "%")
-		//log.Println("Bitfield:", bitfield.Bytes())
-		time.Sleep(30*NS_PER_S)
+		select {
+			case sig := <- signal.Incoming:
+				if usig, ok := sig.(signal.UnixSignal); ok && (usig == signal.SIGINT || usig == signal.SIGTERM) {
+					log.Println("Received", sig, "shutting down")
+					s.Close()
+					return
+				}
+				if usig, ok := sig.(signal.UnixSignal); ok && usig == signal.SIGHUP {
+					log.Println("Received", sig, "reloading the IP filter")
+					if err := s.ReloadIpFilter(); err != nil {
+						log.Println("Error reloading the IP filter:", err)
+					}
+				}
+			case <- status:
+				for _, t := range s.Torrents() {
+					if peerMgr := t.PeerMgr(); peerMgr != nil {
+						log.Println(t.Name(), "-> Active Peers:", peerMgr.ActivePeers(), "Incoming Peers:", peerMgr.IncomingPeers(), "Unused Peers:", peerMgr.UnusedPeers())
+					}
+					log.Println(t.Name(), "->", StateString(t.State()), "Done:", t.Done(), "%", "Distributed copies:", t.DistributedCopies())
+				}
+				log.Println("Connections:", s.Connections())
+				if d := s.DHT(); d != nil {
+					log.Println("DHT Nodes:", d.Nodes())
+				}
+		}
 	}
 }